@@ -30,7 +30,7 @@ const testDir = "./testdata"
 
 func doAlloc(t *testing.T, fs *FileSystem, need int) {
 	_, fb := fs.StatBlocks(-1)
-	blks, cnt, err := fs.allocBlocks(need, need, true)
+	blks, cnt, err := fs.allocBlocks(nil, need, need, true)
 	if err != nil {
 		t.Errorf("alloc blocks failed:%v", err)
 		return
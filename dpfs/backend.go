@@ -0,0 +1,260 @@
+/*
+ backend.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+/*
+  The volumes of a depot, one per block group and the journal, are kept by a
+  VolumeBackend. FileBackend keeps them as files in a directory, the layout
+  of the depots of earlier versions. MemBackend keeps them in memory for
+  tests, and ImageBackend packs them into a single image file.
+
+  A volume reads like a sparse file: a range never written reads as zeros and
+  a read past its end returns io.EOF, as os.File.ReadAt does. Writing to a
+  missing volume creates it.
+*/
+
+// JournalVolume is the volume of the journal, the volume of a block group is
+// its index.
+const JournalVolume = ^uint32(0)
+
+// VolumeBackend stores the volumes of a depot. It must be safe for
+// concurrent use.
+type VolumeBackend interface {
+	// Volumes returns the block group volumes present, in ascending order.
+	Volumes() ([]uint32, error)
+	ReadAt(vol uint32, p []byte, off int64) (int, error)
+	// WriteAt creates the volume when it does not exist.
+	WriteAt(vol uint32, p []byte, off int64) (int, error)
+	Sync(vol uint32) error
+	// Size fails with an error matching os.ErrNotExist when the volume does
+	// not exist.
+	Size(vol uint32) (int64, error)
+	Truncate(vol uint32, size int64) error
+	Remove(vol uint32) error
+	// Close releases the resources held, the volumes are kept.
+	Close() error
+}
+
+// volumeFile is the handle of a volume of a backend.
+type volumeFile struct {
+	backend VolumeBackend
+	vol     uint32
+}
+
+func (f *volumeFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.backend.ReadAt(f.vol, p, off)
+}
+
+func (f *volumeFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.backend.WriteAt(f.vol, p, off)
+}
+
+func (f *volumeFile) Sync() error {
+	return f.backend.Sync(f.vol)
+}
+
+func (f *volumeFile) Size() (int64, error) {
+	return f.backend.Size(f.vol)
+}
+
+func (f *volumeFile) Truncate(size int64) error {
+	return f.backend.Truncate(f.vol, size)
+}
+
+// FileBackend keeps the volumes as files of a directory, named by a template
+// and the group id, and the journal as JournalFn.
+type FileBackend struct {
+	root     string
+	pattern  *regexp.Regexp
+	tpl      string
+	readOnly bool
+	lock     sync.Mutex
+	files    map[uint32]*os.File
+	closed   bool
+}
+
+// NewFileBackend returns the backend of the volume files in root.
+//
+// Parameters:
+//   - root: The directory of the files.
+//   - pattern: A regular expression matching the names of the volume files,
+//     DefaultVfPattern when empty.
+//   - tpl: The template of the volume file names, DefaultVfTpl when empty.
+//
+// Returns:
+//   - *FileBackend: The backend, files are opened on first use.
+func NewFileBackend(root, pattern, tpl string) *FileBackend {
+	if pattern == "" {
+		pattern = DefaultVfPattern
+	}
+	if tpl == "" {
+		tpl = DefaultVfTpl
+	}
+	return &FileBackend{
+		root:    root,
+		pattern: regexp.MustCompile(pattern),
+		tpl:     tpl,
+		files:   make(map[uint32]*os.File),
+	}
+}
+
+func (b *FileBackend) path(vol uint32) string {
+	if vol == JournalVolume {
+		return filepath.Join(b.root, JournalFn)
+	}
+	return filepath.Join(b.root, fmt.Sprintf(b.tpl, vol+1))
+}
+
+// open returns the file of vol, created when create is set.
+func (b *FileBackend) open(vol uint32, create bool) (*os.File, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, os.ErrClosed
+	}
+	if f, ok := b.files[vol]; ok {
+		return f, nil
+	}
+	flag := os.O_RDWR
+	if b.readOnly {
+		flag = os.O_RDONLY
+	} else if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(b.path(vol), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b.files[vol] = f
+	return f, nil
+}
+
+// isClosed reports whether Close was called.
+func (b *FileBackend) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closed
+}
+
+func (b *FileBackend) Volumes() ([]uint32, error) {
+	if b.isClosed() {
+		return nil, os.ErrClosed
+	}
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		return nil, err
+	}
+	var vols []uint32
+	for _, e := range entries {
+		var id uint32
+		if e.IsDir() || !b.pattern.MatchString(e.Name()) {
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), b.tpl, &id); err != nil || id == 0 || fmt.Sprintf(b.tpl, id) != e.Name() {
+			return nil, fmt.Errorf("Bad volume file name %s", e.Name())
+		}
+		vols = append(vols, id-1)
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i] < vols[j] })
+	return vols, nil
+}
+
+func (b *FileBackend) ReadAt(vol uint32, p []byte, off int64) (int, error) {
+	f, err := b.open(vol, false)
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, off)
+}
+
+func (b *FileBackend) WriteAt(vol uint32, p []byte, off int64) (int, error) {
+	f, err := b.open(vol, true)
+	if err != nil {
+		return 0, err
+	}
+	return f.WriteAt(p, off)
+}
+
+func (b *FileBackend) Sync(vol uint32) error {
+	f, err := b.open(vol, false)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (b *FileBackend) Size(vol uint32) (int64, error) {
+	if b.isClosed() {
+		return 0, os.ErrClosed
+	}
+	st, err := os.Stat(b.path(vol))
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (b *FileBackend) Truncate(vol uint32, size int64) error {
+	f, err := b.open(vol, false)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(size)
+}
+
+func (b *FileBackend) Remove(vol uint32) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return os.ErrClosed
+	}
+	if f, ok := b.files[vol]; ok {
+		f.Close()
+		delete(b.files, vol)
+	}
+	b.lock.Unlock()
+	return os.Remove(b.path(vol))
+}
+
+// Close closes the files, NewFileBackend opens them again. The calls made
+// after it fail with os.ErrClosed.
+func (b *FileBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	var first error
+	for vol, f := range b.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(b.files, vol)
+	}
+	return first
+}
@@ -33,6 +33,7 @@ type Bitmap interface {
 	TotalBits() int
 
 	AllocBits(int, int, bool) ([]uint32, int)
+	SetBits(ptrs []uint32)
 	ClearBits(ptrs []uint32)
 	CheckBit(ptr uint32) bool
 }
@@ -75,6 +76,55 @@ func clearBits(bitmap []uint8, from, to uint32) {
 	}
 }
 
+func setBits(bitmap []uint8, from, to uint32) {
+	for i := from; i < to; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+// freeRun returns the first bit of the first run of n clear bits of bitmap,
+// -1 when there is none.
+func freeRun(bitmap []uint8, n int) int {
+	start, cnt := 0, 0
+	for i := 0; i < len(bitmap)*8; {
+		if i%8 == 0 && bitmap[i/8] == 0xff {
+			cnt = 0
+			i += 8
+			continue
+		}
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			cnt = 0
+		} else {
+			if cnt == 0 {
+				start = i
+			}
+			if cnt++; cnt == n {
+				return start
+			}
+		}
+		i++
+	}
+	return -1
+}
+
+func batchSetBits(groupId uint32, bitmap []uint8, ptrs []uint32) int {
+	c := 0
+	for _, p := range ptrs {
+		idx, g, isBig := EntAddr(p).GetAddr()
+		if g != groupId {
+			panic("Inner error:Wrong group id")
+		}
+		if isBig > 0 {
+			setBits(bitmap, idx, idx+64)
+			c += 64
+		} else {
+			bitmap[idx/8] |= 1 << (idx % 8)
+			c++
+		}
+	}
+	return c
+}
+
 func batchClearBits(groupId uint32, bitmap []uint8, ptrs []uint32) int {
 	c := 0
 	for _, p := range ptrs {
@@ -118,6 +168,10 @@ func (b *BitmapBase) CheckBit(ptr uint32) bool {
 	return checkBit(b.GroupId, b.bits, ptr)
 }
 
+func (b *BitmapBase) SetBits(ptrs []uint32) {
+	b.freeBits -= batchSetBits(b.GroupId, b.bits, ptrs)
+}
+
 func (b *BitmapBase) ClearBits(ptrs []uint32) {
 	b.freeBits += batchClearBits(b.GroupId, b.bits, ptrs)
 }
@@ -248,6 +302,10 @@ func (b *Bitmap64) CheckBit(ptr uint32) bool {
 	return checkBit(b.GroupId, b.buffer, ptr)
 }
 
+func (b *Bitmap64) SetBits(ptrs []uint32) {
+	b.freeBits -= batchSetBits(b.GroupId, b.buffer, ptrs)
+}
+
 func (b *Bitmap64) ClearBits(ptrs []uint32) {
 	b.freeBits += batchClearBits(b.GroupId, b.buffer, ptrs)
 }
@@ -216,3 +216,15 @@ func TestBitmapBigAlloc2(t *testing.T) {
 	alternatingAlloc(t, "byte", &bm1, size, batchSize)
 	alternatingAlloc(t, "ui64", &bm2, size, batchSize)
 }
+
+func TestFreeRun(t *testing.T) {
+	bm := make([]uint8, 4)
+	setBits(bm, 0, 3)
+	setBits(bm, 5, 9)
+	setBits(bm, 12, 30)
+	for _, c := range []struct{ n, want int }{{1, 3}, {2, 3}, {3, 9}, {4, -1}} {
+		if got := freeRun(bm, c.n); got != c.want {
+			t.Errorf("freeRun(%d) = %d, want %d", c.n, got, c.want)
+		}
+	}
+}
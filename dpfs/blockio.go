@@ -0,0 +1,237 @@
+/*
+ blockio.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"io"
+)
+
+/*
+  With checksums or encryption a block is read and written whole: a read
+  verifies and decrypts every block it touches, a write that covers a block
+  in part loads the rest of it first. Blocks written by a transaction are
+  sealed when it commits, over their content as it will be once applied, so
+  the checksums, the encryption entries and the blocks are replayed together.
+*/
+
+// fullBlocks reports whether blocks are read and written whole.
+func (fs *FileSystem) fullBlocks() bool {
+	return fs.Smeta.HasChecksums() || fs.Smeta.HasEncryption()
+}
+
+// blockRange returns the first and the end block, relative to the block at
+// the start of the range, of the blocks that n bytes at offset touch.
+func (fs *FileSystem) blockRange(offset, n int) (int, int) {
+	bs := int(fs.Smeta.BlockSize)
+	return offset / bs, (offset + n + bs - 1) / bs
+}
+
+func (fs *FileSystem) blockPos(idx uint32) int64 {
+	return fs.geo.BlockOffset + int64(idx)*int64(fs.Smeta.BlockSize)
+}
+
+// readSpan reads whole blocks from idx on of group g as they are stored,
+// bytes past the end of the volume file read as zeros. It returns the number
+// of bytes in the file.
+func (fs *FileSystem) readSpan(g, idx uint32, data []byte) (int, error) {
+	n, err := fs.device.volumes[g].file.ReadAt(data, fs.blockPos(idx))
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	clear(data[n:])
+	return n, nil
+}
+
+// loadBlocks reads the content of the whole blocks from idx on of group g,
+// verified and decrypted.
+func (fs *FileSystem) loadBlocks(g, idx uint32, data []byte) (int, error) {
+	n, err := fs.readSpan(g, idx, data)
+	if err != nil {
+		return n, err
+	}
+	if fs.Smeta.HasChecksums() {
+		if err := fs.verifyBlocks(g, idx, data); err != nil {
+			return n, err
+		}
+	}
+	if fs.Smeta.HasEncryption() {
+		if err := fs.openBlocks(g, idx, data); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// sealBlocks returns the whole blocks data from idx on of group g as they
+// are to be stored, with their encryption entries and checksums.
+func (fs *FileSystem) sealBlocks(g, idx uint32, data []byte) ([]byte, []byte, []byte, error) {
+	raw, entries := data, []byte(nil)
+	if fs.Smeta.HasEncryption() {
+		var err error
+		if raw, entries, err = fs.encryptBlocks(g, idx, data); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var sums []byte
+	if fs.Smeta.HasChecksums() {
+		sums = fs.encodeSums(raw)
+	}
+	return raw, entries, sums, nil
+}
+
+// storeBlocks writes the whole blocks data from idx on of group g, with
+// their encryption entries and checksums. Nothing is synced in between, the
+// epoch of the generations keeps a nonce from being used twice after a
+// crash, see crypt.go.
+func (fs *FileSystem) storeBlocks(g, idx uint32, data []byte) error {
+	raw, entries, sums, err := fs.sealBlocks(g, idx, data)
+	if err != nil {
+		return err
+	}
+	file := fs.device.volumes[g].file
+	if entries != nil {
+		if _, err := file.WriteAt(entries, fs.geo.CryptOffset+int64(idx)*CryptEntrySize); err != nil {
+			return err
+		}
+	}
+	if _, err := file.WriteAt(raw, fs.blockPos(idx)); err != nil {
+		return err
+	}
+	if sums != nil {
+		_, err = file.WriteAt(sums, fs.geo.ChecksumOffset+int64(idx)*ChecksumSize)
+	}
+	return err
+}
+
+// readFull reads data at offset of the block idx of group g through whole
+// blocks. Like ReadAt it returns io.EOF for a range past the end of the
+// volume file.
+func (fs *FileSystem) readFull(g, idx uint32, offset int, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	first, end := fs.blockRange(offset, len(data))
+	buf := make([]byte, (end-first)*int(fs.Smeta.BlockSize))
+	n, err := fs.loadBlocks(g, idx+uint32(first), buf)
+	if err != nil {
+		return 0, err
+	}
+	from := offset - first*int(fs.Smeta.BlockSize)
+	rdn := copy(data, buf[from:])
+	if n-from < rdn {
+		return max(n-from, 0), io.EOF
+	}
+	return rdn, nil
+}
+
+// writeFull writes data at offset of the block idx of group g through whole
+// blocks, the blocks it covers in part are loaded first.
+func (fs *FileSystem) writeFull(g, idx uint32, offset int, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	bs := int(fs.Smeta.BlockSize)
+	first, end := fs.blockRange(offset, len(data))
+	buf := data
+	if offset%bs != 0 || len(data)%bs != 0 {
+		buf = make([]byte, (end-first)*bs)
+		if offset%bs != 0 {
+			if _, err := fs.loadBlocks(g, idx+uint32(first), buf[:bs]); err != nil {
+				return err
+			}
+		}
+		if tail := (offset + len(data)) % bs; tail != 0 && (end-first > 1 || offset%bs == 0) {
+			if _, err := fs.loadBlocks(g, idx+uint32(end-1), buf[len(buf)-bs:]); err != nil {
+				return err
+			}
+		}
+		copy(buf[offset-first*bs:], data)
+	}
+	return fs.storeBlocks(g, idx+uint32(first), buf)
+}
+
+// stageBlocks replaces the block writes of tx by the whole blocks they touch,
+// sealed, along with their encryption entries and checksums. A block that
+// tx allocated and that does not load holds nothing yet and starts from
+// zeros.
+func (fs *FileSystem) stageBlocks(tx *txn) error {
+	type blockKey struct {
+		group, idx uint32
+	}
+	seen := make(map[blockKey]bool)
+	var blocks []blockKey
+	for _, w := range tx.writes {
+		if w.offset < fs.geo.BlockOffset {
+			continue
+		}
+		first, end := fs.blockRange(int(w.offset-fs.geo.BlockOffset), len(w.data))
+		for i := first; i < end; i++ {
+			k := blockKey{w.group, uint32(i)}
+			if !seen[k] {
+				seen[k] = true
+				blocks = append(blocks, k)
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	fresh := make(map[blockKey]bool)
+	for g, ptrs := range tx.pointers(true, true) {
+		for _, p := range ptrs {
+			idx, _, isBig := EntAddr(p).GetAddr()
+			for i := uint32(0); i < 1+63*uint32(isBig); i++ {
+				fresh[blockKey{g, idx + i}] = true
+			}
+		}
+	}
+	bs := int64(fs.Smeta.BlockSize)
+	data := make([][]byte, len(blocks))
+	for i, b := range blocks {
+		if err := fs.device.checkReady(b.group, &fs.blockGroups[b.group]); err != nil {
+			return err
+		}
+		buf := make([]byte, bs)
+		if _, err := fs.loadBlocks(b.group, b.idx, buf); err != nil {
+			if !fresh[b] {
+				return err
+			}
+			clear(buf)
+		}
+		tx.patch(b.group, fs.blockPos(b.idx), buf)
+		data[i] = buf
+	}
+	tx.dropBlockWrites(fs.geo.BlockOffset)
+	for i, b := range blocks {
+		raw, entries, sums, err := fs.sealBlocks(b.group, b.idx, data[i])
+		if err != nil {
+			return err
+		}
+		if entries != nil {
+			tx.write(b.group, fs.geo.CryptOffset+int64(b.idx)*CryptEntrySize, entries)
+		}
+		tx.write(b.group, fs.blockPos(b.idx), raw)
+		if sums != nil {
+			tx.write(b.group, fs.geo.ChecksumOffset+int64(b.idx)*ChecksumSize, sums)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,521 @@
+/*
+ blockmap.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+/*
+  A slot is one entry of the block list of an inode: slots 0-7 are the direct
+  pointers, the following ones live in the single, double and triple indirect
+  trees. A slot holds a block or a big block, so the data position of a slot
+  depends on the size of all slots before it. A slot without a block (0) is a
+  hole of one block reading back as zeros.
+*/
+
+func (fs *FileSystem) slotSize(ptr uint32) int64 {
+	if EntAddr(ptr).IsBigBlock() > 0 {
+		return 64 * int64(fs.Smeta.BlockSize)
+	}
+	return int64(fs.Smeta.BlockSize)
+}
+
+// slotRoot returns the indirect tree holding slot, its depth and the index
+// of slot inside the tree.
+func (g *Geometry) slotRoot(inode *Inode, slot int) (*uint32, int, int) {
+	i := slot - DirectBlocks
+	if i < g.BlockPointers {
+		return &inode.SingleIndirect, SingleIndirectLv, i
+	}
+	i -= g.BlockPointers
+	if i < pow(g.BlockPointers, DoubleIndirectLv) {
+		return &inode.DoubleIndirect, DoubleIndirectLv, i
+	}
+	return &inode.TripleIndirect, TripleIndirectLv, i - pow(g.BlockPointers, DoubleIndirectLv)
+}
+
+// newPointerBlock allocates a zeroed pointer block of depth.
+func (fs *FileSystem) newPointerBlock(tx *txn, depth int) (uint32, error) {
+	nb, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := fs.writePointerWithCache(tx, nb[0], make([]uint32, fs.geo.BlockPointers), 0, depth); err != nil {
+		return 0, err
+	}
+	return nb[0], nil
+}
+
+// leafBlock returns the single indirect block holding slot (slot >= DirectBlocks)
+// and the index of slot in it. Missing pointer blocks are allocated when alloc
+// is set, otherwise a zero block is returned for them. With alloc the pointer
+// blocks on the way are made writable in place, see ownPointerBlock.
+func (fs *FileSystem) leafBlock(tx *txn, inode *Inode, slot int, alloc bool) (uint32, int, error) {
+	root, depth, i := fs.geo.slotRoot(inode, slot)
+	if *root == 0 {
+		if !alloc {
+			return 0, 0, nil
+		}
+		nb, err := fs.newPointerBlock(tx, depth)
+		if err != nil {
+			return 0, 0, err
+		}
+		*root = nb
+	} else if alloc {
+		nb, err := fs.ownPointerBlock(tx, *root, depth)
+		if err != nil {
+			return 0, 0, err
+		}
+		*root = nb
+	}
+	cur := *root
+	for d := depth; d > SingleIndirectLv; d-- {
+		per := pow(fs.geo.BlockPointers, d-1)
+		child := make([]uint32, 1)
+		if err := fs.readPointerWithCache(tx, cur, child, i/per, d); err != nil {
+			return 0, 0, err
+		}
+		if alloc {
+			nb := child[0]
+			var err error
+			if nb == 0 {
+				nb, err = fs.newPointerBlock(tx, d-1)
+			} else {
+				nb, err = fs.ownPointerBlock(tx, nb, d-1)
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			if nb != child[0] {
+				child[0] = nb
+				if err := fs.writePointerWithCache(tx, cur, child, i/per, d); err != nil {
+					return 0, 0, err
+				}
+			}
+		} else if child[0] == 0 {
+			return 0, 0, nil
+		}
+		cur = child[0]
+		i %= per
+	}
+	return cur, i, nil
+}
+
+// loadSlots reads the pointers of the slots from slot on into ptrs, slots
+// without a block read as 0.
+func (fs *FileSystem) loadSlots(tx *txn, inode *Inode, slot int, ptrs []uint32) error {
+	if inode.HasExtents() {
+		return fs.loadExtentSlots(tx, inode, slot, ptrs)
+	}
+	for len(ptrs) > 0 {
+		if slot < DirectBlocks {
+			ptrs[0] = inode.DirectPointers[slot]
+			slot++
+			ptrs = ptrs[1:]
+			continue
+		}
+		leaf, i, err := fs.leafBlock(tx, inode, slot, false)
+		if err != nil {
+			return err
+		}
+		n := fs.geo.BlockPointers - i
+		if n > len(ptrs) {
+			n = len(ptrs)
+		}
+		if leaf == 0 {
+			for j := 0; j < n; j++ {
+				ptrs[j] = 0
+			}
+		} else if err := fs.readPointerWithCache(tx, leaf, ptrs[:n], i, SingleIndirectLv); err != nil {
+			return err
+		}
+		slot += n
+		ptrs = ptrs[n:]
+	}
+	return nil
+}
+
+// storeSlots writes ptrs to the slots from slot on, allocating the missing
+// pointer blocks.
+func (fs *FileSystem) storeSlots(tx *txn, inode *Inode, slot int, ptrs []uint32) error {
+	if inode.HasExtents() {
+		return fs.storeExtentSlots(tx, inode, slot, ptrs)
+	}
+	for len(ptrs) > 0 {
+		if slot < DirectBlocks {
+			inode.DirectPointers[slot] = ptrs[0]
+			slot++
+			ptrs = ptrs[1:]
+			continue
+		}
+		leaf, i, err := fs.leafBlock(tx, inode, slot, true)
+		if err != nil {
+			return err
+		}
+		n := fs.geo.BlockPointers - i
+		if n > len(ptrs) {
+			n = len(ptrs)
+		}
+		if err := fs.writePointerWithCache(tx, leaf, ptrs[:n], i, SingleIndirectLv); err != nil {
+			return err
+		}
+		slot += n
+		ptrs = ptrs[n:]
+	}
+	return nil
+}
+
+// slotReader serves the pointers of consecutive slots, loading them a leaf
+// block at a time.
+type slotReader struct {
+	fs    *FileSystem
+	tx    *txn
+	inode *Inode
+	from  int
+	ptrs  []uint32
+}
+
+func (fs *FileSystem) newSlotReader(tx *txn, inode *Inode) *slotReader {
+	return &slotReader{fs: fs, tx: tx, inode: inode}
+}
+
+func (r *slotReader) get(slot int) (uint32, error) {
+	if slot < r.from || slot >= r.from+len(r.ptrs) {
+		n := DirectBlocks - slot
+		if r.inode.HasExtents() {
+			n = r.fs.geo.BlockPointers
+		} else if slot >= DirectBlocks {
+			n = r.fs.geo.BlockPointers - (slot-DirectBlocks)%r.fs.geo.BlockPointers
+		}
+		ptrs := make([]uint32, n)
+		if err := r.fs.loadSlots(r.tx, r.inode, slot, ptrs); err != nil {
+			return 0, err
+		}
+		r.from, r.ptrs = slot, ptrs
+	}
+	return r.ptrs[slot-r.from], nil
+}
+
+// set updates the loaded pointers after ptrs were stored from slot on.
+func (r *slotReader) set(slot int, ptrs []uint32) {
+	for i, p := range ptrs {
+		if j := slot + i - r.from; j >= 0 && j < len(r.ptrs) {
+			r.ptrs[j] = p
+		}
+	}
+}
+
+// lastSlot returns the last slot holding a block, all slots behind it are
+// holes. Slot 0 always holds the meta.
+func (fs *FileSystem) lastSlot(tx *txn, inode *Inode) (int, error) {
+	if inode.HasExtents() {
+		return fs.lastExtentSlot(tx, inode)
+	}
+	levels := []struct {
+		blkptr    uint32
+		indirects int
+	}{
+		{inode.TripleIndirect, TripleIndirectLv},
+		{inode.DoubleIndirect, DoubleIndirectLv},
+		{inode.SingleIndirect, SingleIndirectLv},
+	}
+	for _, level := range levels {
+		if level.blkptr == 0 {
+			continue
+		}
+		i, err := fs.lastInTree(tx, level.blkptr, level.indirects)
+		if err != nil {
+			return 0, err
+		}
+		if i >= 0 {
+			start := DirectBlocks
+			for d := SingleIndirectLv; d < level.indirects; d++ {
+				start += pow(fs.geo.BlockPointers, d)
+			}
+			return start + i, nil
+		}
+	}
+	for i := DirectBlocks - 1; i > 0; i-- {
+		if inode.DirectPointers[i] != 0 {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+// lastInTree returns the index of the last data block in the indirect tree
+// of depth, or -1 when the tree holds none.
+func (fs *FileSystem) lastInTree(tx *txn, blockptr uint32, depth int) (int, error) {
+	ptrs := make([]uint32, fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, blockptr, ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	per := pow(fs.geo.BlockPointers, depth-1)
+	for e := fs.geo.BlockPointers - 1; e >= 0; e-- {
+		if ptrs[e] == 0 {
+			continue
+		}
+		if depth == SingleIndirectLv {
+			return e, nil
+		}
+		i, err := fs.lastInTree(tx, ptrs[e], depth-1)
+		if err != nil {
+			return 0, err
+		}
+		if i >= 0 {
+			return e*per + i, nil
+		}
+	}
+	return -1, nil
+}
+
+// usedSlots counts the slots holding a block.
+func (fs *FileSystem) usedSlots(tx *txn, inode *Inode) (int, error) {
+	if inode.HasExtents() {
+		return fs.usedExtentSlots(tx, inode)
+	}
+	used := 0
+	for _, p := range inode.DirectPointers {
+		if p != 0 {
+			used++
+		}
+	}
+	levels := []struct {
+		blkptr    uint32
+		indirects int
+	}{
+		{inode.SingleIndirect, SingleIndirectLv},
+		{inode.DoubleIndirect, DoubleIndirectLv},
+		{inode.TripleIndirect, TripleIndirectLv},
+	}
+	for _, level := range levels {
+		n, err := fs.countTree(tx, level.blkptr, level.indirects)
+		if err != nil {
+			return 0, err
+		}
+		used += n
+	}
+	return used, nil
+}
+
+func (fs *FileSystem) countTree(tx *txn, blockptr uint32, depth int) (int, error) {
+	if blockptr == 0 {
+		return 0, nil
+	}
+	ptrs := make([]uint32, fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, blockptr, ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	cnt := 0
+	for _, p := range ptrs {
+		if depth == SingleIndirectLv {
+			if p != 0 {
+				cnt++
+			}
+			continue
+		}
+		n, err := fs.countTree(tx, p, depth-1)
+		if err != nil {
+			return 0, err
+		}
+		cnt += n
+	}
+	return cnt, nil
+}
+
+// locateSlot returns the slot holding the data position pos (the meta
+// included), the offset of pos in the slot and the pointer of the slot.
+// Holes and the slots behind the last block are one block in size.
+func (fs *FileSystem) locateSlot(tx *txn, inode *Inode, pos int64) (int, int64, uint32, error) {
+	if inode.HasExtents() {
+		// every slot is one block
+		bs := int64(fs.Smeta.BlockSize)
+		ptrs := make([]uint32, 1)
+		if err := fs.loadExtentSlots(tx, inode, int(pos/bs), ptrs); err != nil {
+			return 0, 0, 0, err
+		}
+		return int(pos / bs), pos % bs, ptrs[0], nil
+	}
+	last, err := fs.lastSlot(tx, inode)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	slots := fs.newSlotReader(tx, inode)
+	var start int64 = 0
+	for slot := 0; slot <= last; slot++ {
+		p, err := slots.get(slot)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size := fs.slotSize(p)
+		if pos < start+size {
+			return slot, pos - start, p, nil
+		}
+		start += size
+	}
+	bs := int64(fs.Smeta.BlockSize)
+	return last + 1 + int((pos-start)/bs), (pos - start) % bs, 0, nil
+}
+
+// releaseSlots releases the blocks of the slots from `from` on, together with
+// the indirect blocks left without a used slot.
+func (fs *FileSystem) releaseSlots(tx *txn, inode *Inode, from int) error {
+	if inode.HasExtents() {
+		return fs.releaseExtentSlots(tx, inode, from)
+	}
+	for i := from; i < DirectBlocks; i++ {
+		if inode.DirectPointers[i] != 0 {
+			if err := fs.releaseDataBlock(tx, []uint32{inode.DirectPointers[i]}); err != nil {
+				return err
+			}
+			inode.DirectPointers[i] = 0
+		}
+	}
+	levels := []struct {
+		blkptr    *uint32
+		indirects int
+	}{
+		{&inode.SingleIndirect, SingleIndirectLv},
+		{&inode.DoubleIndirect, DoubleIndirectLv},
+		{&inode.TripleIndirect, TripleIndirectLv},
+	}
+	start := DirectBlocks
+	for _, level := range levels {
+		span := pow(fs.geo.BlockPointers, level.indirects)
+		if *level.blkptr != 0 {
+			if from <= start {
+				if err := fs.releaseIndirectBlocks(tx, *level.blkptr, level.indirects, span); err != nil {
+					return err
+				}
+				*level.blkptr = 0
+			} else if from < start+span {
+				nb, err := fs.cutIndirect(tx, *level.blkptr, level.indirects, from-start)
+				if err != nil {
+					return err
+				}
+				*level.blkptr = nb
+			}
+		}
+		start += span
+	}
+	return nil
+}
+
+// cutIndirect releases the slots of an indirect block of depth from keep on.
+// It returns the block, which is a copy when the block was shared.
+func (fs *FileSystem) cutIndirect(tx *txn, blockptr uint32, depth int, keep int) (uint32, error) {
+	blockptr, err := fs.ownPointerBlock(tx, blockptr, depth)
+	if err != nil {
+		return 0, err
+	}
+	per := pow(fs.geo.BlockPointers, depth-1)
+	ptrs := make([]uint32, fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, blockptr, ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	first := (keep + per - 1) / per //first entry released as a whole
+	if depth == SingleIndirectLv {
+		if err := fs.releaseDataBlock(tx, append([]uint32(nil), ptrs[first:]...)); err != nil {
+			return 0, err
+		}
+	} else {
+		if e := keep / per; keep%per != 0 && ptrs[e] != 0 {
+			nb, err := fs.cutIndirect(tx, ptrs[e], depth-1, keep%per)
+			if err != nil {
+				return 0, err
+			}
+			if nb != ptrs[e] {
+				if err := fs.writePointerWithCache(tx, blockptr, []uint32{nb}, e, depth); err != nil {
+					return 0, err
+				}
+			}
+		}
+		for e := first; e < fs.geo.BlockPointers; e++ {
+			if err := fs.releaseIndirectBlocks(tx, ptrs[e], depth-1, per); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if first == fs.geo.BlockPointers {
+		return blockptr, nil
+	}
+	return blockptr, fs.writePointerWithCache(tx, blockptr, make([]uint32, fs.geo.BlockPointers-first), first, depth)
+}
+
+// inodeBlocks returns the blocks of inode: the data blocks, the indirect
+// blocks and the meta block.
+func (fs *FileSystem) inodeBlocks(tx *txn, inode *Inode) ([]uint32, error) {
+	if inode.IsPacked() {
+		return []uint32{inode.DirectPointers[0]}, nil
+	}
+	if inode.IsInline() {
+		node := *inode
+		node.setInline(nil)
+		inode = &node
+	}
+	if inode.HasExtents() {
+		return fs.extentBlocks(tx, inode)
+	}
+	var blocks []uint32
+	for _, p := range inode.DirectPointers {
+		if p != 0 {
+			blocks = append(blocks, p)
+		}
+	}
+	if inode.HasMetaBlock() {
+		ref, err := fs.readMetaRef(inode)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, ref.Block)
+	}
+	var walk func(blockptr uint32, depth int) error
+	walk = func(blockptr uint32, depth int) error {
+		if blockptr == 0 {
+			return nil
+		}
+		blocks = append(blocks, blockptr)
+		ptrs := make([]uint32, fs.geo.BlockPointers)
+		if err := fs.readPointerWithCache(tx, blockptr, ptrs, 0, depth); err != nil {
+			return err
+		}
+		for _, p := range ptrs {
+			if depth == SingleIndirectLv {
+				if p != 0 {
+					blocks = append(blocks, p)
+				}
+			} else if err := walk(p, depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, root := range []struct {
+		blkptr uint32
+		depth  int
+	}{
+		{inode.SingleIndirect, SingleIndirectLv},
+		{inode.DoubleIndirect, DoubleIndirectLv},
+		{inode.TripleIndirect, TripleIndirectLv},
+	} {
+		if err := walk(root.blkptr, root.depth); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
@@ -22,13 +22,17 @@ package dpfs
 
 import (
 	"container/list"
+	"sync"
 )
 
 const (
 	BlockCacheSize = 128
 )
 
+// CacheLayer is a LRU cache guarded by its own lock. Cached values are treated
+// as immutable once stored, callers replace them instead of modifying in place.
 type CacheLayer struct {
+	lock     sync.Mutex
 	capacity int
 	cache    map[uint32]*list.Element
 	list     *list.List
@@ -48,6 +52,8 @@ func NewCacheLayer(capacity int) *CacheLayer {
 }
 
 func (c *CacheLayer) Get(blockPtr uint32) (any, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if elem, found := c.cache[blockPtr]; found {
 		c.list.MoveToFront(elem)
 		return elem.Value.(*CachedBlock).data, true
@@ -55,6 +61,8 @@ func (c *CacheLayer) Get(blockPtr uint32) (any, bool) {
 	return nil, false
 }
 func (c *CacheLayer) Put(blockPtr uint32, data any) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if elem, found := c.cache[blockPtr]; found {
 		elem.Value.(*CachedBlock).data = data
 		c.list.MoveToFront(elem)
@@ -73,15 +81,31 @@ func (c *CacheLayer) Put(blockPtr uint32, data any) {
 	c.cache[blockPtr] = newElem
 }
 
+func (c *CacheLayer) Remove(blockPtr uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, found := c.cache[blockPtr]; found {
+		c.list.Remove(elem)
+		delete(c.cache, blockPtr)
+	}
+}
+
 type BlockCache struct {
 	lv1, lv2, lv3 *CacheLayer
+	ext           *CacheLayer
 }
 
 func NewBlockCache() *BlockCache {
+	return newBlockCache(BlockCacheSize)
+}
+
+// newBlockCache returns a cache keeping capacity blocks of each level.
+func newBlockCache(capacity int) *BlockCache {
 	return &BlockCache{
-		lv1: NewCacheLayer(BlockCacheSize),
-		lv2: NewCacheLayer(BlockCacheSize),
-		lv3: NewCacheLayer(BlockCacheSize),
+		lv1: NewCacheLayer(capacity),
+		lv2: NewCacheLayer(capacity),
+		lv3: NewCacheLayer(capacity),
+		ext: NewCacheLayer(capacity),
 	}
 }
 
@@ -93,11 +117,20 @@ func (m *BlockCache) Get(level int, blockPtr uint32) (any, bool) {
 		return m.lv2.Get(blockPtr)
 	case TripleIndirectLv:
 		return m.lv3.Get(blockPtr)
+	case ExtentLv:
+		return m.ext.Get(blockPtr)
 	default:
 		return nil, false
 	}
 }
 
+func (m *BlockCache) Remove(blockPtr uint32) {
+	m.lv1.Remove(blockPtr)
+	m.lv2.Remove(blockPtr)
+	m.lv3.Remove(blockPtr)
+	m.ext.Remove(blockPtr)
+}
+
 func (m *BlockCache) Put(level int, blockPtr uint32, data any) {
 	switch level {
 	case SingleIndirectLv:
@@ -106,5 +139,7 @@ func (m *BlockCache) Put(level int, blockPtr uint32, data any) {
 		m.lv2.Put(blockPtr, data)
 	case TripleIndirectLv:
 		m.lv3.Put(blockPtr, data)
+	case ExtentLv:
+		m.ext.Put(blockPtr, data)
 	}
 }
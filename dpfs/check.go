@@ -0,0 +1,939 @@
+/*
+ check.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+  Check walks every allocated inode of the inode bitmaps, follows the direct
+  and indirect pointers and rebuilds the block bitmap the inodes imply, then
+  compares it with the bitmaps of the volumes. Repair truncates an inode at
+  its first bad pointer, quarantines inodes whose meta cannot be parsed and
+  drops inodes without a usable meta block, then rewrites the bitmaps. With
+  dedup a data block may serve several slots, the references are counted
+  and compared with the dedup table. A slab of packed files is claimed once,
+  its records must match the inodes referring to them.
+  Check is an offline tool, nothing else may use the file system meanwhile.
+*/
+
+type IssueKind int
+
+const (
+	IssueLeakedBlock  IssueKind = iota + 1 //allocated, but referenced by no inode
+	IssueDupBlock                          //referenced more than once
+	IssueFreeBlockRef                      //referenced, but free in the bitmap
+	IssueBadGroup                          //pointer with a bad group id
+	IssueBadPointer                        //pointer out of the group, or a missing pointer
+	IssueBadInode
+	IssueBadMetaSize
+	IssueBadFileSize
+	IssueBadBlocks
+	IssueBadMeta
+	IssueBadRefCount //dedup reference count differs from the references
+	IssueBadSlot     //packed inode without its record
+	IssueLostSlot    //packed record of no inode
+)
+
+var issueNames = map[IssueKind]string{
+	IssueLeakedBlock:  "leaked block",
+	IssueDupBlock:     "doubly-referenced block",
+	IssueFreeBlockRef: "pointer into free space",
+	IssueBadGroup:     "bad group id",
+	IssueBadPointer:   "bad pointer",
+	IssueBadInode:     "bad inode",
+	IssueBadMetaSize:  "bad meta size",
+	IssueBadFileSize:  "bad file size",
+	IssueBadBlocks:    "bad block count",
+	IssueBadMeta:      "bad file meta",
+	IssueBadRefCount:  "bad reference count",
+	IssueBadSlot:      "bad packed slot",
+	IssueLostSlot:     "lost packed slot",
+}
+
+func (k IssueKind) String() string {
+	if s, ok := issueNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("issue(%d)", int(k))
+}
+
+type CheckIssue struct {
+	Kind   IssueKind
+	Inode  uint32 //0 for bitmap issues
+	Block  uint32
+	Detail string
+}
+
+func (i CheckIssue) String() string {
+	if i.Inode == 0 {
+		return fmt.Sprintf("%s [block:%08x] %s", i.Kind, i.Block, i.Detail)
+	}
+	return fmt.Sprintf("%s [inode:%08x,block:%08x] %s", i.Kind, i.Inode, i.Block, i.Detail)
+}
+
+type CheckOptions struct {
+	Repair bool   //fix the bitmaps, truncate or quarantine broken inodes
+	Report string //path of the report file, empty for none
+}
+
+type CheckReport struct {
+	Inodes      int   //inodes of files checked
+	Blocks      int64 //blocks referenced by the inodes
+	Issues      []CheckIssue
+	Truncated   []uint32
+	Quarantined []uint32
+	Dropped     []uint32
+	Repaired    bool
+}
+
+func (r *CheckReport) Clean() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *CheckReport) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "fsck report %s\n", time.Now().Format("2006-01-02 15:04:05 MST"))
+	for _, i := range r.Issues {
+		fmt.Fprintf(&buf, "%s\n", i)
+	}
+	for _, p := range r.Truncated {
+		fmt.Fprintf(&buf, "truncated inode %08x\n", p)
+	}
+	for _, p := range r.Quarantined {
+		fmt.Fprintf(&buf, "quarantined inode %08x\n", p)
+	}
+	for _, p := range r.Dropped {
+		fmt.Fprintf(&buf, "dropped inode %08x\n", p)
+	}
+	fmt.Fprintf(&buf, "inodes:%d blocks:%d issues:%d repaired:%v\n", r.Inodes, r.Blocks, len(r.Issues), r.Repaired)
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+type checkMark struct {
+	ptr  uint32
+	slot int //first slot served by the block
+}
+
+type checkIndirect struct {
+	ptr   uint32
+	depth int
+	slot  int
+}
+
+type checkNode struct {
+	ptr        uint32
+	node       *Inode
+	cut        int   //first slot dropped by repair, -1 keeps all
+	cutCap     int64 //capacity of the slots before cut
+	capacity   int64 //data position of the next slot
+	used       int   //slots holding a block
+	fileSize   uint64
+	quarantine bool
+	dropMeta   bool //the meta block is lost, drop the reference to it
+	marks      []checkMark
+	indirects  []checkIndirect
+	extents    []extent    //extents of an extent file, up to the first bad one
+	extBlocks  []checkMark //extent blocks of an extent file
+}
+
+func (n *checkNode) stop(slot int) bool {
+	n.cut = slot
+	n.cutCap = n.capacity
+	return false
+}
+
+type checkSlab struct {
+	slab *slab           //nil when it cannot be claimed or read
+	refs map[uint32]bool //slots of the inodes walked
+}
+
+type checker struct {
+	fs       *FileSystem
+	report   *CheckReport
+	actual   [][]uint8
+	expected [][]uint8
+	owners   map[uint32]int32 //blocks and their references, with reference counts
+	revisit  int              //walking below a block claimed before
+	slabs    map[uint32]*checkSlab
+}
+
+func (c *checker) issue(kind IssueKind, inode, block uint32, format string, args ...any) {
+	c.report.Issues = append(c.report.Issues, CheckIssue{
+		Kind:   kind,
+		Inode:  inode,
+		Block:  block,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) blockSpan(ptr uint32) int64 {
+	if EntAddr(ptr).IsBigBlock() > 0 {
+		return 64 * int64(c.fs.Smeta.BlockSize)
+	}
+	return int64(c.fs.Smeta.BlockSize)
+}
+
+// mark claims the bits of ptr for the inode.
+func (c *checker) mark(n *checkNode, ptr uint32, slot int) bool {
+	idx, group, isBig := EntAddr(ptr).GetAddr()
+	if group < 1 || group > uint32(len(c.actual)) || c.actual[group-1] == nil {
+		c.issue(IssueBadGroup, n.ptr, ptr, "slot %d", slot)
+		return false
+	}
+	cnt := uint32(1)
+	if isBig > 0 {
+		cnt = 64
+	}
+	if idx+cnt > c.fs.Smeta.BlocksInGroup {
+		c.issue(IssueBadPointer, n.ptr, ptr, "slot %d out of group", slot)
+		return false
+	}
+	bm := c.expected[group-1]
+	for i := idx; i < idx+cnt; i++ {
+		if bm[i/8]&(1<<(i%8)) != 0 {
+			c.issue(IssueDupBlock, n.ptr, ptr, "slot %d", slot)
+			return false
+		}
+	}
+	free := 0
+	for i := idx; i < idx+cnt; i++ {
+		bm[i/8] |= 1 << (i % 8)
+		if c.actual[group-1][i/8]&(1<<(i%8)) == 0 {
+			free++
+		}
+	}
+	if free > 0 {
+		c.issue(IssueFreeBlockRef, n.ptr, ptr, "slot %d, %d free blocks", slot, free)
+	}
+	n.marks = append(n.marks, checkMark{ptr, slot})
+	c.report.Blocks += int64(cnt)
+	return true
+}
+
+// markShared claims a data or an indirect block for the inode. With
+// reference counts a block already claimed gets one more reference, and the
+// blocks below a shared indirect block are only counted once.
+func (c *checker) markShared(n *checkNode, ptr uint32, slot int) bool {
+	if c.owners == nil {
+		return c.mark(n, ptr, slot)
+	}
+	if c.revisit > 0 {
+		return true
+	}
+	if cnt, ok := c.owners[refKey(ptr)]; ok {
+		c.owners[refKey(ptr)] = cnt + 1
+		n.marks = append(n.marks, checkMark{ptr, slot})
+		return true
+	}
+	if !c.mark(n, ptr, slot) {
+		return false
+	}
+	c.owners[refKey(ptr)] = 1
+	return true
+}
+
+// unmark releases the claims of the inode from slot on.
+func (c *checker) unmark(n *checkNode, slot int) {
+	c.unmarkIf(n, func(m checkMark) bool { return m.slot >= slot })
+}
+
+// unmarkIf releases the claims of the inode matching drop.
+func (c *checker) unmarkIf(n *checkNode, drop func(checkMark) bool) {
+	kept := n.marks[:0]
+	for _, m := range n.marks {
+		if !drop(m) {
+			kept = append(kept, m)
+			continue
+		}
+		if cnt, ok := c.owners[refKey(m.ptr)]; ok {
+			if cnt > 1 {
+				c.owners[refKey(m.ptr)] = cnt - 1
+				continue
+			}
+			delete(c.owners, refKey(m.ptr))
+		}
+		idx, group, isBig := EntAddr(m.ptr).GetAddr()
+		cnt := uint32(1)
+		if isBig > 0 {
+			cnt = 64
+		}
+		clearBits(c.expected[group-1], idx, idx+cnt)
+		c.report.Blocks -= int64(cnt)
+	}
+	n.marks = kept
+}
+
+func (c *checker) data(n *checkNode, slot int, ptr uint32) bool {
+	if ptr == 0 {
+		if slot == 0 {
+			c.issue(IssueBadPointer, n.ptr, 0, "meta block unallocated")
+			return n.stop(slot)
+		}
+		n.capacity += int64(c.fs.Smeta.BlockSize)
+		return true
+	}
+	if uint64(n.capacity) >= n.node.DataSize() {
+		c.issue(IssueBadFileSize, n.ptr, ptr, "slot %d beyond end of file", slot)
+		return n.stop(slot)
+	}
+	if !c.markShared(n, ptr, slot) {
+		return n.stop(slot)
+	}
+	n.capacity += c.blockSpan(ptr)
+	n.used++
+	return true
+}
+
+// indirect walks an indirect block of depth serving the slots from slot on,
+// a missing one is a hole over all its slots.
+func (c *checker) indirect(n *checkNode, ptr uint32, depth, slot int) bool {
+	if ptr == 0 {
+		n.capacity += int64(pow(c.fs.geo.BlockPointers, depth)) * int64(c.fs.Smeta.BlockSize)
+		return true
+	}
+	_, seen := c.owners[refKey(ptr)]
+	if !c.markShared(n, ptr, slot) {
+		return n.stop(slot)
+	}
+	if seen {
+		// the blocks below are claimed by the first owner
+		c.revisit++
+		defer func() { c.revisit-- }()
+	}
+	n.indirects = append(n.indirects, checkIndirect{ptr, depth, slot})
+	per := pow(c.fs.geo.BlockPointers, depth-1)
+	ptrs := make([]uint32, c.fs.geo.BlockPointers)
+	if err := c.fs.readPointer(nil, ptr, ptrs, 0); err != nil {
+		c.issue(IssueBadPointer, n.ptr, ptr, "read indirect block failed:%s", err)
+		return n.stop(slot)
+	}
+	for i, p := range ptrs {
+		s := slot + i*per
+		if depth == 1 {
+			if !c.data(n, s, p) {
+				return false
+			}
+		} else if !c.indirect(n, p, depth-1, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) walk(n *checkNode) {
+	if n.node.IsInline() {
+		// the pointer area holds the data, the meta block is the only block
+		if n.node.FileSize > InlineLimit {
+			c.issue(IssueBadFileSize, n.ptr, 0, "inline size %d", n.node.FileSize)
+			n.fileSize = InlineLimit
+		}
+		c.data(n, 0, n.node.DirectPointers[0])
+		return
+	}
+	if n.node.HasExtents() {
+		c.walkExtents(n)
+		return
+	}
+	for i := 0; i < DirectBlocks; i++ {
+		if !c.data(n, i, n.node.DirectPointers[i]) {
+			return
+		}
+	}
+	levels := []struct {
+		blkptr    uint32
+		indirects int
+	}{
+		{n.node.SingleIndirect, SingleIndirectLv},
+		{n.node.DoubleIndirect, DoubleIndirectLv},
+		{n.node.TripleIndirect, TripleIndirectLv},
+	}
+	slot := DirectBlocks
+	for _, level := range levels {
+		if !c.indirect(n, level.blkptr, level.indirects, slot) {
+			return
+		}
+		slot += pow(c.fs.geo.BlockPointers, level.indirects)
+	}
+}
+
+// extentTree collects the extents of the tree below the extent block ptr
+// serving the slots from slot on. It returns the first slot of a bad block
+// or extent, or -1.
+func (c *checker) extentTree(n *checkNode, ptr uint32, depth, slot int) int {
+	if !c.markShared(n, ptr, slot) {
+		return slot
+	}
+	n.extBlocks = append(n.extBlocks, checkMark{ptr, slot})
+	buf, err := c.fs.readExtentBlock(nil, ptr, depth)
+	if err != nil {
+		c.issue(IssueBadPointer, n.ptr, ptr, "read extent block failed:%s", err)
+		return slot
+	}
+	depth, cnt := int(buf[1]>>16), int(buf[1]&0xffff)
+	ents := buf[extentHeaderLen:]
+	for i := 0; i < cnt; i++ {
+		if depth == 0 {
+			if bad := c.addExtent(n, ptr, extent{ents[i*3], ents[i*3+1], ents[i*3+2]}); bad >= 0 {
+				return bad
+			}
+			continue
+		}
+		first := int(ents[i*2])
+		if last := len(n.extents); first < slot || last > 0 && first < n.extents[last-1].end() {
+			c.issue(IssueBadPointer, n.ptr, ptr, "extent block of slot %d out of order", first)
+			return max(slot, first)
+		}
+		if bad := c.extentTree(n, ents[i*2+1], depth-1, first); bad >= 0 {
+			return bad
+		}
+	}
+	return -1
+}
+
+// addExtent appends the extent e found in block to the extents of n. It
+// returns the first slot it cannot keep, or -1.
+func (c *checker) addExtent(n *checkNode, block uint32, e extent) int {
+	next := 1
+	if last := len(n.extents); last > 0 {
+		next = n.extents[last-1].end()
+	}
+	if int(e.slot) < next || e.length == 0 || EntAddr(e.block).IsBigBlock() > 0 {
+		c.issue(IssueBadPointer, n.ptr, block, "bad extent [slot:%d,block:%d,length:%d]", e.slot, e.block, e.length)
+		return next
+	}
+	n.extents = append(n.extents, e)
+	return -1
+}
+
+// walkExtents walks the map of an extent file.
+func (c *checker) walkExtents(n *checkNode) {
+	if !c.data(n, 0, n.node.DirectPointers[0]) {
+		return
+	}
+	bad := -1
+	if n.node.TripleIndirect == 0 {
+		for _, e := range n.node.inodeExtents() {
+			if bad = c.addExtent(n, 0, e); bad >= 0 {
+				break
+			}
+		}
+	} else {
+		bad = c.extentTree(n, n.node.TripleIndirect, -1, 1)
+	}
+	bs := int64(c.fs.Smeta.BlockSize)
+	next := 1
+	for _, e := range n.extents {
+		if bad >= 0 && int(e.slot) >= bad {
+			break
+		}
+		n.capacity += int64(int(e.slot)-next) * bs
+		for s := int(e.slot); s < e.end() && (bad < 0 || s < bad); s++ {
+			if !c.data(n, s, e.at(s)) {
+				return
+			}
+		}
+		next = e.end()
+	}
+	if bad >= 0 {
+		n.capacity += int64(max(bad-next, 0)) * bs
+		n.stop(bad)
+	}
+}
+
+func (c *checker) checkMeta(n *checkNode) {
+	node := n.node
+	block, size := node.DirectPointers[0], uint32(node.MetaSize)
+	if node.HasMetaBlock() {
+		ref, err := c.fs.readMetaRef(node)
+		if err != nil {
+			c.issue(IssueBadMeta, n.ptr, node.DirectPointers[0], "%s", err)
+		}
+		if err != nil || !c.mark(n, ref.Block, 0) {
+			n.quarantine = true
+			n.dropMeta = true
+			return
+		}
+		block, size = ref.Block, ref.Size
+	}
+	if node.IsQuarantined() {
+		return
+	}
+	data := make([]byte, size)
+	if _, _, err := c.fs.readBlock(block, 0, data); err != nil {
+		c.issue(IssueBadMeta, n.ptr, block, "read meta failed:%s", err)
+		n.quarantine = true
+		return
+	}
+	nameLen := int32(binary.LittleEndian.Uint32(data))
+	if nameLen < 0 || int(nameLen)+8 > len(data) {
+		c.issue(IssueBadMeta, n.ptr, block, "bad name length %d", nameLen)
+		n.quarantine = true
+		return
+	}
+	extLen := int32(binary.LittleEndian.Uint32(data[4+nameLen:]))
+	if extLen < 0 || int(nameLen)+int(extLen)+8 > len(data) {
+		c.issue(IssueBadMeta, n.ptr, block, "bad meta length %d", extLen)
+		n.quarantine = true
+		return
+	}
+	meta := FileMeta{}
+	if err := meta.FromBytes(data); err != nil {
+		c.issue(IssueBadMeta, n.ptr, block, "%s", err)
+		n.quarantine = true
+	}
+}
+
+// checkPacked checks the record of a packed inode. The slab is claimed by
+// the first inode found in it, but stays claimed when that one is dropped.
+func (c *checker) checkPacked(n *checkNode) {
+	node := n.node
+	ptr, slot := node.DirectPointers[0], node.DirectPointers[1]
+	cs, ok := c.slabs[ptr]
+	if !ok {
+		cs = &checkSlab{refs: make(map[uint32]bool)}
+		if c.mark(n, ptr, 0) {
+			n.marks = nil
+			s, err := c.fs.readSlab(ptr)
+			if err != nil {
+				// no file may keep the slab, it is freed by the repair
+				c.issue(IssueBadPointer, n.ptr, ptr, "read slab failed:%s", err)
+				idx, group, _ := EntAddr(ptr).GetAddr()
+				clearBits(c.expected[group-1], idx, idx+1)
+				c.report.Blocks--
+			}
+			cs.slab = s
+		}
+		c.slabs[ptr] = cs
+	}
+	if cs.slab == nil {
+		c.issue(IssueBadSlot, n.ptr, ptr, "slot %d in a bad slab", slot)
+		n.cut = 0
+		return
+	}
+	rec, err := slabRecord(cs.slab, slot, node)
+	if err != nil || cs.slab.owners[slot] != n.ptr || cs.refs[slot] {
+		c.issue(IssueBadSlot, n.ptr, ptr, "slot %d", slot)
+		n.cut = 0
+		return
+	}
+	cs.refs[slot] = true
+	if node.IsQuarantined() {
+		return
+	}
+	meta := FileMeta{}
+	if err := meta.FromBytes(rec[:node.MetaSize]); err != nil {
+		c.issue(IssueBadMeta, n.ptr, ptr, "%s", err)
+		n.quarantine = true
+	}
+}
+
+// checkSlabs reports the records no inode refers to, it returns the slabs
+// holding them.
+func (c *checker) checkSlabs() []uint32 {
+	var lost []uint32
+	for ptr, cs := range c.slabs {
+		if cs.slab == nil {
+			continue
+		}
+		found := false
+		for i, owner := range cs.slab.owners {
+			if owner != 0 && !cs.refs[uint32(i)] {
+				c.issue(IssueLostSlot, owner, ptr, "slot %d", i)
+				found = true
+			}
+		}
+		if found {
+			lost = append(lost, ptr)
+		}
+	}
+	return lost
+}
+
+// repairSlabs drops the lost records of the slabs, a slab left empty is
+// no longer claimed.
+func (c *checker) repairSlabs(lost []uint32) error {
+	tx := c.fs.beginTx()
+	for _, ptr := range lost {
+		cs := c.slabs[ptr]
+		for i := len(cs.slab.owners) - 1; i >= 0; i-- {
+			if !cs.refs[uint32(i)] {
+				cs.slab.drop(uint32(i), cs.slab.owners[i])
+			}
+		}
+		if len(cs.slab.owners) == 0 {
+			idx, group, _ := EntAddr(ptr).GetAddr()
+			clearBits(c.expected[group-1], idx, idx+1)
+			c.report.Blocks--
+			continue
+		}
+		if err := c.fs.stageBlock(tx, ptr, cs.slab.encode(int(c.fs.Smeta.BlockSize)), 0); err != nil {
+			return err
+		}
+	}
+	// the room of the slabs changed, or they are gone
+	c.fs.pack.lock.Lock()
+	c.fs.pack.open = nil
+	c.fs.pack.lock.Unlock()
+	return c.fs.commitTx(tx)
+}
+
+func (c *checker) checkInode(ptr uint32) *checkNode {
+	node, err := c.fs.readInode(ptr)
+	if err != nil {
+		c.issue(IssueBadInode, ptr, 0, "read inode failed:%s", err)
+		return nil
+	}
+	if c.fs.isSysInode(ptr) {
+		if node.Seq == 0 {
+			return nil //reserved, not set up yet
+		}
+	} else {
+		c.report.Inodes++
+	}
+	n := &checkNode{ptr: ptr, node: node, cut: -1, fileSize: node.FileSize}
+	if node.Seq == 0 || node.Blocks == 0 && !node.IsPacked() {
+		c.issue(IssueBadInode, ptr, 0, "uninitialized inode [seq:%d,blocks:%d]", node.Seq, node.Blocks)
+		n.cut = 0
+		return n
+	}
+	if node.IsPacked() {
+		c.checkPacked(n)
+		return n
+	}
+	metaOk := node.MetaSize > 0 && node.MetaSize%FileMetaAlign == 0 && uint32(node.MetaSize) < c.fs.Smeta.BlockSize
+	if !metaOk && !node.IsQuarantined() {
+		c.issue(IssueBadMetaSize, ptr, 0, "meta size %d", node.MetaSize)
+		n.quarantine = true
+	}
+	if !metaOk && node.HasMetaBlock() {
+		n.dropMeta = true
+	}
+	c.walk(n)
+	if n.cut == 0 {
+		return n
+	}
+	if metaOk {
+		c.checkMeta(n)
+	}
+	if !metaOk || node.IsQuarantined() {
+		return n
+	}
+	if n.cut < 0 {
+		if n.used != int(node.Blocks) {
+			c.issue(IssueBadBlocks, ptr, 0, "%d blocks counted, %d in use", node.Blocks, n.used)
+		}
+	} else if uint64(n.cutCap) < node.DataSize() {
+		n.fileSize = uint64(n.cutCap) - uint64(node.MetaSize)
+	}
+	if n.cut > 0 {
+		c.unmark(n, n.cut)
+	}
+	return n
+}
+
+func (c *checker) repairInode(n *checkNode) error {
+	tx := c.fs.beginTx()
+	if n.cut == 0 {
+		c.unmark(n, 0)
+		if err := c.fs.freeInode(tx, n.ptr); err != nil {
+			return err
+		}
+		c.report.Dropped = append(c.report.Dropped, n.ptr)
+		return c.fs.commitTx(tx)
+	}
+	node := *n.node
+	if n.cut > 0 && node.HasExtents() {
+		if err := c.cutExtents(tx, n, &node); err != nil {
+			return err
+		}
+	} else if n.cut > 0 {
+		for i := n.cut; i < DirectBlocks; i++ {
+			node.DirectPointers[i] = 0
+		}
+		levels := []*uint32{&node.SingleIndirect, &node.DoubleIndirect, &node.TripleIndirect}
+		slot := DirectBlocks
+		for i, blkptr := range levels {
+			if slot >= n.cut {
+				*blkptr = 0
+			}
+			slot += pow(c.fs.geo.BlockPointers, i+1)
+		}
+		for _, ind := range n.indirects {
+			if ind.slot >= n.cut {
+				continue
+			}
+			per := pow(c.fs.geo.BlockPointers, ind.depth-1)
+			from := (n.cut - ind.slot + per - 1) / per
+			if from < c.fs.geo.BlockPointers {
+				if err := c.fs.writePointer(tx, ind.ptr, make([]uint32, c.fs.geo.BlockPointers-from), from); err != nil {
+					return err
+				}
+				c.fs.ibCache.Remove(ind.ptr)
+			}
+		}
+		c.report.Truncated = append(c.report.Truncated, n.ptr)
+	}
+	node.Blocks = uint32(n.used)
+	node.FileSize = n.fileSize
+	if n.quarantine {
+		node.Attr |= 1 << InodeAttrQuarantined
+		c.report.Quarantined = append(c.report.Quarantined, n.ptr)
+	}
+	if n.dropMeta {
+		node.Attr &^= 1 << InodeAttrMetaBlock
+	}
+	if err := c.fs.syncInode(tx, n.ptr, &node); err != nil {
+		return err
+	}
+	return c.fs.commitTx(tx)
+}
+
+// cutExtents drops the slots of an extent file from the cut on. The map left
+// is written into the extent blocks serving the slots before the cut, those
+// it does not need are released with the blocks behind the cut.
+func (c *checker) cutExtents(tx *txn, n *checkNode, node *Inode) error {
+	var kept []extent
+	for _, e := range n.extents {
+		if e.end() <= n.cut {
+			kept = append(kept, e)
+		} else if int(e.slot) < n.cut {
+			kept = append(kept, extent{e.slot, e.block, uint32(n.cut) - e.slot})
+		}
+	}
+	var blocks []uint32
+	for _, m := range n.extBlocks {
+		if m.slot < n.cut {
+			blocks = append(blocks, m.ptr)
+		}
+	}
+	unused, err := c.fs.writeExtents(tx, node, kept, blocks, false)
+	if err != nil {
+		return err
+	}
+	for _, p := range unused {
+		c.fs.ibCache.Remove(p)
+		c.unmarkIf(n, func(m checkMark) bool { return m.ptr == p })
+	}
+	c.report.Truncated = append(c.report.Truncated, n.ptr)
+	return nil
+}
+
+func (c *checker) needRepair(n *checkNode) bool {
+	return n.cut >= 0 || n.quarantine || n.dropMeta || n.fileSize != n.node.FileSize || uint32(n.used) != n.node.Blocks
+}
+
+// compareBitmap reports the differences between the expected and the actual
+// block bitmap of group g, it returns the leaked and the missing blocks.
+func (c *checker) compareBitmap(g int) ([]uint32, []uint32) {
+	var leaked, missing []uint32
+	exp, act := c.expected[g], c.actual[g]
+	runStart := -1
+	flush := func(end int) {
+		if runStart >= 0 {
+			c.issue(IssueLeakedBlock, 0, MakeEntAddr(uint32(runStart), uint32(g)+1, false), "%d blocks", end-runStart)
+			runStart = -1
+		}
+	}
+	for i := 0; i < len(exp)*8; i++ {
+		e := exp[i/8]&(1<<(i%8)) != 0
+		a := act[i/8]&(1<<(i%8)) != 0
+		ptr := MakeEntAddr(uint32(i), uint32(g)+1, false)
+		if a && !e {
+			if runStart < 0 {
+				runStart = i
+			}
+			leaked = append(leaked, ptr)
+			continue
+		}
+		flush(i)
+		if e && !a {
+			missing = append(missing, ptr)
+		}
+	}
+	flush(len(exp) * 8)
+	return leaked, missing
+}
+
+// compareRefs reports the blocks whose count in the dedup table differs
+// from their references, it returns the blocks and the right counts. Both
+// are keyed by refKey.
+func (c *checker) compareRefs() map[uint32]int32 {
+	d := c.fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	bad := make(map[uint32]int32)
+	for p, cnt := range c.owners {
+		if cnt > 1 && d.refs[p] != cnt-1 {
+			bad[p] = cnt - 1
+		}
+	}
+	for p, refs := range d.refs {
+		if c.owners[p] <= 1 && refs != 0 {
+			bad[p] = 0
+		}
+	}
+	for p, refs := range bad {
+		c.issue(IssueBadRefCount, 0, p, "%d references counted, %d expected", d.refs[p], refs)
+	}
+	return bad
+}
+
+func (c *checker) repairRefs(bad map[uint32]int32) error {
+	tx := c.fs.beginTx()
+	d := c.fs.dedup
+	d.lock.Lock()
+	for p, refs := range bad {
+		idx, group, _ := EntAddr(p).GetAddr()
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(refs))
+		tx.write(group-1, c.fs.geo.dedupPos(idx), data)
+		if refs == 0 {
+			delete(d.refs, p)
+		} else {
+			d.refs[p] = refs
+		}
+	}
+	d.orphans = nil
+	d.lock.Unlock()
+	return c.fs.commitTx(tx)
+}
+
+func (c *checker) repairBitmap(g int, leaked, missing []uint32) error {
+	tx := c.fs.beginTx()
+	tx.bitmapOp(recFreeBlocks, uint32(g), leaked)
+	if len(missing) > 0 {
+		group := &c.fs.blockGroups[g]
+		group.lock.Lock()
+		group.blockBitmap.SetBits(missing)
+		group.lock.Unlock()
+		tx.bitmapOp(recAllocBlocks, uint32(g), missing)
+	}
+	return c.fs.commitTx(tx)
+}
+
+// Check verifies the consistency of the inodes and the block bitmaps, and
+// fixes the problems found when opts.Repair is set. It must not run
+// concurrently with any other operation on the file system.
+//
+// Parameters:
+//   - opts: Repair enables the repair, Report names a file the report is
+//     written to.
+//
+// Returns:
+//   - *CheckReport: The problems found and the repairs done.
+//   - error: An error if the check could not complete.
+func (fs *FileSystem) Check(opts CheckOptions) (*CheckReport, error) {
+	if opts.Repair {
+		if err := fs.writable("Check"); err != nil {
+			return nil, err
+		}
+	}
+	n := fs.groupCount()
+	c := &checker{
+		fs:       fs,
+		report:   &CheckReport{},
+		actual:   make([][]uint8, n),
+		expected: make([][]uint8, n),
+		slabs:    make(map[uint32]*checkSlab),
+	}
+	for g := 0; g < int(n); g++ {
+		if fs.device.volumes[g].ready.Load() {
+			c.actual[g] = fs.GetBlockBitmap(g)
+			c.expected[g] = make([]uint8, len(c.actual[g]))
+		}
+	}
+	if fs.dedup != nil {
+		c.owners = make(map[uint32]int32)
+	}
+	var broken []*checkNode
+	for g := 0; g < int(n); g++ {
+		if c.actual[g] == nil {
+			continue
+		}
+		bm := fs.GetInodeBitmap(g)
+		for i := 0; i < len(bm)*8; i++ {
+			if bm[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			n := c.checkInode(MakeEntAddr(uint32(i), uint32(g)+1, false))
+			if n != nil && c.needRepair(n) {
+				broken = append(broken, n)
+			}
+		}
+	}
+	if opts.Repair {
+		for _, n := range broken {
+			if err := c.repairInode(n); err != nil {
+				return c.report, err
+			}
+		}
+	}
+	if lost := c.checkSlabs(); opts.Repair && len(lost) > 0 {
+		if err := c.repairSlabs(lost); err != nil {
+			return c.report, err
+		}
+	}
+	if c.owners != nil {
+		if bad := c.compareRefs(); opts.Repair && len(bad) > 0 {
+			if err := c.repairRefs(bad); err != nil {
+				return c.report, err
+			}
+		}
+	}
+	for g := range c.expected {
+		if c.expected[g] == nil {
+			continue
+		}
+		leaked, missing := c.compareBitmap(g)
+		if opts.Repair && len(leaked)+len(missing) > 0 {
+			if err := c.repairBitmap(g, leaked, missing); err != nil {
+				return c.report, err
+			}
+		}
+	}
+	c.report.Repaired = opts.Repair && len(c.report.Issues) > 0
+	if c.report.Repaired {
+		// files may have been dropped or quarantined
+		if err := fs.RebuildNameIndex(); err != nil {
+			return c.report, err
+		}
+	}
+	fs.log.Infof("Check file system, inodes:%d, blocks:%d, issues:%d", c.report.Inodes, c.report.Blocks, len(c.report.Issues))
+	if opts.Report != "" {
+		file, err := os.Create(opts.Report)
+		if err != nil {
+			return c.report, err
+		}
+		defer file.Close()
+		if _, err := c.report.WriteTo(file); err != nil {
+			return c.report, err
+		}
+	}
+	return c.report, nil
+}
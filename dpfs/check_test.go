@@ -0,0 +1,179 @@
+/*
+ check_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkTestFile(t *testing.T, fs *FileSystem, name string, size int) (string, []byte) {
+	f, key, err := fs.CreateFile(name, []byte(name))
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	data := journalTestData(size)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	return key, data
+}
+
+func checkTestInode(t *testing.T, fs *FileSystem, key string) (uint32, *Inode) {
+	k := FileKey{}
+	if err := k.ParseKey(key); err != nil {
+		t.Fatalf("Parse key failed: %v", err)
+	}
+	node, err := fs.readInode(k.Inodeptr)
+	if err != nil {
+		t.Fatalf("Read inode failed: %v", err)
+	}
+	return k.Inodeptr, node
+}
+
+func corruptInode(t *testing.T, fs *FileSystem, ptr uint32, node *Inode) {
+	tx := fs.beginTx()
+	if err := fs.syncInode(tx, ptr, node); err != nil {
+		t.Fatalf("Sync inode failed: %v", err)
+	}
+	if err := fs.commitTx(tx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func hasIssue(r *CheckReport, kind IssueKind) bool {
+	for _, i := range r.Issues {
+		if i.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func mustCheck(t *testing.T, fs *FileSystem, opts CheckOptions) *CheckReport {
+	r, err := fs.Check(opts)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	return r
+}
+
+func TestCheckClean(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	defer fs.Close()
+	for i, size := range []int{0, 100, 8192 * 8, 8192*300 + 5} {
+		checkTestFile(t, fs, strings.Repeat("f", i+1), size)
+	}
+	r := mustCheck(t, fs, CheckOptions{})
+	if !r.Clean() || r.Inodes != 4 {
+		t.Errorf("Unexpected report, inodes:%d, issues:%v", r.Inodes, r.Issues)
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	keep, keepData := checkTestFile(t, fs, "keep", 8192*20)
+	cut, cutData := checkTestFile(t, fs, "cut", 8192*20)
+	bad, _ := checkTestFile(t, fs, "badmeta", 100)
+	dup, _ := checkTestFile(t, fs, "dup", 8192*3)
+	_, free := fs.StatBlocks(-1)
+
+	// leak a block
+	if _, _, err := fs.allocBlocks(nil, 1, 1, false); err != nil {
+		t.Fatalf("Alloc failed: %v", err)
+	}
+	// a pointer with a bad group id
+	ptr, node := checkTestInode(t, fs, cut)
+	node.DirectPointers[5] = MakeEntAddr(1, 99, false)
+	corruptInode(t, fs, ptr, node)
+	// a block shared by two files
+	_, keepNode := checkTestInode(t, fs, keep)
+	ptr, node = checkTestInode(t, fs, dup)
+	leaked := node.DirectPointers[2]
+	node.DirectPointers[2] = keepNode.DirectPointers[2]
+	corruptInode(t, fs, ptr, node)
+	// unparsable meta
+	ptr, node = checkTestInode(t, fs, bad)
+	if _, _, err := fs.writeBlock(node.DirectPointers[0], []byte{0xff, 0xff, 0xff, 0x7f}, 0); err != nil {
+		t.Fatalf("Write block failed: %v", err)
+	}
+
+	r := mustCheck(t, fs, CheckOptions{})
+	for _, kind := range []IssueKind{IssueLeakedBlock, IssueBadGroup, IssueDupBlock, IssueBadMeta} {
+		if !hasIssue(r, kind) {
+			t.Errorf("Missing issue %s in %v", kind, r.Issues)
+		}
+	}
+	if _, err := fs.GetFileList(); err == nil {
+		t.Errorf("File list of a corrupted file system should fail")
+	}
+
+	report := filepath.Join(testDir, "fsck.txt")
+	r = mustCheck(t, fs, CheckOptions{Repair: true, Report: report})
+	if !r.Repaired || len(r.Truncated) != 2 || len(r.Quarantined) != 1 {
+		t.Errorf("Unexpected repair, truncated:%v, quarantined:%v", r.Truncated, r.Quarantined)
+	}
+	if st, err := os.Stat(report); err != nil || st.Size() == 0 {
+		t.Errorf("Report not written: %v", err)
+	}
+	fs.Close()
+
+	fs = openJournalTestFs(t)
+	defer fs.Close()
+	if r = mustCheck(t, fs, CheckOptions{}); !r.Clean() {
+		t.Errorf("Issues left after repair: %v", r.Issues)
+	}
+	if got := readAll(t, fs, keep); !bytes.Equal(got, keepData) {
+		t.Errorf("Intact file changed by repair")
+	}
+	if got := readAll(t, fs, cut); !bytes.Equal(got, cutData[:len(got)]) || len(got) >= len(cutData) {
+		t.Errorf("Bad truncated file, size:%d", len(got))
+	}
+	if _, err := fs.OpenFile(bad); err != ErrQuarantined {
+		t.Errorf("Open quarantined file: %v", err)
+	}
+	if list, err := fs.GetFileList(); err != nil || len(list) != 3 {
+		t.Errorf("Bad file list after repair, files:%d, err:%v", len(list), err)
+	}
+	if err := fs.DeleteFile(bad); err != nil {
+		t.Errorf("Delete quarantined file failed: %v", err)
+	}
+	_, group, _ := EntAddr(leaked).GetAddr()
+	if fs.blockGroups[group-1].blockBitmap.CheckBit(leaked) {
+		t.Errorf("Block dropped by the dup repair is still allocated")
+	}
+	if _, free2 := fs.StatBlocks(-1); free2 <= free {
+		t.Errorf("No block released by repair %d<=%d", free2, free)
+	}
+}
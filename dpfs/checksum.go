@@ -0,0 +1,84 @@
+/*
+ checksum.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+  Depots created with FeatureChecksums keep a CRC32C of every block, as it is
+  stored in the volume, in a table that follows the block bitmap of each
+  volume. The checksums are written along with the blocks, see blockio.go,
+  and every read of a block verifies it. A checksum of 0 stands for a block
+  that was never written and is not verified.
+*/
+
+const ChecksumSize = 4 // bytes per block in the checksum table
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksum = errors.New("Checksum mismatch")
+
+// ChecksumError names the block whose content does not match its checksum,
+// errors.Is reports it as ErrChecksum.
+type ChecksumError struct {
+	Group uint32 // 1-based group id
+	Block uint32 // block index in the group
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch [group:%d, block:%d]", e.Group, e.Block)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// encodeSums returns the checksum table entries of the blocks in data.
+func (fs *FileSystem) encodeSums(data []byte) []byte {
+	bs := int(fs.Smeta.BlockSize)
+	sums := make([]byte, len(data)/bs*ChecksumSize)
+	for i := 0; i < len(data)/bs; i++ {
+		binary.LittleEndian.PutUint32(sums[i*ChecksumSize:], crc32.Checksum(data[i*bs:(i+1)*bs], castagnoli))
+	}
+	return sums
+}
+
+// verifyBlocks checks data, the whole blocks from idx on of group g, against
+// the checksum table.
+func (fs *FileSystem) verifyBlocks(g, idx uint32, data []byte) error {
+	sums := make([]byte, len(data)/int(fs.Smeta.BlockSize)*ChecksumSize)
+	if _, err := fs.device.volumes[g].file.ReadAt(sums, fs.geo.ChecksumOffset+int64(idx)*ChecksumSize); err != nil {
+		return err
+	}
+	want := fs.encodeSums(data)
+	for i := 0; i < len(sums); i += ChecksumSize {
+		sum := binary.LittleEndian.Uint32(sums[i:])
+		if sum != 0 && sum != binary.LittleEndian.Uint32(want[i:]) {
+			return &ChecksumError{Group: g + 1, Block: idx + uint32(i/ChecksumSize)}
+		}
+	}
+	return nil
+}
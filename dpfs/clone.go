@@ -0,0 +1,223 @@
+/*
+ clone.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+/*
+  A clone is a file sharing the blocks of another one. CloneFile copies the
+  inode: the direct pointers and the roots of the indirect trees of the clone
+  refer to the blocks of the original, and each of them takes one more
+  reference in the dedup table. Only the first block, which holds the meta,
+  is copied so that the clone has a name of its own.
+
+  A file may write a block in place only when neither the block nor any
+  pointer block on its way from the inode is shared. A write copies the
+  shared pointer blocks on the way first, the copy of a pointer block takes
+  a reference on every block it points to, and then the data block when it
+  is still shared. The other files sharing the blocks never see the write.
+*/
+
+var ErrNoClones = errors.New("File system has no block reference counts")
+
+// FeatureClones keeps a reference count per block, so that CloneFile can
+// share the blocks of a file. Depots created with FeatureDedup have them too.
+var FeatureClones Feature = func(fs *FileSystem) {
+	fs.Smeta.EnableClones()
+}
+
+// refBlocks takes a reference on the blocks ptrs on behalf of tx, holes
+// are skipped.
+func (fs *FileSystem) refBlocks(tx *txn, ptrs []uint32) {
+	d := fs.dedup
+	d.lock.Lock()
+	for _, p := range ptrs {
+		if p != 0 {
+			d.refs[refKey(p)]++
+		}
+	}
+	d.lock.Unlock()
+	tx.refOp(recRefBlocks, 0, ptrs)
+}
+
+// ownPointerBlock makes the pointer block ptr of depth writable in place by
+// tx. A shared block is copied, the copy takes a reference on every block it
+// points to and ptr loses the reference of the caller. It returns the block
+// to write, its parent must point to it.
+func (fs *FileSystem) ownPointerBlock(tx *txn, ptr uint32, depth int) (uint32, error) {
+	if fs.dedup == nil || !fs.dedup.shared(ptr) {
+		return ptr, nil
+	}
+	ptrs := make([]uint32, fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, ptr, ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	nb, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := fs.writePointerWithCache(tx, nb[0], ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	fs.refBlocks(tx, ptrs)
+	tx.refOp(recUnrefBlocks, depth, []uint32{ptr})
+	return nb[0], nil
+}
+
+// CloneFile creates a new file with the content and the meta of the file
+// uid under a new name. The new file shares the blocks of the original
+// instead of copying them, a later write to either file copies the blocks
+// it changes so that the other file never sees it.
+//
+// Parameters:
+//   - uid: The unique identifier of the file to clone.
+//   - name: The name of the new file.
+//
+// Returns:
+//   - string: The unique ID of the new file.
+//   - error: ErrNoClones if the depot was created without FeatureClones or
+//     FeatureDedup, or any other error of the clone. Nothing is created in
+//     that case.
+func (fs *FileSystem) CloneFile(uid string, name string) (string, error) {
+	if err := fs.writable("CloneFile"); err != nil {
+		return "", err
+	}
+	if fs.dedup == nil {
+		return "", ErrNoClones
+	}
+	key := FileKey{}
+	if err := fs.parseUid(&key, uid); err != nil {
+		return "", err
+	}
+	lock := fs.inodeLock(key.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if !fs.isValidInode(key.Inodeptr) {
+		return "", FNF
+	}
+	inode, err := fs.readInode(key.Inodeptr)
+	if err != nil {
+		return "", FNF
+	}
+	if fs.inode2Uid(key.Inodeptr, inode) != uid {
+		return "", FNF
+	}
+	if inode.IsQuarantined() {
+		return "", ErrQuarantined
+	}
+	if inode.IsDir() {
+		return "", ErrIsDir
+	}
+	if inode.IsFrozen() {
+		return "", FNF
+	}
+	meta, err := fs.loadMeta(inode)
+	if err != nil {
+		return "", err
+	}
+	meta.Name = name
+	mbuff, err := meta.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	if len(mbuff) >= int(fs.Smeta.BlockSize) {
+		return "", errors.New("File meta overlimit")
+	}
+	tx := fs.beginTx()
+	_, clone, err := fs.cloneInode(tx, inode, mbuff, 0)
+	if err != nil {
+		fs.abortTx(tx)
+		return "", err
+	}
+	if err := fs.commitNames(tx, nameOp{nameAdd, name, clone}); err != nil {
+		return "", err
+	}
+	return clone, nil
+}
+
+// cloneInode sets up a new inode sharing the blocks of inode in tx, holding
+// the encoded meta mbuff and the attributes of inode with attr added. The
+// caller keeps inode from changing. It returns the new inode and its uid,
+// which nobody reaches before tx commits, so its lock is not taken: it may
+// share the stripe of inode.
+func (fs *FileSystem) cloneInode(tx *txn, inode *Inode, mbuff []byte, attr uint16) (uint32, string, error) {
+	inodeptr, err := fs.allocInode(tx)
+	if err != nil {
+		return 0, "", err
+	}
+	oldnode, err := fs.readInodeTx(tx, inodeptr)
+	if err != nil {
+		return 0, "", err
+	}
+	clone := *inode
+	clone.Seq = oldnode.Seq + 1
+	clone.CTime = uint64(time.Now().Unix())
+	clone.Attr &^= 1 << InodeAttrMetaBlock
+	clone.Attr |= attr
+	if inode.IsPacked() {
+		// a record is small, the clone gets a copy of its own
+		rec, err := fs.packedRecord(inode)
+		if err != nil {
+			return 0, "", err
+		}
+		clone.DirectPointers = [DirectBlocks]uint32{}
+		if err := fs.repack(tx, inodeptr, &clone, mbuff, rec[inode.MetaSize:]); err != nil {
+			return 0, "", err
+		}
+		return inodeptr, fs.inode2Uid(inodeptr, &clone), nil
+	}
+	// the meta size stays, so that the data keeps its place in the blocks
+	buf := make([]byte, fs.Smeta.BlockSize)
+	// the volume file may end inside the block, the rest reads as zeros
+	if _, _, err := fs.readBlock(inode.DirectPointers[0], 0, buf); err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	blks, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, _, err := fs.writeBlock(blks[0], buf, 0); err != nil {
+		return 0, "", err
+	}
+	clone.DirectPointers[0] = blks[0]
+	switch {
+	case clone.IsInline():
+	case clone.HasExtents():
+		if err := fs.cloneExtents(tx, inode, &clone); err != nil {
+			return 0, "", err
+		}
+	default:
+		shared := append([]uint32(nil), clone.DirectPointers[1:]...)
+		shared = append(shared, clone.SingleIndirect, clone.DoubleIndirect, clone.TripleIndirect)
+		fs.refBlocks(tx, shared)
+	}
+	if err := fs.syncInode(tx, inodeptr, &clone); err != nil {
+		return 0, "", err
+	}
+	if err := fs.storeMeta(tx, inodeptr, &clone, mbuff); err != nil {
+		return 0, "", err
+	}
+	return inodeptr, fs.inode2Uid(inodeptr, &clone), nil
+}
@@ -0,0 +1,284 @@
+/*
+ compress.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+  A compressed file keeps its content in chunks of CompressChunk bytes, each
+  compressed on its own with the codec recorded in Inode.Attr. Chunk k is
+  stored at k*chunkSpan of the data stream of the inode behind a header:
+
+    [compLen u32][rawLen u32][compressed data]
+
+  The rest of the span is never written and stays a hole, so the headers are
+  a length table that takes a read or a seek straight to its chunk, nothing
+  in front of it is decompressed. A chunk shorter than CompressChunk reads as
+  padded with zeros, except the last one whose raw length ends the file, and
+  a chunk never written reads as zeros. Inode.FileSize is the size of the
+  stream, the size of the content is found from the header of the last chunk.
+*/
+
+// Codec is the compression of the content of a file.
+type Codec uint16
+
+const (
+	CodecNone  Codec = 0
+	CodecFlate Codec = 1 // compress/flate, default level
+)
+
+const (
+	CompressChunk   = 64 * 1024 // bytes of content per compressed chunk
+	chunkHeaderSize = 8
+	codecMask       = 3
+)
+
+var ErrBadChunk = errors.New("Bad compressed chunk")
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// FileOption sets an option of a file created by CreateFile or CreatePath.
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	codec Codec
+}
+
+// WithCodec compresses the content of the new file with codec c.
+func WithCodec(c Codec) FileOption {
+	return func(o *fileOptions) {
+		o.codec = c
+	}
+}
+
+// fileAttr returns the inode attributes set by opts.
+func fileAttr(opts []FileOption) (uint16, error) {
+	var o fileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.codec > CodecFlate {
+		return 0, errors.New("Unknown codec")
+	}
+	return uint16(o.codec) << InodeAttrCodec, nil
+}
+
+func (i *Inode) Codec() Codec {
+	return Codec(i.Attr>>InodeAttrCodec) & codecMask
+}
+
+func compressChunk(c Codec, raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressChunk(c Codec, data, raw []byte) error {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return ErrBadChunk
+	}
+	return nil
+}
+
+// chunkSpan is the room of a chunk in the data stream, enough for the
+// header and the compressed data of a chunk that does not compress.
+func (fs *FileSystem) chunkSpan() int64 {
+	return CompressChunk + int64(fs.Smeta.BlockSize)
+}
+
+// chunkLen returns the length of the content of chunk k in a file of size.
+func chunkLen(k, size int64) int {
+	return int(min(CompressChunk, size-k*CompressChunk))
+}
+
+// fileSize returns the size of the content of inode.
+func (fs *FileSystem) fileSize(tx *txn, inode *Inode) (int64, error) {
+	if inode.Codec() == CodecNone || inode.FileSize == 0 {
+		return int64(inode.FileSize), nil
+	}
+	k := (int64(inode.FileSize) - 1) / fs.chunkSpan()
+	_, rawLen, err := fs.chunkHeader(tx, inode, k)
+	return k*CompressChunk + int64(rawLen), err
+}
+
+// readStream reads data at off of the data stream of inode.
+func (fs *FileSystem) readStream(tx *txn, inode *Inode, off int64, data []byte) error {
+	cur, err := fs.slotOffset(tx, inode, off)
+	if err != nil {
+		return err
+	}
+	n, err := fs.readSlots(tx, inode, &cur, data)
+	if err == nil && n < len(data) {
+		err = ErrBadChunk
+	}
+	return err
+}
+
+func (fs *FileSystem) chunkHeader(tx *txn, inode *Inode, k int64) (uint32, uint32, error) {
+	hdr := make([]byte, chunkHeaderSize)
+	if err := fs.readStream(tx, inode, k*fs.chunkSpan(), hdr); err != nil {
+		return 0, 0, err
+	}
+	compLen := binary.LittleEndian.Uint32(hdr)
+	rawLen := binary.LittleEndian.Uint32(hdr[4:])
+	if int64(compLen)+chunkHeaderSize > fs.chunkSpan() || rawLen > CompressChunk {
+		return 0, 0, ErrBadChunk
+	}
+	return compLen, rawLen, nil
+}
+
+// readChunk returns the first length bytes of the content of chunk k.
+func (fs *FileSystem) readChunk(tx *txn, inode *Inode, k int64, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	if k*fs.chunkSpan() >= int64(inode.FileSize) {
+		return buf, nil
+	}
+	compLen, rawLen, err := fs.chunkHeader(tx, inode, k)
+	if err != nil || compLen == 0 {
+		return buf, err
+	}
+	data := make([]byte, compLen)
+	if err := fs.readStream(tx, inode, k*fs.chunkSpan()+chunkHeaderSize, data); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, rawLen)
+	if err := decompressChunk(inode.Codec(), data, raw); err != nil {
+		return nil, err
+	}
+	copy(buf, raw)
+	return buf, nil
+}
+
+// readChunks reads the content of a compressed inode at cur, only the chunks
+// that data covers are decompressed.
+func (fs *FileSystem) readChunks(tx *txn, inode *Inode, cur *VfileOffset, data []byte) (int, error) {
+	size, err := fs.fileSize(tx, inode)
+	if err != nil {
+		return 0, err
+	}
+	if cur.offset >= size {
+		return 0, io.EOF
+	}
+	if cur.offset+int64(len(data)) > size {
+		data = data[:size-cur.offset]
+	}
+	rdn := 0
+	for rdn < len(data) {
+		k := cur.offset / CompressChunk
+		chunk, err := fs.readChunk(tx, inode, k, chunkLen(k, size))
+		if err != nil {
+			return rdn, err
+		}
+		n := copy(data[rdn:], chunk[cur.offset-k*CompressChunk:])
+		cur.offset += int64(n)
+		rdn += n
+	}
+	return rdn, nil
+}
+
+// writeChunks writes data at cur of a compressed file, every chunk it
+// touches is compressed again.
+func (vf *Vfile) writeChunks(cur *VfileOffset, data []byte) (int, error) {
+	size, err := vf.fs.fileSize(vf.tx, vf.Inode)
+	if err != nil {
+		return 0, err
+	}
+	end := max(size, cur.offset+int64(len(data)))
+	wtn := 0
+	for wtn < len(data) {
+		k := cur.offset / CompressChunk
+		chunk, err := vf.fs.readChunk(vf.tx, vf.Inode, k, chunkLen(k, end))
+		if err != nil {
+			return wtn, err
+		}
+		n := copy(chunk[cur.offset-k*CompressChunk:], data[wtn:])
+		if err := vf.writeChunk(k, chunk, k == (end-1)/CompressChunk); err != nil {
+			return wtn, err
+		}
+		cur.offset += int64(n)
+		wtn += n
+	}
+	return wtn, nil
+}
+
+// writeChunk stores raw as the content of chunk k, the stream is cut behind
+// the last chunk.
+func (vf *Vfile) writeChunk(k int64, raw []byte, last bool) error {
+	comp, err := compressChunk(vf.Inode.Codec(), raw)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, chunkHeaderSize+len(comp))
+	binary.LittleEndian.PutUint32(buf, uint32(len(comp)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(raw)))
+	copy(buf[chunkHeaderSize:], comp)
+	if int64(len(buf)) > vf.fs.chunkSpan() {
+		return ErrBadChunk
+	}
+	pos := k * vf.fs.chunkSpan()
+	cur, err := vf.fs.slotOffset(vf.tx, vf.Inode, pos)
+	if err != nil {
+		return err
+	}
+	if _, err := vf.writeSlots(&cur, buf); err != nil {
+		return err
+	}
+	if end := pos + int64(len(buf)); last && vf.Inode.FileSize > uint64(end) {
+		return vf.shrink(end)
+	}
+	return nil
+}
+
+// truncateChunks changes the size of a compressed file, the chunk holding
+// the new end of file is written again as the last one.
+func (vf *Vfile) truncateChunks(size int64) error {
+	if size == 0 {
+		return vf.shrink(0)
+	}
+	k := (size - 1) / CompressChunk
+	chunk, err := vf.fs.readChunk(vf.tx, vf.Inode, k, chunkLen(k, size))
+	if err != nil {
+		return err
+	}
+	return vf.writeChunk(k, chunk, true)
+}
@@ -0,0 +1,559 @@
+/*
+ crypt.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+  A file system created with a key provider encrypts the blocks of its block
+  area, data, meta and indirect blocks, with AES-GCM. Each block has an entry
+  in a table behind the block bitmap and the checksum table:
+
+    [key id u32][flags u32][generation u64][GCM tag 16 bytes]
+
+  The generation is raised on every write of the block, and the nonce is made
+  of the EntAddr of the block and its generation. The entry and the block
+  are written without a sync in between, a crash may keep the block and lose
+  its entry, so the generation read back cannot tell which were used. Every
+  writable open therefore raises an epoch, synced to the volumes before the
+  first write, and the generations of a session start at epoch<<32: a nonce
+  is never used twice under a key as long as a block is written fewer than
+  2^32 times between two opens. A block of generation 0 was never written
+  and one flagged empty was free when its key was rotated out, both read as
+  zeros. The id of the key new blocks are encrypted with and the epoch are
+  kept in a KeyHeader that follows the group descriptor of every volume.
+*/
+
+const (
+	CryptEntrySize = 32 // bytes per block in the encryption table
+	cryptEmpty     = 1  // entry flag, the block holds nothing
+	gcmTagSize     = 16
+	rotateBatch    = 64 // blocks re-encrypted per transaction
+)
+
+var (
+	ErrNoKeyProvider = errors.New("Encrypted file system needs a key provider")
+	ErrNotEncrypted  = errors.New("File system is not encrypted")
+	ErrAuth          = errors.New("Block authentication failed")
+	ErrNoKey         = errors.New("Key not found")
+	ErrRotating      = errors.New("Key rotation in progress")
+	ErrRotateStopped = errors.New("Key rotation stopped")
+)
+
+// KeyProvider supplies the AES keys of an encrypted file system, keys are
+// 16, 24 or 32 bytes long.
+type KeyProvider interface {
+	// CurrentKey returns the id of the key to encrypt new blocks with and
+	// the key, ids are never 0.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key of id.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyHeader follows the group descriptor in the volumes of an encrypted file
+// system.
+type KeyHeader struct {
+	KeyId uint32 // key new blocks are encrypted with
+	Epoch uint32 // raised by every writable open, see encryptBlocks
+}
+
+// WithKeyProvider encrypts a new file system with the keys of kp. An
+// encrypted file system cannot be opened without it.
+func WithKeyProvider(kp KeyProvider) Feature {
+	return func(fs *FileSystem) {
+		fs.keys = kp
+		fs.Smeta.EnableEncryption()
+	}
+}
+
+type cryptor struct {
+	keys     KeyProvider
+	epoch    uint64 // the generations of this session start at epoch<<32
+	cur      atomic.Uint32
+	rotating atomic.Bool
+	lock     sync.Mutex
+	aeads    map[uint32]cipher.AEAD
+}
+
+func (c *cryptor) aead(id uint32) (cipher.AEAD, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if a, ok := c.aeads[id]; ok {
+		return a, nil
+	}
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = a
+	return a, nil
+}
+
+// initCrypt sets up the encryption of the file system once its volumes are
+// loaded, a new file system takes the current key of the provider.
+func (fs *FileSystem) initCrypt() error {
+	if !fs.Smeta.HasEncryption() {
+		return nil
+	}
+	if fs.keys == nil {
+		return ErrNoKeyProvider
+	}
+	c := &cryptor{keys: fs.keys, aeads: make(map[uint32]cipher.AEAD)}
+	if fs.device.keyHdr.KeyId == 0 {
+		id, _, err := fs.keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		fs.device.keyHdr.KeyId = id
+	}
+	if _, err := c.aead(fs.device.keyHdr.KeyId); err != nil {
+		return err
+	}
+	if !fs.readOnly {
+		fs.device.keyHdr.Epoch++
+		if err := fs.setKeyHeader(fs.device.keyHdr); err != nil {
+			return err
+		}
+	}
+	c.epoch = uint64(fs.device.keyHdr.Epoch)
+	c.cur.Store(fs.device.keyHdr.KeyId)
+	fs.crypt = c
+	return nil
+}
+
+func blockNonce(g, idx uint32, gen uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint32(nonce, MakeEntAddr(idx, g+1, false))
+	binary.LittleEndian.PutUint64(nonce[4:], gen)
+	return nonce
+}
+
+func (fs *FileSystem) readEntries(g, idx uint32, n int) ([]byte, error) {
+	entries := make([]byte, n*CryptEntrySize)
+	if _, err := fs.device.volumes[g].file.ReadAt(entries, fs.geo.CryptOffset+int64(idx)*CryptEntrySize); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// encryptBlocks encrypts the whole blocks data from idx on of group g with
+// the current key, and returns them with their new entries. A generation is
+// at least the first one of the epoch, the entry read may be older than the
+// block stored.
+func (fs *FileSystem) encryptBlocks(g, idx uint32, data []byte) ([]byte, []byte, error) {
+	bs := int(fs.Smeta.BlockSize)
+	entries, err := fs.readEntries(g, idx, len(data)/bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := fs.crypt.cur.Load()
+	a, err := fs.crypt.aead(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := make([]byte, len(data))
+	for i := 0; i < len(data)/bs; i++ {
+		e := entries[i*CryptEntrySize : (i+1)*CryptEntrySize]
+		gen := max(binary.LittleEndian.Uint64(e[8:])+1, fs.crypt.epoch<<32)
+		sealed := a.Seal(nil, blockNonce(g, idx+uint32(i), gen), data[i*bs:(i+1)*bs], nil)
+		copy(raw[i*bs:], sealed[:bs])
+		binary.LittleEndian.PutUint32(e, id)
+		binary.LittleEndian.PutUint32(e[4:], 0)
+		binary.LittleEndian.PutUint64(e[8:], gen)
+		copy(e[16:], sealed[bs:])
+	}
+	return raw, entries, nil
+}
+
+// openBlocks decrypts in place the whole blocks data from idx on of group g.
+func (fs *FileSystem) openBlocks(g, idx uint32, data []byte) error {
+	bs := int(fs.Smeta.BlockSize)
+	entries, err := fs.readEntries(g, idx, len(data)/bs)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, bs+gcmTagSize)
+	for i := 0; i < len(data)/bs; i++ {
+		e := entries[i*CryptEntrySize : (i+1)*CryptEntrySize]
+		blk := data[i*bs : (i+1)*bs]
+		gen := binary.LittleEndian.Uint64(e[8:])
+		if gen == 0 || binary.LittleEndian.Uint32(e[4:])&cryptEmpty != 0 {
+			clear(blk)
+			continue
+		}
+		a, err := fs.crypt.aead(binary.LittleEndian.Uint32(e))
+		if err != nil {
+			return err
+		}
+		copy(sealed, blk)
+		copy(sealed[bs:], e[16:])
+		if _, err := a.Open(blk[:0], blockNonce(g, idx+uint32(i), gen), sealed, nil); err != nil {
+			return fmt.Errorf("%w [group:%d, block:%d]", ErrAuth, g+1, idx+uint32(i))
+		}
+	}
+	return nil
+}
+
+// RotateKey makes the current key of the key provider the key of new blocks,
+// and re-encrypts the blocks under other keys in the background. The blocks
+// of files are re-encrypted in transactions, free blocks are flagged empty.
+// The old keys must be kept by the provider until the rotation is done.
+// Close stops the re-encryption and waits for it, RotateKey called again
+// after the depot is reopened re-encrypts the blocks left.
+//
+// Returns:
+//   - <-chan error: Receives the result of the re-encryption once done,
+//     ErrRotateStopped when the file system was closed.
+//   - error: ErrNotEncrypted, ErrRotating while a rotation runs, os.ErrClosed
+//     after Close, or an error of the key provider.
+func (fs *FileSystem) RotateKey() (<-chan error, error) {
+	if err := fs.writable("RotateKey"); err != nil {
+		return nil, err
+	}
+	if !fs.Smeta.HasEncryption() {
+		return nil, ErrNotEncrypted
+	}
+	if !fs.crypt.rotating.CompareAndSwap(false, true) {
+		return nil, ErrRotating
+	}
+	id, _, err := fs.keys.CurrentKey()
+	if err == nil {
+		_, err = fs.crypt.aead(id)
+	}
+	if err == nil {
+		hdr := fs.device.keyHdr
+		hdr.KeyId = id
+		err = fs.setKeyHeader(hdr)
+	}
+	if err != nil {
+		fs.crypt.rotating.Store(false)
+		return nil, err
+	}
+	fs.crypt.cur.Store(id)
+	done := make(chan error, 1)
+	err = fs.goBackground(func() {
+		defer fs.crypt.rotating.Store(false)
+		err := fs.reencrypt(id)
+		if err != nil && err != ErrRotateStopped {
+			fs.log.Errorf("Key rotation failed:%s", err)
+		}
+		done <- err
+	})
+	if err != nil {
+		fs.crypt.rotating.Store(false)
+		return nil, err
+	}
+	return done, nil
+}
+
+// setKeyHeader records hdr in every volume and syncs it.
+func (fs *FileSystem) setKeyHeader(hdr KeyHeader) error {
+	for g := 0; g < int(fs.groupCount()); g++ {
+		fs.blockGroups[g].lock.Lock()
+		defer fs.blockGroups[g].lock.Unlock()
+	}
+	data := make([]byte, binary.Size(hdr))
+	binary.LittleEndian.PutUint32(data, hdr.KeyId)
+	binary.LittleEndian.PutUint32(data[4:], hdr.Epoch)
+	pos := int64(binary.Size(SuperBlock{}) + binary.Size(BlockGroupDescriptor{}))
+	for g := range fs.device.volumes {
+		v := &fs.device.volumes[g]
+		if !v.ready.Load() {
+			continue
+		}
+		if _, err := v.file.WriteAt(data, pos); err != nil {
+			return err
+		}
+		if err := v.file.Sync(); err != nil {
+			return err
+		}
+	}
+	fs.device.keyHdr = hdr
+	return nil
+}
+
+// reencrypt re-encrypts the blocks not under key id, it returns
+// ErrRotateStopped once the file system is closing.
+func (fs *FileSystem) reencrypt(id uint32) error {
+	stopped := func() bool {
+		select {
+		case <-fs.bg.closing:
+			return true
+		default:
+			return false
+		}
+	}
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if !fs.device.volumes[g].ready.Load() {
+			continue
+		}
+		bm := fs.GetInodeBitmap(g)
+		for i := 0; i < len(bm)*8; i++ {
+			if bm[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			if stopped() {
+				return ErrRotateStopped
+			}
+			if err := fs.reencryptInode(MakeEntAddr(uint32(i), uint32(g)+1, false), id); err != nil {
+				return err
+			}
+		}
+	}
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if stopped() {
+			return ErrRotateStopped
+		}
+		if err := fs.reencryptFree(uint32(g), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptInode re-encrypts the blocks of the inode ptr that are not under
+// key id. It holds the locks of everything that may write them.
+func (fs *FileSystem) reencryptInode(ptr uint32, id uint32) error {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	lock := fs.inodeLock(ptr)
+	lock.Lock()
+	defer lock.Unlock()
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	if !fs.isSysInode(ptr) && !fs.isValidInode(ptr) {
+		return nil
+	}
+	node, err := fs.readInode(ptr)
+	if err != nil || node.Seq == 0 || node.IsQuarantined() {
+		return err
+	}
+	if node.IsPacked() {
+		// the slab holds records of files under other inode locks
+		fs.pack.lock.Lock()
+		defer fs.pack.lock.Unlock()
+	}
+	ptrs, err := fs.inodeBlocks(nil, node)
+	if err != nil {
+		return err
+	}
+	var stale []uint32
+	for _, p := range ptrs {
+		idx, group, isBig := EntAddr(p).GetAddr()
+		n := 1 + 63*int(isBig)
+		entries, err := fs.readEntries(group-1, idx, n)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			e := entries[i*CryptEntrySize:]
+			if binary.LittleEndian.Uint64(e[8:]) != 0 && binary.LittleEndian.Uint32(e) != id &&
+				binary.LittleEndian.Uint32(e[4:])&cryptEmpty == 0 {
+				stale = append(stale, MakeEntAddr(idx+uint32(i), group, false))
+			}
+		}
+	}
+	for len(stale) > 0 {
+		batch := stale[:min(rotateBatch, len(stale))]
+		stale = stale[len(batch):]
+		tx := fs.beginTx()
+		for _, p := range batch {
+			idx, group, _ := EntAddr(p).GetAddr()
+			buf := make([]byte, fs.Smeta.BlockSize)
+			if _, err := fs.loadBlocks(group-1, idx, buf); err != nil {
+				return err
+			}
+			// staged as is, the commit encrypts it with the current key
+			tx.write(group-1, fs.blockPos(idx), buf)
+		}
+		if err := fs.commitTx(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptFree flags the free blocks of group g that are not under key id
+// empty, their old content is dropped.
+func (fs *FileSystem) reencryptFree(g uint32, id uint32) error {
+	const span = 4096
+	group := &fs.blockGroups[g]
+	for from := uint32(0); from < fs.Smeta.BlocksInGroup; from += span {
+		group.lock.Lock()
+		if !fs.device.volumes[g].ready.Load() {
+			group.lock.Unlock()
+			return nil
+		}
+		n := int(min(span, fs.Smeta.BlocksInGroup-from))
+		entries, err := fs.readEntries(g, from, n)
+		if err == nil {
+			changed := false
+			for i := 0; i < n; i++ {
+				e := entries[i*CryptEntrySize:]
+				if binary.LittleEndian.Uint64(e[8:]) == 0 || binary.LittleEndian.Uint32(e) == id ||
+					group.blockBitmap.CheckBit(MakeEntAddr(from+uint32(i), g+1, false)) {
+					continue
+				}
+				binary.LittleEndian.PutUint32(e, id)
+				binary.LittleEndian.PutUint32(e[4:], cryptEmpty)
+				clear(e[16:CryptEntrySize])
+				changed = true
+			}
+			if changed {
+				_, err = fs.device.volumes[g].file.WriteAt(entries, fs.geo.CryptOffset+int64(from)*CryptEntrySize)
+			}
+		}
+		group.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileKeyProvider is a KeyProvider keeping its keys in a file, a line
+// "id:hex key" per key. The key with the highest id is the current one.
+type FileKeyProvider struct {
+	lock sync.RWMutex
+	path string
+	keys map[uint32][]byte
+	cur  uint32
+}
+
+// NewFileKeyProvider loads the keys of the file at path. A missing file is
+// created, with a new random key.
+//
+// Parameters:
+//   - path: The path of the key file.
+//
+// Returns:
+//   - *FileKeyProvider: The key provider.
+//   - error: An error if the file cannot be read or holds a bad line.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path, keys: make(map[uint32][]byte)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, err := p.AddKey(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ids, hexKey, ok := strings.Cut(line, ":")
+		id, err := strconv.ParseUint(ids, 10, 32)
+		if !ok || err != nil || id == 0 {
+			return nil, fmt.Errorf("bad key line %q", line)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("bad key %d: %w", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("bad key %d: %w", id, err)
+		}
+		p.keys[uint32(id)] = key
+		p.cur = max(p.cur, uint32(id))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.cur == 0 {
+		return nil, ErrNoKey
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.cur, p.keys[p.cur], nil
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrNoKey, id)
+	}
+	return key, nil
+}
+
+// AddKey adds a new random 256-bit key to the file and makes it the current
+// key, RotateKey then moves the file system over to it.
+//
+// Returns:
+//   - uint32: The id of the new key.
+//   - error: An error if the key cannot be saved.
+func (p *FileKeyProvider) AddKey() (uint32, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := p.cur + 1
+	file, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%d:%s\n", id, hex.EncodeToString(key)); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	p.keys[id] = key
+	p.cur = id
+	return id, nil
+}
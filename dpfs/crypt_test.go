@@ -0,0 +1,101 @@
+/*
+ crypt_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCryptEpoch(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	kp, err := NewFileKeyProvider(filepath.Join(testDir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	open := func() *FileSystem {
+		fs, err := MakeFileSystem(2, 64*1024, testDir, "", "", 0, false, WithKeyProvider(kp))
+		if err != nil {
+			t.Fatalf("Failed to open file system: %v", err)
+		}
+		return fs
+	}
+	data := journalTestData(8192 * 3)
+	write := func(fs *FileSystem, f *Vfile) {
+		if _, err := f.WriteAt(data, 0); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	fs := open()
+	f, key, err := fs.CreateFile("epoch", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	write(fs, f)
+	idx, group, _ := EntAddr(f.Inode.DirectPointers[1]).GetAddr()
+	pos := fs.geo.CryptOffset + int64(idx)*CryptEntrySize
+	entry := func(fs *FileSystem) []byte {
+		e := make([]byte, CryptEntrySize)
+		if _, err := fs.device.volumes[group-1].file.ReadAt(e, pos); err != nil {
+			t.Fatalf("Read entry failed: %v", err)
+		}
+		return e
+	}
+	old := entry(fs)
+	write(fs, f)
+	used := binary.LittleEndian.Uint64(entry(fs)[8:])
+	epoch := fs.crypt.epoch
+	fs.Close()
+
+	// a crash kept the block, but lost its entry
+	vol := filepath.Join(testDir, "vol.000001")
+	file, err := os.OpenFile(vol, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Open volume failed: %v", err)
+	}
+	if _, err := file.WriteAt(old, pos); err != nil {
+		t.Fatalf("Write entry failed: %v", err)
+	}
+	file.Close()
+
+	fs = open()
+	defer fs.Close()
+	if fs.crypt.epoch != epoch+1 {
+		t.Errorf("Epoch %d after epoch %d", fs.crypt.epoch, epoch)
+	}
+	if f, err = fs.OpenFile(key); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	write(fs, f)
+	if gen := binary.LittleEndian.Uint64(entry(fs)[8:]); gen <= used {
+		t.Errorf("Generation %d reused after a crash, %d used before", gen, used)
+	}
+	got := make([]byte, len(data))
+	if _, err := f.ReadAt(got, 0); err != nil || string(got) != string(data) {
+		t.Errorf("Bad data after the crash: %v", err)
+	}
+}
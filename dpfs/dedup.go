@@ -0,0 +1,474 @@
+/*
+ dedup.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+  On a depot created with FeatureDedup the full blocks written to regular
+  files are hashed, and a block whose content is already stored is shared
+  instead of written again. A table behind the block bitmap and the checksum
+  and encryption tables keeps an entry per block:
+
+    [extra references i32][content hash 12 bytes]
+
+  The count is the number of references beyond the first, so a block owned
+  by a single file has a zero entry like any block of a depot without dedup.
+  The hashes are loaded into an index when the file system opens; a match is
+  always verified against the stored block before it is shared. The data of
+  a file starts behind its meta in the first block, so the blocks of two
+  files line up when their meta sizes match.
+
+  A shared block is never written in place, a write to it copies the block
+  first. Whether a released block is freed or only loses a reference is
+  decided when its transaction commits, so that concurrent releases of the
+  owners of a block agree on who frees it.
+
+  The same table serves the file clones of a depot created with
+  FeatureClones, see clone.go. The blocks of a depot with either feature are
+  counted by reference, and big blocks under the index of their first block.
+*/
+
+const DedupEntrySize = 16 // bytes per block in the dedup table
+
+var (
+	ErrNoDedup        = errors.New("File system has no dedup")
+	ErrDedupEncrypted = errors.New("Dedup cannot be combined with encryption")
+)
+
+type blockHash [12]byte
+
+func hashBlock(data []byte) blockHash {
+	var h blockHash
+	sum := sha256.Sum256(data)
+	copy(h[:], sum[:])
+	return h
+}
+
+// FeatureDedup stores identical full blocks of files once. It cannot be
+// combined with WithKeyProvider, the hashes of the dedup table would tell
+// whether a depot holds a known block.
+var FeatureDedup Feature = func(fs *FileSystem) {
+	fs.Smeta.EnableDedup()
+}
+
+// DedupStats sums up the sharing of blocks on a depot with dedup.
+type DedupStats struct {
+	IndexedBlocks int   // blocks known by content hash
+	SharedBlocks  int   // blocks referenced more than once
+	References    int64 // references saved by sharing
+	LogicalBytes  int64 // bytes of the blocks in use, as the files see them
+	PhysicalBytes int64 // bytes of the blocks in use, as stored
+}
+
+// dedupIndex is the in-memory state of the dedup table. The reference counts
+// include the references taken by transactions in flight, they are keyed by
+// refKey.
+type dedupIndex struct {
+	lock       sync.Mutex
+	commitLock sync.Mutex // serializes the commits, see stageRefs
+	refs       map[uint32]int32
+	index      map[blockHash]uint32
+	hashes     map[uint32]blockHash
+	orphans    []uint32 // blocks left without an owner by an aborted share
+}
+
+func (g *Geometry) dedupPos(idx uint32) int64 {
+	return g.DedupOffset + int64(idx)*DedupEntrySize
+}
+
+// refKey returns the key of the reference count of the block ptr, a big
+// block is counted under its first block.
+func refKey(ptr uint32) uint32 {
+	return ptr &^ 0x80000000
+}
+
+// shared reports whether the block ptr has more than one reference.
+func (d *dedupIndex) shared(ptr uint32) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.refs[refKey(ptr)] > 0
+}
+
+// initDedup loads the dedup tables of the volumes.
+func (fs *FileSystem) initDedup() error {
+	if !fs.Smeta.HasRefCounts() {
+		return nil
+	}
+	d := &dedupIndex{
+		refs:   make(map[uint32]int32),
+		index:  make(map[blockHash]uint32),
+		hashes: make(map[uint32]blockHash),
+	}
+	const span = 4096
+	var zero blockHash
+	buf := make([]byte, span*DedupEntrySize)
+	for g := uint32(0); g < fs.groupCount(); g++ {
+		if !fs.device.volumes[g].ready.Load() {
+			continue
+		}
+		bm := &fs.blockGroups[g].blockBitmap
+		for from := uint32(0); from < fs.Smeta.BlocksInGroup; from += span {
+			n := min(span, fs.Smeta.BlocksInGroup-from)
+			if _, err := fs.device.volumes[g].file.ReadAt(buf[:n*DedupEntrySize], fs.geo.dedupPos(from)); err != nil {
+				return err
+			}
+			for i := uint32(0); i < n; i++ {
+				e := buf[i*DedupEntrySize : (i+1)*DedupEntrySize]
+				ptr := MakeEntAddr(from+i, g+1, false)
+				if bytes.Equal(e, make([]byte, DedupEntrySize)) || !bm.CheckBit(ptr) {
+					continue
+				}
+				refs := int32(binary.LittleEndian.Uint32(e))
+				if refs != 0 {
+					d.refs[ptr] = refs
+				}
+				if refs < 0 {
+					// a share aborted by a crash left the block without an owner
+					d.orphans = append(d.orphans, ptr)
+					continue
+				}
+				var h blockHash
+				copy(h[:], e[4:])
+				if h != zero {
+					if _, ok := d.index[h]; !ok {
+						d.index[h] = ptr
+					}
+					d.hashes[ptr] = h
+				}
+			}
+		}
+	}
+	fs.dedup = d
+	return fs.freeOrphans()
+}
+
+// freeOrphans frees the blocks found without an owner when the file system
+// opens, a read-only one leaves them to Check.
+func (fs *FileSystem) freeOrphans() error {
+	d := fs.dedup
+	if len(d.orphans) == 0 || fs.readOnly {
+		return nil
+	}
+	fs.log.Warnf("Free %d blocks left without an owner", len(d.orphans))
+	tx := fs.beginTx()
+	tx.orphans, d.orphans = d.orphans, nil
+	return fs.commitTx(tx)
+}
+
+// dedupFile reports whether the blocks of the inode take part in dedup,
+// only the regular files of a depot with dedup do.
+func (fs *FileSystem) dedupFile(inodeptr uint32, inode *Inode) bool {
+	return fs.Smeta.HasDedup() && !fs.isSysInode(inodeptr) && !inode.IsDir() && inode.Codec() == CodecNone
+}
+
+// shareBlock looks for a stored block holding data, whose hash is sum. A
+// block found other than ptr gets a reference on behalf of tx. It returns 0
+// when there is none.
+func (fs *FileSystem) shareBlock(tx *txn, sum blockHash, data []byte, ptr uint32) (uint32, error) {
+	d := fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	found, ok := d.index[sum]
+	if !ok {
+		return 0, nil
+	}
+	// the block is read under the lock, its owner cannot write it meanwhile
+	buf := make([]byte, len(data))
+	if _, _, err := fs.readBlock(found, 0, buf); err != nil || !bytes.Equal(buf, data) {
+		return 0, nil
+	}
+	if found == ptr {
+		return ptr, nil
+	}
+	d.refs[refKey(found)]++
+	tx.refOp(recRefBlocks, 0, []uint32{found})
+	return found, nil
+}
+
+// indexBlock records sum as the hash of the block ptr that tx wrote.
+func (fs *FileSystem) indexBlock(tx *txn, ptr uint32, sum blockHash) {
+	d := fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.unindexLocked(ptr)
+	if _, ok := d.index[sum]; !ok {
+		d.index[sum] = ptr
+	}
+	d.hashes[ptr] = sum
+	tx.indexed = append(tx.indexed, ptr)
+	idx, group, _ := EntAddr(ptr).GetAddr()
+	tx.write(group-1, fs.geo.dedupPos(idx)+4, sum[:])
+}
+
+func (d *dedupIndex) unindexLocked(ptr uint32) bool {
+	h, ok := d.hashes[ptr]
+	if !ok {
+		return false
+	}
+	delete(d.hashes, ptr)
+	if d.index[h] == ptr {
+		delete(d.index, h)
+	}
+	return true
+}
+
+// orphanLocked queues the block ptr, left without an owner, to be freed. It
+// can no longer be shared.
+func (d *dedupIndex) orphanLocked(ptr uint32) {
+	d.unindexLocked(ptr)
+	d.orphans = append(d.orphans, ptr)
+}
+
+// ownBlock makes the block ptr of slot writable in place by tx. A shared
+// block is copied to a new block first, which replaces it in the slot. The
+// pointer blocks on the way to slot are made writable before, a block below
+// a shared one is shared as well.
+func (fs *FileSystem) ownBlock(tx *txn, inode *Inode, slot int, ptr uint32) (uint32, error) {
+	if slot >= DirectBlocks && !inode.HasExtents() {
+		if _, _, err := fs.leafBlock(tx, inode, slot, true); err != nil {
+			return 0, err
+		}
+	}
+	d := fs.dedup
+	d.lock.Lock()
+	if d.refs[refKey(ptr)] <= 0 {
+		if d.unindexLocked(ptr) {
+			idx, group, _ := EntAddr(ptr).GetAddr()
+			tx.write(group-1, fs.geo.dedupPos(idx)+4, make([]byte, len(blockHash{})))
+		}
+		d.lock.Unlock()
+		return ptr, nil
+	}
+	d.lock.Unlock()
+	size := fs.slotSize(ptr)
+	buf := make([]byte, size)
+	// the volume file may end inside the block, the rest reads as zeros
+	if _, _, err := fs.readBlock(ptr, 0, buf); err != nil && err != io.EOF {
+		return 0, err
+	}
+	// a big block is replaced by a big block, the slots behind stay in place
+	blks, _, err := fs.allocBlocks(tx, int(size/int64(fs.Smeta.BlockSize)), 1, size > int64(fs.Smeta.BlockSize))
+	if err != nil {
+		return 0, err
+	}
+	if fs.slotSize(blks[0]) != size {
+		return 0, errors.New("No big block free for the copy")
+	}
+	if _, _, err := fs.writeBlock(blks[0], buf, 0); err != nil {
+		return 0, err
+	}
+	if err := fs.storeSlots(tx, inode, slot, blks); err != nil {
+		return 0, err
+	}
+	return blks[0], fs.releaseDataBlock(tx, []uint32{ptr})
+}
+
+// stageRefs decides the fate of the blocks tx releases and turns the
+// reference changes of tx into writes of the dedup table. A released block
+// with references left loses one, otherwise it is freed along with the
+// blocks orphaned by aborted shares. A freed indirect block releases its
+// children in turn. The entry of a freed block is zeroed, the count of a
+// block allocated by tx starts from zero whatever the table held. It runs
+// with the commits serialized, so the table holds the counts of every
+// transaction committed before.
+func (fs *FileSystem) stageRefs(tx *txn) error {
+	d := fs.dedup
+	type refPos struct {
+		group, idx uint32
+	}
+	deltas := make(map[refPos]int32)
+	var order []refPos
+	add := func(ptr uint32, delta int32) {
+		idx, group, _ := EntAddr(ptr).GetAddr()
+		k := refPos{group - 1, idx}
+		if _, ok := deltas[k]; !ok {
+			order = append(order, k)
+		}
+		deltas[k] += delta
+	}
+	free := make(map[uint32][]uint32)
+	freed := make(map[refPos]bool)
+	dropped := make(map[uint32]int32) //references released so far
+	zero := make([]byte, DedupEntrySize)
+	work := append([]refChange(nil), tx.refs...)
+	d.lock.Lock()
+	for i := 0; i < len(work); i++ {
+		r := work[i]
+		k := refKey(r.ptr)
+		idx, group, _ := EntAddr(r.ptr).GetAddr()
+		switch {
+		case r.typ == recRefBlocks:
+			add(r.ptr, 1)
+		case d.refs[k] > dropped[k]:
+			dropped[k]++
+			add(r.ptr, -1)
+			tx.unrefs = append(tx.unrefs, r.ptr)
+		default:
+			free[group-1] = append(free[group-1], r.ptr)
+			freed[refPos{group - 1, idx}] = true
+			if _, ok := d.refs[k]; d.unindexLocked(r.ptr) || ok {
+				tx.write(group-1, fs.geo.dedupPos(idx), zero)
+			}
+			if r.depth == 0 {
+				continue
+			}
+			ptrs := make([]uint32, fs.geo.BlockPointers)
+			if err := fs.readPointer(tx, r.ptr, ptrs, 0); err != nil {
+				d.lock.Unlock()
+				return err
+			}
+			for _, p := range ptrs {
+				if p != 0 {
+					work = append(work, refChange{recUnrefBlocks, p, r.depth - 1})
+				}
+			}
+		}
+	}
+	for _, p := range d.orphans {
+		if d.refs[refKey(p)] < 0 {
+			tx.orphans = append(tx.orphans, p)
+		}
+	}
+	d.orphans = nil
+	for _, p := range tx.orphans {
+		idx, group, _ := EntAddr(p).GetAddr()
+		free[group-1] = append(free[group-1], p)
+		freed[refPos{group - 1, idx}] = true
+		d.unindexLocked(p)
+		tx.write(group-1, fs.geo.dedupPos(idx), zero)
+	}
+	d.lock.Unlock()
+	for g, ptrs := range free {
+		tx.bitmapOp(recFreeBlocks, g, ptrs)
+	}
+	// a block freed before may have left a count behind
+	allocated := make(map[refPos]bool)
+	for g, ptrs := range tx.pointers(true, true) {
+		for _, p := range ptrs {
+			idx, _, _ := EntAddr(p).GetAddr()
+			k := refPos{g, idx}
+			allocated[k] = true
+			if _, ok := deltas[k]; !ok {
+				order = append(order, k)
+			}
+		}
+	}
+	for _, k := range order {
+		if freed[k] || deltas[k] == 0 && !allocated[k] {
+			continue
+		}
+		if err := fs.device.checkReady(k.group, &fs.blockGroups[k.group]); err != nil {
+			return err
+		}
+		data := make([]byte, 4)
+		if _, err := fs.device.volumes[k.group].file.ReadAt(data, fs.geo.dedupPos(k.idx)); err != nil {
+			return err
+		}
+		tx.patch(k.group, fs.geo.dedupPos(k.idx), data)
+		refs := int32(binary.LittleEndian.Uint32(data))
+		if allocated[k] {
+			if refs == 0 && deltas[k] == 0 {
+				continue
+			}
+			refs = 0
+		}
+		binary.LittleEndian.PutUint32(data, uint32(refs+deltas[k]))
+		tx.write(k.group, fs.geo.dedupPos(k.idx), data)
+	}
+	return nil
+}
+
+// settleRefs applies the reference changes of tx once it is durable.
+func (fs *FileSystem) settleRefs(tx *txn) {
+	d := fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, p := range tx.unrefs {
+		k := refKey(p)
+		if d.refs[k]--; d.refs[k] == 0 {
+			delete(d.refs, k)
+		} else if d.refs[k] < 0 {
+			d.orphanLocked(p)
+		}
+	}
+	for _, ptrs := range tx.pointers(true, false) {
+		for _, p := range ptrs {
+			delete(d.refs, refKey(p))
+		}
+	}
+}
+
+// abortRefs drops the references taken by tx. A block whose owners are all
+// gone meanwhile is freed by the next commit.
+func (fs *FileSystem) abortRefs(tx *txn) {
+	d := fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, r := range tx.refs {
+		if r.typ != recRefBlocks {
+			continue
+		}
+		k := refKey(r.ptr)
+		if d.refs[k]--; d.refs[k] == 0 {
+			delete(d.refs, k)
+		} else if d.refs[k] < 0 {
+			d.orphanLocked(r.ptr)
+		}
+	}
+	for _, p := range tx.indexed {
+		d.unindexLocked(p)
+	}
+	d.orphans = append(d.orphans, tx.orphans...)
+}
+
+// DedupStats returns how much the sharing of blocks saves.
+//
+// Returns:
+//   - DedupStats: The counts of the shared blocks, and the bytes in use as
+//     seen by the files and as stored.
+//   - error: ErrNoDedup if the depot was created without FeatureDedup.
+func (fs *FileSystem) DedupStats() (DedupStats, error) {
+	if fs.dedup == nil {
+		return DedupStats{}, ErrNoDedup
+	}
+	total, free := fs.StatBlocks(-1)
+	st := DedupStats{PhysicalBytes: (total - free) * int64(fs.Smeta.BlockSize)}
+	d := fs.dedup
+	d.lock.Lock()
+	st.IndexedBlocks = len(d.hashes)
+	for _, n := range d.refs {
+		if n > 0 {
+			st.SharedBlocks++
+			st.References += int64(n)
+		}
+	}
+	d.lock.Unlock()
+	st.LogicalBytes = st.PhysicalBytes + st.References*int64(fs.Smeta.BlockSize)
+	return st, nil
+}
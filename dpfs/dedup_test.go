@@ -0,0 +1,81 @@
+/*
+ dedup_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDedupOrphans(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *FileSystem {
+		fs, err := MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, FeatureDedup)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	fs := open()
+	_, free := fs.StatBlocks(-1)
+	// a block whose share was aborted by a crash, its owner is gone
+	tx := fs.beginTx()
+	ptrs, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		t.Fatalf("Alloc failed: %v", err)
+	}
+	if err := fs.commitTx(tx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// a count written with the allocation would be reset, see stageRefs
+	tx = fs.beginTx()
+	idx, group, _ := EntAddr(ptrs[0]).GetAddr()
+	tx.write(group-1, fs.geo.dedupPos(idx), []byte{0xff, 0xff, 0xff, 0xff})
+	if err := fs.commitTx(tx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	fs.Close()
+
+	ro, err := OpenReadOnly(testDir)
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	r := mustCheck(t, ro, CheckOptions{})
+	for _, kind := range []IssueKind{IssueLeakedBlock, IssueBadRefCount} {
+		if !hasIssue(r, kind) {
+			t.Errorf("Missing issue %s in %v", kind, r.Issues)
+		}
+	}
+	ro.Close()
+
+	fs = open()
+	defer fs.Close()
+	if _, free2 := fs.StatBlocks(-1); free2 != free {
+		t.Errorf("Orphan not freed, free blocks %d->%d", free, free2)
+	}
+	if r := mustCheck(t, fs, CheckOptions{}); !r.Clean() {
+		t.Errorf("Issues left after mount: %v", r.Issues)
+	}
+}
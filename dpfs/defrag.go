@@ -0,0 +1,486 @@
+/*
+ defrag.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+  Defragment rewrites the files whose blocks are scattered, one transaction
+  per file. The blocks of a file are copied in slot order to a single run of
+  free blocks, the first one of the depot long enough, and the file is mapped
+  to the copy in place of the old blocks. Each 64 slots in a row holding a
+  block become a big block on depots with BigAlloc, except for slot 0 and the
+  slots of extent files. A file already in one run moves only to a run in
+  front of it, so the files gather at the start of the groups and the free
+  space behind them joins up.
+
+  A file is rewritten with the tree lock and its inode lock held, readers of
+  the file wait for it and read the new blocks after. Files sharing a block
+  with a clone, a snapshot or a dedup twin are left alone, a copy would split
+  what they share. Packed and inline files have no blocks of their own, and
+  the system files stay where they are.
+
+  The next inode of the pass is the cursor, it is kept in the ExtMetas of the
+  system file SysInodeDefrag and updated with each file rewritten, so that a
+  pass stopped or cut by a crash resumes there. Depots without system inodes
+  keep it in memory.
+*/
+
+const defragMetaSize = 4 // [next inode u32]
+
+var (
+	ErrDefragRunning = errors.New("Defragmentation in progress")
+	ErrDefragStopped = errors.New("Defragmentation stopped")
+)
+
+// DefragOptions tunes a Defragment pass.
+type DefragOptions struct {
+	Rate    int             // blocks copied per second at most, 0 for no limit
+	Stop    <-chan struct{} // stops the pass when closed, at the next file
+	Restart bool            // start a new pass instead of resuming the last one
+}
+
+// DefragStats counts the work of the running or last Defragment pass.
+type DefragStats struct {
+	Files     int // files rewritten
+	Blocks    int // blocks copied
+	BigBlocks int // big blocks made of blocks in a row
+}
+
+type defragger struct {
+	running atomic.Bool
+	lock    sync.Mutex
+	stats   DefragStats
+	next    uint32 // inode the pass resumes at, 0 for a new pass
+	file    *Vfile // the cursor, kept under the tree lock
+}
+
+// defragSlot is a slot of the new layout of a file, made of the n slots of
+// the old layout from slot from on.
+type defragSlot struct {
+	from, n int
+	size    int // in blocks, 0 for a hole
+}
+
+func encodeDefragMeta(next uint32) []byte {
+	data := make([]byte, defragMetaSize)
+	binary.LittleEndian.PutUint32(data, next)
+	return data
+}
+
+// Defragment starts a pass rewriting the scattered files of the depot into
+// runs of consecutive blocks in the background. A pass stopped resumes where
+// it stopped on the next call, even after the depot was reopened. Reads and
+// writes of the files go on meanwhile, the file being rewritten waits for it.
+// Close stops the pass and waits for it.
+//
+// Parameters:
+//   - opts: The rate of the pass, the channel stopping it and whether to
+//     start over.
+//
+// Returns:
+//   - <-chan error: Receives the result of the pass once done,
+//     ErrDefragStopped when opts.Stop was closed or the file system closed.
+//   - error: ErrDefragRunning while a pass runs, os.ErrClosed after Close,
+//     or an error reading the cursor.
+func (fs *FileSystem) Defragment(opts DefragOptions) (<-chan error, error) {
+	if err := fs.writable("Defragment"); err != nil {
+		return nil, err
+	}
+	df := &fs.defrag
+	if !df.running.CompareAndSwap(false, true) {
+		return nil, ErrDefragRunning
+	}
+	next, err := fs.loadDefragCursor()
+	if err != nil {
+		df.running.Store(false)
+		return nil, err
+	}
+	if opts.Restart {
+		next = 0
+	}
+	df.lock.Lock()
+	df.stats = DefragStats{}
+	df.lock.Unlock()
+	done := make(chan error, 1)
+	err = fs.goBackground(func() {
+		defer df.running.Store(false)
+		err := fs.defragment(opts, next)
+		if err != nil && err != ErrDefragStopped {
+			fs.log.Errorf("Defragmentation failed:%s", err)
+		}
+		done <- err
+	})
+	if err != nil {
+		df.running.Store(false)
+		return nil, err
+	}
+	return done, nil
+}
+
+// DefragProgress returns the counters of the running or last Defragment pass.
+func (fs *FileSystem) DefragProgress() DefragStats {
+	fs.defrag.lock.Lock()
+	defer fs.defrag.lock.Unlock()
+	return fs.defrag.stats
+}
+
+func (fs *FileSystem) defragment(opts DefragOptions, next uint32) error {
+	stop := func(at uint32) error {
+		if err := fs.saveDefragCursor(at); err != nil {
+			return err
+		}
+		return ErrDefragStopped
+	}
+	from, group, _ := EntAddr(next).GetAddr()
+	if next == 0 {
+		group = 1
+	}
+	for g := int(group) - 1; g < int(fs.groupCount()); g++ {
+		bm := fs.GetInodeBitmap(g)
+		for k := int(from); k < len(bm)*8; k++ {
+			if bm[k/8]&(1<<(k%8)) == 0 {
+				continue
+			}
+			ptr := MakeEntAddr(uint32(k), uint32(g)+1, false)
+			select {
+			case <-opts.Stop:
+				return stop(ptr)
+			case <-fs.bg.closing:
+				return stop(ptr)
+			default:
+			}
+			after := MakeEntAddr(uint32(k)+1, uint32(g)+1, false)
+			n, err := fs.defragInode(ptr, after)
+			if err != nil {
+				return err
+			}
+			if n == 0 || opts.Rate <= 0 {
+				continue
+			}
+			select {
+			case <-opts.Stop:
+				return stop(after)
+			case <-fs.bg.closing:
+				return stop(after)
+			case <-time.After(time.Duration(n) * time.Second / time.Duration(opts.Rate)):
+			}
+		}
+		from = 0
+	}
+	return fs.saveDefragCursor(0)
+}
+
+// loadDefragCursor returns the inode the last pass stopped at.
+func (fs *FileSystem) loadDefragCursor() (uint32, error) {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	df := &fs.defrag
+	if !fs.Smeta.HasSysInodes() {
+		return df.next, nil
+	}
+	node, err := fs.readInode(sysInodePtr(SysInodeDefrag))
+	if err != nil || node.Seq == 0 {
+		return 0, err
+	}
+	f, err := fs.defragFile()
+	if err != nil {
+		return 0, err
+	}
+	df.next = binary.LittleEndian.Uint32(f.Meta.ExtMetas)
+	return df.next, nil
+}
+
+// defragFile returns the system file holding the cursor, it is set up on
+// first use. The tree lock must be held.
+func (fs *FileSystem) defragFile() (*Vfile, error) {
+	df := &fs.defrag
+	if df.file == nil {
+		f, err := fs.openSysFile(SysInodeDefrag, 0, encodeDefragMeta(0))
+		if err != nil {
+			return nil, err
+		}
+		if len(f.Meta.ExtMetas) != defragMetaSize {
+			return nil, errors.New("Bad defragmentation cursor")
+		}
+		df.file = f
+	}
+	return df.file, nil
+}
+
+// storeDefragCursor stages next as the cursor in tx. The tree lock must be
+// held.
+func (fs *FileSystem) storeDefragCursor(tx *txn, next uint32) error {
+	if !fs.Smeta.HasSysInodes() {
+		return nil
+	}
+	f, err := fs.defragFile()
+	if err != nil {
+		return err
+	}
+	meta := FileMeta{ExtMetas: encodeDefragMeta(next)}
+	mbuff, err := meta.ToBytes()
+	if err != nil {
+		return err
+	}
+	return fs.storeMeta(tx, f.Inodeptr, f.Inode, mbuff)
+}
+
+// saveDefragCursor persists next as the cursor.
+func (fs *FileSystem) saveDefragCursor(next uint32) error {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	df := &fs.defrag
+	if df.next == next {
+		return nil
+	}
+	tx := fs.beginTx()
+	if err := fs.storeDefragCursor(tx, next); err != nil {
+		df.file = nil
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		df.file = nil
+		return err
+	}
+	df.next = next
+	return nil
+}
+
+// defragInode rewrites the blocks of the inode ptr into a run when they are
+// scattered, with next as the cursor. It returns the number of blocks copied.
+func (fs *FileSystem) defragInode(ptr uint32, next uint32) (int, error) {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	lock := fs.inodeLock(ptr)
+	lock.Lock()
+	defer lock.Unlock()
+	if fs.isSysInode(ptr) || !fs.isValidInode(ptr) {
+		return 0, nil
+	}
+	node, err := fs.readInode(ptr)
+	if err != nil || node.Seq == 0 || node.IsQuarantined() || node.IsPacked() || node.IsInline() {
+		return 0, err
+	}
+	if d := fs.dedup; d != nil {
+		blocks, err := fs.inodeBlocks(nil, node)
+		if err != nil || slices.ContainsFunc(blocks, d.shared) {
+			return 0, err
+		}
+	}
+	last, err := fs.lastSlot(nil, node)
+	if err != nil || last < 0 {
+		return 0, err
+	}
+	ptrs := make([]uint32, last+1)
+	if err := fs.loadSlots(nil, node, 0, ptrs); err != nil {
+		return 0, err
+	}
+	layout, big := fs.defragLayout(node, ptrs)
+	var sizes []int
+	for _, s := range layout {
+		if s.size > 0 {
+			sizes = append(sizes, s.size)
+		}
+	}
+	below := uint64(math.MaxUint64)
+	if big == 0 && fs.contiguous(ptrs) {
+		// in one run already, it only moves to the front
+		below = runPos(ptrs[0])
+	}
+	tx := fs.beginTx()
+	blks, err := fs.allocRun(tx, sizes, below)
+	if err != nil || blks == nil {
+		fs.abortTx(tx)
+		return 0, err
+	}
+	inode := *node
+	n, err := fs.defragCopy(tx, &inode, ptrs, layout, blks)
+	if err == nil {
+		err = fs.syncInode(tx, ptr, &inode)
+	}
+	if err == nil {
+		err = fs.storeDefragCursor(tx, next)
+	}
+	if err != nil {
+		fs.defrag.file = nil
+		fs.abortTx(tx)
+		return 0, err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		fs.defrag.file = nil
+		return 0, err
+	}
+	fs.defrag.next = next
+	if inode.IsDir() {
+		// the handles kept of the directories are stale
+		fs.tree.dirs = nil
+	}
+	df := &fs.defrag
+	df.lock.Lock()
+	df.stats.Files++
+	df.stats.Blocks += n
+	df.stats.BigBlocks += big
+	df.lock.Unlock()
+	return n, nil
+}
+
+// defragLayout returns the slots of inode once rewritten from the slots ptrs,
+// and how many big blocks it makes of blocks in a row.
+func (fs *FileSystem) defragLayout(inode *Inode, ptrs []uint32) ([]defragSlot, int) {
+	upgrade := fs.Smeta.IsBigAllocEnabled() && !inode.HasExtents()
+	var layout []defragSlot
+	big := 0
+	for s := 0; s < len(ptrs); {
+		if upgrade && s > 0 && s+64 <= len(ptrs) && !slices.ContainsFunc(ptrs[s:s+64], func(p uint32) bool {
+			return p == 0 || EntAddr(p).IsBigBlock() > 0
+		}) {
+			layout = append(layout, defragSlot{s, 64, 64})
+			big++
+			s += 64
+			continue
+		}
+		size := 0
+		if ptrs[s] != 0 {
+			size = int(fs.slotSize(ptrs[s]) / int64(fs.Smeta.BlockSize))
+		}
+		layout = append(layout, defragSlot{s, 1, size})
+		s++
+	}
+	return layout, big
+}
+
+// contiguous reports whether the blocks of the slots ptrs follow each other,
+// the holes aside.
+func (fs *FileSystem) contiguous(ptrs []uint32) bool {
+	var end uint64
+	for _, p := range ptrs {
+		if p == 0 {
+			continue
+		}
+		if end != 0 && runPos(p) != end {
+			return false
+		}
+		end = runPos(p) + uint64(fs.slotSize(p)/int64(fs.Smeta.BlockSize))
+	}
+	return true
+}
+
+// runPos returns the position of the block ptr in the order of the depot.
+func runPos(ptr uint32) uint64 {
+	idx, group, _ := EntAddr(ptr).GetAddr()
+	return uint64(group)<<32 | uint64(idx)
+}
+
+// allocRun allocates the slots of sizes, in blocks, in a run of consecutive
+// blocks: the first one of the depot long enough that starts before the
+// position below. It returns the block of each slot, nil without such a run.
+func (fs *FileSystem) allocRun(tx *txn, sizes []int, below uint64) ([]uint32, error) {
+	n := 0
+	for _, size := range sizes {
+		n += size
+	}
+	for g := uint32(0); g < fs.groupCount(); g++ {
+		group := &fs.blockGroups[g]
+		group.lock.Lock()
+		if group.blockBitmap.FreeBits() < n || group.retired.Load() {
+			group.lock.Unlock()
+			continue
+		}
+		if err := fs.device.checkReadyLocked(g, group); err != nil {
+			group.lock.Unlock()
+			return nil, err
+		}
+		start := freeRun(group.blockBitmap.GetData(-1, 0), n)
+		if start < 0 || runPos(MakeEntAddr(uint32(start), g+1, false)) >= below {
+			group.lock.Unlock()
+			if start >= 0 {
+				return nil, nil
+			}
+			continue
+		}
+		blks := make([]uint32, 0, len(sizes))
+		for _, size := range sizes {
+			blks = append(blks, MakeEntAddr(uint32(start), g+1, size == 64))
+			start += size
+		}
+		group.blockBitmap.SetBits(blks)
+		tx.bitmapOp(recAllocBlocks, g, blks)
+		group.lock.Unlock()
+		return blks, nil
+	}
+	return nil, nil
+}
+
+// defragCopy copies the data of the slots ptrs of inode to the blocks blks
+// taking the slots of layout, and maps inode to them in tx. The old blocks
+// are released. It returns the number of blocks copied.
+func (fs *FileSystem) defragCopy(tx *txn, inode *Inode, ptrs []uint32, layout []defragSlot, blks []uint32) (int, error) {
+	d := fs.dedup
+	slots := make([]uint32, len(layout))
+	sizes := blks
+	copied := 0
+	for i, s := range layout {
+		if s.size == 0 {
+			continue
+		}
+		nb := blks[0]
+		blks = blks[1:]
+		slots[i] = nb
+		buf := make([]byte, fs.slotSize(nb))
+		off := 0
+		for _, p := range ptrs[s.from : s.from+s.n] {
+			size := int(fs.slotSize(p))
+			// the volume file may end inside the block, the rest reads as zeros
+			if _, _, err := fs.readBlock(p, 0, buf[off:off+size]); err != nil && err != io.EOF {
+				return 0, err
+			}
+			off += size
+		}
+		if _, _, err := fs.writeBlock(nb, buf, 0); err != nil {
+			return 0, err
+		}
+		copied += s.size
+		if d != nil && s.n == 1 {
+			d.lock.Lock()
+			sum, indexed := d.hashes[ptrs[s.from]]
+			d.lock.Unlock()
+			if indexed {
+				fs.indexBlock(tx, nb, sum)
+			}
+		}
+	}
+	if err := fs.releaseSlots(tx, inode, 0); err != nil {
+		return 0, err
+	}
+	inode.Blocks = uint32(len(sizes))
+	return copied, fs.storeSlots(tx, inode, 0, slots)
+}
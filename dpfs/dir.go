@@ -0,0 +1,704 @@
+/*
+ dir.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+  A directory is an inode with InodeAttrDir set. Its data is a name log (see
+  namelog.go) mapping the names of its children to their uids, the epoch of
+  the log is the ExtMetas of the directory. The root directory is the system
+  file SysInodeRoot, so directories need a depot with system inodes. A file
+  in a directory is named by the last element of its path. A file deleted by
+  uid leaves its entry behind, such an entry counts as missing and goes away
+  with the next compaction or removal of the entry. Path operations are
+  serialized by the lock of the tree, directories are cached once loaded.
+*/
+
+const (
+	dirMetaSize   = 4 // [epoch u32]
+	dirCompactMin = 64
+)
+
+var (
+	ErrExists      = errors.New("File exists")
+	ErrIsDir       = errors.New("Is a directory")
+	ErrNotDir      = errors.New("Not a directory")
+	ErrDirNotEmpty = errors.New("Directory not empty")
+	ErrBadPath     = errors.New("Bad path")
+	ErrNoSysInodes = errors.New("Depot without system inodes")
+)
+
+// DirEntry is an entry of a directory returned by ReadDir.
+type DirEntry struct {
+	Name  string
+	Uid   string
+	IsDir bool
+	Size  int64
+}
+
+type dirTree struct {
+	lock sync.Mutex
+	root string              // uid of the root directory, once loaded
+	dirs map[string]*dirNode // loaded directories by uid
+}
+
+type dirNode struct {
+	uid     string
+	file    *Vfile
+	epoch   uint32
+	records int
+	entries map[string]string
+}
+
+// dirChange holds the ops of a path operation on the entries of a directory.
+type dirChange struct {
+	d   *dirNode
+	ops []nameOp
+}
+
+func encodeDirMeta(epoch uint32) []byte {
+	data := make([]byte, dirMetaSize)
+	binary.LittleEndian.PutUint32(data, epoch)
+	return data
+}
+
+func (d *dirNode) apply(op nameOp) {
+	d.records++
+	switch op.op {
+	case nameAdd:
+		d.entries[op.name] = op.uid
+	case nameDel:
+		if d.entries[op.name] == op.uid {
+			delete(d.entries, op.name)
+		}
+	}
+}
+
+// entry returns the uid and the inode of the entry name of d.
+func (fs *FileSystem) entry(d *dirNode, name string) (string, uint32, bool) {
+	uid, ok := d.entries[name]
+	if !ok {
+		return "", 0, false
+	}
+	key := FileKey{}
+	if err := fs.parseUid(&key, uid); err != nil {
+		return "", 0, false
+	}
+	return uid, key.Inodeptr, true
+}
+
+// splitPath returns the elements of the slash separated path p, the root
+// has none.
+func splitPath(p string) ([]string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil, nil
+	}
+	parts := strings.Split(p, "/")
+	for _, s := range parts {
+		if s == "" || s == "." || s == ".." {
+			return nil, fmt.Errorf("%w: %s", ErrBadPath, p)
+		}
+	}
+	return parts, nil
+}
+
+// lookupInode returns the inode of the committed file uid, FNF when it is
+// gone.
+func (fs *FileSystem) lookupInode(inodeptr uint32, uid string) (*Inode, error) {
+	if !fs.isValidInode(inodeptr) {
+		return nil, FNF
+	}
+	node, err := fs.readInode(inodeptr)
+	if err != nil || fs.inode2Uid(inodeptr, node) != uid {
+		return nil, FNF
+	}
+	return node, nil
+}
+
+// loadDirLocked reads the entries of the directory f. The tree lock must be
+// held.
+func (fs *FileSystem) loadDirLocked(uid string, f *Vfile) (*dirNode, error) {
+	if len(f.Meta.ExtMetas) != dirMetaSize {
+		return nil, errors.New("Bad directory meta")
+	}
+	d := &dirNode{
+		uid:     uid,
+		file:    f,
+		epoch:   binary.LittleEndian.Uint32(f.Meta.ExtMetas),
+		entries: make(map[string]string),
+	}
+	if err := fs.readLog(f, d.epoch, d.apply); err != nil {
+		return nil, fmt.Errorf("directory %s: %w", uid, err)
+	}
+	t := &fs.tree
+	if t.dirs == nil {
+		t.dirs = make(map[string]*dirNode)
+	}
+	t.dirs[uid] = d
+	return d, nil
+}
+
+// rootLocked returns the root directory, it is set up on first use. The
+// tree lock must be held.
+func (fs *FileSystem) rootLocked() (*dirNode, error) {
+	t := &fs.tree
+	if d := t.dirs[t.root]; d != nil {
+		return d, nil
+	}
+	if !fs.Smeta.HasSysInodes() {
+		return nil, ErrNoSysInodes
+	}
+	f, err := fs.openSysFile(SysInodeRoot, 1<<InodeAttrDir, encodeDirMeta(0))
+	if err != nil {
+		return nil, err
+	}
+	t.root = fs.inode2Uid(f.Inodeptr, f.Inode)
+	return fs.loadDirLocked(t.root, f)
+}
+
+// dirLocked returns the directory uid. The tree lock must be held.
+func (fs *FileSystem) dirLocked(uid string, inodeptr uint32) (*dirNode, error) {
+	if d := fs.tree.dirs[uid]; d != nil {
+		return d, nil
+	}
+	node, err := fs.lookupInode(inodeptr, uid)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, ErrNotDir
+	}
+	f, err := fs.inodeFile(inodeptr, node)
+	if err != nil {
+		return nil, err
+	}
+	return fs.loadDirLocked(uid, f)
+}
+
+// walkLocked returns the directory at the path parts. The tree lock must be
+// held.
+func (fs *FileSystem) walkLocked(parts []string) (*dirNode, error) {
+	d, err := fs.rootLocked()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range parts {
+		uid, ptr, ok := fs.entry(d, name)
+		if !ok {
+			return nil, FNF
+		}
+		if d, err = fs.dirLocked(uid, ptr); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// liveEntries returns the entries of d whose files exist, ordered by name.
+func (fs *FileSystem) liveEntries(d *dirNode) []DirEntry {
+	list := make([]DirEntry, 0, len(d.entries))
+	for name := range d.entries {
+		uid, ptr, ok := fs.entry(d, name)
+		if !ok {
+			continue
+		}
+		node, err := fs.lookupInode(ptr, uid)
+		if err != nil {
+			continue
+		}
+		size, _ := fs.fileSize(nil, node)
+		list = append(list, DirEntry{Name: name, Uid: uid, IsDir: node.IsDir(), Size: size})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// exists reports whether the entry name of d refers to an existing file.
+func (fs *FileSystem) exists(d *dirNode, name string) bool {
+	uid, ptr, ok := fs.entry(d, name)
+	if !ok {
+		return false
+	}
+	_, err := fs.lookupInode(ptr, uid)
+	return err == nil
+}
+
+// commitDirs commits tx with the changes to the directories and the ops of
+// the name index. The directories are changed in memory ahead of the
+// commit, a failed commit drops them from the cache. A log is compacted in
+// tx when it grew too long or the directory became empty. The tree lock
+// must be held.
+func (fs *FileSystem) commitDirs(tx *txn, changes []dirChange, names ...nameOp) error {
+	var compacted []*dirNode
+	fail := func(err error) error {
+		for _, c := range changes {
+			delete(fs.tree.dirs, c.d.uid)
+		}
+		return err
+	}
+	for _, c := range changes {
+		d := c.d
+		for _, op := range c.ops {
+			d.apply(op)
+		}
+		var err error
+		if d.records > dirCompactMin && d.records > 2*len(d.entries) || len(d.entries) == 0 && d.records > 0 {
+			err = fs.compactDir(tx, d)
+			compacted = append(compacted, d)
+		} else {
+			err = fs.writeLog(tx, d.file, d.epoch, c.ops, false)
+		}
+		if err != nil {
+			fs.abortTx(tx)
+			return fail(err)
+		}
+	}
+	if err := fs.commitNames(tx, names...); err != nil {
+		return fail(err)
+	}
+	for _, d := range compacted {
+		d.epoch++
+		d.records = len(d.entries)
+	}
+	return nil
+}
+
+// compactDir rewrites the log of d in tx as a snapshot of its entries under
+// the next epoch.
+func (fs *FileSystem) compactDir(tx *txn, d *dirNode) error {
+	ops := make([]nameOp, 0, len(d.entries))
+	for name, uid := range d.entries {
+		ops = append(ops, nameOp{nameAdd, name, uid})
+	}
+	if err := fs.writeLog(tx, d.file, d.epoch+1, ops, true); err != nil {
+		return err
+	}
+	m := FileMeta{Name: d.file.Meta.Name, ExtMetas: encodeDirMeta(d.epoch + 1)}
+	mbuff, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	return fs.storeMeta(tx, d.file.Inodeptr, d.file.Inode, mbuff)
+}
+
+// Mkdir creates the directory p, its parent must exist.
+//
+// Parameters:
+//   - p: The slash separated path of the directory.
+//
+// Returns:
+//   - string: The uid of the directory.
+//   - error: ErrExists when p exists, FNF or ErrNotDir when the parent does
+//     not exist or is not a directory.
+func (fs *FileSystem) Mkdir(p string) (string, error) {
+	if err := fs.writable("Mkdir"); err != nil {
+		return "", err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 0 {
+		return "", ErrExists
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	return fs.mkdirLocked(parts)
+}
+
+// MkdirAll creates the directory p along with the parents that do not
+// exist. It does nothing when p is a directory already.
+//
+// Parameters:
+//   - p: The slash separated path of the directory.
+//
+// Returns:
+//   - string: The uid of the directory.
+//   - error: ErrNotDir when an element of p is a file.
+func (fs *FileSystem) MkdirAll(p string) (string, error) {
+	if err := fs.writable("MkdirAll"); err != nil {
+		return "", err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return "", err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	d, err := fs.rootLocked()
+	if err != nil {
+		return "", err
+	}
+	for i, name := range parts {
+		if !fs.exists(d, name) {
+			if _, err := fs.mkdirLocked(parts[:i+1]); err != nil {
+				return "", err
+			}
+		}
+		uid, ptr, _ := fs.entry(d, name)
+		if d, err = fs.dirLocked(uid, ptr); err != nil {
+			return "", err
+		}
+	}
+	return d.uid, nil
+}
+
+func (fs *FileSystem) mkdirLocked(parts []string) (string, error) {
+	d, err := fs.walkLocked(parts[:len(parts)-1])
+	if err != nil {
+		return "", err
+	}
+	name := parts[len(parts)-1]
+	if fs.exists(d, name) {
+		return "", ErrExists
+	}
+	tx := fs.beginTx()
+	_, uid, err := fs.newFile(tx, name, encodeDirMeta(0), 1<<InodeAttrDir)
+	if err != nil {
+		fs.abortTx(tx)
+		return "", err
+	}
+	if err := fs.commitDirs(tx, []dirChange{{d, []nameOp{{nameAdd, name, uid}}}}); err != nil {
+		return "", err
+	}
+	return uid, nil
+}
+
+// CreatePath creates the file p, its directory must exist. The file is named
+// by the last element of p.
+//
+// Parameters:
+//   - p: The slash separated path of the file.
+//   - meta: The metadata of the file, as for CreateFile.
+//   - opts: Options of the file, as for CreateFile.
+//
+// Returns:
+//   - *Vfile: The handle of the new file.
+//   - string: The uid of the file.
+//   - error: ErrExists when p exists, FNF or ErrNotDir when the directory
+//     does not exist or is not a directory.
+func (fs *FileSystem) CreatePath(p string, meta []byte, opts ...FileOption) (*Vfile, string, error) {
+	if err := fs.writable("CreatePath"); err != nil {
+		return nil, "", err
+	}
+	attr, err := fileAttr(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parts) == 0 {
+		return nil, "", ErrIsDir
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	d, err := fs.walkLocked(parts[:len(parts)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	name := parts[len(parts)-1]
+	if fs.exists(d, name) {
+		return nil, "", ErrExists
+	}
+	tx := fs.beginTx()
+	vf, uid, err := fs.newFile(tx, name, meta, attr)
+	if err != nil {
+		fs.abortTx(tx)
+		return nil, "", err
+	}
+	add := nameOp{nameAdd, name, uid}
+	if err := fs.commitDirs(tx, []dirChange{{d, []nameOp{add}}}, add); err != nil {
+		return nil, "", err
+	}
+	return vf, uid, nil
+}
+
+// Stat returns the entry of the file or directory p.
+//
+// Parameters:
+//   - p: The slash separated path.
+//
+// Returns:
+//   - DirEntry: The entry of p, the root has no name.
+//   - error: FNF when p does not exist.
+func (fs *FileSystem) Stat(p string) (DirEntry, error) {
+	if err := fs.alive(); err != nil {
+		return DirEntry{}, err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	if len(parts) == 0 {
+		d, err := fs.rootLocked()
+		if err != nil {
+			return DirEntry{}, err
+		}
+		return DirEntry{Uid: d.uid, IsDir: true}, nil
+	}
+	d, err := fs.walkLocked(parts[:len(parts)-1])
+	if err != nil {
+		return DirEntry{}, err
+	}
+	name := parts[len(parts)-1]
+	uid, ptr, ok := fs.entry(d, name)
+	if !ok {
+		return DirEntry{}, FNF
+	}
+	node, err := fs.lookupInode(ptr, uid)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	size, err := fs.fileSize(nil, node)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return DirEntry{Name: name, Uid: uid, IsDir: node.IsDir(), Size: size}, nil
+}
+
+// OpenPath opens the file p.
+//
+// Parameters:
+//   - p: The slash separated path of the file.
+//
+// Returns:
+//   - *Vfile: The handle of the file.
+//   - error: FNF when p does not exist, ErrIsDir when it is a directory.
+func (fs *FileSystem) OpenPath(p string) (*Vfile, error) {
+	e, err := fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir {
+		return nil, ErrIsDir
+	}
+	return fs.OpenFile(e.Uid)
+}
+
+// ReadDir returns the entries of the directory p, ordered by name.
+//
+// Parameters:
+//   - p: The slash separated path of the directory, "" or "/" for the root.
+//
+// Returns:
+//   - []DirEntry: The entries of the directory.
+//   - error: FNF when p does not exist, ErrNotDir when it is a file.
+func (fs *FileSystem) ReadDir(p string) ([]DirEntry, error) {
+	if err := fs.alive(); err != nil {
+		return nil, err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return nil, err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	d, err := fs.walkLocked(parts)
+	if err != nil {
+		return nil, err
+	}
+	return fs.liveEntries(d), nil
+}
+
+// Rename moves the file or directory oldPath to newPath, which may be in
+// another directory. The uid does not change, the name of the file becomes
+// the last element of newPath.
+//
+// Parameters:
+//   - oldPath: The path of the file or directory.
+//   - newPath: Its new path, the directory of it must exist.
+//
+// Returns:
+//   - error: ErrExists when newPath exists, ErrBadPath when a directory is
+//     moved into itself.
+func (fs *FileSystem) Rename(oldPath, newPath string) error {
+	if err := fs.writable("Rename"); err != nil {
+		return err
+	}
+	op, err := splitPath(oldPath)
+	if err != nil {
+		return err
+	}
+	np, err := splitPath(newPath)
+	if err != nil {
+		return err
+	}
+	if len(op) == 0 || len(np) == 0 {
+		return fmt.Errorf("%w: the root cannot move", ErrBadPath)
+	}
+	if len(np) >= len(op) && strings.Join(np[:len(op)], "/") == strings.Join(op, "/") {
+		if len(np) == len(op) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s is inside %s", ErrBadPath, newPath, oldPath)
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	src, err := fs.walkLocked(op[:len(op)-1])
+	if err != nil {
+		return err
+	}
+	dst, err := fs.walkLocked(np[:len(np)-1])
+	if err != nil {
+		return err
+	}
+	name, nname := op[len(op)-1], np[len(np)-1]
+	uid, ptr, ok := fs.entry(src, name)
+	if !ok {
+		return FNF
+	}
+	if fs.exists(dst, nname) {
+		return ErrExists
+	}
+	lock := fs.inodeLock(ptr)
+	lock.Lock()
+	defer lock.Unlock()
+	node, err := fs.lookupInode(ptr, uid)
+	if err != nil {
+		return err
+	}
+	del, add := nameOp{nameDel, name, uid}, nameOp{nameAdd, nname, uid}
+	changes := []dirChange{{src, []nameOp{del}}, {dst, []nameOp{add}}}
+	if src == dst {
+		changes = []dirChange{{src, []nameOp{del, add}}}
+	}
+	var names []nameOp
+	tx := fs.beginTx()
+	if name != nname {
+		if !node.IsDir() {
+			names = []nameOp{del, add}
+		}
+		meta, err := fs.loadMeta(node)
+		if err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+		meta.Name = nname
+		mbuff, err := meta.ToBytes()
+		if err == nil && len(mbuff) >= int(fs.Smeta.BlockSize) {
+			err = errors.New("File meta overlimit")
+		}
+		if err == nil {
+			err = fs.storeMeta(tx, ptr, node, mbuff)
+		}
+		if err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	if err := fs.commitDirs(tx, changes, names...); err != nil {
+		return err
+	}
+	// the cached handle has the old meta
+	delete(fs.tree.dirs, uid)
+	return nil
+}
+
+// DeletePath deletes the file or directory p. A directory that is not empty
+// is deleted with everything in it when recursive is set, each file in a
+// transaction of its own.
+//
+// Parameters:
+//   - p: The slash separated path.
+//   - recursive: Whether to delete a directory that is not empty.
+//
+// Returns:
+//   - error: FNF when p does not exist, ErrDirNotEmpty when p is a
+//     directory with entries and recursive is not set.
+func (fs *FileSystem) DeletePath(p string, recursive bool) error {
+	if err := fs.writable("DeletePath"); err != nil {
+		return err
+	}
+	parts, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("%w: the root cannot be deleted", ErrBadPath)
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	d, err := fs.walkLocked(parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+	return fs.removeLocked(d, parts[len(parts)-1], recursive)
+}
+
+func (fs *FileSystem) removeLocked(d *dirNode, name string, recursive bool) error {
+	uid, ptr, ok := fs.entry(d, name)
+	if !ok {
+		return FNF
+	}
+	if child, err := fs.dirLocked(uid, ptr); err == nil {
+		entries := fs.liveEntries(child)
+		if len(entries) > 0 && !recursive {
+			return ErrDirNotEmpty
+		}
+		for _, e := range entries {
+			if err := fs.removeLocked(child, e.Name, true); err != nil {
+				return err
+			}
+		}
+	} else if err != ErrNotDir && err != FNF {
+		return err
+	}
+	lock := fs.inodeLock(ptr)
+	lock.Lock()
+	defer lock.Unlock()
+	del := nameOp{nameDel, name, uid}
+	tx := fs.beginTx()
+	node, err := fs.lookupInode(ptr, uid)
+	if err == FNF {
+		// deleted by uid, drop the entry only
+		return fs.commitDirs(tx, []dirChange{{d, []nameOp{del}}})
+	} else if err != nil {
+		return err
+	}
+	var names []nameOp
+	if !node.IsDir() {
+		if meta, err := fs.loadMeta(node); err == nil {
+			names = append(names, nameOp{nameDel, meta.Name, uid})
+		}
+	}
+	if err := fs.releaseInode(tx, ptr, node); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitDirs(tx, []dirChange{{d, []nameOp{del}}}, names...); err != nil {
+		return err
+	}
+	delete(fs.tree.dirs, uid)
+	return nil
+}
@@ -0,0 +1,730 @@
+/*
+ evacuate.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+  EvacuateGroup empties a block group so that its volume file can go. The
+  group is retired first: nothing allocates from it any more, and a slab in
+  it takes no records. Then every inode with a block or its record in the
+  group is rewritten, one transaction per inode. The data blocks are copied
+  to other groups, the pointer blocks above a moved block are rewritten and
+  copied when they are shared or sit in the group, and an inode of the group
+  moves to an inode of another group. Once the last groups of the depot are
+  retired and empty they are removed, and the super block shrinks like with
+  Grow.
+
+  A uid holds the address of its inode, an inode that moved keeps its uid
+  through the move table. It is the system file SysInodeMoves, a name log
+  (see namelog.go) mapping the uid a moved file had to the uid of the inode
+  holding it now. Its ExtMetas is the epoch of the log followed by a bitmap
+  of the retired groups. An entry applies while the inode keeps the
+  generation and creation time of the entry, inode2Uid reports the old uid of
+  a moved inode and parseUid resolves it to the inode. The log is compacted
+  when a group is retired.
+
+  An inode is moved with the tree lock, its inode lock and the locks of the
+  snapshot catalog and the name index held. A handle opened before the move
+  of its inode returns FNF, like a lookup running beside the move. A data
+  block shared by clones or dedup is copied once, the owners moved later
+  take a reference on the copy while it holds the same content. A pointer
+  block shared is copied for each owner.
+*/
+
+const movesMetaSize = 4 + MaxBlockGroupNum/8 // [epoch u32][retired groups]
+
+var (
+	ErrSysGroup   = errors.New("Group holds the system files")
+	ErrGroupInUse = errors.New("Group still in use")
+)
+
+// moveEntry is a file moved to another inode, by the uid it had and the key
+// of its inode.
+type moveEntry struct {
+	uid string
+	cur FileKey
+}
+
+type moveTable struct {
+	lock    sync.RWMutex
+	moved   map[uint32]moveEntry // by the inode the uid names
+	homes   map[uint32]uint32    // inode a file moved to, inode its uid names
+	retired [MaxBlockGroupNum / 8]byte
+	epoch   uint32 // the log and the retired groups are kept under the tree lock
+	file    *Vfile
+}
+
+func encodeMovesMeta(epoch uint32, retired []byte) []byte {
+	data := make([]byte, movesMetaSize)
+	binary.LittleEndian.PutUint32(data, epoch)
+	copy(data[4:], retired)
+	return data
+}
+
+// set records that the file uid is held by the inode cur now.
+func (m *moveTable) set(uid string, cur FileKey) {
+	key := FileKey{}
+	if key.ParseKey(uid) != nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.moved == nil {
+		m.moved = make(map[uint32]moveEntry)
+		m.homes = make(map[uint32]uint32)
+	}
+	if e, ok := m.moved[key.Inodeptr]; ok {
+		delete(m.homes, e.cur.Inodeptr)
+	}
+	m.moved[key.Inodeptr] = moveEntry{uid, cur}
+	m.homes[cur.Inodeptr] = key.Inodeptr
+}
+
+// home returns the uid the file of the inode had before it moved.
+func (m *moveTable) home(inodeptr uint32, inode *Inode) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	from, ok := m.homes[inodeptr]
+	if !ok {
+		return "", false
+	}
+	e := m.moved[from]
+	if e.cur.Inodeptr != inodeptr || e.cur.Seq != inode.Seq || e.cur.Stamp != uint32(inode.CTime) {
+		return "", false
+	}
+	return e.uid, true
+}
+
+// parseUid parses uid into key, which names the inode holding the file when
+// the file moved.
+func (fs *FileSystem) parseUid(key *FileKey, uid string) error {
+	if err := key.ParseKey(uid); err != nil {
+		return err
+	}
+	m := &fs.moves
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if e, ok := m.moved[key.Inodeptr]; ok && e.uid == uid {
+		key.Inodeptr = e.cur.Inodeptr
+	}
+	return nil
+}
+
+// isRetired reports whether the block ptr is in a retired group.
+func (fs *FileSystem) isRetired(ptr uint32) bool {
+	_, group, _ := EntAddr(ptr).GetAddr()
+	return group > 0 && fs.blockGroups[group-1].retired.Load()
+}
+
+// initMoves loads the move table when the file system is opened, a depot
+// that never evacuated a group has none.
+func (fs *FileSystem) initMoves() error {
+	if !fs.Smeta.HasSysInodes() {
+		return nil
+	}
+	node, err := fs.readInode(sysInodePtr(SysInodeMoves))
+	if err != nil || node.Seq == 0 {
+		return err
+	}
+	return fs.loadMoves()
+}
+
+// loadMoves reads the move table and the retired groups from the log.
+func (fs *FileSystem) loadMoves() error {
+	m := &fs.moves
+	f, err := fs.openSysFile(SysInodeMoves, 0, encodeMovesMeta(0, nil))
+	if err != nil {
+		return err
+	}
+	if len(f.Meta.ExtMetas) != movesMetaSize {
+		return errors.New("Bad move table meta")
+	}
+	m.file = f
+	m.epoch = binary.LittleEndian.Uint32(f.Meta.ExtMetas)
+	copy(m.retired[:], f.Meta.ExtMetas[4:])
+	for g := uint32(0); g < fs.Smeta.TotalGroups; g++ {
+		fs.blockGroups[g].retired.Store(m.retired[g/8]&(1<<(g%8)) != 0)
+	}
+	var ops []nameOp
+	if err := fs.readLog(f, m.epoch, func(op nameOp) { ops = append(ops, op) }); err != nil {
+		return fmt.Errorf("move table: %w", err)
+	}
+	for _, op := range ops {
+		cur := FileKey{}
+		if err := cur.ParseKey(op.uid); err != nil {
+			return fmt.Errorf("move table: %w", err)
+		}
+		m.set(op.name, cur)
+	}
+	return nil
+}
+
+// movesFile returns the log of the move table, it is set up on first use.
+// The tree lock must be held.
+func (fs *FileSystem) movesFile() (*Vfile, error) {
+	m := &fs.moves
+	if m.file == nil {
+		if err := fs.loadMoves(); err != nil {
+			return nil, err
+		}
+	}
+	return m.file, nil
+}
+
+// storeRetired persists the retired groups in tx, with the log rewritten
+// under the next epoch when compact is set. The tree lock must be held and
+// nothing may move meanwhile.
+func (fs *FileSystem) storeRetired(tx *txn, compact bool) error {
+	m := &fs.moves
+	f, err := fs.movesFile()
+	if err != nil {
+		return err
+	}
+	epoch := m.epoch
+	if compact {
+		epoch++
+		var ops []nameOp
+		m.lock.Lock()
+		for from, e := range m.moved {
+			if node, err := fs.readInode(e.cur.Inodeptr); err != nil || !fs.isValidInode(e.cur.Inodeptr) ||
+				node.Seq != e.cur.Seq || uint32(node.CTime) != e.cur.Stamp {
+				// the file is gone
+				delete(m.homes, e.cur.Inodeptr)
+				delete(m.moved, from)
+				continue
+			}
+			ops = append(ops, nameOp{nameAdd, e.uid, e.cur.ToString()})
+		}
+		m.lock.Unlock()
+		if err := fs.writeLog(tx, f, epoch, ops, true); err != nil {
+			return err
+		}
+	}
+	meta := FileMeta{ExtMetas: encodeMovesMeta(epoch, m.retired[:])}
+	mbuff, err := meta.ToBytes()
+	if err != nil {
+		return err
+	}
+	return fs.storeMeta(tx, f.Inodeptr, f.Inode, mbuff)
+}
+
+// EvacuateGroup moves every block and inode out of the block group idx, which
+// takes no new blocks or inodes from then on. The volume files of the last
+// groups are removed once they are evacuated, and the number of groups of
+// the depot shrinks. A group evacuated that is not among the last ones stays
+// empty until the groups behind it are evacuated too. The uids of the files
+// do not change, handles opened before return FNF when their inode moved.
+//
+// Parameters:
+//   - idx: The index of the group, from 1 on. Group 0 holds the system
+//     files and cannot be evacuated.
+//
+// Returns:
+//   - error: ErrNoSysInodes on a depot without system inodes, ErrSysGroup
+//     for group 0, ErrBadGroupNum for a group the depot does not have,
+//     ErrGroupInUse when blocks or inodes were left in the group, or any
+//     error moving them. The group stays retired on error, EvacuateGroup
+//     may be called again.
+func (fs *FileSystem) EvacuateGroup(idx int) error {
+	if err := fs.writable("EvacuateGroup"); err != nil {
+		return err
+	}
+	if !fs.Smeta.HasSysInodes() {
+		return ErrNoSysInodes
+	}
+	if idx == 0 {
+		return ErrSysGroup
+	}
+	if idx < 0 || idx >= int(fs.groupCount()) {
+		return ErrBadGroupNum
+	}
+	g := uint32(idx)
+	if err := fs.retireGroup(g); err != nil {
+		return err
+	}
+	e := &evacuation{fs: fs, group: g + 1, copies: make(map[uint32]uint32)}
+	for i := 0; i < int(fs.groupCount()); i++ {
+		bm := fs.GetInodeBitmap(i)
+		for k := 0; k < len(bm)*8; k++ {
+			if bm[k/8]&(1<<(k%8)) == 0 {
+				continue
+			}
+			if err := e.moveInode(MakeEntAddr(uint32(k), uint32(i)+1, false)); err != nil {
+				return err
+			}
+		}
+	}
+	total, free := fs.StatBlocks(idx)
+	inodes, freeInodes := fs.StatInodes(idx)
+	if free != total || freeInodes != inodes {
+		return fmt.Errorf("%w: %d blocks, %d inodes left", ErrGroupInUse, total-free, inodes-freeInodes)
+	}
+	return fs.dropGroups()
+}
+
+// retireGroup closes the group g to allocation, once the operations in
+// flight are done.
+func (fs *FileSystem) retireGroup(g uint32) error {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	defer fs.lockInodes()()
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	m := &fs.moves
+	if _, err := fs.movesFile(); err != nil {
+		return err
+	}
+	fs.blockGroups[g].retired.Store(true)
+	m.retired[g/8] |= 1 << (g % 8)
+	tx := fs.beginTx()
+	if err := fs.storeRetired(tx, true); err != nil {
+		m.file = nil
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		m.file = nil
+		return err
+	}
+	m.epoch++
+	return nil
+}
+
+// dropGroups removes the last groups of the depot while they are retired
+// and empty.
+func (fs *FileSystem) dropGroups() error {
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	defer fs.lockInodes()()
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	old := fs.Smeta.TotalGroups
+	n := old
+	for ; n > 1 && fs.blockGroups[n-1].retired.Load(); n-- {
+		total, free := fs.StatBlocks(int(n - 1))
+		inodes, freeInodes := fs.StatInodes(int(n - 1))
+		if free != total || freeInodes != inodes {
+			break
+		}
+	}
+	if n == old {
+		return nil
+	}
+	// the groups stop being retired first, a crash before the super blocks
+	// are rewritten leaves them empty
+	m := &fs.moves
+	for g := n; g < old; g++ {
+		m.retired[g/8] &^= 1 << (g % 8)
+	}
+	tx := fs.beginTx()
+	if err := fs.storeRetired(tx, false); err != nil {
+		m.file = nil
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		m.file = nil
+		return err
+	}
+	smeta, durable, err := fs.commitSuperBlock(n)
+	if !durable {
+		return err
+	}
+	atomic.StoreUint32(&fs.Smeta.TotalGroups, n)
+	atomic.StoreUint32(&fs.curBlockGroups, 0)
+	if rerr := fs.device.shrink(smeta); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// keepHomes writes the generation of the files that moved out of the groups
+// from on to the inodes they left, for groups added again by Grow. A new
+// file of such an inode gets the next generation, so that it never takes the
+// uid of the moved file.
+func (fs *FileSystem) keepHomes(from uint32) error {
+	m := &fs.moves
+	tx := fs.beginTx()
+	m.lock.RLock()
+	for home, e := range m.moved {
+		key := FileKey{}
+		if _, group, _ := EntAddr(home).GetAddr(); group <= from || group > fs.Smeta.TotalGroups || key.ParseKey(e.uid) != nil {
+			continue
+		}
+		if err := fs.syncInode(tx, home, &Inode{Seq: key.Seq}); err != nil {
+			m.lock.RUnlock()
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	m.lock.RUnlock()
+	return fs.commitTx(tx)
+}
+
+// evacuation moves the blocks and the inodes out of a group.
+type evacuation struct {
+	fs     *FileSystem
+	group  uint32            // id of the group, from 1 on
+	copies map[uint32]uint32 // shared data blocks copied by the moves committed
+	made   map[uint32]uint32 // shared data blocks copied by the move in flight
+}
+
+// holds reports whether the block or inode ptr is in the group.
+func (e *evacuation) holds(ptr uint32) bool {
+	_, group, _ := EntAddr(ptr).GetAddr()
+	return ptr != 0 && group == e.group
+}
+
+// moveInode moves the blocks of the inode ptr out of the group, and the inode
+// itself when it is in the group. It holds the locks of everything that may
+// use them.
+func (e *evacuation) moveInode(ptr uint32) error {
+	fs := e.fs
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	lock := fs.inodeLock(ptr)
+	lock.Lock()
+	defer lock.Unlock()
+	fs.snaps.lock.Lock()
+	defer fs.snaps.lock.Unlock()
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	if !fs.isSysInode(ptr) && !fs.isValidInode(ptr) {
+		return nil
+	}
+	node, err := fs.readInode(ptr)
+	if err != nil || node.Seq == 0 || node.IsQuarantined() {
+		return err
+	}
+	blocks, err := fs.inodeBlocks(nil, node)
+	if err != nil {
+		return err
+	}
+	if !e.holds(ptr) && !slices.ContainsFunc(blocks, e.holds) {
+		return nil
+	}
+	e.made = make(map[uint32]uint32)
+	tx := fs.beginTx()
+	inode := *node
+	dst, err := e.moveNode(tx, ptr, node, &inode)
+	if err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		return err
+	}
+	for old, nb := range e.made {
+		e.copies[old] = nb
+	}
+	if dst != ptr {
+		fs.moves.set(fs.inode2Uid(ptr, node), FileKey{fs.Smeta.ShardId, dst, inode.Seq, uint32(inode.CTime)})
+	}
+	if fs.isSysInode(ptr) || inode.IsDir() {
+		// the handles kept of the system files and directories are stale
+		fs.tree.dirs = nil
+		fs.names.loaded = false
+		fs.snaps.loaded = false
+		fs.moves.file = nil
+		fs.defrag.file = nil
+	}
+	return nil
+}
+
+// moveNode moves the blocks of the inode ptr, whose copy inode is changed,
+// and the inode itself in tx. It returns the inode holding the file then.
+func (e *evacuation) moveNode(tx *txn, ptr uint32, node, inode *Inode) (uint32, error) {
+	fs := e.fs
+	dst := ptr
+	if e.holds(ptr) {
+		var err error
+		if dst, err = fs.allocInode(tx); err != nil {
+			return 0, err
+		}
+		// nobody reaches the new inode before tx commits, like in cloneInode
+		old, err := fs.readInodeTx(tx, dst)
+		if err != nil {
+			return 0, err
+		}
+		inode.Seq = old.Seq + 1
+		f, err := fs.movesFile()
+		if err != nil {
+			return 0, err
+		}
+		cur := FileKey{fs.Smeta.ShardId, dst, inode.Seq, uint32(inode.CTime)}
+		op := nameOp{nameAdd, fs.inode2Uid(ptr, node), cur.ToString()}
+		if err := fs.writeLog(tx, f, fs.moves.epoch, []nameOp{op}, false); err != nil {
+			fs.moves.file = nil
+			return 0, err
+		}
+		if err := fs.freeInode(tx, ptr); err != nil {
+			return 0, err
+		}
+	}
+	if node.IsPacked() {
+		rec, err := fs.packedRecord(node)
+		if err != nil {
+			return 0, err
+		}
+		tx.releaseSlot(ptr, node)
+		tx.storeSlot(dst, inode, rec)
+		return dst, nil
+	}
+	if err := e.moveBlocks(tx, inode); err != nil {
+		return 0, err
+	}
+	return dst, fs.syncInode(tx, dst, inode)
+}
+
+// moveBlocks moves the blocks of inode out of the group in tx.
+func (e *evacuation) moveBlocks(tx *txn, inode *Inode) error {
+	fs := e.fs
+	var err error
+	switch {
+	case inode.IsInline():
+		inode.DirectPointers[0], err = e.moveData(tx, inode.DirectPointers[0], false)
+	case inode.HasExtents():
+		if inode.DirectPointers[0], err = e.moveData(tx, inode.DirectPointers[0], false); err == nil {
+			err = e.moveExtents(tx, inode)
+		}
+	default:
+		for i := range inode.DirectPointers {
+			if inode.DirectPointers[i], err = e.moveData(tx, inode.DirectPointers[i], false); err != nil {
+				return err
+			}
+		}
+		for _, root := range []struct {
+			ptr   *uint32
+			depth int
+		}{
+			{&inode.SingleIndirect, SingleIndirectLv},
+			{&inode.DoubleIndirect, DoubleIndirectLv},
+			{&inode.TripleIndirect, TripleIndirectLv},
+		} {
+			if *root.ptr, err = e.moveTree(tx, *root.ptr, root.depth, false); err != nil {
+				return err
+			}
+		}
+	}
+	if err != nil || !inode.HasMetaBlock() {
+		return err
+	}
+	ref, err := fs.readMetaRef(inode)
+	if err != nil || !e.holds(ref.Block) {
+		return err
+	}
+	if ref.Block, err = e.moveData(tx, ref.Block, false); err != nil {
+		return err
+	}
+	// the first block is never shared, the reference is written in place
+	data := make([]byte, binary.Size(ref))
+	binary.LittleEndian.PutUint32(data, ref.Block)
+	binary.LittleEndian.PutUint32(data[4:], ref.Size)
+	return fs.stageBlock(tx, inode.DirectPointers[0], data, 0)
+}
+
+// moveTree moves the blocks below the pointer block ptr of depth out of the
+// group, and ptr itself. A pointer block that changes is copied when it is
+// shared or below a shared one, or when it is in the group. It returns the
+// block taking the place of ptr.
+func (e *evacuation) moveTree(tx *txn, ptr uint32, depth int, shared bool) (uint32, error) {
+	if ptr == 0 {
+		return 0, nil
+	}
+	fs := e.fs
+	shared = shared || fs.dedup != nil && fs.dedup.shared(ptr)
+	ptrs := make([]uint32, e.fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, ptr, ptrs, 0, depth); err != nil {
+		return 0, err
+	}
+	moved := make([]uint32, len(ptrs))
+	changed := false
+	for i, p := range ptrs {
+		var err error
+		if depth == SingleIndirectLv {
+			moved[i], err = e.moveData(tx, p, shared)
+		} else {
+			moved[i], err = e.moveTree(tx, p, depth-1, shared)
+		}
+		if err != nil {
+			return 0, err
+		}
+		changed = changed || moved[i] != p
+	}
+	if !e.holds(ptr) && (!changed || !shared) {
+		if !changed {
+			return ptr, nil
+		}
+		return ptr, fs.writePointerWithCache(tx, ptr, moved, 0, depth)
+	}
+	nb, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := fs.writePointerWithCache(tx, nb[0], moved, 0, depth); err != nil {
+		return 0, err
+	}
+	if shared {
+		// the copy takes a reference on the blocks of ptr, the moved ones
+		// lost theirs to the move already
+		fs.refBlocks(tx, ptrs)
+		tx.refOp(recUnrefBlocks, depth, []uint32{ptr})
+		return nb[0], nil
+	}
+	return nb[0], fs.releaseDataBlock(tx, []uint32{ptr})
+}
+
+// moveExtents moves the blocks mapped by the extents of inode and its
+// extent blocks out of the group.
+func (e *evacuation) moveExtents(tx *txn, inode *Inode) error {
+	fs := e.fs
+	exts, blocks, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return err
+	}
+	changed := slices.ContainsFunc(blocks, e.holds)
+	var moved []extent
+	for _, ext := range exts {
+		for s := int(ext.slot); s < ext.end(); s++ {
+			p, err := e.moveData(tx, ext.at(s), false)
+			if err != nil {
+				return err
+			}
+			changed = changed || p != ext.at(s)
+			moved = append(moved, extent{uint32(s), p, 1})
+		}
+	}
+	if !changed {
+		return nil
+	}
+	var kept []uint32
+	for _, p := range blocks {
+		if e.holds(p) {
+			fs.ibCache.Remove(p)
+			if err := fs.releaseDataBlock(tx, []uint32{p}); err != nil {
+				return err
+			}
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	return fs.storeExtents(tx, inode, mergeExtents(moved), kept)
+}
+
+// moveData returns the data block taking the place of ptr, a copy in another
+// group when ptr is in the group. The copy of a shared block, or of a block
+// below a shared pointer block, serves the other owners too.
+func (e *evacuation) moveData(tx *txn, ptr uint32, shared bool) (uint32, error) {
+	if !e.holds(ptr) {
+		return ptr, nil
+	}
+	fs := e.fs
+	d := fs.dedup
+	if d != nil {
+		if nb, ok := e.made[ptr]; ok {
+			fs.refBlocks(tx, []uint32{nb})
+			return nb, fs.releaseDataBlock(tx, []uint32{ptr})
+		}
+		if nb, ok := e.copies[ptr]; ok {
+			if ok, err := e.shareCopy(tx, ptr, nb); err != nil {
+				return 0, err
+			} else if ok {
+				return nb, fs.releaseDataBlock(tx, []uint32{ptr})
+			}
+		}
+	}
+	size := fs.slotSize(ptr)
+	buf := make([]byte, size)
+	// the volume file may end inside the block, the rest reads as zeros
+	if _, _, err := fs.readBlock(ptr, 0, buf); err != nil && err != io.EOF {
+		return 0, err
+	}
+	// a big block is replaced by a big block like in ownBlock
+	blks, _, err := fs.allocBlocks(tx, int(size/int64(fs.Smeta.BlockSize)), 1, size > int64(fs.Smeta.BlockSize))
+	if err != nil {
+		return 0, err
+	}
+	if fs.slotSize(blks[0]) != size {
+		return 0, errors.New("No big block free for the copy")
+	}
+	if _, _, err := fs.writeBlock(blks[0], buf, 0); err != nil {
+		return 0, err
+	}
+	if d != nil {
+		d.lock.Lock()
+		sum, indexed := d.hashes[ptr]
+		shared = shared || d.refs[refKey(ptr)] > 0
+		d.lock.Unlock()
+		if indexed {
+			fs.indexBlock(tx, blks[0], sum)
+		}
+		if shared {
+			e.made[ptr] = blks[0]
+		}
+	}
+	return blks[0], fs.releaseDataBlock(tx, []uint32{ptr})
+}
+
+// shareCopy takes a reference on nb, the copy of the block ptr made by an
+// earlier move, when nb is still in use with the content of ptr.
+func (e *evacuation) shareCopy(tx *txn, ptr, nb uint32) (bool, error) {
+	fs := e.fs
+	size := fs.slotSize(ptr)
+	if fs.slotSize(nb) != size {
+		return false, nil
+	}
+	want := make([]byte, size)
+	if _, _, err := fs.readBlock(ptr, 0, want); err != nil && err != io.EOF {
+		return false, err
+	}
+	d := fs.dedup
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, group, _ := EntAddr(nb).GetAddr()
+	bg := &fs.blockGroups[group-1]
+	bg.lock.Lock()
+	used := bg.blockBitmap.CheckBit(nb)
+	bg.lock.Unlock()
+	if !used {
+		return false, nil
+	}
+	// the copy is read under the lock, its owner cannot write it meanwhile
+	buf := make([]byte, size)
+	if _, _, err := fs.readBlock(nb, 0, buf); err != nil && err != io.EOF {
+		return false, err
+	}
+	if !bytes.Equal(buf, want) {
+		return false, nil
+	}
+	d.refs[refKey(nb)]++
+	tx.refOp(recRefBlocks, 0, []uint32{nb})
+	return true, nil
+}
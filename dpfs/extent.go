@@ -0,0 +1,502 @@
+/*
+ extent.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"errors"
+	"sort"
+)
+
+/*
+  On depots created with FeatureExtents the blocks of a new file are mapped
+  by extents instead of pointer trees. An extent maps a run of slots to the
+  same number of consecutive blocks of a group:
+
+    [first slot u32][first block u32][slots u32]
+
+  A slot of an extent file is always one block: the blocks of a big block
+  allocated for it are mapped one by one and end up in a single extent. So
+  the slot of a data position is found by a division, and its block by a
+  binary search over the extents. Slot 0 is DirectPointers[0], it holds the
+  meta like for any file. Up to 3 extents sit in the rest of the pointer area
+  of the inode, a file with more keeps them in a tree of extent blocks with
+  the root in TripleIndirect:
+
+    [magic u32][depth u16][count u16] then count entries
+      leaf (depth 0):  extents
+      interior:        [first slot u32][child block u32]
+
+  The map is written as a whole when it changes, into the extent blocks it
+  had before. Extent blocks are never shared: a clone gets a copy of the map
+  and takes a reference on each block of it.
+*/
+
+const (
+	ExtentLv        = 4          // cache level of the extent blocks
+	extentMagic     = 0x4E545845 // "EXTN"
+	inodeExtents    = 3          // extents held by the inode itself
+	maxExtentDepth  = 8
+	extentHeaderLen = 2
+)
+
+var errBadExtents = errors.New("Bad extent block")
+
+// FeatureExtents maps the blocks of new files with extents.
+var FeatureExtents Feature = func(fs *FileSystem) {
+	fs.Smeta.EnableExtents()
+}
+
+func (i *Inode) HasExtents() bool {
+	return i.Attr&(1<<InodeAttrExtents) != 0
+}
+
+// extent maps the slots from slot on to the blocks of a group from block on.
+type extent struct {
+	slot   uint32
+	block  uint32
+	length uint32
+}
+
+func (e extent) end() int {
+	return int(e.slot + e.length)
+}
+
+// at returns the block of slot, which lies in e.
+func (e extent) at(slot int) uint32 {
+	idx, group, _ := EntAddr(e.block).GetAddr()
+	return MakeEntAddr(idx+uint32(slot-int(e.slot)), group, false)
+}
+
+// follows reports whether ptr is the block behind the last one of e.
+func (e extent) follows(ptr uint32) bool {
+	idx, group, isBig := EntAddr(ptr).GetAddr()
+	first, egroup, _ := EntAddr(e.block).GetAddr()
+	return isBig == 0 && group == egroup && idx == first+e.length
+}
+
+func (g *Geometry) leafExtents() int {
+	return (g.BlockPointers - extentHeaderLen) / 3
+}
+
+func (g *Geometry) nodeChildren() int {
+	return (g.BlockPointers - extentHeaderLen) / 2
+}
+
+// extentArea returns the fields of the inode holding its extents.
+func (i *Inode) extentArea() []*uint32 {
+	area := make([]*uint32, 0, inodeExtents*3)
+	for k := 1; k < DirectBlocks; k++ {
+		area = append(area, &i.DirectPointers[k])
+	}
+	return append(area, &i.SingleIndirect, &i.DoubleIndirect)
+}
+
+// inodeExtents returns the extents held by the inode itself.
+func (i *Inode) inodeExtents() []extent {
+	area := i.extentArea()
+	var exts []extent
+	for k := 0; k < inodeExtents; k++ {
+		if e := (extent{*area[k*3], *area[k*3+1], *area[k*3+2]}); e.length > 0 {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+// mergeExtents joins the neighbours of the sorted exts mapping consecutive
+// blocks.
+func mergeExtents(exts []extent) []extent {
+	merged := exts[:0]
+	for _, e := range exts {
+		if n := len(merged); n > 0 && merged[n-1].end() == int(e.slot) && merged[n-1].follows(e.block) {
+			merged[n-1].length += e.length
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// mapSlots returns exts with the slots from slot on mapped to ptrs, a 0
+// pointer is a hole.
+func mapSlots(exts []extent, slot int, ptrs []uint32) []extent {
+	end := slot + len(ptrs)
+	var out []extent
+	for _, e := range exts {
+		if e.end() <= slot || int(e.slot) >= end {
+			out = append(out, e)
+			continue
+		}
+		if int(e.slot) < slot {
+			out = append(out, extent{e.slot, e.block, uint32(slot) - e.slot})
+		}
+		if e.end() > end {
+			out = append(out, extent{uint32(end), e.at(end), uint32(e.end() - end)})
+		}
+	}
+	for i, p := range ptrs {
+		if p != 0 {
+			out = append(out, extent{uint32(slot + i), p, 1})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].slot < out[j].slot })
+	return mergeExtents(out)
+}
+
+// readExtentBlock reads the extent block ptr, which sits at depth or at any
+// depth when depth is negative.
+func (fs *FileSystem) readExtentBlock(tx *txn, ptr uint32, depth int) ([]uint32, error) {
+	buf := make([]uint32, fs.geo.BlockPointers)
+	if err := fs.readPointerWithCache(tx, ptr, buf, 0, ExtentLv); err != nil {
+		return nil, err
+	}
+	d, cnt := int(buf[1]>>16), int(buf[1]&0xffff)
+	limit := fs.geo.leafExtents()
+	if d > 0 {
+		limit = fs.geo.nodeChildren()
+	}
+	if buf[0] != extentMagic || d >= maxExtentDepth || depth >= 0 && d != depth || cnt == 0 || cnt > limit {
+		return nil, errBadExtents
+	}
+	return buf, nil
+}
+
+// visitExtents calls fn with the extents of the tree below ptr ending behind
+// slot from, in order, until fn returns false.
+func (fs *FileSystem) visitExtents(tx *txn, ptr uint32, depth int, from int, fn func(extent) bool) (bool, error) {
+	buf, err := fs.readExtentBlock(tx, ptr, depth)
+	if err != nil {
+		return false, err
+	}
+	depth, cnt := int(buf[1]>>16), int(buf[1]&0xffff)
+	ents := buf[extentHeaderLen:]
+	if depth == 0 {
+		i := sort.Search(cnt, func(i int) bool { return int(ents[i*3]+ents[i*3+2]) > from })
+		for ; i < cnt; i++ {
+			if !fn(extent{ents[i*3], ents[i*3+1], ents[i*3+2]}) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	i := sort.Search(cnt, func(i int) bool { return int(ents[i*2]) > from }) - 1
+	for i = max(i, 0); i < cnt; i++ {
+		if more, err := fs.visitExtents(tx, ents[i*2+1], depth-1, from, fn); err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// walkExtents calls fn with the extents of inode ending behind slot from, in
+// order, until fn returns false.
+func (fs *FileSystem) walkExtents(tx *txn, inode *Inode, from int, fn func(extent) bool) error {
+	if inode.TripleIndirect == 0 {
+		for _, e := range inode.inodeExtents() {
+			if e.end() > from && !fn(e) {
+				break
+			}
+		}
+		return nil
+	}
+	_, err := fs.visitExtents(tx, inode.TripleIndirect, -1, from, fn)
+	return err
+}
+
+// loadExtents returns the extents of inode and its extent blocks.
+func (fs *FileSystem) loadExtents(tx *txn, inode *Inode) ([]extent, []uint32, error) {
+	if inode.TripleIndirect == 0 {
+		return inode.inodeExtents(), nil, nil
+	}
+	var exts []extent
+	var blocks []uint32
+	var load func(ptr uint32, depth int) error
+	load = func(ptr uint32, depth int) error {
+		buf, err := fs.readExtentBlock(tx, ptr, depth)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, ptr)
+		depth, cnt := int(buf[1]>>16), int(buf[1]&0xffff)
+		ents := buf[extentHeaderLen:]
+		for i := 0; i < cnt; i++ {
+			if depth == 0 {
+				exts = append(exts, extent{ents[i*3], ents[i*3+1], ents[i*3+2]})
+			} else if err := load(ents[i*2+1], depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := load(inode.TripleIndirect, -1); err != nil {
+		return nil, nil, err
+	}
+	return exts, blocks, nil
+}
+
+// writeExtents stores exts as the map of inode. The extent blocks are taken
+// from blocks first, more are allocated when alloc is set. It returns the
+// blocks left unused.
+func (fs *FileSystem) writeExtents(tx *txn, inode *Inode, exts []extent, blocks []uint32, alloc bool) ([]uint32, error) {
+	area := inode.extentArea()
+	for _, f := range area {
+		*f = 0
+	}
+	inode.TripleIndirect = 0
+	if len(exts) <= inodeExtents {
+		for i, e := range exts {
+			*area[i*3], *area[i*3+1], *area[i*3+2] = e.slot, e.block, e.length
+		}
+		return blocks, nil
+	}
+	type child struct {
+		slot, ptr uint32
+	}
+	store := func(depth int, cnt int, ents []uint32) (uint32, error) {
+		var ptr uint32
+		if len(blocks) > 0 {
+			ptr, blocks = blocks[0], blocks[1:]
+		} else if !alloc {
+			return 0, errBadExtents
+		} else {
+			nb, _, err := fs.allocBlocks(tx, 1, 1, false)
+			if err != nil {
+				return 0, err
+			}
+			ptr = nb[0]
+		}
+		buf := make([]uint32, fs.geo.BlockPointers)
+		buf[0], buf[1] = extentMagic, uint32(depth)<<16|uint32(cnt)
+		copy(buf[extentHeaderLen:], ents)
+		return ptr, fs.writePointerWithCache(tx, ptr, buf, 0, ExtentLv)
+	}
+	var level []child
+	for i := 0; i < len(exts); i += fs.geo.leafExtents() {
+		part := exts[i:min(i+fs.geo.leafExtents(), len(exts))]
+		ents := make([]uint32, 0, len(part)*3)
+		for _, e := range part {
+			ents = append(ents, e.slot, e.block, e.length)
+		}
+		ptr, err := store(0, len(part), ents)
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, child{part[0].slot, ptr})
+	}
+	for depth := 1; len(level) > 1; depth++ {
+		var up []child
+		for i := 0; i < len(level); i += fs.geo.nodeChildren() {
+			part := level[i:min(i+fs.geo.nodeChildren(), len(level))]
+			ents := make([]uint32, 0, len(part)*2)
+			for _, c := range part {
+				ents = append(ents, c.slot, c.ptr)
+			}
+			ptr, err := store(depth, len(part), ents)
+			if err != nil {
+				return nil, err
+			}
+			up = append(up, child{part[0].slot, ptr})
+		}
+		level = up
+	}
+	inode.TripleIndirect = level[0].ptr
+	return blocks, nil
+}
+
+// storeExtents stores exts as the map of inode, reusing its extent blocks
+// and releasing those left over.
+func (fs *FileSystem) storeExtents(tx *txn, inode *Inode, exts []extent, blocks []uint32) error {
+	unused, err := fs.writeExtents(tx, inode, exts, blocks, true)
+	if err != nil {
+		return err
+	}
+	for _, p := range unused {
+		fs.ibCache.Remove(p)
+	}
+	return fs.releaseDataBlock(tx, unused)
+}
+
+// extentSlots returns the blocks of the slots of exts.
+func extentSlots(exts []extent) []uint32 {
+	var ptrs []uint32
+	for _, e := range exts {
+		for s := int(e.slot); s < e.end(); s++ {
+			ptrs = append(ptrs, e.at(s))
+		}
+	}
+	return ptrs
+}
+
+// loadExtentSlots is loadSlots of an extent file.
+func (fs *FileSystem) loadExtentSlots(tx *txn, inode *Inode, slot int, ptrs []uint32) error {
+	clear(ptrs)
+	if slot == 0 && len(ptrs) > 0 {
+		ptrs[0] = inode.DirectPointers[0]
+	}
+	end := slot + len(ptrs)
+	return fs.walkExtents(tx, inode, slot, func(e extent) bool {
+		if int(e.slot) >= end {
+			return false
+		}
+		for s := max(slot, int(e.slot)); s < min(end, e.end()); s++ {
+			ptrs[s-slot] = e.at(s)
+		}
+		return true
+	})
+}
+
+// storeExtentSlots is storeSlots of an extent file.
+func (fs *FileSystem) storeExtentSlots(tx *txn, inode *Inode, slot int, ptrs []uint32) error {
+	if slot == 0 && len(ptrs) > 0 {
+		inode.DirectPointers[0] = ptrs[0]
+		slot, ptrs = 1, ptrs[1:]
+	}
+	if len(ptrs) == 0 {
+		return nil
+	}
+	exts, blocks, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return err
+	}
+	return fs.storeExtents(tx, inode, mapSlots(exts, slot, ptrs), blocks)
+}
+
+// lastExtentSlot is lastSlot of an extent file.
+func (fs *FileSystem) lastExtentSlot(tx *txn, inode *Inode) (int, error) {
+	if inode.TripleIndirect == 0 {
+		exts := inode.inodeExtents()
+		if len(exts) == 0 {
+			return 0, nil
+		}
+		return exts[len(exts)-1].end() - 1, nil
+	}
+	ptr, depth := inode.TripleIndirect, -1
+	for {
+		buf, err := fs.readExtentBlock(tx, ptr, depth)
+		if err != nil {
+			return 0, err
+		}
+		depth = int(buf[1] >> 16)
+		last := int(buf[1]&0xffff) - 1
+		ents := buf[extentHeaderLen:]
+		if depth == 0 {
+			return int(ents[last*3]+ents[last*3+2]) - 1, nil
+		}
+		ptr, depth = ents[last*2+1], depth-1
+	}
+}
+
+// usedExtentSlots is usedSlots of an extent file.
+func (fs *FileSystem) usedExtentSlots(tx *txn, inode *Inode) (int, error) {
+	exts, _, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	if inode.DirectPointers[0] != 0 {
+		used++
+	}
+	for _, e := range exts {
+		used += int(e.length)
+	}
+	return used, nil
+}
+
+// releaseExtentSlots is releaseSlots of an extent file.
+func (fs *FileSystem) releaseExtentSlots(tx *txn, inode *Inode, from int) error {
+	if from == 0 {
+		if err := fs.releaseDataBlock(tx, []uint32{inode.DirectPointers[0]}); err != nil {
+			return err
+		}
+		inode.DirectPointers[0] = 0
+		from = 1
+	}
+	exts, blocks, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return err
+	}
+	var kept, cut []extent
+	for _, e := range exts {
+		switch {
+		case e.end() <= from:
+			kept = append(kept, e)
+		case int(e.slot) >= from:
+			cut = append(cut, e)
+		default:
+			kept = append(kept, extent{e.slot, e.block, uint32(from) - e.slot})
+			cut = append(cut, extent{uint32(from), e.at(from), uint32(e.end() - from)})
+		}
+	}
+	if err := fs.releaseDataBlock(tx, extentSlots(cut)); err != nil {
+		return err
+	}
+	return fs.storeExtents(tx, inode, kept, blocks)
+}
+
+// extentBlocks is inodeBlocks of an extent file.
+func (fs *FileSystem) extentBlocks(tx *txn, inode *Inode) ([]uint32, error) {
+	exts, blocks, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return nil, err
+	}
+	blocks = append(blocks, extentSlots(exts)...)
+	if inode.DirectPointers[0] != 0 {
+		blocks = append(blocks, inode.DirectPointers[0])
+	}
+	if inode.HasMetaBlock() {
+		ref, err := fs.readMetaRef(inode)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, ref.Block)
+	}
+	return blocks, nil
+}
+
+// cloneExtents gives the clone of an extent file a map of its own, which
+// takes a reference on each block of inode.
+func (fs *FileSystem) cloneExtents(tx *txn, inode, clone *Inode) error {
+	exts, _, err := fs.loadExtents(tx, inode)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.writeExtents(tx, clone, exts, nil, true); err != nil {
+		return err
+	}
+	fs.refBlocks(tx, extentSlots(exts))
+	return nil
+}
+
+// expandBig replaces the big blocks of blks by their blocks.
+func expandBig(blks []uint32) []uint32 {
+	var out []uint32
+	for _, p := range blks {
+		idx, group, isBig := EntAddr(p).GetAddr()
+		if isBig == 0 {
+			out = append(out, p)
+			continue
+		}
+		for i := uint32(0); i < 64; i++ {
+			out = append(out, MakeEntAddr(idx+i, group, false))
+		}
+	}
+	return out
+}
@@ -26,7 +26,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -49,7 +52,8 @@ const (
 )
 
 const (
-	BlocksOverlimit = 10
+	BlocksOverlimit  = 10
+	InodeLockStripes = 64
 )
 
 const (
@@ -69,6 +73,8 @@ var (
 
 var FNF = errors.New("File not found")
 
+var ErrQuarantined = errors.New("File quarantined")
+
 var BAD_UID = errors.New("Bad UID for file")
 var BAD_GID = errors.New("Bad GID") //bad group id
 
@@ -76,18 +82,51 @@ type BlockGroupDescriptor struct {
 	GroupId uint32
 }
 
+// BlockGroup holds the in-memory bitmaps of one volume. lock guards both
+// bitmaps and the on-disk copy of them, as well as the creation of the volume file.
 type BlockGroup struct {
+	lock        sync.Mutex
 	gmeta       BlockGroupDescriptor
 	inodeBitmap Bitmap64
 	blockBitmap Bitmap64
+	// bitmaps as persisted on disk, loaded lazily by the journal so that a
+	// commit never writes bits of transactions still in flight
+	durableInodes []uint8
+	durableBlocks []uint8
+	retired       atomic.Bool // closed to allocation, see EvacuateGroup
 }
 
+// FileSystem is safe for concurrent use. Bitmaps are protected per group,
+// volume I/O is positional only, and every inode is guarded by one of the
+// striped inodeLocks so that handles of the same file do not interleave.
 type FileSystem struct {
 	Smeta          SuperBlock
-	curBlockGroups uint32 //index
+	curBlockGroups uint32 //index, accessed atomically
 	blockGroups    []BlockGroup
 	device         *VolumeFiles
+	geo            *Geometry //layout of the volume files, owned by device
 	ibCache        *BlockCache
+	inodeLocks     [InodeLockStripes]sync.RWMutex
+	names          nameIndex
+	tree           dirTree
+	keys           KeyProvider
+	crypt          *cryptor //of encrypted file systems
+	dedup          *dedupIndex
+	snaps          snapCatalog
+	pack           packer
+	moves          moveTable
+	defrag         defragger
+	bg             background //goroutines stopped by Close
+	log            logrus.FieldLogger
+	readOnly       bool //opened by OpenReadOnly
+}
+
+// background tracks the goroutines a file system runs on its own, such as a
+// Defragment pass, so that Close can stop them and wait for them.
+type background struct {
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+	closing chan struct{} //closed by Close
 }
 
 type FileMeta struct {
@@ -131,14 +170,15 @@ func (m *FileMeta) ToBytes() ([]byte, error) {
 }
 
 type FileSnap struct {
-	Key    string
-	Inode  uint32
-	Name   string
-	Meta   []byte
-	Size   int64
-	CTime  uint64
-	MTime  uint64
-	FileId uint64
+	Key      string
+	Inode    uint32
+	Name     string
+	Meta     []byte
+	Size     int64 //size of the content
+	Physical int64 //bytes of the blocks taken, meta included
+	CTime    uint64
+	MTime    uint64
+	FileId   uint64
 }
 
 func (m *FileMeta) FromBytes(data []byte) error {
@@ -180,7 +220,7 @@ type Inode struct {
 	Attr           uint16
 	MetaSize       uint16               //4
 	Blocks         uint32               //8
-	FileSize       uint64               //16 file size in bytes
+	FileSize       uint64               //16 file size in bytes, of the chunk stream if compressed
 	CTime          uint64               //24 creation time
 	MTime          uint64               //32 creation time
 	DirectPointers [DirectBlocks]uint32 //96
@@ -189,13 +229,59 @@ type Inode struct {
 	TripleIndirect uint32               //108
 }
 
+// Inode.Attr bits
+const (
+	InodeAttrQuarantined = 0 // set by Check on inodes with unreadable meta
+	InodeAttrMetaBlock   = 1 // meta moved to a block of its own by UpdateMeta
+	InodeAttrDir         = 2 // a directory, see dir.go
+	InodeAttrCodec       = 3 // bits 3-4, the Codec of a compressed file, see compress.go
+	InodeAttrFrozen      = 5 // held by a snapshot, see snapshot.go
+	InodeAttrPacked      = 6 // meta and data in a slot of a shared block, see pack.go
+	InodeAttrInline      = 7 // data in the pointer area, see inline.go
+	InodeAttrExtents     = 8 // blocks mapped by extents, see extent.go
+)
+
 func (i *Inode) DataSize() uint64 {
 	return uint64(i.MetaSize) + i.FileSize
 }
 
+func (i *Inode) IsQuarantined() bool {
+	return i.Attr&(1<<InodeAttrQuarantined) != 0
+}
+
+func (i *Inode) HasMetaBlock() bool {
+	return i.Attr&(1<<InodeAttrMetaBlock) != 0
+}
+
+func (i *Inode) IsDir() bool {
+	return i.Attr&(1<<InodeAttrDir) != 0
+}
+
+func (i *Inode) IsFrozen() bool {
+	return i.Attr&(1<<InodeAttrFrozen) != 0
+}
+
+// Feature is an optional feature given to MakeFileSystem. The format
+// features, recorded in SuperBlock.Attr, only apply to a new file system.
+type Feature func(fs *FileSystem)
+
+// FeatureChecksums keeps a CRC32C of every block, verified on read.
+var FeatureChecksums Feature = func(fs *FileSystem) {
+	fs.Smeta.EnableChecksums()
+}
+
+// metaRef is stored in front of the data in place of a meta that moved to a
+// block of its own.
+type metaRef struct {
+	Block uint32
+	Size  uint32
+}
+
 // MakeFileSystem initializes and creates a new file system instance.
 // It sets up the underlying structure based on the specified parameters,
 // allowing for efficient file management and storage operations.
+// It is MakeFileSystemWithOptions with the default block size, inodes
+// ratio and tuning.
 //
 // Parameters:
 //   - groupNum (uint32): The number of data files in the file system.
@@ -211,241 +297,350 @@ func (i *Inode) DataSize() uint64 {
 //     ID generation for files.
 //   - enableBigAlloc (bool): A flag indicating whether to enable large
 //     allocation for improved performance.
+//   - features (...Feature): Optional features, such as FeatureChecksums or
+//     WithKeyProvider. An existing file system keeps the format features it
+//     was created with, but needs its key provider.
 //
 // Returns:
 //   - *FileSystem: A pointer to the newly created FileSystem instance.
 //   - error: An error if the creation fails. If successful, the file system
 //     is ready for use.
 
-func MakeFileSystem(groupNum, blocksInGroup uint32, root, pattern, tpl string, shardId uint16, enableBigAlloc bool) (*FileSystem, error) {
-	if blocksInGroup == 0 {
-		blocksInGroup = DefaultBlocksInGroup
-	}
-	fs := FileSystem{
-		Smeta: SuperBlock{
-			BlockSize:     DefaultBlockSize,
-			TotalGroups:   groupNum,
-			BlocksInGroup: blocksInGroup,
-			InodesRatio:   DefaultInodesRatio,
-			ShardId:       shardId,
-		},
-		device:  &VolumeFiles{},
-		ibCache: NewBlockCache(),
-	}
-	if enableBigAlloc {
-		fs.Smeta.EnableBigAlloc()
-	}
-	if err := fs.device.Init(root, pattern, tpl, fs.Smeta, fs.blockGroups); err != nil {
-		return nil, err
-	}
-	fs.Smeta = fs.device.smeta
-	fs.blockGroups = fs.device.groups
-	fs.curBlockGroups = 0
-	logrus.Debugf("set current group idx:%d", fs.curBlockGroups)
-	logrus.Infof(
-		"Init file system <Total space: %d GB, Block: %d, Blocksize: %d, Group: %d, INodeSize: %d, TotalInodes: %d>",
-		fs.Smeta.TotalSpace()/(1024*1024*1024),
-		fs.Smeta.TotalBlocks(),
-		fs.Smeta.BlockSize,
-		fs.Smeta.TotalGroups,
-		binary.Size(Inode{}),
-		fs.Smeta.TotalInodes(),
-	)
-	return &fs, nil
+func MakeFileSystem(groupNum, blocksInGroup uint32, root, pattern, tpl string, shardId uint16, enableBigAlloc bool, features ...Feature) (*FileSystem, error) {
+	return MakeFileSystemWithOptions(Options{
+		Root:          root,
+		Pattern:       pattern,
+		Template:      tpl,
+		Groups:        groupNum,
+		BlocksInGroup: blocksInGroup,
+		ShardId:       shardId,
+		BigAlloc:      enableBigAlloc,
+		Features:      features,
+	})
 }
 
 // Close closes all open data files associated with the file system and ensures
 // that any buffered data is written to disk by calling Sync. If any Sync operation
 // fails, it logs a warning and returns the first encountered error. After closing,
-// the file references and statuses are reset to avoid further access.
+// the file references and statuses are reset to avoid further access, the
+// calls made after it fail with os.ErrClosed.
 //
 // Returns:
 // error: If any Sync operation fails, it returns the corresponding error.
 // Otherwise, it returns nil if all files are successfully synced and closed.
 func (f *FileSystem) Close() error {
+	f.stopBackground()
+	if f.device.closed.Swap(true) {
+		return nil
+	}
 	var err error = nil
-	for i := 0; i < int(f.Smeta.TotalGroups); i++ {
+	for i := 0; i < int(f.groupCount()); i++ {
 		v := &f.device.volumes[i]
+		f.blockGroups[i].lock.Lock()
 		if v.Status != 0 && v.file != nil {
-			if e := v.file.Sync(); e != nil {
-				logrus.Warnf("Sync data file [%d:%s] failed :%v", i, v.Fn, e)
-				err = e
+			if !f.readOnly {
+				if e := v.file.Sync(); e != nil {
+					f.log.Warnf("Sync data file [%d:%s] failed :%v", i, v.Fn, e)
+					err = e
+				}
 			}
-			v.file.Close()
+			v.ready.Store(false)
 			v.file = nil
 			v.Status = 0
 		}
+		f.blockGroups[i].lock.Unlock()
+	}
+	if f.device.journal != nil {
+		if e := f.device.journal.Close(); e != nil {
+			err = e
+		}
+	}
+	if e := f.device.backend.Close(); e != nil {
+		err = e
 	}
 	return err
 }
 
+// goBackground runs fn in a goroutine Close waits for, fn must return soon
+// after fs.bg.closing is closed.
+func (fs *FileSystem) goBackground(fn func()) error {
+	fs.bg.lock.Lock()
+	defer fs.bg.lock.Unlock()
+	select {
+	case <-fs.bg.closing:
+		return os.ErrClosed
+	default:
+	}
+	fs.bg.wg.Add(1)
+	go func() {
+		defer fs.bg.wg.Done()
+		fn()
+	}()
+	return nil
+}
+
+// stopBackground tells the goroutines of goBackground to stop and waits for
+// them, the file system is still usable while they wind up.
+func (fs *FileSystem) stopBackground() {
+	fs.bg.lock.Lock()
+	select {
+	case <-fs.bg.closing:
+	default:
+		close(fs.bg.closing)
+	}
+	fs.bg.lock.Unlock()
+	fs.bg.wg.Wait()
+}
+
 func (f *FileSystem) GetVolumeInfo(idx int) *Volume {
-	if idx < 0 || idx >= int(f.Smeta.TotalGroups) {
+	if idx < 0 || idx >= int(f.groupCount()) {
 		return nil
 	}
 	return &f.device.volumes[idx]
 }
 
+// GetBlockBitmap returns a copy of the block bitmap of group idx.
 func (f *FileSystem) GetBlockBitmap(idx int) []uint8 {
-	if idx < 0 || idx >= int(f.Smeta.TotalGroups) {
+	if idx < 0 || idx >= int(f.groupCount()) {
 		return nil
 	}
-	return f.blockGroups[idx].blockBitmap.GetData(-1, 0)
+	g := &f.blockGroups[idx]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]uint8(nil), g.blockBitmap.GetData(-1, 0)...)
 }
 
+// GetInodeBitmap returns a copy of the inode bitmap of group idx.
 func (f *FileSystem) GetInodeBitmap(idx int) []uint8 {
-	if idx < 0 || idx >= int(f.Smeta.TotalGroups) {
+	if idx < 0 || idx >= int(f.groupCount()) {
 		return nil
 	}
-	return f.blockGroups[idx].inodeBitmap.GetData(-1, 0)
+	g := &f.blockGroups[idx]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]uint8(nil), g.inodeBitmap.GetData(-1, 0)...)
 }
 
 func (f *FileSystem) DrawBlockBm(lim int) {
-	if lim > int(f.Smeta.TotalGroups) {
-		lim = int(f.Smeta.TotalGroups)
-	}
+	lim = min(lim, int(f.groupCount()))
 	for i := 0; i < lim; i++ {
-		group := &f.blockGroups[i]
-		g := MakeHeatMap(group.blockBitmap.GetData(-1, 0), 1, nil)
+		g := MakeHeatMap(f.GetBlockBitmap(i), 1, nil)
 		g.Draw()
 	}
 }
 
+func (fs *FileSystem) inodeLock(inodeptr uint32) *sync.RWMutex {
+	idx, group, _ := EntAddr(inodeptr).GetAddr()
+	return &fs.inodeLocks[(idx^group)%InodeLockStripes]
+}
+
+// isValidInode reports whether inodeptr is a committed file, system files
+// are not.
 func (fs *FileSystem) isValidInode(inodeptr uint32) bool {
 	_, group, _ := EntAddr(inodeptr).GetAddr()
-	if group == 0 || group > fs.Smeta.TotalGroups {
+	if group == 0 || group > fs.groupCount() || fs.isSysInode(inodeptr) {
 		return false
 	}
 	bg := &fs.blockGroups[group-1]
-	return bg.inodeBitmap.CheckBit(inodeptr)
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	if !bg.inodeBitmap.CheckBit(inodeptr) {
+		return false
+	}
+	// the inode may be allocated by a transaction still in flight, only a
+	// committed allocation makes it valid
+	if err := fs.device.checkReadyLocked(group-1, bg); err != nil {
+		return false
+	}
+	if err := fs.loadDurableLocked(group - 1); err != nil {
+		return false
+	}
+	return checkBit(bg.inodeBitmap.GroupId, bg.durableInodes, inodeptr)
 }
 
-func (fs *FileSystem) freeInode(inodeptr uint32) error {
-	idx, group, _ := EntAddr(inodeptr).GetAddr()
-	if group == 0 || group > fs.Smeta.TotalGroups {
+// freeInode releases the inode when tx commits.
+func (fs *FileSystem) freeInode(tx *txn, inodeptr uint32) error {
+	_, group, _ := EntAddr(inodeptr).GetAddr()
+	if group == 0 || group > fs.groupCount() {
 		return BAD_UID
 	}
-	bg := &fs.blockGroups[group-1]
-	bg.inodeBitmap.ClearBits([]uint32{inodeptr})
-	data := bg.inodeBitmap.GetData(int(idx/8), 1)
-	_, err := fs.device.volumes[group-1].file.WriteAt(data, int64(idx/8)+InodeBitmapOffset)
-	return err
+	tx.bitmapOp(recFreeInodes, group-1, []uint32{inodeptr})
+	return nil
 }
 
-func (fs *FileSystem) allocInode() (uint32, error) {
-	cur := fs.curBlockGroups
-	for i := 0; i < int(fs.Smeta.TotalGroups); i++ {
-		if fs.blockGroups[cur].inodeBitmap.FreeBits() > 0 {
-			lst, _ := fs.blockGroups[cur].inodeBitmap.AllocBits(1, 1, false)
-			if len(lst) > 0 {
-				idx, _, _ := EntAddr(lst[0]).GetAddr()
-				data := fs.blockGroups[cur].inodeBitmap.GetData(int(idx/8), 1)
-				fs.device.volumes[cur].file.WriteAt(data, int64(idx/8)+InodeBitmapOffset)
-				return lst[0], nil
-			}
+func (fs *FileSystem) allocInode(tx *txn) (uint32, error) {
+	cur := atomic.LoadUint32(&fs.curBlockGroups)
+	n := fs.groupCount()
+	for i := 0; i < int(n); i++ {
+		if ptr, err := fs.allocInodeInGroup(tx, cur%n); ptr != 0 || err != nil {
+			return ptr, err
 		}
-		cur = (cur + 1) % fs.Smeta.TotalGroups
+		cur = (cur + 1) % n
 	}
 	return 0, fmt.Errorf("No free inodes")
 }
 
+func (fs *FileSystem) allocInodeInGroup(tx *txn, cur uint32) (uint32, error) {
+	g := &fs.blockGroups[cur]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.inodeBitmap.FreeBits() == 0 || g.retired.Load() {
+		return 0, nil
+	}
+	if err := fs.device.checkReadyLocked(cur, g); err != nil {
+		return 0, err
+	}
+	lst, _ := g.inodeBitmap.AllocBits(1, 1, false)
+	if len(lst) == 0 {
+		return 0, nil
+	}
+	tx.bitmapOp(recAllocInodes, cur, lst)
+	return lst[0], nil
+}
+
+func (fs *FileSystem) freeBlocks(idx int) int64 {
+	g := &fs.blockGroups[idx]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return int64(g.blockBitmap.FreeBits())
+}
+
+func (fs *FileSystem) freeInodes(idx int) int64 {
+	g := &fs.blockGroups[idx]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return int64(g.inodeBitmap.FreeBits())
+}
+
+// Geometry returns the layout of the volume files of the file system.
+//
+// Returns:
+//   - Geometry: The offsets of the tables and of the blocks in a volume file,
+//     and the pointers per indirect block.
+func (fs *FileSystem) Geometry() Geometry {
+	return *fs.geo
+}
+
 func (fs *FileSystem) StatBlocks(idx int) (int64, int64) {
 	var c int64 = 0
-	if idx >= 0 && idx < int(fs.Smeta.TotalGroups) {
-		return int64(fs.Smeta.BlocksInGroup), int64(fs.blockGroups[idx].blockBitmap.FreeBits())
+	n := fs.groupCount()
+	if idx >= 0 && idx < int(n) {
+		return int64(fs.Smeta.BlocksInGroup), fs.freeBlocks(idx)
 	}
-	for i := 0; i < int(fs.Smeta.TotalGroups); i++ {
-		c += int64(fs.blockGroups[i].blockBitmap.FreeBits())
+	for i := 0; i < int(n); i++ {
+		c += fs.freeBlocks(i)
 	}
-	return fs.Smeta.TotalBlocks(), c //total,free
+	return int64(n) * int64(fs.Smeta.BlocksInGroup), c //total,free
 }
 
 func (fs *FileSystem) StatInodes(idx int) (int64, int64) {
 	var c int64 = 0
-	if idx >= 0 && idx < int(fs.Smeta.TotalGroups) {
-		return int64(fs.Smeta.BlocksInGroup / fs.Smeta.InodesRatio), int64(fs.blockGroups[idx].inodeBitmap.FreeBits())
+	n := fs.groupCount()
+	if idx >= 0 && idx < int(n) {
+		return int64(fs.Smeta.BlocksInGroup / fs.Smeta.InodesRatio), fs.freeInodes(idx)
 	}
-	for i := 0; i < int(fs.Smeta.TotalGroups); i++ {
-		c += int64(fs.blockGroups[i].inodeBitmap.FreeBits())
+	for i := 0; i < int(n); i++ {
+		c += fs.freeInodes(i)
 	}
-	return fs.Smeta.TotalInodes(), c //total,free
+	return int64(n) * int64(fs.Smeta.BlocksInGroup/fs.Smeta.InodesRatio), c //total,free
 }
 
 func (fs *FileSystem) haveFreeBlocks(numBlocks int) bool {
-	idx := fs.curBlockGroups
+	n := fs.groupCount()
+	idx := atomic.LoadUint32(&fs.curBlockGroups)
 	cnt := 0
 	for {
-		group := &fs.blockGroups[idx]
-		numBlocks -= int(group.blockBitmap.FreeBits())
+		if !fs.blockGroups[idx].retired.Load() {
+			numBlocks -= int(fs.freeBlocks(int(idx)))
+		}
 		if numBlocks <= 0 {
 			return true
 		}
 		cnt++
-		idx = (idx + 1) % fs.Smeta.TotalGroups
-		if cnt >= int(fs.Smeta.TotalGroups) {
+		idx = (idx + 1) % n
+		if cnt >= int(n) {
 			break
 		}
 	}
 	return false
 }
 
-func (fs *FileSystem) syncInode(p uint32, node *Inode) error {
+// syncInode stages the inode in tx, it reaches the volume when tx commits.
+func (fs *FileSystem) syncInode(tx *txn, p uint32, node *Inode) error {
 	idx, group, _ := EntAddr(p).GetAddr()
-	if err := fs.device.checkReady(group-1, &fs.blockGroups[group-1]); err != nil {
-		return err
-	}
-	offset := InodeOffset + int64(idx*uint32(InodeSize))
-	logrus.Debugf("sync inode [%d] to [%s:%d]", p, fs.device.volumes[group-1].Fn, offset)
-	if _, err := fs.device.volumes[group-1].file.Seek(offset, io.SeekStart); err != nil {
-		return err
-	}
-	if err := binary.Write(fs.device.volumes[group-1].file, binary.LittleEndian, node); err != nil {
-		return err
+	if group == 0 || group > fs.groupCount() {
+		return BAD_GID
 	}
-	if err := fs.device.volumes[group-1].file.Sync(); err != nil {
+	offset := fs.geo.InodeOffset + int64(idx*uint32(InodeSize))
+	fs.log.Debugf("sync inode [%d] to [%s:%d]", p, fs.device.volumes[group-1].Fn, offset)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, node); err != nil {
 		return err
 	}
+	tx.write(group-1, offset, buf.Bytes())
 	return nil
 }
 
 func (fs *FileSystem) readInode(p uint32) (*Inode, error) {
+	return fs.readInodeTx(nil, p)
+}
+
+func (fs *FileSystem) readInodeTx(tx *txn, p uint32) (*Inode, error) {
 	idx, group, _ := EntAddr(p).GetAddr()
-	if group <= 0 || group > fs.Smeta.TotalGroups {
+	if group <= 0 || group > fs.groupCount() {
 		return nil, errors.New("Bad group id")
 	}
 
 	if err := fs.device.checkReady(group-1, &fs.blockGroups[group-1]); err != nil {
 		return nil, err
 	}
-	offset := InodeOffset + int64(idx*uint32(InodeSize))
-	if _, err := fs.device.volumes[group-1].file.Seek(offset, io.SeekStart); err != nil {
-		logrus.Errorf("read inode failed(bad offset): %s", err)
+	offset := fs.geo.InodeOffset + int64(idx*uint32(InodeSize))
+	data := make([]byte, InodeSize)
+	if _, err := fs.device.volumes[group-1].file.ReadAt(data, offset); err != nil {
+		fs.log.Errorf("read inode failed(bad offset): %s", err)
 		return nil, err
 	}
+	tx.patch(group-1, offset, data)
 	inode := Inode{}
-	if err := binary.Read(fs.device.volumes[group-1].file, binary.LittleEndian, &inode); err != nil {
-		logrus.Errorf("read inode failed: %s", err)
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &inode); err != nil {
+		fs.log.Errorf("read inode failed: %s", err)
 		return nil, err
 	}
 	return &inode, nil
 }
 
+// syncBlockAlloc persists allocated blocks at once, it is used when the
+// allocation is not part of a transaction. The group lock must be held.
 func (fs *FileSystem) syncBlockAlloc(idx uint32, blks []uint32) error {
-	if err := fs.device.checkReady(idx, &fs.blockGroups[idx]); err != nil {
+	if err := fs.applyBitmapLocked(&journalRec{typ: recAllocBlocks, group: idx, ptrs: blks}); err != nil {
 		return err
 	}
-	segs, _ := mergeSeg(blks)
-	for _, s := range segs {
-		data := fs.blockGroups[idx].blockBitmap.GetData(s.offset, s.length)
-		fs.device.volumes[idx].file.WriteAt(data, int64(s.offset)+BlockBitmapOffset)
-		if err := fs.device.volumes[idx].file.Sync(); err != nil {
-			return err
-		}
+	return fs.device.sync(fs.device.volumes[idx].file)
+}
+
+func (fs *FileSystem) allocInGroup(tx *txn, idx uint32, numBlocks int, limit int, bigAlloc bool) ([]uint32, int, error) {
+	group := &fs.blockGroups[idx]
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if group.blockBitmap.FreeBits() == 0 || group.retired.Load() {
+		return nil, 0, nil
 	}
-	return nil
+	if err := fs.device.checkReadyLocked(idx, group); err != nil {
+		return nil, 0, err
+	}
+	blks, cnt := group.blockBitmap.AllocBits(numBlocks, limit, bigAlloc)
+	if tx != nil {
+		tx.bitmapOp(recAllocBlocks, idx, blks)
+	} else if err := fs.syncBlockAlloc(idx, blks); err != nil {
+		group.blockBitmap.ClearBits(blks)
+		return nil, 0, err
+	}
+	return blks, cnt, nil
 }
 
-func (fs *FileSystem) allocBlocks(numBlocks int, hlimit int, bigAlloc bool) ([]uint32, int, error) {
+// allocBlocks allocates blocks on behalf of tx, a nil tx persists the
+// allocation immediately.
+func (fs *FileSystem) allocBlocks(tx *txn, numBlocks int, hlimit int, bigAlloc bool) ([]uint32, int, error) {
 	if !fs.Smeta.IsBigAllocEnabled() {
 		bigAlloc = false
 	}
@@ -456,29 +651,29 @@ func (fs *FileSystem) allocBlocks(numBlocks int, hlimit int, bigAlloc bool) ([]u
 	allocatedBlocks := []uint32{}
 	need := numBlocks
 
-	idx := fs.curBlockGroups
+	groups := fs.groupCount()
+	idx := atomic.LoadUint32(&fs.curBlockGroups)
 	cnt := 0
 	for {
-		group := &fs.blockGroups[idx]
 		limit := hlimit - len(allocatedBlocks)
 		if limit == 0 {
 			break
 		}
-		if group.blockBitmap.FreeBits() > 0 {
-			blks, cnt := group.blockBitmap.AllocBits(numBlocks, limit, bigAlloc)
-			numBlocks -= cnt
+		blks, n, err := fs.allocInGroup(tx, idx, numBlocks, limit, bigAlloc)
+		if err != nil {
+			return allocatedBlocks, need - numBlocks, err
+		}
+		if n > 0 {
+			numBlocks -= n
 			allocatedBlocks = append(allocatedBlocks, blks...)
-			if err := fs.syncBlockAlloc(idx, blks); err != nil {
-				return allocatedBlocks, need - numBlocks, err
-			}
 			if numBlocks <= 0 || len(allocatedBlocks) == hlimit {
 				break
 			}
 		}
 		cnt++
-		idx = (idx + 1) % fs.Smeta.TotalGroups
-		fs.curBlockGroups = idx
-		if cnt >= int(fs.Smeta.TotalGroups) {
+		idx = (idx + 1) % groups
+		atomic.StoreUint32(&fs.curBlockGroups, idx)
+		if cnt >= int(groups) {
 			break
 		}
 	}
@@ -490,6 +685,9 @@ func (fs *FileSystem) allocBlocks(numBlocks int, hlimit int, bigAlloc bool) ([]u
 
 func (fs *FileSystem) readBlock(blkptr uint32, offset int, data []byte) (int, int, error) {
 	idx, group, isBig := EntAddr(blkptr).GetAddr()
+	if group < 1 || group > fs.groupCount() {
+		return 0, 0, BAD_GID
+	}
 	blksize := int(fs.Smeta.BlockSize)
 	if isBig > 0 {
 		blksize = 64 * int(fs.Smeta.BlockSize)
@@ -502,46 +700,58 @@ func (fs *FileSystem) readBlock(blkptr uint32, offset int, data []byte) (int, in
 	if err := fs.device.checkReady(group-1, &fs.blockGroups[group-1]); err != nil {
 		return 0, left, err
 	}
-	pos := BlockOffset + int64(idx)*int64(fs.Smeta.BlockSize) + int64(offset)
-	if _, err := fs.device.volumes[group-1].file.Seek(pos, io.SeekStart); err != nil {
-		logrus.Errorf("read block failed(bad offset): %s", err)
-		return 0, left, err
+	var rdn int
+	var err error
+	if fs.fullBlocks() {
+		rdn, err = fs.readFull(group-1, idx, offset, data[:size])
+	} else {
+		pos := fs.geo.BlockOffset + int64(idx)*int64(fs.Smeta.BlockSize) + int64(offset)
+		rdn, err = fs.device.volumes[group-1].file.ReadAt(data[:size], pos)
 	}
-	rdn, err := fs.device.volumes[group-1].file.ReadAt(data[:size], pos)
-
 	if err != nil {
 		if err != io.EOF {
-			logrus.Errorf("read block failed. [offset:%d,len:%d,err:%s]", offset, rdn, err)
+			fs.log.Errorf("read block failed. [offset:%d,len:%d,err:%s]", offset, rdn, err)
 		}
 		return rdn, left, err
 	}
 	return rdn, left, nil
 }
 
-func (fs *FileSystem) writePointer(block uint32, blockptrs []uint32, offset int) error {
+// writePointer stages pointers in tx, pointer blocks are metadata and reach
+// the volume only when tx commits.
+func (fs *FileSystem) writePointer(tx *txn, block uint32, blockptrs []uint32, offset int) error {
+	idx, group, _ := EntAddr(block).GetAddr()
+	if group < 1 || group > fs.groupCount() {
+		return BAD_GID
+	}
+	if offset+len(blockptrs) > fs.geo.BlockPointers {
+		return errors.New("bad offset")
+	}
 	data := make([]byte, 4*len(blockptrs))
 	for i, ptr := range blockptrs {
 		binary.LittleEndian.PutUint32(data[i*4:], uint32(ptr))
 	}
-	_, _, err := fs.writeBlock(block, data, offset*4) //need to merge first and cache
-	return err
+	tx.write(group-1, fs.geo.BlockOffset+int64(idx)*int64(fs.Smeta.BlockSize)+int64(offset*4), data)
+	return nil
 }
 
-func (fs *FileSystem) writePointerWithCache(block uint32, blockptrs []uint32, offset int, lv int) error {
-	if err := fs.writePointer(block, blockptrs, offset); err != nil {
+func (fs *FileSystem) writePointerWithCache(tx *txn, block uint32, blockptrs []uint32, offset int, lv int) error {
+	if err := fs.writePointer(tx, block, blockptrs, offset); err != nil {
 		return err
 	}
 	if data, ok := fs.ibCache.Get(lv, block); ok {
 		if offset+len(blockptrs) <= len(data.([]uint32)) {
-			copy(data.([]uint32)[offset:], blockptrs)
+			ptrs := append([]uint32(nil), data.([]uint32)...)
+			copy(ptrs[offset:], blockptrs)
+			fs.ibCache.Put(lv, block, ptrs)
 		}
-	} else if len(blockptrs) == BlockPointers {
-		fs.ibCache.Put(lv, block, blockptrs)
+	} else if len(blockptrs) == fs.geo.BlockPointers {
+		fs.ibCache.Put(lv, block, append([]uint32(nil), blockptrs...))
 	}
 	return nil
 }
 
-func (fs *FileSystem) readPointer(blkptr uint32, blockptrs []uint32, offset int) error {
+func (fs *FileSystem) readPointer(tx *txn, blkptr uint32, blockptrs []uint32, offset int) error {
 	data := make([]byte, 4*len(blockptrs))
 	rdn, _, err := fs.readBlock(blkptr, 4*offset, data)
 	if err != nil {
@@ -550,34 +760,39 @@ func (fs *FileSystem) readPointer(blkptr uint32, blockptrs []uint32, offset int)
 	if rdn != len(data) {
 		return errors.New("bad blockptrs length")
 	}
+	idx, group, _ := EntAddr(blkptr).GetAddr()
+	tx.patch(group-1, fs.geo.BlockOffset+int64(idx)*int64(fs.Smeta.BlockSize)+int64(offset*4), data)
 	for i := 0; i < len(blockptrs); i++ {
 		blockptrs[i] = binary.LittleEndian.Uint32(data[i*4:])
 	}
 	return nil
 }
 
-func (fs *FileSystem) readPointerWithCache(blkptr uint32, blockptrs []uint32, offset int, lv int) error {
+func (fs *FileSystem) readPointerWithCache(tx *txn, blkptr uint32, blockptrs []uint32, offset int, lv int) error {
 	if data, ok := fs.ibCache.Get(lv, blkptr); ok {
 		if offset+len(blockptrs) <= len(data.([]uint32)) {
 			copy(blockptrs, data.([]uint32)[offset:])
 			return nil
 		} else {
-			logrus.Warnf("read pointer from cache failed, bad offset [block:%d, lv:%d,offset:%d,len:%d]",
+			fs.log.Warnf("read pointer from cache failed, bad offset [block:%d, lv:%d,offset:%d,len:%d]",
 				blkptr, lv, offset, len(data.([]uint32)))
 			return errors.New("Bad pointer offset")
 		}
 	}
-	if err := fs.readPointer(blkptr, blockptrs, offset); err != nil {
+	if err := fs.readPointer(tx, blkptr, blockptrs, offset); err != nil {
 		return err
 	}
-	if offset == 0 && len(blockptrs) == int(BlockPointers) {
-		fs.ibCache.Put(lv, blkptr, blockptrs)
+	if offset == 0 && len(blockptrs) == int(fs.geo.BlockPointers) {
+		fs.ibCache.Put(lv, blkptr, append([]uint32(nil), blockptrs...))
 	}
 	return nil
 }
 
 func (fs *FileSystem) writeBlock(blkptr uint32, data []byte, offset int) (int, int, error) {
 	idx, group, isBig := EntAddr(blkptr).GetAddr()
+	if group < 1 || group > fs.groupCount() {
+		return 0, 0, BAD_GID
+	}
 	size := int(fs.Smeta.BlockSize)
 	if isBig > 0 {
 		size = 64 * int(fs.Smeta.BlockSize)
@@ -592,11 +807,16 @@ func (fs *FileSystem) writeBlock(blkptr uint32, data []byte, offset int) (int, i
 		size = len(data)
 		broff = offset + size
 	}
-	pos := BlockOffset + int64(offset) + int64(idx)*int64(fs.Smeta.BlockSize)
-	if _, err := fs.device.volumes[group-1].file.Seek(pos, io.SeekStart); err != nil {
-		logrus.Errorf("read block failed(bad offset): %s", err)
+	if err := fs.device.checkReady(group-1, &fs.blockGroups[group-1]); err != nil {
 		return 0, 0, err
 	}
+	if fs.fullBlocks() {
+		if err := fs.writeFull(group-1, idx, offset, data[:size]); err != nil {
+			return 0, 0, err
+		}
+		return size, broff, nil
+	}
+	pos := fs.geo.BlockOffset + int64(offset) + int64(idx)*int64(fs.Smeta.BlockSize)
 	wtn, err := fs.device.volumes[group-1].file.WriteAt(data[:size], pos)
 	if err != nil {
 		return 0, 0, err
@@ -604,20 +824,50 @@ func (fs *FileSystem) writeBlock(blkptr uint32, data []byte, offset int) (int, i
 	return wtn, broff, nil
 }
 
+// zeroBlock zeroes the bytes of the block from `from` up to `to`.
+func (fs *FileSystem) zeroBlock(blkptr uint32, from, to int64) error {
+	if from >= to {
+		return nil
+	}
+	_, _, err := fs.writeBlock(blkptr, make([]byte, to-from), int(from))
+	return err
+}
+
 func (fs *FileSystem) inode2snap(ptr uint32) (FileSnap, error) {
 	node, err := fs.readInode(ptr)
 	if err != nil {
-		logrus.Errorf("Read inode error:%s", err)
+		fs.log.Errorf("Read inode error:%s", err)
+		return FileSnap{}, err
+	}
+	if node.IsFrozen() {
+		return FileSnap{}, errFrozen
+	}
+	return fs.node2snap(ptr, node)
+}
+
+func (fs *FileSystem) node2snap(ptr uint32, node *Inode) (FileSnap, error) {
+	if node.IsQuarantined() {
+		return FileSnap{}, ErrQuarantined
+	}
+	if node.IsDir() {
+		return FileSnap{}, ErrIsDir
+	}
+	size, err := fs.fileSize(nil, node)
+	if err != nil {
 		return FileSnap{}, err
 	}
 	snap := FileSnap{
-		Key:   fs.inode2Uid(ptr, node),
-		Inode: ptr,
-		Name:  "",
-		Meta:  nil,
-		Size:  int64(node.FileSize),
-		CTime: node.CTime,
-		MTime: node.MTime,
+		Key:      fs.inode2Uid(ptr, node),
+		Inode:    ptr,
+		Name:     "",
+		Meta:     nil,
+		Size:     size,
+		Physical: int64(node.Blocks) * int64(fs.Smeta.BlockSize),
+		CTime:    node.CTime,
+		MTime:    node.MTime,
+	}
+	if node.IsPacked() {
+		snap.Physical = int64(node.DataSize())
 	}
 	meta, err := fs.loadMeta(node)
 	if err != nil {
@@ -639,10 +889,9 @@ func (fs *FileSystem) calcOffset(dataSize uint64, inodeptr uint32) int {
 
 func (fs *FileSystem) GetFileList() ([]FileSnap, error) {
 	var list []FileSnap
-	for g := 0; g < int(fs.Smeta.TotalGroups); g++ {
-		if fs.device.volumes[g].Status > 0 {
-			gp := &fs.blockGroups[g]
-			bm := gp.inodeBitmap.GetData(-1, 0)
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if fs.device.volumes[g].ready.Load() {
+			bm := fs.GetInodeBitmap(g)
 			for i := 0; i < len(bm); i++ {
 				if bm[i] == 0 {
 					continue
@@ -650,7 +899,13 @@ func (fs *FileSystem) GetFileList() ([]FileSnap, error) {
 				for bitIndex := 0; bitIndex < 8; bitIndex++ {
 					if (bm[i] & (1 << bitIndex)) > 0 {
 						ptr := MakeEntAddr(uint32(i*8+bitIndex), uint32(g)+1, false)
+						if fs.isSysInode(ptr) {
+							continue
+						}
 						snap, err := fs.inode2snap(ptr)
+						if err == ErrQuarantined || err == ErrIsDir || err == errFrozen {
+							continue
+						}
 						if err != nil {
 							return list, err
 						}
@@ -665,10 +920,9 @@ func (fs *FileSystem) GetFileList() ([]FileSnap, error) {
 
 func (fs *FileSystem) listInodes() { //for debug
 	fmt.Printf("%-20s  %-10s  %-25s  %-20s\n", "inode(group:idx)", "filesize", "date", "fileid")
-	for g := 0; g < int(fs.Smeta.TotalGroups); g++ {
-		if fs.device.volumes[g].Status > 0 {
-			gp := &fs.blockGroups[g]
-			bm := gp.inodeBitmap.GetData(-1, 0)
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if fs.device.volumes[g].ready.Load() {
+			bm := fs.GetInodeBitmap(g)
 			for i := 0; i < len(bm); i++ {
 				if bm[i] == 0 {
 					continue
@@ -705,64 +959,70 @@ func pow(base, exp int) int {
 	return result
 }
 
-func (fs *FileSystem) releaseIndirectBlocks(blockptr uint32, depth int, blocks int) error {
+func (fs *FileSystem) releaseIndirectBlocks(tx *txn, blockptr uint32, depth int, blocks int) error {
 	if blockptr == 0 {
 		return nil
 	}
+	if fs.dedup != nil {
+		// a shared tree only loses a reference, decided on commit
+		tx.refOp(recUnrefBlocks, depth, []uint32{blockptr})
+		return nil
+	}
 	var pos = 0
 	if depth == 1 {
 		pos = blocks
 	} else {
-		pos = (blocks + pow(BlockPointers, depth-1) - 1) / (pow(BlockPointers, depth-1))
+		pos = (blocks + pow(fs.geo.BlockPointers, depth-1) - 1) / (pow(fs.geo.BlockPointers, depth-1))
 	}
-	logrus.Debugf("release indirect blocks [%d,depth:%d,blocks:%d,pos:%d]", blockptr, depth, blocks, pos)
-	if pos >= BlockPointers {
-		pos = BlockPointers
+	fs.log.Debugf("release indirect blocks [%d,depth:%d,blocks:%d,pos:%d]", blockptr, depth, blocks, pos)
+	if pos >= fs.geo.BlockPointers {
+		pos = fs.geo.BlockPointers
 	}
 	blockptrs := make([]uint32, pos)
-	err := fs.readPointer(blockptr, blockptrs, 0)
+	err := fs.readPointer(tx, blockptr, blockptrs, 0)
 	if err != nil {
 		return err
 	}
 
 	if depth == 1 {
-		if err := fs.releaseDataBlock(blockptrs); err != nil {
+		if err := fs.releaseDataBlock(tx, blockptrs); err != nil {
 			return err
 		}
 	} else {
 		for _, ptr := range blockptrs {
-			err := fs.releaseIndirectBlocks(ptr, depth-1, blocks)
+			err := fs.releaseIndirectBlocks(tx, ptr, depth-1, blocks)
 			if err != nil {
 				return err
 			}
-			blocks -= pow(BlockPointers, depth-1)
+			blocks -= pow(fs.geo.BlockPointers, depth-1)
 		}
 	}
-	return fs.releaseDataBlock([]uint32{blockptr})
+	return fs.releaseDataBlock(tx, []uint32{blockptr})
 }
 
-func (fs *FileSystem) releaseDataBlock(blockptrs []uint32) error {
+// releaseDataBlock releases blocks when tx commits, until then they stay
+// allocated so that no other transaction can reuse them. With reference
+// counts a shared block only loses a reference.
+func (fs *FileSystem) releaseDataBlock(tx *txn, blockptrs []uint32) error {
 	sort.Slice(blockptrs, func(i, j int) bool {
 		return (blockptrs[i] & 0x7fffffff) < (blockptrs[j] & 0x7fffffff)
 	})
 	groups := make(map[uint32][]uint32)
 	for _, v := range blockptrs {
+		if v == 0 {
+			continue
+		}
 		_, group, _ := EntAddr(v).GetAddr()
 		groups[group] = append(groups[group], v)
 	}
 	for g, v := range groups {
-		if g < 1 || g > fs.Smeta.TotalGroups {
+		if g < 1 || g > fs.groupCount() {
 			return BAD_GID
 		}
-		if err := fs.device.checkReady(g-1, &fs.blockGroups[g-1]); err != nil {
-			return err
-		}
-		fs.blockGroups[g-1].blockBitmap.ClearBits(v)
-		segs, _ := mergeSeg(v)
-		for _, s := range segs {
-			//data := fs.blockGroups[g-1].blockBitmap[s.offset : s.offset+s.length]
-			data := fs.blockGroups[g-1].blockBitmap.GetData(s.offset, s.length)
-			fs.device.volumes[g-1].file.WriteAt(data, int64(s.offset)+BlockBitmapOffset)
+		if fs.dedup != nil {
+			tx.refOp(recUnrefBlocks, 0, v)
+		} else {
+			tx.bitmapOp(recFreeBlocks, g-1, v)
 		}
 	}
 	return nil
@@ -780,10 +1040,16 @@ func (fs *FileSystem) releaseDataBlock(blockptrs []uint32) error {
 //     exist or if there are permission issues). If successful, the file is removed
 //     from the file system.
 func (fs *FileSystem) DeleteFile(uid string) error {
+	if err := fs.writable("DeleteFile"); err != nil {
+		return err
+	}
 	key := FileKey{}
-	if err := key.ParseKey(uid); err != nil {
+	if err := fs.parseUid(&key, uid); err != nil {
 		return err
 	}
+	lock := fs.inodeLock(key.Inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
 	if !fs.isValidInode(key.Inodeptr) {
 		return FNF
 	}
@@ -795,49 +1061,56 @@ func (fs *FileSystem) DeleteFile(uid string) error {
 	if fs.inode2Uid(key.Inodeptr, inode) != uid {
 		return FNF
 	}
-	logrus.Debugf("delete file [uid:%s,inode:%d,size:%d,blocks:%d]", uid, key.Inodeptr, inode.FileSize, inode.Blocks)
-	for i := 0; i < DirectBlocks && i < int(inode.Blocks); i++ {
-		if inode.DirectPointers[i] != 0 {
-			if err := fs.releaseDataBlock([]uint32{inode.DirectPointers[i]}); err != nil {
-				return err
-			}
-			inode.DirectPointers[i] = 0
-		}
+	if inode.IsDir() {
+		return ErrIsDir
 	}
-	blocks := int(inode.Blocks - DirectBlocks)
-	if inode.SingleIndirect > 0 && blocks > 0 {
-		n := pow(BlockPointers, SingleIndirectLv)
-		batch := blocks
-		if blocks > n {
-			batch = n
-		}
-		if err := fs.releaseIndirectBlocks(inode.SingleIndirect, SingleIndirectLv, batch); err != nil {
+	if inode.IsFrozen() {
+		return FNF
+	}
+	fs.log.Debugf("delete file [uid:%s,inode:%d,size:%d,blocks:%d]", uid, key.Inodeptr, inode.FileSize, inode.Blocks)
+	var ops []nameOp
+	if meta, err := fs.loadMeta(inode); err == nil {
+		ops = append(ops, nameOp{nameDel, meta.Name, uid})
+	}
+	tx := fs.beginTx()
+	if err := fs.releaseInode(tx, key.Inodeptr, inode); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	return fs.commitNames(tx, ops...)
+}
+
+// releaseInode releases all blocks of the inode and the inode itself.
+func (fs *FileSystem) releaseInode(tx *txn, inodeptr uint32, inode *Inode) error {
+	if inode.IsPacked() {
+		tx.releaseSlot(inodeptr, inode)
+		return fs.freeInode(tx, inodeptr)
+	}
+	if inode.HasMetaBlock() {
+		ref, err := fs.readMetaRef(inode)
+		if err != nil {
 			return err
 		}
-		blocks -= batch
-		inode.SingleIndirect = 0
-	}
-	if inode.DoubleIndirect > 0 && blocks > 0 {
-		n := pow(BlockPointers, DoubleIndirectLv)
-		batch := blocks
-		if blocks > n {
-			batch = n
-		}
-		if err := fs.releaseIndirectBlocks(inode.DoubleIndirect, DoubleIndirectLv, batch); err != nil {
+		if err := fs.releaseDataBlock(tx, []uint32{ref.Block}); err != nil {
 			return err
 		}
-		blocks -= batch
-		inode.DoubleIndirect = 0
 	}
-	if inode.TripleIndirect > 0 && blocks > 0 {
-		if err := fs.releaseIndirectBlocks(inode.TripleIndirect, 3, blocks); err != nil {
-			return err
-		}
+	if inode.IsInline() {
+		// only the meta block is a block
+		inode.setInline(nil)
 	}
-	return fs.freeInode(key.Inodeptr)
+	if err := fs.releaseSlots(tx, inode, 0); err != nil {
+		return err
+	}
+	return fs.freeInode(tx, inodeptr)
 }
 
+// inode2Uid returns the uid of the file held by the inode, the uid it had
+// before a move for an inode moved by EvacuateGroup.
 func (fs *FileSystem) inode2Uid(inodeptr uint32, inode *Inode) string {
+	if uid, ok := fs.moves.home(inodeptr, inode); ok {
+		return uid
+	}
 	k := FileKey{
 		Shard:    fs.Smeta.ShardId,
 		Inodeptr: inodeptr,
@@ -859,6 +1132,7 @@ func (fs *FileSystem) inode2Uid(inodeptr uint32, inode *Inode) string {
 //     that adheres to the file system's naming conventions.
 //   - meta: A byte slice containing metadata associated with the file. This
 //     could include information such as file type, permissions, or custom data.
+//   - opts: Options of the file, WithCodec(CodecFlate) compresses its content.
 //
 // Returns:
 //   - (*Vfile): A pointer to the newly created Vfile instance representing
@@ -866,7 +1140,29 @@ func (fs *FileSystem) inode2Uid(inodeptr uint32, inode *Inode) string {
 //   - string: The unique ID assigned to the created file.
 //   - error: Any error that occurred during the file creation process. If
 //     successful, error will be nil.
-func (fs *FileSystem) CreateFile(name string, meta []byte) (*Vfile, string, error) {
+func (fs *FileSystem) CreateFile(name string, meta []byte, opts ...FileOption) (*Vfile, string, error) {
+	if err := fs.writable("CreateFile"); err != nil {
+		return nil, "", err
+	}
+	attr, err := fileAttr(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	tx := fs.beginTx()
+	vf, uid, err := fs.newFile(tx, name, meta, attr)
+	if err != nil {
+		fs.abortTx(tx)
+		return nil, "", err
+	}
+	if err := fs.commitNames(tx, nameOp{nameAdd, name, uid}); err != nil {
+		return nil, "", err
+	}
+	return vf, uid, nil
+}
+
+// newFile sets up a new inode with the attributes attr in tx, and returns a
+// handle of it with its uid.
+func (fs *FileSystem) newFile(tx *txn, name string, meta []byte, attr uint16) (*Vfile, string, error) {
 	vf := Vfile{
 		fs:   fs,
 		Meta: new(FileMeta),
@@ -877,54 +1173,239 @@ func (fs *FileSystem) CreateFile(name string, meta []byte) (*Vfile, string, erro
 	vf.Meta.ExtMetas = meta
 	vf.Meta.Name = name
 	mbuff, err := vf.Meta.ToBytes()
+	if err != nil {
+		return nil, "", err
+	}
 	if len(mbuff) >= int(fs.Smeta.BlockSize) {
 		return nil, "", errors.New("File meta overlimit")
 	}
-
-	inodeptr, err := fs.allocInode()
+	inodeptr, err := fs.allocInode(tx)
 	if err != nil {
 		return nil, "", err
 	}
+	lock := fs.inodeLock(inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
 	vf.Inodeptr = inodeptr
-	oldnode, err := fs.readInode(inodeptr)
+	oldnode, err := fs.readInodeTx(tx, inodeptr)
 	if err != nil {
 		return nil, "", err
 	}
-	inode := Inode{
-		Seq:   oldnode.Seq + 1,
-		CTime: uint64(time.Now().Unix()),
+	var inode *Inode
+	var extents uint16
+	if fs.Smeta.HasExtents() {
+		extents = 1 << InodeAttrExtents
 	}
+	switch {
+	case fs.Smeta.HasPacking() && attr == 0 && len(mbuff) <= PackLimit:
+		inode, err = fs.newPacked(tx, inodeptr, oldnode.Seq+1, mbuff)
+	case fs.Smeta.HasInline() && !fs.Smeta.HasEncryption() && attr == 0:
+		// inodes are not encrypted, the data of an encrypted depot stays in blocks
+		inode, err = fs.initInode(tx, inodeptr, oldnode.Seq+1, 1<<InodeAttrInline|extents, mbuff)
+	default:
+		inode, err = fs.initInode(tx, inodeptr, oldnode.Seq+1, attr|extents, mbuff)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	vf.Inode = inode
+	vf.offset.blkRemOffset = len(mbuff)
+	return &vf, fs.inode2Uid(inodeptr, inode), nil
+}
 
-	uid := fs.inode2Uid(inodeptr, &inode)
-
-	inode.MetaSize = uint16(len(mbuff))
-	inode.Blocks = 1
-	blks, _, err := fs.allocBlocks(1, 1, false)
+// initInode sets up inodeptr as an empty file of generation seq with the
+// attributes attr, holding the encoded meta mbuff.
+func (fs *FileSystem) initInode(tx *txn, inodeptr uint32, seq uint32, attr uint16, mbuff []byte) (*Inode, error) {
+	inode := &Inode{
+		Seq:      seq,
+		Attr:     attr,
+		CTime:    uint64(time.Now().Unix()),
+		MetaSize: uint16(len(mbuff)),
+		Blocks:   1,
+	}
+	blks, _, err := fs.allocBlocks(tx, 1, 1, false)
 	if err != nil {
-		return nil, uid, err
+		return nil, err
 	}
 	if _, _, err := fs.writeBlock(blks[0], mbuff, 0); err != nil {
-		return nil, uid, err
+		return nil, err
 	}
 	inode.DirectPointers[0] = blks[0]
-	vf.Inode = &inode
-	vf.offset.blkRemOffset = len(mbuff)
-	if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-		return nil, uid, err
-	}
-	return &vf, uid, nil
+	return inode, fs.syncInode(tx, inodeptr, inode)
 }
 
 func (fs *FileSystem) loadMeta(node *Inode) (FileMeta, error) {
 	meta := FileMeta{}
-	data := make([]byte, node.MetaSize)
-	if _, _, err := fs.readBlock(node.DirectPointers[0], 0, data); err != nil {
+	data, err := fs.readMeta(node)
+	if err != nil {
 		return meta, err
 	}
-	err := meta.FromBytes(data)
+	err = meta.FromBytes(data)
 	return meta, err
 }
 
+// readMeta returns the encoded meta of node.
+func (fs *FileSystem) readMeta(node *Inode) ([]byte, error) {
+	if node.IsPacked() {
+		rec, err := fs.packedRecord(node)
+		if err != nil {
+			return nil, err
+		}
+		return rec[:node.MetaSize], nil
+	}
+	block, size := node.DirectPointers[0], uint32(node.MetaSize)
+	if node.HasMetaBlock() {
+		ref, err := fs.readMetaRef(node)
+		if err != nil {
+			return nil, err
+		}
+		block, size = ref.Block, ref.Size
+	}
+	data := make([]byte, size)
+	if _, _, err := fs.readBlock(block, 0, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (fs *FileSystem) readMetaRef(node *Inode) (metaRef, error) {
+	ref := metaRef{}
+	data := make([]byte, binary.Size(ref))
+	if _, _, err := fs.readBlock(node.DirectPointers[0], 0, data); err != nil {
+		return ref, err
+	}
+	ref.Block = binary.LittleEndian.Uint32(data)
+	ref.Size = binary.LittleEndian.Uint32(data[4:])
+	if ref.Block == 0 || ref.Size == 0 || ref.Size >= fs.Smeta.BlockSize {
+		return ref, errors.New("Bad meta reference")
+	}
+	return ref, nil
+}
+
+// stageBlock writes data to the block at offset when tx commits, for block
+// content that must change atomically with the inode.
+func (fs *FileSystem) stageBlock(tx *txn, blkptr uint32, data []byte, offset int) error {
+	idx, group, _ := EntAddr(blkptr).GetAddr()
+	if group < 1 || group > fs.groupCount() {
+		return BAD_GID
+	}
+	tx.write(group-1, fs.geo.BlockOffset+int64(idx)*int64(fs.Smeta.BlockSize)+int64(offset), data)
+	return nil
+}
+
+// storeMeta replaces the encoded meta of inode with mbuff. The meta stays in
+// front of the data while it fits there, otherwise it moves to a block of
+// its own and a metaRef takes its place, so the data never moves.
+func (fs *FileSystem) storeMeta(tx *txn, inodeptr uint32, inode *Inode, mbuff []byte) error {
+	if inode.IsPacked() {
+		rec, err := fs.packedRecord(inode)
+		if err != nil {
+			return err
+		}
+		return fs.repack(tx, inodeptr, inode, mbuff, rec[inode.MetaSize:])
+	}
+	if !inode.HasMetaBlock() && len(mbuff) <= int(inode.MetaSize) {
+		data := make([]byte, inode.MetaSize)
+		copy(data, mbuff)
+		return fs.stageBlock(tx, inode.DirectPointers[0], data, 0)
+	}
+	var ref metaRef
+	if inode.HasMetaBlock() {
+		var err error
+		if ref, err = fs.readMetaRef(inode); err != nil {
+			return err
+		}
+		if err := fs.stageBlock(tx, ref.Block, mbuff, 0); err != nil {
+			return err
+		}
+	} else {
+		blks, _, err := fs.allocBlocks(tx, 1, 1, false)
+		if err != nil {
+			return err
+		}
+		// a new block, nothing refers to it before tx commits
+		if _, _, err := fs.writeBlock(blks[0], mbuff, 0); err != nil {
+			return err
+		}
+		ref.Block = blks[0]
+		inode.Attr |= 1 << InodeAttrMetaBlock
+		if err := fs.syncInode(tx, inodeptr, inode); err != nil {
+			return err
+		}
+	}
+	ref.Size = uint32(len(mbuff))
+	data := make([]byte, binary.Size(ref))
+	binary.LittleEndian.PutUint32(data, ref.Block)
+	binary.LittleEndian.PutUint32(data[4:], ref.Size)
+	return fs.stageBlock(tx, inode.DirectPointers[0], data, 0)
+}
+
+// UpdateMeta replaces the name and the meta of a file, the uid stays the
+// same. The encoded length of both must be less than the size of a block,
+// as for CreateFile. Opened handles keep the meta they were opened with.
+//
+// Parameters:
+//   - uid: The unique identifier of the file.
+//   - name: The new name of the file.
+//   - meta: The new metadata of the file.
+//
+// Returns:
+//   - error: Any error that occurred, the meta is unchanged in that case.
+func (fs *FileSystem) UpdateMeta(uid string, name string, meta []byte) error {
+	if err := fs.writable("UpdateMeta"); err != nil {
+		return err
+	}
+	if len(meta) > MaxFileMetaSize {
+		return errors.New("meta overlimit")
+	}
+	m := FileMeta{Name: name, ExtMetas: meta}
+	mbuff, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	if len(mbuff) >= int(fs.Smeta.BlockSize) {
+		return errors.New("File meta overlimit")
+	}
+	key := FileKey{}
+	if err := fs.parseUid(&key, uid); err != nil {
+		return err
+	}
+	lock := fs.inodeLock(key.Inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
+	if !fs.isValidInode(key.Inodeptr) {
+		return FNF
+	}
+	inode, err := fs.readInode(key.Inodeptr)
+	if err != nil {
+		return FNF
+	}
+	if fs.inode2Uid(key.Inodeptr, inode) != uid {
+		return FNF
+	}
+	if inode.IsQuarantined() {
+		return ErrQuarantined
+	}
+	if inode.IsDir() {
+		return ErrIsDir
+	}
+	if inode.IsFrozen() {
+		return FNF
+	}
+	var ops []nameOp
+	if old, err := fs.loadMeta(inode); err != nil {
+		return err
+	} else if old.Name != name {
+		ops = append(ops, nameOp{nameDel, old.Name, uid}, nameOp{nameAdd, name, uid})
+	}
+	tx := fs.beginTx()
+	if err := fs.storeMeta(tx, key.Inodeptr, inode, mbuff); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	return fs.commitNames(tx, ops...)
+}
+
 // OpenFile opens a file in the file system using the specified unique ID (uid).
 // It retrieves the corresponding Vfile instance, allowing for file operations such
 // as reading, writing, and seeking.
@@ -938,8 +1419,17 @@ func (fs *FileSystem) loadMeta(node *Inode) (FileMeta, error) {
 //   - error: An error if the file could not be opened (e.g., if the file does
 //     not exist or if there are permission issues).
 func (fs *FileSystem) OpenFile(uid string) (*Vfile, error) {
+	return fs.openFile(uid, false)
+}
+
+// openFile opens the file uid, or the file uid frozen by a snapshot when
+// frozen is set. The handle of a frozen file is read-only.
+func (fs *FileSystem) openFile(uid string, frozen bool) (*Vfile, error) {
+	if err := fs.alive(); err != nil {
+		return nil, err
+	}
 	key := FileKey{}
-	if err := key.ParseKey(uid); err != nil {
+	if err := fs.parseUid(&key, uid); err != nil {
 		return nil, err
 	}
 	vf := Vfile{
@@ -947,6 +1437,12 @@ func (fs *FileSystem) OpenFile(uid string) (*Vfile, error) {
 		Meta: new(FileMeta),
 	}
 
+	lock := fs.inodeLock(key.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if !fs.isValidInode(key.Inodeptr) {
+		return nil, FNF
+	}
 	inode, err := fs.readInode(key.Inodeptr)
 	if err != nil {
 		return nil, FNF
@@ -956,10 +1452,20 @@ func (fs *FileSystem) OpenFile(uid string) (*Vfile, error) {
 		return nil, FNF
 	}
 
-	vf.Inodeptr = key.Inodeptr
-	vf.Inode = inode
-	if inode.MetaSize > uint16(fs.Smeta.BlockSize) {
-		return nil, errors.New("Bad meta size")
+	if inode.IsQuarantined() {
+		return nil, ErrQuarantined
+	}
+	if inode.IsDir() {
+		return nil, ErrIsDir
+	}
+	if inode.IsFrozen() != frozen {
+		return nil, FNF
+	}
+	vf.Inodeptr = key.Inodeptr
+	vf.Inode = inode
+	vf.readOnly = frozen
+	if uint32(inode.MetaSize) > fs.Smeta.BlockSize {
+		return nil, errors.New("Bad meta size")
 	}
 	vf.offset.blkRemOffset = int(inode.MetaSize)
 
@@ -968,7 +1474,7 @@ func (fs *FileSystem) OpenFile(uid string) (*Vfile, error) {
 		return nil, err
 	}
 	vf.Meta = &meta
-	logrus.Debugf("Open file [inode:%d , size:%d,name:%s,block:%d,indirect<%d,%d,%d> blocks:%v]",
+	fs.log.Debugf("Open file [inode:%d , size:%d,name:%s,block:%d,indirect<%d,%d,%d> blocks:%v]",
 		key.Inodeptr, vf.Inode.FileSize, vf.Meta.Name, vf.Inode.Blocks,
 		vf.Inode.SingleIndirect, vf.Inode.DoubleIndirect, vf.Inode.TripleIndirect, vf.Inode.DirectPointers)
 
@@ -981,7 +1487,10 @@ type VfileOffset struct {
 	blkRemOffset int
 }
 
+// Vfile is a handle of an opened file. A handle may be shared by several
+// goroutines, its methods are serialized by the handle lock.
 type Vfile struct {
+	lock     sync.Mutex
 	FileId   uint64
 	Meta     *FileMeta
 	fs       *FileSystem
@@ -989,130 +1498,43 @@ type Vfile struct {
 	Inode    *Inode
 	offset   VfileOffset
 	vols     []uint32
+	tx       *txn // metadata transaction of the running write
+	readOnly bool
 }
 
-func (vf *Vfile) allocBlocks(numBlocks int, hlimit int, bigAlloc bool) ([]uint32, int, error) {
-	blks, n, err := vf.fs.allocBlocks(numBlocks, hlimit, bigAlloc)
-	for _, v := range blks {
-		_, group, _ := EntAddr(v).GetAddr()
-		AddUnique(&vf.vols, group)
+// reload refreshes the cached inode so that changes made through other
+// handles of the same file become visible. It returns FNF once the file
+// has been deleted. The inode lock must be held.
+func (vf *Vfile) reload() error {
+	if !vf.fs.isValidInode(vf.Inodeptr) {
+		return FNF
 	}
-	return blks, n, err
-}
-
-func (vf *Vfile) readFromIndirect(blockptr uint32, blockIndex uint32, data []byte, depth int) (int, error) {
-	blkIdx := blockIndex / uint32(pow(BlockPointers, depth-1))
-	blockptrs := make([]uint32, BlockPointers)
-	err := vf.fs.readPointerWithCache(blockptr, blockptrs, 0, depth)
+	node, err := vf.fs.readInode(vf.Inodeptr)
 	if err != nil {
-		return 0, err
-	}
-	totalRdn := 0
-	if depth == 1 {
-		for i := blkIdx; i < uint32(BlockPointers); i++ {
-			rdn, left, err := vf.fs.readBlock(blockptrs[i], vf.offset.blkRemOffset, data[totalRdn:])
-			if err != nil {
-				return rdn, err
-			}
-			if left == 0 {
-				vf.offset.blockIdx++
-				vf.offset.blkRemOffset = 0
-			} else {
-				vf.offset.blkRemOffset += rdn
-			}
-			totalRdn += rdn
-			if totalRdn >= len(data) {
-				break
-			}
-		}
-		return totalRdn, nil
-	}
-	for i := blkIdx; i < uint32(BlockPointers); i++ {
-		if blockptrs[i] == 0 {
-			return 0, errors.New("read from unallocated block")
-		}
-		var offset uint32 = 0
-		if i == blkIdx {
-			offset = blockIndex % uint32(pow(BlockPointers, depth-1))
-		}
-		rdn, err := vf.readFromIndirect(blockptrs[i], offset, data[totalRdn:], depth-1)
-		if err != nil {
-			return totalRdn, err
-		}
-		totalRdn += rdn
-		if totalRdn >= len(data) {
-			break
-		}
+		return err
 	}
-	return totalRdn, nil
-}
-
-func (vf *Vfile) aliginBlock(size int) int {
-	return (size + int(vf.fs.Smeta.BlockSize) - 1) / int(vf.fs.Smeta.BlockSize)
-}
-
-func (vf *Vfile) readIndirectBlocks(blockIndex uint32, data []byte) (int, error) {
-	levels := []struct {
-		blkptr    *uint32
-		indirects int
-	}{
-		{&vf.Inode.SingleIndirect, SingleIndirectLv},
-		{&vf.Inode.DoubleIndirect, DoubleIndirectLv},
-		{&vf.Inode.TripleIndirect, TripleIndirectLv},
+	if node.Seq != vf.Inode.Seq || node.CTime != vf.Inode.CTime {
+		return FNF
 	}
-	for _, level := range levels {
-		if blockIndex < uint32(pow(BlockPointers, level.indirects)) {
-			if *level.blkptr == 0 {
-				return 0, errors.New("bad indirect block id")
-			}
-			return vf.readFromIndirect(*level.blkptr, blockIndex, data, level.indirects)
-		}
-		if level.indirects != TripleIndirectLv {
-			blockIndex -= uint32(pow(BlockPointers, level.indirects))
-		}
+	if *node != *vf.Inode {
+		// the slots may have moved, find the position again
+		*vf.Inode = *node
+		_, err = vf.seekPos(vf.offset.offset)
 	}
-	return 0, errors.New("system full")
+	return err
 }
 
-func (vf *Vfile) escapeBlock(ptr uint32, depth int, pos int64) (bool, error) {
-	blockptrs := make([]uint32, BlockPointers)
-	err := vf.fs.readPointer(ptr, blockptrs, 0)
-	if err != nil {
-		return false, err
+func (vf *Vfile) allocBlocks(numBlocks int, hlimit int, bigAlloc bool) ([]uint32, int, error) {
+	blks, n, err := vf.fs.allocBlocks(vf.tx, numBlocks, hlimit, bigAlloc)
+	if vf.Inode.HasExtents() {
+		// a slot of an extent file is one block
+		blks = expandBig(blks)
 	}
-	if depth == 1 {
-		for _, v := range blockptrs {
-			if v == 0 {
-				return false, io.EOF
-			}
-			_, _, isBig := EntAddr(v).GetAddr()
-			blksize := int64(vf.fs.Smeta.BlockSize)
-			if isBig > 0 {
-				blksize = 64 * int64(vf.fs.Smeta.BlockSize)
-			}
-			vf.offset.blockIdx++
-			if vf.offset.offset+blksize > pos {
-				vf.offset.blkRemOffset = int(pos - vf.offset.offset)
-				vf.offset.offset += int64(vf.offset.blkRemOffset)
-				return true, nil
-			} else if vf.offset.offset+blksize == pos {
-				vf.offset.blockIdx++ //move to next block boundary
-				vf.offset.offset = pos
-				return true, nil
-			} else {
-				vf.offset.offset += blksize
-			}
-		}
-
-	} else {
-		for _, v := range blockptrs {
-			ok, err := vf.escapeBlock(v, depth-1, pos)
-			if err != nil || ok {
-				return ok, err
-			}
-		}
+	for _, v := range blks {
+		_, group, _ := EntAddr(v).GetAddr()
+		AddUnique(&vf.vols, group)
 	}
-	return false, nil
+	return blks, n, err
 }
 
 // SeekPos sets the current position of the Vfile to the specified offset.
@@ -1120,68 +1542,59 @@ func (vf *Vfile) escapeBlock(ptr uint32, depth int, pos int64) (bool, error) {
 // This method allows random access to the file, enabling reading or writing
 // from a specific position.
 // For better performance when frequently seeking, it is recommended to use the GetOffset method to retrieve the actual address of the offset after seeking.
-// Note that after calling GetOffset, you should use the Seek method to set the file pointer to the actual position.
+// Note that after calling GetOffset, you should use the SeekOffset method to set the file pointer to the actual position.
 //
 // Parameters:
-//   - pos: The new position (offset) in the file, in bytes. This can be
-//     any valid offset within the file's size.
+//   - pos: The new position (offset) in the file, in bytes. It may lie
+//     beyond the end of file, a write there leaves a hole in between
+//     that reads back as zeros.
 //
 // Returns:
 //   - VfileOffset: The new position of the file after seeking.
 //   - error: Any error that occurred during the seek operation. If successful,
 //     error will be nil.
 func (vf *Vfile) SeekPos(pos int64) (VfileOffset, error) {
-	if pos >= int64(vf.Inode.FileSize) {
-		vf.offset.offset = int64(vf.Inode.FileSize)
-		vf.offset.blockIdx = vf.Inode.Blocks - 1
-		vf.offset.blkRemOffset = int(vf.Inode.DataSize() % uint64(vf.fs.Smeta.BlockSize))
-	}
-	vf.offset.blkRemOffset = int(vf.Inode.MetaSize)
-	vf.offset.offset = 0
-	vf.offset.blockIdx = 0
-	for i := vf.offset.blockIdx; i < DirectBlocks; i++ {
-		if vf.Inode.DirectPointers[i] == 0 {
-			return vf.offset, nil
-		}
-		vf.offset.blockIdx = i
-		_, _, isBig := EntAddr(vf.Inode.DirectPointers[i]).GetAddr()
-		blksize := int64(vf.fs.Smeta.BlockSize)
-		if isBig > 0 {
-			blksize = 64 * int64(vf.fs.Smeta.BlockSize)
-		}
-		if vf.offset.blkRemOffset != 0 { //first block
-			blksize -= int64(vf.offset.blkRemOffset)
-		}
-		if vf.offset.offset+blksize > pos {
-			vf.offset.blkRemOffset += int(pos - vf.offset.offset)
-			vf.offset.offset = pos
-			return vf.offset, nil
-		} else if vf.offset.offset+blksize == pos {
-			vf.offset.blkRemOffset = 0
-			vf.offset.blockIdx += 1 //base 0
-			vf.offset.offset = pos
-			return vf.offset, nil
-		} else {
-			vf.offset.offset += blksize
-			vf.offset.blkRemOffset = 0
-		}
+	if pos < 0 {
+		return vf.GetOffset(), errors.New("negative position")
+	}
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if err := vf.reload(); err != nil {
+		return vf.offset, err
+	}
+	return vf.seekPos(pos)
+}
+
+func (vf *Vfile) seekPos(pos int64) (VfileOffset, error) {
+	off, err := vf.fs.seekOffset(vf.tx, vf.Inode, pos)
+	if err != nil {
+		return vf.offset, err
 	}
-	//seek indirect
-	levels := []struct {
-		blkptr    uint32
-		indirects int
-	}{
-		{vf.Inode.SingleIndirect, SingleIndirectLv},
-		{vf.Inode.DoubleIndirect, DoubleIndirectLv},
-		{vf.Inode.TripleIndirect, TripleIndirectLv},
-	}
-	for _, level := range levels {
-		ok, err := vf.escapeBlock(level.blkptr, level.indirects, pos)
-		if err != nil || ok {
-			return vf.offset, err
-		}
+	vf.offset = off
+	return vf.offset, nil
+}
+
+// seekOffset returns the offset of the file position pos.
+func (fs *FileSystem) seekOffset(tx *txn, inode *Inode, pos int64) (VfileOffset, error) {
+	if inode.Codec() != CodecNone {
+		return VfileOffset{offset: pos}, nil
+	}
+	if inode.IsPacked() || inode.IsInline() {
+		return fs.packedOffset(inode, pos), nil
+	}
+	return fs.slotOffset(tx, inode, pos)
+}
+
+// slotOffset returns the offset of the position pos of the data stream.
+func (fs *FileSystem) slotOffset(tx *txn, inode *Inode, pos int64) (VfileOffset, error) {
+	slot, off, _, err := fs.locateSlot(tx, inode, int64(inode.MetaSize)+pos)
+	if err != nil {
+		return VfileOffset{}, err
 	}
-	return vf.offset, errors.New("system error")
+	return VfileOffset{offset: pos, blockIdx: uint32(slot), blkRemOffset: int(off)}, nil
 }
 
 // GetOffset retrieves the current offset of the Vfile.
@@ -1189,10 +1602,12 @@ func (vf *Vfile) SeekPos(pos int64) (VfileOffset, error) {
 // This method is useful for tracking the current read/write position
 // within the file without modifying it.
 func (vf *Vfile) GetOffset() VfileOffset {
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
 	return vf.offset
 }
 
-// Seek sets the current offset of the Vfile to the specified value.
+// SeekOffset sets the current offset of the Vfile to the specified value.
 // It updates the file's position for subsequent read or write operations.
 // This method allows you to move the file pointer to any valid position
 // within the file, facilitating random access.
@@ -1200,7 +1615,11 @@ func (vf *Vfile) GetOffset() VfileOffset {
 // Parameters:
 //   - off: The new offset to set, represented as a VfileOffset value.
 //     This value is typically obtained by calling the GetOffset method.
-func (vf *Vfile) Seek(off VfileOffset) {
+//
+// SeekOffset was named Seek before Vfile implemented io.Seeker.
+func (vf *Vfile) SeekOffset(off VfileOffset) {
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
 	vf.offset = off
 }
 
@@ -1215,51 +1634,74 @@ func (vf *Vfile) Seek(off VfileOffset) {
 // - int: The number of bytes actually read.
 // - error: Any error that occurred during the read operation. If successful, error will be nil.
 func (vf *Vfile) Read(data []byte) (int, error) {
-	if uint64(vf.offset.offset) >= vf.Inode.FileSize {
-		return 0, io.EOF
+	if err := vf.fs.alive(); err != nil {
+		return 0, err
 	}
-	if uint64(vf.offset.offset+int64(len(data))) > vf.Inode.FileSize {
-		data = data[:vf.Inode.FileSize-uint64(vf.offset.offset)]
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if err := vf.reload(); err != nil {
+		return 0, err
 	}
+	return vf.fs.readData(vf.tx, vf.Inode, &vf.offset, data)
+}
 
-	rdn := 0
-	for i := vf.offset.blockIdx; i < DirectBlocks; i++ {
-		if vf.Inode.DirectPointers[i] == 0 {
-			break
-		}
-		rd, left, err := vf.fs.readBlock(vf.Inode.DirectPointers[i], vf.offset.blkRemOffset, data[rdn:])
-		vf.offset.blockIdx = i
-		if left == 0 {
-			vf.offset.blockIdx++
-			vf.offset.blkRemOffset = 0
-		} else {
-			vf.offset.blkRemOffset += rd
-		}
-		if err != nil {
-			return rd, err
-		}
-		rdn += rd
-		if rdn == len(data) {
-			break
-		}
+// readData reads data of inode at cur.
+func (fs *FileSystem) readData(tx *txn, inode *Inode, cur *VfileOffset, data []byte) (int, error) {
+	if inode.IsPacked() {
+		return fs.readPacked(inode, cur, data)
+	}
+	if inode.IsInline() {
+		return fs.readInline(inode, cur, data)
 	}
+	if inode.Codec() != CodecNone {
+		return fs.readChunks(tx, inode, cur, data)
+	}
+	return fs.readSlots(tx, inode, cur, data)
+}
+
+// readSlots reads the data stream of inode at cur.
+func (fs *FileSystem) readSlots(tx *txn, inode *Inode, cur *VfileOffset, data []byte) (int, error) {
+	if uint64(cur.offset) >= inode.FileSize {
+		return 0, io.EOF
+	}
+	if uint64(cur.offset+int64(len(data))) > inode.FileSize {
+		data = data[:inode.FileSize-uint64(cur.offset)]
+	}
+	slots := fs.newSlotReader(tx, inode)
+	rdn := 0
 	for rdn < len(data) {
-		blockIdx := vf.offset.blockIdx - DirectBlocks
-		rd, err := vf.readIndirectBlocks(blockIdx, data[rdn:])
+		ptr, err := slots.get(int(cur.blockIdx))
 		if err != nil {
 			return rdn, err
 		}
-		if rd == 0 {
-			logrus.Errorf("read indirect blocks return zero length")
-			break
+		n := int(fs.slotSize(ptr)) - cur.blkRemOffset
+		if n > len(data)-rdn {
+			n = len(data) - rdn
 		}
-		rdn += rd
-		logrus.Debugf("read indirect blocks, len:%d,total:%d, err:%v\n", rd, rdn, err)
+		if ptr == 0 {
+			clear(data[rdn : rdn+n])
+		} else if _, _, err := fs.readBlock(ptr, cur.blkRemOffset, data[rdn:rdn+n]); err != nil {
+			return rdn, err
+		}
+		fs.advance(cur, ptr, n)
+		rdn += n
 	}
-	vf.offset.offset += int64(rdn)
 	return rdn, nil
 }
 
+// advance moves cur n bytes forward in the slot of ptr.
+func (fs *FileSystem) advance(cur *VfileOffset, ptr uint32, n int) {
+	cur.offset += int64(n)
+	cur.blkRemOffset += n
+	if int64(cur.blkRemOffset) == fs.slotSize(ptr) {
+		cur.blockIdx++
+		cur.blkRemOffset = 0
+	}
+}
+
 // Write writes the provided byte slice to the Vfile.
 // It returns the number of bytes written and any error encountered.
 // The method writes up to len(data) bytes, potentially overwriting existing content in the file.
@@ -1270,81 +1712,361 @@ func (vf *Vfile) Read(data []byte) (int, error) {
 // Returns:
 // - int: The number of bytes successfully written to the file.
 // - error: Any error that occurred during the write operation. If successful, error will be nil.
-func (vf *Vfile) Write(data []byte) (totalWtn int, err error) {
+func (vf *Vfile) Write(data []byte) (int, error) {
+	if vf.Inode == nil {
+		return 0, errors.New("Invalid inode")
+	}
+	if err := vf.fs.writable("Write"); err != nil {
+		return 0, err
+	}
+	if vf.readOnly {
+		return 0, ErrReadOnly
+	}
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := vf.reload(); err != nil {
+		return 0, err
+	}
+	offset := vf.offset
+	wtn, err := vf.writeTx(&vf.offset, data)
+	if err != nil {
+		// the metadata of the write is rolled back, so is the stream position
+		vf.offset = offset
+		if rerr := vf.reload(); rerr != nil {
+			return 0, rerr
+		}
+		return 0, err
+	}
+	return wtn, nil
+}
+
+// writeTx writes data at cur in a transaction of its own.
+func (vf *Vfile) writeTx(cur *VfileOffset, data []byte) (int, error) {
+	vf.tx = vf.fs.beginTx()
+	defer func() { vf.tx = nil }()
+	wtn, err := vf.write(cur, data)
+	if err != nil {
+		vf.fs.abortTx(vf.tx)
+		return 0, err
+	}
+	if err := vf.fs.commitTx(vf.tx); err != nil {
+		return 0, err
+	}
+	return wtn, nil
+}
+
+// ReadAt reads len(data) bytes from the file starting at byte offset off,
+// it implements io.ReaderAt. The position of the handle is not used nor
+// changed, so that ReadAt may run in parallel with other calls on the same
+// handle.
+//
+// Parameters:
+//   - data: A byte slice into which the file's data will be read.
+//   - off: The position in the file to read from.
+//
+// Returns:
+//   - int: The number of bytes read.
+//   - error: io.EOF when fewer than len(data) bytes were read because the
+//     end of file was reached, or any other error of the read.
+func (vf *Vfile) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if err := vf.fs.alive(); err != nil {
+		return 0, err
+	}
+	vf.lock.Lock()
 	if vf.Inode == nil {
+		vf.lock.Unlock()
 		return 0, errors.New("Invalid inode")
 	}
-	for vf.offset.blockIdx < DirectBlocks { //overwrite
-		if vf.Inode.DirectPointers[vf.offset.blockIdx] != 0 {
-			wtn, broff, err := vf.fs.writeBlock(vf.Inode.DirectPointers[vf.offset.blockIdx], data, vf.offset.blkRemOffset)
+	seq, ctime := vf.Inode.Seq, vf.Inode.CTime
+	vf.lock.Unlock()
+
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if !vf.fs.isValidInode(vf.Inodeptr) {
+		return 0, FNF
+	}
+	node, err := vf.fs.readInode(vf.Inodeptr)
+	if err != nil {
+		return 0, err
+	}
+	if node.Seq != seq || node.CTime != ctime {
+		return 0, FNF
+	}
+	cur, err := vf.fs.seekOffset(nil, node, off)
+	if err != nil {
+		return 0, err
+	}
+	rdn, err := vf.fs.readData(nil, node, &cur, data)
+	if err == nil && rdn < len(data) {
+		err = io.EOF
+	}
+	return rdn, err
+}
+
+// WriteAt writes data to the file starting at byte offset off, it
+// implements io.WriterAt. The position of the handle is not changed. Writing
+// beyond the end of file leaves a hole in between.
+//
+// Parameters:
+//   - data: A byte slice containing the data to be written to the file.
+//   - off: The position in the file to write to.
+//
+// Returns:
+//   - int: The number of bytes written, len(data) unless error is set.
+//   - error: Any error that occurred, nothing is written in that case.
+func (vf *Vfile) WriteAt(data []byte, off int64) (int, error) {
+	if err := vf.fs.writable("WriteAt"); err != nil {
+		return 0, err
+	}
+	if vf.readOnly {
+		return 0, ErrReadOnly
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	if vf.Inode == nil {
+		return 0, errors.New("Invalid inode")
+	}
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := vf.reload(); err != nil {
+		return 0, err
+	}
+	cur, err := vf.fs.seekOffset(nil, vf.Inode, off)
+	if err != nil {
+		return 0, err
+	}
+	blocks := vf.Inode.Blocks
+	wtn, err := vf.writeTx(&cur, data)
+	if err != nil {
+		if rerr := vf.reload(); rerr != nil {
+			return 0, rerr
+		}
+		return 0, err
+	}
+	if vf.Inode.Blocks != blocks && vf.offset.offset > off {
+		// new blocks may have moved the slots behind the write
+		_, err = vf.seekPos(vf.offset.offset)
+	}
+	return wtn, err
+}
+
+// Seek sets the position of the handle for the next Read or Write, it
+// implements io.Seeker. The position may lie beyond the end of file. The
+// former Seek(VfileOffset) is SeekOffset.
+//
+// Parameters:
+//   - offset: The offset relative to whence.
+//   - whence: io.SeekStart, io.SeekCurrent or io.SeekEnd.
+//
+// Returns:
+//   - int64: The new position relative to the start of the file.
+//   - error: Any error that occurred, the position is unchanged in that case.
+func (vf *Vfile) Seek(offset int64, whence int) (int64, error) {
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	if err := vf.reload(); err != nil {
+		return vf.offset.offset, err
+	}
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = vf.offset.offset + offset
+	case io.SeekEnd:
+		size, err := vf.fs.fileSize(nil, vf.Inode)
+		if err != nil {
+			return vf.offset.offset, err
+		}
+		pos = size + offset
+	default:
+		return vf.offset.offset, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return vf.offset.offset, errors.New("negative position")
+	}
+	if pos != vf.offset.offset {
+		if _, err := vf.seekPos(pos); err != nil {
+			return vf.offset.offset, err
+		}
+	}
+	return pos, nil
+}
+
+// Size returns the size of the file in bytes. The size last seen is
+// returned once the file has been deleted.
+func (vf *Vfile) Size() int64 {
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.RLock()
+	defer lock.RUnlock()
+	vf.reload()
+	size, err := vf.fs.fileSize(nil, vf.Inode)
+	if err != nil {
+		return int64(vf.Inode.FileSize)
+	}
+	return size
+}
+
+// write writes data at cur.
+func (vf *Vfile) write(cur *VfileOffset, data []byte) (int, error) {
+	if vf.Inode.IsPacked() {
+		return vf.writePacked(cur, data)
+	}
+	if vf.Inode.IsInline() {
+		return vf.writeInline(cur, data)
+	}
+	if vf.Inode.Codec() != CodecNone {
+		return vf.writeChunks(cur, data)
+	}
+	return vf.writeSlots(cur, data)
+}
+
+// writeSlots writes the data stream at cur. A hole written to gets a block of
+// its own, the slots behind the last block are allocated in batches with big
+// blocks. Bytes of a new block covered by the file but not by data are zeroed.
+func (vf *Vfile) writeSlots(cur *VfileOffset, data []byte) (int, error) {
+	fs := vf.fs
+	end := uint64(cur.offset) + uint64(len(data))
+	size := vf.Inode.FileSize
+	if end > size {
+		size = end
+	}
+	if uint64(cur.offset) > vf.Inode.FileSize {
+		if err := vf.zeroTail(int64(vf.Inode.FileSize), cur.offset); err != nil {
+			return 0, err
+		}
+	}
+	last, err := fs.lastSlot(vf.tx, vf.Inode)
+	if err != nil {
+		return 0, err
+	}
+	slots := fs.newSlotReader(vf.tx, vf.Inode)
+	fresh, freshEnd := 0, 0 //slots allocated by the last batch
+	dedup := fs.dedupFile(vf.Inodeptr, vf.Inode)
+	bs := int(fs.Smeta.BlockSize)
+	wtn := 0
+	for wtn < len(data) {
+		slot := int(cur.blockIdx)
+		var ptr uint32
+		if slot <= last {
+			if ptr, err = slots.get(slot); err != nil {
+				return wtn, err
+			}
+		}
+		var sum blockHash
+		full := dedup && cur.blkRemOffset == 0 && len(data)-wtn >= bs
+		if full {
+			sum = hashBlock(data[wtn : wtn+bs])
+			shared, err := fs.shareBlock(vf.tx, sum, data[wtn:wtn+bs], ptr)
 			if err != nil {
-				return totalWtn, err
+				return wtn, err
 			}
-			totalWtn += wtn
-			data = data[wtn:]
-			vf.Inode.FileSize += uint64(wtn)
-			vf.offset.offset += int64(wtn)
-			vf.offset.blkRemOffset = broff
-			if broff == 0 {
-				vf.offset.blockIdx++
+			if shared != 0 && shared != ptr {
+				if err := fs.storeSlots(vf.tx, vf.Inode, slot, []uint32{shared}); err != nil {
+					return wtn, err
+				}
+				slots.set(slot, []uint32{shared})
+				if ptr == 0 {
+					vf.Inode.Blocks++
+					last = max(last, slot)
+				} else if err := fs.releaseDataBlock(vf.tx, []uint32{ptr}); err != nil {
+					return wtn, err
+				}
 			}
-			if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-				return 0, err
+			if shared != 0 {
+				fs.advance(cur, shared, bs)
+				wtn += bs
+				continue
 			}
-		} else {
-			allocNum := vf.aliginBlock(len(data))
-			nb, batch, err := vf.allocBlocks(allocNum, int(DirectBlocks-vf.offset.blockIdx), true)
+		}
+		if ptr == 0 {
+			num, limit, big := 1, 1, false
+			if slot > last && cur.blkRemOffset == 0 && !dedup {
+				num = (len(data) - wtn + bs - 1) / bs
+				limit, big = num, true
+			}
+			blks, _, err := vf.allocBlocks(num, limit, big)
 			if err != nil {
-				return totalWtn, err
+				return wtn, err
 			}
-			allocNum -= batch
-			for i := 0; i < len(nb); i++ {
-				vf.Inode.DirectPointers[vf.offset.blockIdx] = nb[i]
-				if wtn, broff, err := vf.fs.writeBlock(nb[i], data, 0); err != nil {
-					return 0, err
-				} else {
-					data = data[wtn:]
-					vf.Inode.FileSize += uint64(wtn)
-					vf.Inode.Blocks++
-					totalWtn += wtn
-					//update offset
-					vf.offset.offset += int64(wtn)
-					vf.offset.blkRemOffset = broff
-					if broff == 0 {
-						vf.offset.blockIdx++
-					}
-				}
+			if err := fs.storeSlots(vf.tx, vf.Inode, slot, blks); err != nil {
+				return wtn, err
+			}
+			slots.set(slot, blks)
+			vf.Inode.Blocks += uint32(len(blks))
+			fresh, freshEnd = slot, slot+len(blks)
+			if freshEnd > last {
+				last = freshEnd - 1
 			}
-			if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-				return 0, err
+			ptr = blks[0]
+		} else if fs.dedup != nil && (slot < fresh || slot >= freshEnd) {
+			// a shared block is copied before it is written
+			if ptr, err = fs.ownBlock(vf.tx, vf.Inode, slot, ptr); err != nil {
+				return wtn, err
 			}
+			slots.set(slot, []uint32{ptr})
+		}
+		n := int(fs.slotSize(ptr)) - cur.blkRemOffset
+		if n > len(data)-wtn {
+			n = len(data) - wtn
+		}
+		if slot >= fresh && slot < freshEnd {
+			// a new block is written from its start up to the end of the
+			// last block the file covers, so none of its stale bytes is read
+			bs := int64(fs.Smeta.BlockSize)
+			tail := int64(cur.blkRemOffset) + int64(size) - cur.offset
+			tail = min((tail+bs-1)/bs*bs, fs.slotSize(ptr))
+			buf := make([]byte, tail)
+			copy(buf[cur.blkRemOffset:], data[wtn:wtn+n])
+			if _, _, err := fs.writeBlock(ptr, buf, 0); err != nil {
+				return wtn, err
+			}
+		} else if _, _, err := fs.writeBlock(ptr, data[wtn:wtn+n], cur.blkRemOffset); err != nil {
+			return wtn, err
 		}
-		if len(data) == 0 {
-			return totalWtn, nil
+		if full {
+			fs.indexBlock(vf.tx, ptr, sum)
 		}
+		fs.advance(cur, ptr, n)
+		wtn += n
 	}
-	for len(data) > 0 {
-		if vf.offset.blockIdx < DirectBlocks {
-			return totalWtn, errors.New("Inner err,Wrong inode.Blocks ")
-		}
-		wtn, err := vf.writeIndirectBlocks(vf.offset.blockIdx-DirectBlocks, data)
-		if err != nil {
-			return totalWtn, err
-		}
-		if wtn == 0 {
-			logrus.Errorf("write indirect blocks return zero length")
-			break
+	vf.Inode.FileSize = size
+	return wtn, fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
+}
+
+// zeroTail zeroes the stale bytes behind the end of file `from` up to `to` in
+// the block holding the end of file, they belong to the file once it grows.
+func (vf *Vfile) zeroTail(from, to int64) error {
+	slot, off, ptr, err := vf.fs.locateSlot(vf.tx, vf.Inode, int64(vf.Inode.MetaSize)+from)
+	if err != nil || ptr == 0 {
+		return err
+	}
+	if vf.fs.dedup != nil {
+		if ptr, err = vf.fs.ownBlock(vf.tx, vf.Inode, slot, ptr); err != nil {
+			return err
 		}
-		totalWtn += wtn
-		data = data[wtn:]
-		logrus.Debugf("write indirect blocks, len:%d,left:%d,total:%d, err:%v\n", wtn, len(data), totalWtn, err)
 	}
-
-	if len(data) > 0 {
-		return totalWtn, errors.New("Fill system full")
-	} else {
-		return totalWtn, nil
+	end := vf.fs.slotSize(ptr)
+	if n := off + to - from; n < end {
+		end = n
 	}
+	return vf.fs.zeroBlock(ptr, off, end)
 }
 
 // Sync flushes any in-memory data related to the current file to the storage device.
@@ -1353,8 +2075,10 @@ func (vf *Vfile) Write(data []byte) (totalWtn int, err error) {
 // If the system experiences a failure after calling Sync, the data is guaranteed to be written.
 // Returns an error if the synchronization fails.
 func (vf *Vfile) Sync() error {
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
 	for _, g := range vf.vols {
-		if g >= 1 && g <= vf.fs.Smeta.TotalGroups {
+		if g >= 1 && g <= vf.fs.groupCount() {
 			if err := vf.fs.device.volumes[g-1].file.Sync(); err != nil {
 				return err
 			}
@@ -1364,122 +2088,127 @@ func (vf *Vfile) Sync() error {
 	return nil
 }
 
-func (vf *Vfile) writeIndirectBlocks(blockIndex uint32, data []byte) (int, error) {
-	levels := []struct {
-		blkptr    *uint32
-		indirects int
-	}{
-		{&vf.Inode.SingleIndirect, SingleIndirectLv},
-		{&vf.Inode.DoubleIndirect, DoubleIndirectLv},
-		{&vf.Inode.TripleIndirect, TripleIndirectLv},
-	}
-	for _, level := range levels {
-		if blockIndex < uint32(pow(BlockPointers, level.indirects)) {
-			if *level.blkptr == 0 {
-				nb, _, err := vf.fs.allocBlocks(1, 1, false)
-				if err != nil {
-					return 0, err
-				}
-				err = vf.fs.writePointerWithCache(nb[0], make([]uint32, BlockPointers), 0, level.indirects)
-				if err != nil {
-					return 0, err
-				}
-				*(level.blkptr) = nb[0]
-				if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-					return 0, err
-				}
-			}
-			return vf.writeToIndirect(*level.blkptr, blockIndex, data, level.indirects)
-		}
-		if level.indirects != TripleIndirectLv {
-			blockIndex -= uint32(pow(BlockPointers, level.indirects))
-		}
+// Truncate changes the size of the file in place, the uid stays the same.
+// Shrinking releases the trailing data blocks and the indirect blocks left
+// empty, extending leaves the new range as a hole reading back as zeros. The position of the
+// handle is kept, or moved to the new end of file when it lies beyond.
+//
+// Parameters:
+//   - size: The new size of the file in bytes.
+//
+// Returns:
+//   - error: Any error that occurred, the file is unchanged in that case.
+func (vf *Vfile) Truncate(size int64) error {
+	if err := vf.fs.writable("Truncate"); err != nil {
+		return err
 	}
-	return 0, errors.New("system full")
-}
-
-func (vf *Vfile) batchWriteNewBlk(blockptr uint32, blockIndex uint32, data []byte) (int, error) {
-	totalWtn := 0
-	batchLimit := BlockPointers - int(blockIndex)
-	allocNum := vf.aliginBlock(len(data))
-	blks, _, err := vf.allocBlocks(allocNum, batchLimit, true)
-	if err != nil {
-		return totalWtn, err
+	if vf.readOnly {
+		return ErrReadOnly
 	}
-	logrus.Debugf("batch_fill [%d-%d @%d] batchLimit:%d alloc:%d", blockIndex, BlockPointers, blockptr, batchLimit, len(blks))
-	err = vf.fs.writePointerWithCache(blockptr, blks, int(blockIndex), 1)
-	if err != nil {
-		return totalWtn, err
+	if size < 0 {
+		return errors.New("negative size")
 	}
-	for i := 0; i < len(blks); i++ {
-		wtn, broff, err := vf.fs.writeBlock(blks[i], data[totalWtn:], 0)
-		if err != nil {
-			return wtn, err
-		}
-		vf.Inode.FileSize += uint64(wtn)
-		vf.Inode.Blocks++
-		totalWtn += wtn
-		vf.offset.offset += int64(wtn)
-		vf.offset.blkRemOffset = broff
-		if broff == 0 {
-			vf.offset.blockIdx++
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	if vf.Inode == nil {
+		return errors.New("Invalid inode")
+	}
+	lock := vf.fs.inodeLock(vf.Inodeptr)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := vf.reload(); err != nil {
+		return err
+	}
+	cur, err := vf.fs.fileSize(nil, vf.Inode)
+	if err != nil || size == cur {
+		return err
+	}
+	pos := vf.offset.offset
+	if pos > size {
+		pos = size
+	}
+	vf.tx = vf.fs.beginTx()
+	defer func() { vf.tx = nil }()
+	switch {
+	case vf.Inode.IsPacked():
+		err = vf.truncatePacked(size)
+	case vf.Inode.IsInline():
+		err = vf.truncateInline(size)
+	case vf.Inode.Codec() != CodecNone:
+		err = vf.truncateChunks(size)
+	case size < cur:
+		err = vf.shrink(size)
+	default:
+		err = vf.extend(size)
+	}
+	if err == nil {
+		err = vf.fs.commitTx(vf.tx)
+	} else {
+		vf.fs.abortTx(vf.tx)
+	}
+	vf.tx = nil
+	if err != nil {
+		if rerr := vf.reload(); rerr != nil {
+			return rerr
 		}
 	}
-	if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-		return 0, err
+	if _, serr := vf.seekPos(pos); err == nil {
+		err = serr
 	}
-
-	return totalWtn, nil
+	return err
 }
 
-func (vf *Vfile) writeToIndirect(blockptr uint32, blockIndex uint32, data []byte, depth int) (int, error) {
-	if depth == 1 && vf.offset.blockIdx >= vf.Inode.Blocks {
-		return vf.batchWriteNewBlk(blockptr, blockIndex, data)
+// shrink cuts the file to size. A big block holding the new end of file is
+// split into blocks, and the blocks of it behind the end are released. A
+// shared big block is kept whole.
+func (vf *Vfile) shrink(size int64) error {
+	fs := vf.fs
+	slot, off, ptr, err := fs.locateSlot(vf.tx, vf.Inode, int64(vf.Inode.MetaSize)+size-1)
+	if err != nil {
+		return err
 	}
-	if depth == 0 {
-		wtn, bloff, err := vf.fs.writeBlock(blockptr, data, vf.offset.blkRemOffset)
-		if err != nil {
-			return wtn, err
-		}
-		if vf.offset.blkRemOffset == 0 {
-			vf.Inode.Blocks++
-		}
-		vf.offset.offset += int64(wtn)
-		if vf.offset.offset > int64(vf.Inode.FileSize) {
-			vf.Inode.FileSize = uint64(vf.offset.offset)
-		}
-		if bloff == 0 {
-			vf.offset.blockIdx++
+	if err := fs.releaseSlots(vf.tx, vf.Inode, slot+1); err != nil {
+		return err
+	}
+	shared := false
+	if EntAddr(ptr).IsBigBlock() > 0 && fs.dedup != nil {
+		// a block below a shared pointer block is shared as well
+		if slot >= DirectBlocks && !vf.Inode.HasExtents() {
+			if _, _, err := fs.leafBlock(vf.tx, vf.Inode, slot, true); err != nil {
+				return err
+			}
 		}
-		vf.offset.blkRemOffset = bloff
-		if err := vf.fs.syncInode(vf.Inodeptr, vf.Inode); err != nil {
-			return 0, err
+		shared = fs.dedup.shared(ptr)
+	}
+	if idx, group, isBig := EntAddr(ptr).GetAddr(); isBig > 0 && !shared {
+		used := uint32(off/int64(fs.Smeta.BlockSize)) + 1
+		if used < 64 {
+			small := make([]uint32, 64)
+			for i := range small {
+				small[i] = MakeEntAddr(idx+uint32(i), group, false)
+			}
+			if err := fs.releaseDataBlock(vf.tx, small[used:]); err != nil {
+				return err
+			}
+			if err := fs.storeSlots(vf.tx, vf.Inode, slot, small[:used]); err != nil {
+				return err
+			}
 		}
-		return wtn, nil
 	}
-	indirectIndex := blockIndex / uint32(pow(BlockPointers, depth-1))
-
-	blockptrs := make([]uint32, 1)
-	err := vf.fs.readPointerWithCache(blockptr, blockptrs, int(indirectIndex), depth)
-	if err != nil && err != io.EOF {
-		return 0, err
+	blocks, err := fs.usedSlots(vf.tx, vf.Inode)
+	if err != nil {
+		return err
 	}
-	if blockptrs[0] == 0 {
-		nb, _, err := vf.fs.allocBlocks(1, 1, false)
-		if err != nil {
-			return 0, err
-		}
-
-		err = vf.fs.writePointerWithCache(nb[0], make([]uint32, BlockPointers), 0, depth-1)
-		if err != nil {
-			return 0, err
-		}
+	vf.Inode.Blocks = uint32(blocks)
+	vf.Inode.FileSize = uint64(size)
+	return fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
+}
 
-		blockptrs[0] = nb[0]
-		err = vf.fs.writePointerWithCache(blockptr, blockptrs, int(indirectIndex), depth)
-		if err != nil {
-			return 0, err
-		}
+// extend grows the file to size, the new range is a hole.
+func (vf *Vfile) extend(size int64) error {
+	if err := vf.zeroTail(int64(vf.Inode.FileSize), size); err != nil {
+		return err
 	}
-	return vf.writeToIndirect(blockptrs[0], blockIndex%uint32(pow(BlockPointers, depth-1)), data, depth-1)
+	vf.Inode.FileSize = uint64(size)
+	return vf.fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
 }
@@ -0,0 +1,134 @@
+/*
+ grow.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+/*
+  Grow adds block groups to a live depot. The number of groups is part of
+  the super block, which is signed and copied at the head of every volume
+  file, and a volume whose copy differs is rejected when the depot is
+  opened. The copies are therefore rewritten in one journal transaction: a
+  crash leaves either the old copies, or a journal which scanFiles replays
+  before it reads the super block again.
+
+  The group and volume tables are sized for MaxBlockGroupNum when the depot
+  is opened, so growing never moves a group lock or a bitmap in use. A new
+  group starts with empty bitmaps and its volume file is created by its
+  first allocation, signed with the new super block. The volume files of
+  the old groups are created before the transaction, one created after it
+  would keep the old copy.
+
+  A group that EvacuateGroup removed comes back empty, the inodes its files
+  moved out of get their generations back so that no new file takes their
+  uids (see keepHomes).
+
+  TotalGroups is raised with the tree lock, every inode lock and the lock of
+  the name index held, the paths running without them read it through
+  groupCount.
+*/
+
+var ErrBadGroupNum = errors.New("Bad number of block groups")
+
+// Grow adds block groups to the file system, which allocates from the new
+// groups right away. It waits for the file operations in flight.
+//
+// Parameters:
+//   - newGroupNum (uint32): The new number of groups, more than the current
+//     one and at most MaxBlockGroupNum.
+//
+// Returns:
+//   - error: ErrBadGroupNum for a bad number, or an error writing the super
+//     blocks. The file system keeps its groups unless the change reached the
+//     journal.
+func (fs *FileSystem) Grow(newGroupNum uint32) error {
+	if err := fs.writable("Grow"); err != nil {
+		return err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	defer fs.lockInodes()()
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	old := fs.Smeta.TotalGroups
+	if newGroupNum <= old || newGroupNum > MaxBlockGroupNum {
+		return ErrBadGroupNum
+	}
+	smeta, durable, err := fs.commitSuperBlock(newGroupNum)
+	if !durable {
+		return err
+	}
+	fs.device.grow(smeta)
+	atomic.StoreUint32(&fs.Smeta.TotalGroups, newGroupNum)
+	atomic.StoreUint32(&fs.curBlockGroups, old)
+	if err != nil {
+		return err
+	}
+	return fs.keepHomes(old)
+}
+
+// commitSuperBlock rewrites the super block copies of the groups kept by a
+// change to total groups in one journal transaction. It returns the new
+// super block, and whether the change reached the journal. The caller holds
+// the locks Grow takes.
+func (fs *FileSystem) commitSuperBlock(total uint32) (SuperBlock, bool, error) {
+	kept := min(total, fs.Smeta.TotalGroups)
+	for g := uint32(0); g < kept; g++ {
+		if err := fs.device.checkReady(g, &fs.blockGroups[g]); err != nil {
+			return SuperBlock{}, false, err
+		}
+	}
+	smeta := fs.device.smeta
+	smeta.TotalGroups = total
+	smeta.Sign()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, smeta); err != nil {
+		return SuperBlock{}, false, err
+	}
+	recs := make([]*journalRec, kept)
+	for g := range recs {
+		recs[g] = &journalRec{typ: recWrite, group: uint32(g), data: buf.Bytes()}
+	}
+	durable, err := fs.device.journal.commit(recs, func() error {
+		for _, r := range recs {
+			file := fs.device.volumes[r.group].file
+			if _, err := file.WriteAt(r.data, r.offset); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return smeta, durable, err
+}
+
+// groupCount returns the number of block groups, for the paths that may run
+// beside Grow.
+func (fs *FileSystem) groupCount() uint32 {
+	return atomic.LoadUint32(&fs.Smeta.TotalGroups)
+}
@@ -0,0 +1,299 @@
+/*
+ imagebackend.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+  An image holds a header and a slot of a fixed size per volume, the journal
+  first and then the groups up to MaxBlockGroupNum. The header keeps the slot
+  size and the size of every volume, -1 for a missing one. The image is a
+  sparse file, a slot takes the room of the bytes written to it.
+
+  [magic u64][slot size u64][volume size i64]...
+*/
+
+const (
+	imageMagic      = 0x31474D4953465044 // "DPFSIMG1"
+	imageSlots      = MaxBlockGroupNum + 1
+	imageHeaderSize = 16 * 1024
+)
+
+var ErrImageFull = errors.New("Volume exceeds the image slot")
+
+// ImageBackend keeps the volumes of a depot in a single image file.
+type ImageBackend struct {
+	lock  sync.RWMutex
+	file  *os.File
+	slot  int64
+	sizes [imageSlots]int64
+}
+
+// NewImageBackend opens the image file path, or creates it with slots of
+// slotSize bytes.
+//
+// Parameters:
+//   - path: The image file.
+//   - slotSize: The bytes of a volume at most, a multiple of 4096. A volume
+//     needs Geometry.BlockOffset plus the bytes of the blocks of a group. It
+//     is ignored, and can be 0, when the image exists.
+//
+// Returns:
+//   - *ImageBackend: The backend of the image.
+//   - error: Any error opening or creating the image.
+func NewImageBackend(path string, slotSize int64) (*ImageBackend, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b := &ImageBackend{file: file, slot: slotSize}
+	if err := b.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// load reads the header of the image, a new image gets one.
+func (b *ImageBackend) load() error {
+	hdr := make([]byte, 16+8*imageSlots)
+	n, err := b.file.ReadAt(hdr, 0)
+	if err == io.EOF && n == 0 {
+		if b.slot <= 0 || b.slot%4096 != 0 {
+			return fmt.Errorf("Bad image slot size %d", b.slot)
+		}
+		binary.LittleEndian.PutUint64(hdr, imageMagic)
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(b.slot))
+		for i := range b.sizes {
+			b.sizes[i] = -1
+			binary.LittleEndian.PutUint64(hdr[16+8*i:], uint64(b.sizes[i]))
+		}
+		if _, err := b.file.WriteAt(hdr, 0); err != nil {
+			return err
+		}
+		return b.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(hdr) != imageMagic {
+		return errors.New("Not a depot image")
+	}
+	b.slot = int64(binary.LittleEndian.Uint64(hdr[8:]))
+	return binary.Read(bytes.NewReader(hdr[16:]), binary.LittleEndian, &b.sizes)
+}
+
+// slotOf returns the slot of vol.
+func slotOf(vol uint32) (int, error) {
+	if vol == JournalVolume {
+		return 0, nil
+	}
+	if vol >= imageSlots-1 {
+		return 0, fmt.Errorf("No image slot for volume %d", vol)
+	}
+	return int(vol) + 1, nil
+}
+
+// setSize records the size of the volume of slot s. The lock must be held.
+func (b *ImageBackend) setSize(s int, size int64) error {
+	b.sizes[s] = size
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(size))
+	_, err := b.file.WriteAt(data, int64(16+8*s))
+	return err
+}
+
+// zero clears the bytes from..to of slot s, so that they read as zeros when
+// the volume grows again.
+func (b *ImageBackend) zero(s int, from, to int64) error {
+	const span = 1 << 20
+	buf := make([]byte, min(span, max(to-from, 0)))
+	for pos := from; pos < to; pos += span {
+		n := min(span, to-pos)
+		if _, err := b.file.WriteAt(buf[:n], imageHeaderSize+int64(s)*b.slot+pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *ImageBackend) Volumes() ([]uint32, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.file == nil {
+		return nil, os.ErrClosed
+	}
+	var vols []uint32
+	for s := 1; s < imageSlots; s++ {
+		if b.sizes[s] >= 0 {
+			vols = append(vols, uint32(s-1))
+		}
+	}
+	return vols, nil
+}
+
+func (b *ImageBackend) ReadAt(vol uint32, p []byte, off int64) (int, error) {
+	s, err := slotOf(vol)
+	if err != nil {
+		return 0, err
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.file == nil {
+		return 0, os.ErrClosed
+	}
+	size := b.sizes[s]
+	if size < 0 {
+		return 0, os.ErrNotExist
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), size-off))
+	m, err := b.file.ReadAt(p[:n], imageHeaderSize+int64(s)*b.slot+off)
+	if err == io.EOF {
+		// the tail of the image was never written
+		clear(p[m:n])
+	} else if err != nil {
+		return m, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *ImageBackend) WriteAt(vol uint32, p []byte, off int64) (int, error) {
+	s, err := slotOf(vol)
+	if err != nil {
+		return 0, err
+	}
+	if off+int64(len(p)) > b.slot {
+		return 0, ErrImageFull
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.file == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := b.file.WriteAt(p, imageHeaderSize+int64(s)*b.slot+off)
+	if err != nil {
+		return n, err
+	}
+	if end := off + int64(n); end > b.sizes[s] {
+		err = b.setSize(s, end)
+	}
+	return n, err
+}
+
+func (b *ImageBackend) Sync(vol uint32) error {
+	s, err := slotOf(vol)
+	if err != nil {
+		return err
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.file == nil {
+		return os.ErrClosed
+	}
+	if b.sizes[s] < 0 {
+		return os.ErrNotExist
+	}
+	return b.file.Sync()
+}
+
+func (b *ImageBackend) Size(vol uint32) (int64, error) {
+	s, err := slotOf(vol)
+	if err != nil {
+		return 0, err
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.file == nil {
+		return 0, os.ErrClosed
+	}
+	if b.sizes[s] < 0 {
+		return 0, os.ErrNotExist
+	}
+	return b.sizes[s], nil
+}
+
+func (b *ImageBackend) Truncate(vol uint32, size int64) error {
+	s, err := slotOf(vol)
+	if err != nil {
+		return err
+	}
+	if size > b.slot {
+		return ErrImageFull
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.file == nil {
+		return os.ErrClosed
+	}
+	if b.sizes[s] < 0 {
+		return os.ErrNotExist
+	}
+	if err := b.zero(s, size, b.sizes[s]); err != nil {
+		return err
+	}
+	return b.setSize(s, size)
+}
+
+func (b *ImageBackend) Remove(vol uint32) error {
+	s, err := slotOf(vol)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.file == nil {
+		return os.ErrClosed
+	}
+	if b.sizes[s] < 0 {
+		return os.ErrNotExist
+	}
+	if err := b.zero(s, 0, b.sizes[s]); err != nil {
+		return err
+	}
+	return b.setSize(s, -1)
+}
+
+// Close closes the image file, NewImageBackend opens it again. The calls
+// made after it fail with os.ErrClosed.
+func (b *ImageBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
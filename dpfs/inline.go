@@ -0,0 +1,136 @@
+/*
+ inline.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+/*
+  On depots created with FeatureInline a new file starts inline: its data
+  lives in the inode, in the pointer area behind DirectPointers[0], which
+  keeps the block of the meta. Reading the file reads no block but the meta.
+  A file whose data grows beyond InlineLimit bytes moves to blocks, the data
+  goes behind the meta in the first block like for any other file. Packed
+  files are never inline, their data sits next to the meta already.
+*/
+
+const InlineLimit = (DirectBlocks + 2) * 4 // bytes of data of an inline file at most
+
+// FeatureInline keeps the data of tiny files in their inode. Inodes are not
+// encrypted, an encrypted depot keeps the data of every file in blocks.
+var FeatureInline Feature = func(fs *FileSystem) {
+	fs.Smeta.EnableInline()
+}
+
+func (i *Inode) IsInline() bool {
+	return i.Attr&(1<<InodeAttrInline) != 0
+}
+
+// inlineData returns the pointer area of an inline inode.
+func (i *Inode) inlineData() []byte {
+	buf := make([]byte, InlineLimit)
+	for k, p := range i.DirectPointers[1:] {
+		binary.LittleEndian.PutUint32(buf[k*4:], p)
+	}
+	binary.LittleEndian.PutUint32(buf[InlineLimit-12:], i.SingleIndirect)
+	binary.LittleEndian.PutUint32(buf[InlineLimit-8:], i.DoubleIndirect)
+	binary.LittleEndian.PutUint32(buf[InlineLimit-4:], i.TripleIndirect)
+	return buf
+}
+
+// setInline stores data in the pointer area, the rest of it is zeroed.
+func (i *Inode) setInline(data []byte) {
+	buf := make([]byte, InlineLimit)
+	copy(buf, data)
+	for k := range i.DirectPointers[1:] {
+		i.DirectPointers[k+1] = binary.LittleEndian.Uint32(buf[k*4:])
+	}
+	i.SingleIndirect = binary.LittleEndian.Uint32(buf[InlineLimit-12:])
+	i.DoubleIndirect = binary.LittleEndian.Uint32(buf[InlineLimit-8:])
+	i.TripleIndirect = binary.LittleEndian.Uint32(buf[InlineLimit-4:])
+}
+
+// readInline reads the data of the inline inode at cur.
+func (fs *FileSystem) readInline(inode *Inode, cur *VfileOffset, data []byte) (int, error) {
+	if uint64(cur.offset) >= inode.FileSize {
+		return 0, io.EOF
+	}
+	n := copy(data, inode.inlineData()[cur.offset:inode.FileSize])
+	*cur = fs.packedOffset(inode, cur.offset+int64(n))
+	return n, nil
+}
+
+// writeInline writes data at cur of an inline file, a file growing beyond
+// InlineLimit moves to blocks first.
+func (vf *Vfile) writeInline(cur *VfileOffset, data []byte) (int, error) {
+	end := max(int64(vf.Inode.FileSize), cur.offset+int64(len(data)))
+	if end > InlineLimit {
+		if err := vf.uninline(); err != nil {
+			return 0, err
+		}
+		var err error
+		if *cur, err = vf.fs.slotOffset(vf.tx, vf.Inode, cur.offset); err != nil {
+			return 0, err
+		}
+		return vf.writeSlots(cur, data)
+	}
+	buf := vf.Inode.inlineData()
+	copy(buf[cur.offset:], data)
+	vf.Inode.setInline(buf)
+	vf.Inode.FileSize = uint64(end)
+	*cur = vf.fs.packedOffset(vf.Inode, cur.offset+int64(len(data)))
+	return len(data), vf.fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
+}
+
+// truncateInline changes the size of an inline file.
+func (vf *Vfile) truncateInline(size int64) error {
+	if size > InlineLimit {
+		if err := vf.uninline(); err != nil {
+			return err
+		}
+		return vf.extend(size)
+	}
+	buf := vf.Inode.inlineData()
+	clear(buf[min(size, int64(vf.Inode.FileSize)):])
+	vf.Inode.setInline(buf)
+	vf.Inode.FileSize = uint64(size)
+	return vf.fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
+}
+
+// uninline moves the data of the inline file behind the meta in its first
+// block.
+func (vf *Vfile) uninline() error {
+	data := vf.Inode.inlineData()[:vf.Inode.FileSize]
+	vf.Inode.setInline(nil)
+	vf.Inode.Attr &^= 1 << InodeAttrInline
+	vf.Inode.FileSize = 0
+	if len(data) == 0 {
+		return vf.fs.syncInode(vf.tx, vf.Inodeptr, vf.Inode)
+	}
+	cur, err := vf.fs.slotOffset(vf.tx, vf.Inode, 0)
+	if err != nil {
+		return err
+	}
+	_, err = vf.writeSlots(&cur, data)
+	return err
+}
@@ -0,0 +1,674 @@
+/*
+ journal.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+  The journal is a redo log of metadata updates. A transaction collects
+  inode and pointer block writes (physical records) and bitmap changes
+  (logical records, a list of inode or block pointers to set or clear).
+  On commit the records and a commit record are written and synced to the
+  journal file, then applied to the volume files, then the journal is
+  truncated. Replay applies a transaction only when all its records and
+  its commit record are intact, otherwise the transaction is dropped.
+*/
+
+const (
+	JournalFn    = "depot.journal"
+	JournalMagic = 0x4A524E4C
+)
+
+const (
+	recWrite = iota + 1
+	recAllocBlocks
+	recFreeBlocks
+	recAllocInodes
+	recFreeInodes
+	recCommit
+	recRefBlocks   // a reference taken on shared blocks, never journaled
+	recUnrefBlocks // blocks released on a depot with reference counts, never journaled
+)
+
+var (
+	ErrJournal        = errors.New("Bad journal")
+	ErrJournalPending = errors.New("Journal holds a transaction not applied")
+)
+
+type journalHeader struct {
+	Magic  uint32
+	Type   uint16
+	Pad    uint16
+	TxId   uint64
+	Group  uint32 //group index, base 0
+	Length uint32 //payload length
+	Offset int64  //volume offset of recWrite, number of records of recCommit
+}
+
+var journalHeaderSize = binary.Size(journalHeader{})
+
+type journalRec struct {
+	typ    uint16
+	group  uint32
+	offset int64
+	data   []byte
+	ptrs   []uint32
+}
+
+type Journal struct {
+	lock    sync.Mutex
+	file    *volumeFile
+	txId    uint64
+	log     logrus.FieldLogger
+	noSync  bool
+	pending error       // the last transaction is durable but not applied
+	crash   func() bool // tests stop a commit right after the journal sync
+}
+
+// openJournal opens the journal kept in the volume file, a read-only
+// journal is never created and a missing one holds nothing.
+func openJournal(file *volumeFile, readOnly bool) (*Journal, error) {
+	if _, err := file.Size(); os.IsNotExist(err) {
+		if readOnly {
+			return &Journal{log: logrus.StandardLogger()}, nil
+		}
+		if _, err := file.WriteAt(nil, 0); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file, log: logrus.StandardLogger()}, nil
+}
+
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.file = nil // the backend is closed with the file system
+	return nil
+}
+
+func encodeRec(buf *bytes.Buffer, txId uint64, r *journalRec) {
+	payload := r.data
+	if r.typ != recWrite && r.typ != recCommit {
+		payload = make([]byte, 4*len(r.ptrs))
+		for i, p := range r.ptrs {
+			binary.LittleEndian.PutUint32(payload[i*4:], p)
+		}
+	}
+	h := journalHeader{
+		Magic:  JournalMagic,
+		Type:   r.typ,
+		TxId:   txId,
+		Group:  r.group,
+		Length: uint32(len(payload)),
+		Offset: r.offset,
+	}
+	start := buf.Len()
+	binary.Write(buf, binary.LittleEndian, &h)
+	buf.Write(payload)
+	crc := crc32.ChecksumIEEE(buf.Bytes()[start:])
+	binary.Write(buf, binary.LittleEndian, crc)
+}
+
+func decodeRec(r io.Reader) (journalHeader, *journalRec, error) {
+	h := journalHeader{}
+	hb := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return h, nil, err
+	}
+	if err := binary.Read(bytes.NewReader(hb), binary.LittleEndian, &h); err != nil {
+		return h, nil, err
+	}
+	if h.Magic != JournalMagic || h.Length > uint32(MaxBlockSize)*64 {
+		return h, nil, ErrJournal
+	}
+	payload := make([]byte, h.Length+4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, err
+	}
+	crc := crc32.ChecksumIEEE(append(hb, payload[:h.Length]...))
+	if crc != binary.LittleEndian.Uint32(payload[h.Length:]) {
+		return h, nil, ErrJournal
+	}
+	rec := &journalRec{typ: h.Type, group: h.Group, offset: h.Offset, data: payload[:h.Length]}
+	if h.Type != recWrite && h.Type != recCommit {
+		rec.ptrs = make([]uint32, h.Length/4)
+		for i := range rec.ptrs {
+			rec.ptrs[i] = binary.LittleEndian.Uint32(rec.data[i*4:])
+		}
+		rec.data = nil
+	}
+	return h, rec, nil
+}
+
+// commit makes the records durable in the journal, then calls apply. The
+// returned bool reports whether the transaction reached the journal, once it
+// did the transaction will survive a crash even if apply fails. A failed
+// apply leaves the transaction in the journal and fails the later commits
+// with ErrJournalPending, which would overwrite it, until the file system is
+// opened again and replays it.
+func (j *Journal) commit(recs []*journalRec, apply func() error) (bool, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return false, errors.New("Journal closed")
+	}
+	if j.pending != nil {
+		return false, j.pending
+	}
+	j.txId++
+	var buf bytes.Buffer
+	for _, r := range recs {
+		encodeRec(&buf, j.txId, r)
+	}
+	encodeRec(&buf, j.txId, &journalRec{typ: recCommit, offset: int64(len(recs))})
+	if _, err := j.file.WriteAt(buf.Bytes(), 0); err != nil {
+		return false, err
+	}
+	if !j.noSync {
+		if err := j.file.Sync(); err != nil {
+			return false, err
+		}
+	}
+	if j.crash != nil && j.crash() {
+		j.pending = fmt.Errorf("%w [tx:%d], the commit crashed", ErrJournalPending, j.txId)
+		return true, nil
+	}
+	if err := apply(); err != nil {
+		j.pending = fmt.Errorf("%w [tx:%d], reopen the file system to replay it: %v", ErrJournalPending, j.txId, err)
+		return true, err
+	}
+	return true, j.file.Truncate(0)
+}
+
+// readCommitted returns the records of the last complete transaction in the
+// journal, or nil when there is nothing to replay.
+func (j *Journal) readCommitted() ([]*journalRec, error) {
+	size, err := j.file.Size()
+	if err != nil {
+		return nil, err
+	}
+	r := io.NewSectionReader(j.file, 0, size)
+	var recs []*journalRec
+	var txId uint64
+	for {
+		h, rec, err := decodeRec(r)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != ErrJournal {
+				return nil, err
+			}
+			if err == io.EOF && txId == 0 {
+				return nil, nil
+			}
+			j.log.Warnf("Drop incomplete journal transaction [tx:%d,records:%d]", txId, len(recs))
+			return nil, nil
+		}
+		if len(recs) == 0 && txId == 0 {
+			txId = h.TxId
+		}
+		if h.TxId != txId {
+			return nil, nil
+		}
+		if rec.typ == recCommit {
+			if rec.offset != int64(len(recs)) {
+				return nil, nil
+			}
+			return recs, nil
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// replay applies a committed transaction left behind by a crash directly to
+// the volume files, before the bitmaps are loaded.
+func (j *Journal) replay(v *VolumeFiles) error {
+	if j.file == nil {
+		return nil
+	}
+	recs, err := j.readCommitted()
+	if err != nil {
+		return err
+	}
+	if v.readOnly {
+		if len(recs) > 0 {
+			// the volumes may miss a part of the last transaction
+			j.log.Warnf("Journal holds %d records not replayed, the depot is opened read-only", len(recs))
+		}
+		return nil
+	}
+	if len(recs) > 0 {
+		j.log.Infof("Replay journal, %d records", len(recs))
+		files := map[uint32]*volumeFile{}
+		for _, r := range recs {
+			f, ok := files[r.group]
+			if !ok {
+				if int(r.group) >= len(v.volumes) {
+					return BAD_GID
+				}
+				f = v.volume(r.group)
+				if _, err := f.Size(); err != nil {
+					if os.IsNotExist(err) {
+						j.log.Warnf("Skip journal record of missing volume %s", v.volumes[r.group].Fn)
+						continue
+					}
+					return err
+				}
+				files[r.group] = f
+			}
+			if err := replayRec(f, r, &v.geo); err != nil {
+				return err
+			}
+		}
+		for _, f := range files {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return j.file.Truncate(0)
+}
+
+func replayRec(f *volumeFile, r *journalRec, geo *Geometry) error {
+	var base int64
+	switch r.typ {
+	case recWrite:
+		_, err := f.WriteAt(r.data, r.offset)
+		return err
+	case recAllocBlocks, recFreeBlocks:
+		base = geo.BlockBitmapOffset
+	case recAllocInodes, recFreeInodes:
+		base = geo.InodeBitmapOffset
+	default:
+		return ErrJournal
+	}
+	for _, s := range bitSpans(r.ptrs) {
+		data := make([]byte, s.length)
+		if _, err := f.ReadAt(data, base+int64(s.offset)); err != nil {
+			return err
+		}
+		applyBitmapRec(r, data, s.offset)
+		if _, err := f.WriteAt(data, base+int64(s.offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBitmapRec applies a logical bitmap record to data, a window of the
+// bitmap starting at byte offset from.
+func applyBitmapRec(r *journalRec, data []byte, from int) {
+	for _, p := range r.ptrs {
+		idx, _, isBig := EntAddr(p).GetAddr()
+		n := uint32(1)
+		if isBig > 0 {
+			n = 64
+		}
+		for i := idx; i < idx+n; i++ {
+			pos := int(i/8) - from
+			if pos < 0 || pos >= len(data) {
+				continue
+			}
+			if r.typ == recAllocBlocks || r.typ == recAllocInodes {
+				data[pos] |= 1 << (i % 8)
+			} else {
+				data[pos] &^= 1 << (i % 8)
+			}
+		}
+	}
+}
+
+type txKey struct {
+	group  uint32
+	offset int64
+	length int
+}
+
+// txn collects the metadata updates of one file system operation. Reads
+// done on behalf of the operation see its pending writes through patch.
+type txn struct {
+	writes []*journalRec
+	index  map[txKey]int
+	bitmap []*journalRec
+	// reference counts, see stageRefs
+	refs    []refChange
+	unrefs  []uint32 //released blocks that only lose a reference
+	orphans []uint32
+	indexed []uint32 //blocks given a content hash
+	// packed records, see stageSlots
+	slots    []slotChange
+	slabRoom map[uint32]int
+}
+
+func newTxn() *txn {
+	return &txn{index: make(map[txKey]int)}
+}
+
+func (tx *txn) write(group uint32, offset int64, data []byte) {
+	key := txKey{group, offset, len(data)}
+	if i, ok := tx.index[key]; ok {
+		if i == len(tx.writes)-1 {
+			copy(tx.writes[i].data, data)
+			return
+		}
+		// later writes may overlap, keep the records in write order
+		tx.writes = append(tx.writes[:i], tx.writes[i+1:]...)
+		for k, j := range tx.index {
+			if j > i {
+				tx.index[k] = j - 1
+			}
+		}
+	}
+	tx.index[key] = len(tx.writes)
+	tx.writes = append(tx.writes, &journalRec{
+		typ:    recWrite,
+		group:  group,
+		offset: offset,
+		data:   append([]byte(nil), data...),
+	})
+}
+
+// dropBlockWrites removes the writes to the block area of the volumes, which
+// starts at blockOffset.
+func (tx *txn) dropBlockWrites(blockOffset int64) {
+	writes := tx.writes[:0]
+	tx.index = make(map[txKey]int)
+	for _, w := range tx.writes {
+		if w.offset < blockOffset {
+			tx.index[txKey{w.group, w.offset, len(w.data)}] = len(writes)
+			writes = append(writes, w)
+		}
+	}
+	tx.writes = writes
+}
+
+// refChange is a reference taken on a block or released. A released
+// indirect block carries the depth of its tree, its children are released
+// too when it is freed.
+type refChange struct {
+	typ   uint16 // recRefBlocks or recUnrefBlocks
+	ptr   uint32
+	depth int
+}
+
+// refOp records a reference change of blocks, turned into writes of the
+// dedup table on commit.
+func (tx *txn) refOp(typ uint16, depth int, ptrs []uint32) {
+	for _, p := range ptrs {
+		if p != 0 {
+			tx.refs = append(tx.refs, refChange{typ, p, depth})
+		}
+	}
+}
+
+func (tx *txn) bitmapOp(typ uint16, group uint32, ptrs []uint32) {
+	if len(ptrs) == 0 {
+		return
+	}
+	tx.bitmap = append(tx.bitmap, &journalRec{typ: typ, group: group, ptrs: append([]uint32(nil), ptrs...)})
+}
+
+// patch overlays the pending writes of the transaction on data, which was
+// read from offset of the volume of group.
+func (tx *txn) patch(group uint32, offset int64, data []byte) {
+	if tx == nil {
+		return
+	}
+	end := offset + int64(len(data))
+	for _, w := range tx.writes {
+		wend := w.offset + int64(len(w.data))
+		if w.group != group || w.offset >= end || wend <= offset {
+			continue
+		}
+		from, to := w.offset, wend
+		if from < offset {
+			from = offset
+		}
+		if to > end {
+			to = end
+		}
+		copy(data[from-offset:to-offset], w.data[from-w.offset:to-w.offset])
+	}
+}
+
+func (tx *txn) empty() bool {
+	return len(tx.writes) == 0 && len(tx.bitmap) == 0 && len(tx.refs) == 0 && len(tx.slots) == 0 && len(tx.orphans) == 0
+}
+
+func (tx *txn) records() []*journalRec {
+	return append(append([]*journalRec(nil), tx.bitmap...), tx.writes...)
+}
+
+// pointers returns the allocated (alloc==true) or released pointers of the
+// transaction, grouped by group index.
+func (tx *txn) pointers(blocks, alloc bool) map[uint32][]uint32 {
+	typ := uint16(recFreeInodes)
+	switch {
+	case blocks && alloc:
+		typ = recAllocBlocks
+	case blocks:
+		typ = recFreeBlocks
+	case alloc:
+		typ = recAllocInodes
+	}
+	ret := map[uint32][]uint32{}
+	for _, r := range tx.bitmap {
+		if r.typ == typ {
+			ret[r.group] = append(ret[r.group], r.ptrs...)
+		}
+	}
+	return ret
+}
+
+func (tx *txn) groups() []uint32 {
+	set := map[uint32]bool{}
+	for _, r := range tx.records() {
+		set[r.group] = true
+	}
+	ret := make([]uint32, 0, len(set))
+	for g := range set {
+		ret = append(ret, g)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func (fs *FileSystem) beginTx() *txn {
+	return newTxn()
+}
+
+// commitTx persists the transaction through the journal and applies it. When
+// the transaction never reached the journal it is rolled back in memory.
+func (fs *FileSystem) commitTx(tx *txn) error {
+	if tx.empty() {
+		return nil
+	}
+	if err := fs.writable("commit"); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	if len(tx.slots) > 0 {
+		// the slabs are shared by files under other inode locks, and the
+		// blocks of the slabs freed are released before the references
+		fs.pack.lock.Lock()
+		defer fs.pack.lock.Unlock()
+		if err := fs.stageSlots(tx); err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	if fs.dedup != nil {
+		// the released pointer blocks are read before their writes are sealed
+		fs.dedup.commitLock.Lock()
+		defer fs.dedup.commitLock.Unlock()
+		if err := fs.stageRefs(tx); err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	if fs.fullBlocks() {
+		if err := fs.stageBlocks(tx); err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	durable, err := fs.device.journal.commit(tx.records(), func() error {
+		if fs.dedup != nil {
+			fs.settleRefs(tx)
+		}
+		if tx.slabRoom != nil {
+			fs.settleSlots(tx)
+		}
+		return fs.applyTx(tx)
+	})
+	if err != nil && !durable {
+		fs.abortTx(tx)
+	}
+	return err
+}
+
+// abortTx drops the in-memory effects of a transaction that was not committed:
+// allocated inodes and blocks are returned and pointer blocks written by the
+// transaction are evicted from the cache.
+func (fs *FileSystem) abortTx(tx *txn) {
+	for g, ptrs := range tx.pointers(true, true) {
+		group := &fs.blockGroups[g]
+		group.lock.Lock()
+		group.blockBitmap.ClearBits(ptrs)
+		group.lock.Unlock()
+	}
+	for g, ptrs := range tx.pointers(false, true) {
+		group := &fs.blockGroups[g]
+		group.lock.Lock()
+		group.inodeBitmap.ClearBits(ptrs)
+		group.lock.Unlock()
+	}
+	for _, w := range tx.writes {
+		if w.offset >= fs.geo.BlockOffset {
+			idx := uint32((w.offset - fs.geo.BlockOffset) / int64(fs.Smeta.BlockSize))
+			fs.ibCache.Remove(MakeEntAddr(idx, w.group+1, false))
+		}
+	}
+	if fs.dedup != nil {
+		fs.abortRefs(tx)
+	}
+}
+
+func (fs *FileSystem) applyTx(tx *txn) error {
+	for _, g := range tx.groups() {
+		if err := fs.applyGroupTx(tx, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) applyGroupTx(tx *txn, g uint32) error {
+	group := &fs.blockGroups[g]
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if err := fs.device.checkReadyLocked(g, group); err != nil {
+		return err
+	}
+	for _, r := range tx.bitmap {
+		if r.group != g {
+			continue
+		}
+		if err := fs.applyBitmapLocked(r); err != nil {
+			return err
+		}
+	}
+	file := fs.device.volumes[g].file
+	for _, w := range tx.writes {
+		if w.group != g {
+			continue
+		}
+		if _, err := file.WriteAt(w.data, w.offset); err != nil {
+			return err
+		}
+	}
+	return fs.device.sync(file)
+}
+
+// applyBitmapLocked applies a bitmap record to the durable copy of the bitmap
+// and writes the touched bytes to the volume. Released bits become visible to
+// the allocator only here, after the release is durable. The group lock must
+// be held.
+func (fs *FileSystem) applyBitmapLocked(r *journalRec) error {
+	group := &fs.blockGroups[r.group]
+	if err := fs.loadDurableLocked(r.group); err != nil {
+		return err
+	}
+	bm, base := group.durableBlocks, fs.geo.BlockBitmapOffset
+	switch r.typ {
+	case recAllocInodes:
+		bm, base = group.durableInodes, fs.geo.InodeBitmapOffset
+	case recFreeInodes:
+		bm, base = group.durableInodes, fs.geo.InodeBitmapOffset
+		group.inodeBitmap.ClearBits(r.ptrs)
+	case recFreeBlocks:
+		group.blockBitmap.ClearBits(r.ptrs)
+		for _, p := range r.ptrs {
+			fs.ibCache.Remove(p)
+		}
+	}
+	applyBitmapRec(r, bm, 0)
+	for _, s := range bitSpans(r.ptrs) {
+		if _, err := fs.device.volumes[r.group].file.WriteAt(bm[s.offset:s.offset+s.length], base+int64(s.offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDurableLocked reads the on-disk bitmaps of a group. Bits allocated by
+// transactions in flight are only set in the in-memory bitmaps, the durable
+// copies track what the volume file holds so that a commit never persists
+// allocations of another, uncommitted transaction.
+func (fs *FileSystem) loadDurableLocked(g uint32) error {
+	group := &fs.blockGroups[g]
+	if group.durableBlocks != nil {
+		return nil
+	}
+	file := fs.device.volumes[g].file
+	inodes := make([]uint8, group.inodeBitmap.TotalBits()/8)
+	if _, err := file.ReadAt(inodes, fs.geo.InodeBitmapOffset); err != nil {
+		return err
+	}
+	blocks := make([]uint8, group.blockBitmap.TotalBits()/8)
+	if _, err := file.ReadAt(blocks, fs.geo.BlockBitmapOffset); err != nil {
+		return err
+	}
+	group.durableInodes, group.durableBlocks = inodes, blocks
+	return nil
+}
@@ -0,0 +1,251 @@
+/*
+ journal_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func journalTestData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func openJournalTestFs(t *testing.T) *FileSystem {
+	fs, err := MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	return fs
+}
+
+func readAll(t *testing.T, fs *FileSystem, key string) []byte {
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		t.Fatalf("Open file failed: %v", err)
+	}
+	data := make([]byte, f.Inode.FileSize)
+	for rdn := 0; rdn < len(data); {
+		n, err := f.Read(data[rdn:])
+		if err != nil {
+			t.Fatalf("Read file failed: %v", err)
+		}
+		rdn += n
+	}
+	return data
+}
+
+// crashNextCommit makes the next commit of fs stop right after the journal is
+// synced, leaving the volume files as a crash would.
+func crashNextCommit(fs *FileSystem) {
+	fs.device.journal.crash = func() bool { return true }
+}
+
+func TestJournalReplay(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+	f, key, err := fs.CreateFile("journal", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	data := journalTestData(8192*40 + 123)
+	if _, err := f.Write(data[:8192*3]); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	crashNextCommit(fs)
+	if _, err := f.Write(data[8192*3:]); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	_, used := fs.StatBlocks(-1)
+	fs.Close()
+
+	fs = openJournalTestFs(t)
+	if got := readAll(t, fs, key); !bytes.Equal(got, data) {
+		t.Errorf("Data mismatch after replay, size:%d!=%d", len(got), len(data))
+	}
+	if _, free := fs.StatBlocks(-1); free != used {
+		t.Errorf("Bad free blocks after replay %d!=%d", free, used)
+	}
+
+	crashNextCommit(fs)
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete file failed: %v", err)
+	}
+	fs.Close()
+
+	fs = openJournalTestFs(t)
+	defer fs.Close()
+	if _, err := fs.OpenFile(key); err != FNF {
+		t.Errorf("Deleted file still readable after replay: %v", err)
+	}
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
+
+func TestJournalApplyFailure(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	payload := []byte("durable, not applied")
+	pos := fs.geo.BlockOffset + 100*int64(fs.Smeta.BlockSize)
+	recs := []*journalRec{{typ: recWrite, group: 0, offset: pos, data: payload}}
+	durable, err := fs.device.journal.commit(recs, func() error { return errors.New("apply failed") })
+	if !durable || err == nil {
+		t.Fatalf("Commit returns %v, %v", durable, err)
+	}
+	// a commit would overwrite the transaction in the journal
+	if _, _, err := fs.CreateFile("later", nil); !errors.Is(err, ErrJournalPending) {
+		t.Errorf("Commit after a failed apply returns %v", err)
+	}
+	fs.Close()
+
+	fs = openJournalTestFs(t)
+	defer fs.Close()
+	got := make([]byte, len(payload))
+	if _, err := fs.device.volumes[0].file.ReadAt(got, pos); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("Transaction not replayed %q: %v", got, err)
+	}
+	if _, _, err := fs.CreateFile("later", nil); err != nil {
+		t.Errorf("Create file after replay failed: %v", err)
+	}
+}
+
+func TestJournalTornTransaction(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	f, key, err := fs.CreateFile("torn", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	data := journalTestData(8192 * 2)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	_, used := fs.StatBlocks(-1)
+	crashNextCommit(fs)
+	if _, err := f.Write(journalTestData(8192 * 30)); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	fs.Close()
+
+	// lose the tail of the commit record
+	fn := filepath.Join(testDir, JournalFn)
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("Stat journal failed: %v", err)
+	}
+	if err := os.Truncate(fn, st.Size()-1); err != nil {
+		t.Fatalf("Truncate journal failed: %v", err)
+	}
+
+	fs = openJournalTestFs(t)
+	defer fs.Close()
+	if got := readAll(t, fs, key); !bytes.Equal(got, data) {
+		t.Errorf("Torn transaction was replayed, size:%d!=%d", len(got), len(data))
+	}
+	if _, free := fs.StatBlocks(-1); free != used {
+		t.Errorf("Bad free blocks after dropping torn transaction %d!=%d", free, used)
+	}
+}
+
+func TestJournalGrow(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs := openJournalTestFs(t)
+	f, key, err := fs.CreateFile("grow", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	data := journalTestData(8192*5 + 7)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+	crashNextCommit(fs)
+	if err := fs.Grow(3); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	fs.Close()
+
+	// lose the commit record, the depot keeps its groups
+	fn := filepath.Join(testDir, JournalFn)
+	journal, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Read journal failed: %v", err)
+	}
+	if err := os.Truncate(fn, int64(len(journal))-1); err != nil {
+		t.Fatalf("Truncate journal failed: %v", err)
+	}
+	fs = openJournalTestFs(t)
+	if fs.Smeta.TotalGroups != 2 {
+		t.Errorf("Torn grow was replayed, %d groups", fs.Smeta.TotalGroups)
+	}
+	fs.Close()
+
+	// the super blocks are rewritten by the replay
+	if err := os.WriteFile(fn, journal, 0644); err != nil {
+		t.Fatalf("Write journal failed: %v", err)
+	}
+	fs = openJournalTestFs(t)
+	if fs.Smeta.TotalGroups != 3 {
+		fs.Close()
+		t.Fatalf("Grow not replayed, %d groups", fs.Smeta.TotalGroups)
+	}
+	if got := readAll(t, fs, key); !bytes.Equal(got, data) {
+		t.Errorf("Data mismatch after replay, size:%d!=%d", len(got), len(data))
+	}
+	for g := 0; g < 3; g++ {
+		if err := fs.device.checkReady(uint32(g), &fs.blockGroups[g]); err != nil {
+			t.Errorf("Volume of group %d not usable: %v", g, err)
+		}
+	}
+	fs.Close()
+	fs = openJournalTestFs(t)
+	defer fs.Close()
+	if fs.Smeta.TotalGroups != 3 {
+		t.Errorf("Bad group number %d after reopen", fs.Smeta.TotalGroups)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ membackend.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const memPageSize = 64 * 1024
+
+// MemBackend keeps the volumes in memory, in pages allocated on first write,
+// so that a test can use a depot of many large groups and only pay for the
+// bytes it writes. The volumes outlive Close, a file system opened on the
+// backend returned by Reopen finds them.
+type MemBackend struct {
+	*memStore
+	closed bool
+}
+
+// memStore holds the volumes shared by a MemBackend and its reopened copies.
+type memStore struct {
+	lock sync.RWMutex
+	vols map[uint32]*memVolume
+}
+
+type memVolume struct {
+	size  int64
+	pages map[int64][]byte
+}
+
+// NewMemBackend returns an empty in-memory backend.
+func NewMemBackend() *MemBackend {
+	return &MemBackend{memStore: &memStore{vols: make(map[uint32]*memVolume)}}
+}
+
+// Reopen returns a new backend on the volumes of b, which may be closed.
+func (b *MemBackend) Reopen() *MemBackend {
+	return &MemBackend{memStore: b.memStore}
+}
+
+// Allocated returns the bytes of the pages allocated by all volumes.
+func (b *MemBackend) Allocated() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var n int64
+	for _, v := range b.vols {
+		n += int64(len(v.pages)) * memPageSize
+	}
+	return n
+}
+
+func (b *MemBackend) volume(vol uint32) (*memVolume, error) {
+	if b.closed {
+		return nil, os.ErrClosed
+	}
+	v, ok := b.vols[vol]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return v, nil
+}
+
+func (b *MemBackend) Volumes() ([]uint32, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return nil, os.ErrClosed
+	}
+	var vols []uint32
+	for vol := range b.vols {
+		if vol != JournalVolume {
+			vols = append(vols, vol)
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i] < vols[j] })
+	return vols, nil
+}
+
+func (b *MemBackend) ReadAt(vol uint32, p []byte, off int64) (int, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	v, err := b.volume(vol)
+	if err != nil {
+		return 0, err
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), v.size-off))
+	for i := 0; i < n; {
+		pos := off + int64(i)
+		page, in := pos/memPageSize, int(pos%memPageSize)
+		m := min(n-i, memPageSize-in)
+		if data, ok := v.pages[page]; ok {
+			copy(p[i:i+m], data[in:])
+		} else {
+			clear(p[i : i+m])
+		}
+		i += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *MemBackend) WriteAt(vol uint32, p []byte, off int64) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	v, ok := b.vols[vol]
+	if !ok {
+		v = &memVolume{pages: make(map[int64][]byte)}
+		b.vols[vol] = v
+	}
+	for i := 0; i < len(p); {
+		pos := off + int64(i)
+		page, in := pos/memPageSize, int(pos%memPageSize)
+		data, ok := v.pages[page]
+		if !ok {
+			data = make([]byte, memPageSize)
+			v.pages[page] = data
+		}
+		i += copy(data[in:], p[i:])
+	}
+	v.size = max(v.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+func (b *MemBackend) Sync(vol uint32) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	_, err := b.volume(vol)
+	return err
+}
+
+func (b *MemBackend) Size(vol uint32) (int64, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	v, err := b.volume(vol)
+	if err != nil {
+		return 0, err
+	}
+	return v.size, nil
+}
+
+func (b *MemBackend) Truncate(vol uint32, size int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	v, err := b.volume(vol)
+	if err != nil {
+		return err
+	}
+	for page, data := range v.pages {
+		if start := page * memPageSize; start >= size {
+			delete(v.pages, page)
+		} else if size-start < memPageSize {
+			clear(data[size-start:])
+		}
+	}
+	v.size = size
+	return nil
+}
+
+func (b *MemBackend) Remove(vol uint32) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, err := b.volume(vol); err != nil {
+		return err
+	}
+	delete(b.vols, vol)
+	return nil
+}
+
+// Close closes the backend, the calls made after it fail with os.ErrClosed.
+// Reopen returns a backend on the same volumes.
+func (b *MemBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	return nil
+}
@@ -36,7 +36,15 @@ const (
 )
 
 const (
-	AttrBigAlloc = 0
+	AttrBigAlloc  = 0
+	AttrSysInodes = 1 // the first SysInodes inodes of group 1 hold system files
+	AttrChecksums = 2 // a CRC32C per block in a table after the block bitmap
+	AttrEncrypted = 3 // blocks encrypted with AES-GCM, see crypt.go
+	AttrDedup     = 4 // identical blocks stored once, see dedup.go
+	AttrClones    = 5 // block reference counts for file clones, see clone.go
+	AttrPacking   = 6 // small files packed into shared blocks, see pack.go
+	AttrInline    = 7 // data of tiny files in the inode, see inline.go
+	AttrExtents   = 8 // blocks of new files mapped by extents, see extent.go
 )
 
 // File system meta
@@ -46,7 +54,7 @@ type SuperBlock struct {
 	BlocksInGroup uint32
 	InodesRatio   uint32
 	ShardId       uint16
-	Attr          uint16 //bit 0 BigAlloc
+	Attr          uint16 //bit 0 BigAlloc, bit 1 SysInodes, bit 2 Checksums, bit 3 Encrypted, bit 4 Dedup, bit 5 Clones, bit 6 Packing, bit 7 Inline, bit 8 Extents
 	Magic         uint32
 	Crc           uint64
 }
@@ -59,6 +67,76 @@ func (s *SuperBlock) IsBigAllocEnabled() bool {
 	return s.Attr&(1<<AttrBigAlloc) != 0
 }
 
+func (s *SuperBlock) EnableSysInodes() {
+	s.Attr |= (1 << AttrSysInodes)
+}
+
+func (s *SuperBlock) HasSysInodes() bool {
+	return s.Attr&(1<<AttrSysInodes) != 0
+}
+
+func (s *SuperBlock) EnableChecksums() {
+	s.Attr |= (1 << AttrChecksums)
+}
+
+func (s *SuperBlock) HasChecksums() bool {
+	return s.Attr&(1<<AttrChecksums) != 0
+}
+
+func (s *SuperBlock) EnableEncryption() {
+	s.Attr |= (1 << AttrEncrypted)
+}
+
+func (s *SuperBlock) HasEncryption() bool {
+	return s.Attr&(1<<AttrEncrypted) != 0
+}
+
+func (s *SuperBlock) EnableDedup() {
+	s.Attr |= (1 << AttrDedup)
+}
+
+func (s *SuperBlock) HasDedup() bool {
+	return s.Attr&(1<<AttrDedup) != 0
+}
+
+func (s *SuperBlock) EnableClones() {
+	s.Attr |= (1 << AttrClones)
+}
+
+func (s *SuperBlock) HasClones() bool {
+	return s.Attr&(1<<AttrClones) != 0
+}
+
+func (s *SuperBlock) EnablePacking() {
+	s.Attr |= (1 << AttrPacking)
+}
+
+func (s *SuperBlock) HasPacking() bool {
+	return s.Attr&(1<<AttrPacking) != 0
+}
+
+func (s *SuperBlock) EnableInline() {
+	s.Attr |= (1 << AttrInline)
+}
+
+func (s *SuperBlock) HasInline() bool {
+	return s.Attr&(1<<AttrInline) != 0
+}
+
+func (s *SuperBlock) EnableExtents() {
+	s.Attr |= (1 << AttrExtents)
+}
+
+func (s *SuperBlock) HasExtents() bool {
+	return s.Attr&(1<<AttrExtents) != 0
+}
+
+// HasRefCounts reports whether the volumes keep a reference count per block,
+// both dedup and clones share blocks.
+func (s *SuperBlock) HasRefCounts() bool {
+	return s.HasDedup() || s.HasClones()
+}
+
 func (s *SuperBlock) Checksum() uint64 {
 	data := fmt.Sprintf("%d_%d_%d_%d_%d_%d_%x",
 		s.BlockSize,
@@ -0,0 +1,147 @@
+/*
+ namelog.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+  A name log is a file holding add/del records of name to uid mappings, used
+  by the name index and by directories. Every record carries the epoch of the
+  log, a compaction rewrites the log as a snapshot under the next epoch. The
+  records start at the second slot of the file, so that a rewrite never
+  overwrites the block in front of them in place: the blocks released by the
+  rewrite are reused only after the commit, and a crash before it leaves the
+  old log as it was.
+
+  record: [crc32][epoch u32][op u8][uid len u8][name len u16][uid][name]
+*/
+
+const (
+	nameAdd = 1
+	nameDel = 2
+)
+
+const nameRecHeader = 12
+
+type nameOp struct {
+	op   uint8
+	name string
+	uid  string
+}
+
+func encodeNameRec(buf []byte, epoch uint32, op nameOp) []byte {
+	rec := make([]byte, nameRecHeader, nameRecHeader+len(op.uid)+len(op.name))
+	binary.LittleEndian.PutUint32(rec[4:], epoch)
+	rec[8] = op.op
+	rec[9] = uint8(len(op.uid))
+	binary.LittleEndian.PutUint16(rec[10:], uint16(len(op.name)))
+	rec = append(append(rec, op.uid...), op.name...)
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(rec[4:]))
+	return append(buf, rec...)
+}
+
+func decodeNameRec(data []byte, epoch uint32) (nameOp, int, error) {
+	if len(data) < nameRecHeader {
+		return nameOp{}, 0, errors.New("short name record")
+	}
+	n := nameRecHeader + int(data[9]) + int(binary.LittleEndian.Uint16(data[10:]))
+	if len(data) < n || crc32.ChecksumIEEE(data[4:n]) != binary.LittleEndian.Uint32(data) {
+		return nameOp{}, 0, errors.New("bad name record")
+	}
+	if e := binary.LittleEndian.Uint32(data[4:]); e != epoch {
+		return nameOp{}, 0, fmt.Errorf("name record of epoch %d in epoch %d", e, epoch)
+	}
+	op := nameOp{
+		op:   data[8],
+		uid:  string(data[nameRecHeader : nameRecHeader+int(data[9])]),
+		name: string(data[nameRecHeader+int(data[9]) : n]),
+	}
+	if op.op != nameAdd && op.op != nameDel {
+		return nameOp{}, 0, fmt.Errorf("bad name record type %d", op.op)
+	}
+	return op, n, nil
+}
+
+// logBase returns the position of the first record in the log f.
+func (fs *FileSystem) logBase(f *Vfile) int64 {
+	return int64(fs.Smeta.BlockSize) - int64(f.Inode.MetaSize)
+}
+
+// writeLog appends ops to the log f in tx under epoch, or replaces the log
+// with them when rewrite is set.
+func (fs *FileSystem) writeLog(tx *txn, f *Vfile, epoch uint32, ops []nameOp, rewrite bool) error {
+	f.tx = tx
+	defer func() { f.tx = nil }()
+	base := fs.logBase(f)
+	if rewrite && f.Inode.FileSize > uint64(base) {
+		if err := f.shrink(base); err != nil {
+			return err
+		}
+	}
+	pos := int64(f.Inode.FileSize)
+	if pos < base {
+		pos = base
+	}
+	var buf []byte
+	for _, op := range ops {
+		buf = encodeNameRec(buf, epoch, op)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	cur, err := fs.seekOffset(tx, f.Inode, pos)
+	if err != nil {
+		return err
+	}
+	_, err = f.write(&cur, buf)
+	return err
+}
+
+// readLog calls apply for every record of the log f, it fails on a record
+// that is damaged or not of epoch.
+func (fs *FileSystem) readLog(f *Vfile, epoch uint32, apply func(nameOp)) error {
+	base := fs.logBase(f)
+	if f.Inode.FileSize <= uint64(base) {
+		return nil
+	}
+	data := make([]byte, int64(f.Inode.FileSize)-base)
+	cur, err := fs.seekOffset(nil, f.Inode, base)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.readData(nil, f.Inode, &cur, data); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		op, n, err := decodeNameRec(data, epoch)
+		if err != nil {
+			return err
+		}
+		apply(op)
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+/*
+ names.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+  The name index maps FileMeta.Name to the uids of the files. It is kept in
+  memory and persisted as a name log (see namelog.go) in the system file
+  SysInodeNames, appended in the transaction of the operation that changes a
+  name. The epoch of the log and the flags of the index are the ExtMetas of
+  the system file. A log that fails to load is rebuilt from the inodes.
+  Depots without system inodes keep the index in memory only and build it
+  from the inodes on first use.
+*/
+
+const (
+	namesMetaSize     = 8    // [epoch u32][flags u32]
+	namesCompactMin   = 1024 // records in the log before a compaction
+	namesFlagUnique   = 1
+	namesCompactRatio = 2
+)
+
+var ErrNameExists = errors.New("File name exists")
+
+// NameEntry is a file found by ScanPrefix.
+type NameEntry struct {
+	Name string
+	Uid  string
+}
+
+type nameIndex struct {
+	lock    sync.Mutex
+	loaded  bool
+	unique  bool
+	epoch   uint32
+	names   map[string][]string
+	sorted  []string // names in order, nil when stale
+	live    int      // uids in the index
+	records int      // records in the log
+	file    *Vfile   // nil on depots without system inodes
+}
+
+func encodeNamesMeta(epoch uint32, unique bool) []byte {
+	data := make([]byte, namesMetaSize)
+	binary.LittleEndian.PutUint32(data, epoch)
+	if unique {
+		binary.LittleEndian.PutUint32(data[4:], namesFlagUnique)
+	}
+	return data
+}
+
+func (ni *nameIndex) reset() {
+	ni.names = make(map[string][]string)
+	ni.sorted = nil
+	ni.live, ni.records = 0, 0
+}
+
+func (ni *nameIndex) apply(op nameOp) {
+	ni.records++
+	uids := ni.names[op.name]
+	for i, uid := range uids {
+		if uid != op.uid {
+			continue
+		}
+		if op.op == nameDel {
+			uids = append(uids[:i:i], uids[i+1:]...)
+			ni.live--
+			if len(uids) == 0 {
+				delete(ni.names, op.name)
+				ni.sorted = nil
+			} else {
+				ni.names[op.name] = uids
+			}
+		}
+		return
+	}
+	if op.op == nameAdd {
+		if len(uids) == 0 {
+			ni.sorted = nil
+		}
+		ni.names[op.name] = append(uids, op.uid)
+		ni.live++
+	}
+}
+
+// conflict returns the first op adding a name another file already has.
+func (ni *nameIndex) conflict(ops []nameOp) *nameOp {
+	for i := range ops {
+		if ops[i].op != nameAdd {
+			continue
+		}
+		for _, uid := range ni.names[ops[i].name] {
+			if uid != ops[i].uid {
+				return &ops[i]
+			}
+		}
+	}
+	return nil
+}
+
+// initNames loads the index of a depot with system inodes when the file
+// system is opened, the index of another depot is built on first use.
+func (fs *FileSystem) initNames() error {
+	if !fs.Smeta.HasSysInodes() {
+		return nil
+	}
+	fs.names.lock.Lock()
+	defer fs.names.lock.Unlock()
+	return fs.loadNamesLocked()
+}
+
+// loadNamesLocked reads the index from the log, or rebuilds it when the log
+// is damaged. The index lock must be held.
+func (fs *FileSystem) loadNamesLocked() error {
+	ni := &fs.names
+	if ni.loaded {
+		return nil
+	}
+	ni.reset()
+	if !fs.Smeta.HasSysInodes() {
+		return fs.rebuildNamesLocked()
+	}
+	f, err := fs.openSysFile(SysInodeNames, 0, encodeNamesMeta(0, false))
+	if err != nil {
+		return err
+	}
+	if len(f.Meta.ExtMetas) != namesMetaSize {
+		return errors.New("Bad name index meta")
+	}
+	ni.file = f
+	ni.epoch = binary.LittleEndian.Uint32(f.Meta.ExtMetas)
+	ni.unique = binary.LittleEndian.Uint32(f.Meta.ExtMetas[4:])&namesFlagUnique != 0
+	if err := fs.readLog(f, ni.epoch, ni.apply); err != nil {
+		fs.log.Warnf("Name index damaged, rebuild it: %v", err)
+		return fs.rebuildNamesLocked()
+	}
+	ni.loaded = true
+	return nil
+}
+
+// rebuildNamesLocked builds the index from the committed inodes and writes
+// it to the log. The index lock must be held.
+func (fs *FileSystem) rebuildNamesLocked() error {
+	ni := &fs.names
+	ni.reset()
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if !fs.device.volumes[g].ready.Load() {
+			continue
+		}
+		bm := fs.GetInodeBitmap(g)
+		for i := 0; i < len(bm)*8; i++ {
+			if bm[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			ptr := MakeEntAddr(uint32(i), uint32(g)+1, false)
+			if !fs.isValidInode(ptr) {
+				continue
+			}
+			snap, err := fs.inode2snap(ptr)
+			if err == ErrIsDir || err == errFrozen {
+				continue
+			} else if err != nil {
+				fs.log.Warnf("Name index skips inode %d: %v", ptr, err)
+				continue
+			}
+			ni.apply(nameOp{nameAdd, snap.Name, snap.Key})
+		}
+	}
+	if ni.file == nil || fs.readOnly {
+		ni.loaded = true
+		return nil
+	}
+	tx := fs.beginTx()
+	if err := fs.compactNamesLocked(tx); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		return err
+	}
+	ni.epoch++
+	ni.records = ni.live
+	ni.loaded = true
+	return nil
+}
+
+// compactNamesLocked rewrites the log in tx as a snapshot of the index under
+// the next epoch. The index lock must be held.
+func (fs *FileSystem) compactNamesLocked(tx *txn) error {
+	ni := &fs.names
+	var ops []nameOp
+	for name, uids := range ni.names {
+		for _, uid := range uids {
+			ops = append(ops, nameOp{nameAdd, name, uid})
+		}
+	}
+	if err := fs.writeLog(tx, ni.file, ni.epoch+1, ops, true); err != nil {
+		return err
+	}
+	return fs.storeNamesMeta(tx, ni.epoch+1, ni.unique)
+}
+
+func (fs *FileSystem) storeNamesMeta(tx *txn, epoch uint32, unique bool) error {
+	f := fs.names.file
+	m := FileMeta{ExtMetas: encodeNamesMeta(epoch, unique)}
+	mbuff, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	return fs.storeMeta(tx, f.Inodeptr, f.Inode, mbuff)
+}
+
+// commitNames commits tx together with the changes ops make to the index.
+// With unique names on, tx is aborted and ErrNameExists returned when an op
+// adds a name another file has. tx is aborted on any error before the commit.
+// The log is compacted in tx when it grew too long, or when the index became
+// empty, which gives back all blocks of the log at once.
+func (fs *FileSystem) commitNames(tx *txn, ops ...nameOp) error {
+	ni := &fs.names
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if len(ops) == 0 || (!ni.loaded && !ni.unique && !fs.Smeta.HasSysInodes()) {
+		// an index in memory only is built from the inodes on first use
+		return fs.commitTx(tx)
+	}
+	if err := fs.loadNamesLocked(); err != nil {
+		fs.abortTx(tx)
+		return err
+	}
+	if ni.unique {
+		if op := ni.conflict(ops); op != nil {
+			fs.abortTx(tx)
+			return fmt.Errorf("%w: %s", ErrNameExists, op.name)
+		}
+	}
+	// applied ahead of the commit, a failed commit reloads the index
+	for _, op := range ops {
+		ni.apply(op)
+	}
+	compact := ni.records > namesCompactMin && ni.records > namesCompactRatio*ni.live ||
+		ni.live == 0 && ni.records > 0
+	if ni.file != nil {
+		var err error
+		if compact {
+			err = fs.compactNamesLocked(tx)
+		} else {
+			err = fs.writeLog(tx, ni.file, ni.epoch, ops, false)
+		}
+		if err != nil {
+			ni.loaded = false
+			fs.abortTx(tx)
+			return err
+		}
+	}
+	if err := fs.commitTx(tx); err != nil {
+		ni.loaded = false
+		return err
+	}
+	if ni.file != nil && compact {
+		ni.epoch++
+		ni.records = ni.live
+	}
+	return nil
+}
+
+// LookupByName returns the uids of the files named name, in the order they
+// got the name.
+//
+// Parameters:
+//   - name: The name of the files.
+//
+// Returns:
+//   - []string: The uids of the files.
+//   - error: FNF when no file has the name, or an error loading the index.
+func (fs *FileSystem) LookupByName(name string) ([]string, error) {
+	ni := &fs.names
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if err := fs.loadNamesLocked(); err != nil {
+		return nil, err
+	}
+	uids := ni.names[name]
+	if len(uids) == 0 {
+		return nil, FNF
+	}
+	return append([]string(nil), uids...), nil
+}
+
+// ScanPrefix returns the files whose name starts with prefix, ordered by
+// name. An empty prefix returns all files.
+//
+// Parameters:
+//   - prefix: The prefix of the names.
+//
+// Returns:
+//   - []NameEntry: The names and uids of the files found.
+//   - error: An error loading the index.
+func (fs *FileSystem) ScanPrefix(prefix string) ([]NameEntry, error) {
+	ni := &fs.names
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if err := fs.loadNamesLocked(); err != nil {
+		return nil, err
+	}
+	if ni.sorted == nil {
+		ni.sorted = make([]string, 0, len(ni.names))
+		for name := range ni.names {
+			ni.sorted = append(ni.sorted, name)
+		}
+		sort.Strings(ni.sorted)
+	}
+	var list []NameEntry
+	for i := sort.SearchStrings(ni.sorted, prefix); i < len(ni.sorted); i++ {
+		name := ni.sorted[i]
+		if !strings.HasPrefix(name, prefix) {
+			break
+		}
+		for _, uid := range ni.names[name] {
+			list = append(list, NameEntry{Name: name, Uid: uid})
+		}
+	}
+	return list, nil
+}
+
+// SetUniqueNames turns the uniqueness of names on or off. While it is on,
+// CreateFile and UpdateMeta fail with ErrNameExists on a name another file
+// has. The setting is kept in the depot, depots without system inodes keep
+// it until they are closed.
+//
+// Parameters:
+//   - on: Whether names must be unique.
+//
+// Returns:
+//   - error: ErrNameExists when turning it on while files share a name.
+func (fs *FileSystem) SetUniqueNames(on bool) error {
+	if err := fs.writable("SetUniqueNames"); err != nil {
+		return err
+	}
+	ni := &fs.names
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if err := fs.loadNamesLocked(); err != nil {
+		return err
+	}
+	if on == ni.unique {
+		return nil
+	}
+	if on {
+		for name, uids := range ni.names {
+			if len(uids) > 1 {
+				return fmt.Errorf("%w: %s", ErrNameExists, name)
+			}
+		}
+	}
+	if ni.file != nil {
+		tx := fs.beginTx()
+		if err := fs.storeNamesMeta(tx, ni.epoch, on); err != nil {
+			fs.abortTx(tx)
+			return err
+		}
+		if err := fs.commitTx(tx); err != nil {
+			return err
+		}
+	}
+	ni.unique = on
+	return nil
+}
+
+// RebuildNameIndex builds the name index again from the inodes, e.g. after
+// the volumes were changed by other means than the file system.
+//
+// Returns:
+//   - error: Any error reading the inodes or writing the index.
+func (fs *FileSystem) RebuildNameIndex() error {
+	if err := fs.writable("RebuildNameIndex"); err != nil {
+		return err
+	}
+	ni := &fs.names
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if fs.Smeta.HasSysInodes() {
+		ni.loaded = false
+		if err := fs.loadNamesLocked(); err != nil {
+			return err
+		}
+	}
+	return fs.rebuildNamesLocked()
+}
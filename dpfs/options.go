@@ -0,0 +1,198 @@
+/*
+ options.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+  The geometry of a depot is fixed when it is created: the block size, the
+  number of blocks of a group and the number of blocks per inode (the inodes
+  ratio). A group holds BlocksInGroup/InodesRatio inodes. A small-object depot
+  takes 4 KB blocks and the lowest ratio, a media depot large blocks and a
+  high ratio. An existing depot keeps the geometry of its super block, the
+  options only apply to the way it is used.
+*/
+
+// SyncPolicy tells when the journal and the volume files are synced.
+type SyncPolicy int
+
+const (
+	// SyncCommit syncs the journal and the volumes touched by each
+	// transaction, a transaction committed survives a crash.
+	SyncCommit SyncPolicy = iota
+	// SyncOnClose leaves the syncs to Close and Vfile.Sync. It is faster, but
+	// a crash may lose the transactions committed since the last sync and
+	// leave the depot for Check to repair.
+	SyncOnClose
+)
+
+var ErrBadGeometry = errors.New("Bad depot geometry")
+
+// Options describes the depot opened or created by MakeFileSystemWithOptions.
+// The zero value of a field takes its default.
+type Options struct {
+	Root          string             // directory of the volume files
+	Pattern       string             // regular expression of the volume file names
+	Template      string             // template of the volume file names
+	Groups        uint32             // block groups of a new depot, one volume file each
+	BlocksInGroup uint32             // blocks of a group, DefaultBlocksInGroup when 0
+	BlockSize     uint32             // DefaultBlockSize when 0
+	InodesRatio   uint32             // blocks per inode, DefaultInodesRatio when 0
+	ShardId       uint16             // part of the uids of the files
+	BigAlloc      bool               // allocate big blocks of 64 blocks for large writes
+	CacheBlocks   int                // pointer blocks cached per tree level, BlockCacheSize when 0
+	Sync          SyncPolicy         // SyncCommit by default
+	Logger        logrus.FieldLogger // the standard logrus logger when nil
+	Features      []Feature          // such as FeatureChecksums or WithKeyProvider
+	ReadOnly      bool               // open an existing depot read-only, see OpenReadOnly
+	Backend       VolumeBackend      // the files of Root when nil, closed by FileSystem.Close
+}
+
+// validate fills in the defaults of o and checks the geometry.
+func (o *Options) validate() error {
+	if o.BlocksInGroup == 0 {
+		o.BlocksInGroup = DefaultBlocksInGroup
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.InodesRatio == 0 {
+		o.InodesRatio = DefaultInodesRatio
+	}
+	if o.CacheBlocks == 0 {
+		o.CacheBlocks = BlockCacheSize
+	}
+	if o.Logger == nil {
+		o.Logger = logrus.StandardLogger()
+	}
+	if o.ReadOnly && o.Groups == 0 {
+		o.Groups = 1 // the depot exists, its groups come from the super block
+	}
+	switch {
+	case o.Groups == 0 || o.Groups > MaxBlockGroupNum:
+		return fmt.Errorf("%w: %d groups, a depot has 1 to %d", ErrBadGeometry, o.Groups, MaxBlockGroupNum)
+	case o.BlockSize%4096 != 0 || o.BlockSize > MaxBlockSize:
+		return fmt.Errorf("%w: block size %d, it must be a multiple of 4096 up to %d", ErrBadGeometry, o.BlockSize, MaxBlockSize)
+	case o.BlocksInGroup%1024 != 0 || o.BlocksInGroup > DefaultBlocksInGroup:
+		// a block address holds 20 bits of block index
+		return fmt.Errorf("%w: %d blocks in a group, it must be a multiple of 1024 up to %d", ErrBadGeometry, o.BlocksInGroup, DefaultBlocksInGroup)
+	case o.InodesRatio%DefaultInodesRatio != 0:
+		return fmt.Errorf("%w: inodes ratio %d, it must be a multiple of %d", ErrBadGeometry, o.InodesRatio, DefaultInodesRatio)
+	case o.BlocksInGroup/o.InodesRatio == 0 || (o.BlocksInGroup/o.InodesRatio)%64 != 0:
+		// the inode bitmap is kept in words of 64 bits
+		return fmt.Errorf("%w: %d blocks in a group with inodes ratio %d give %d inodes, it must be a non-zero multiple of 64",
+			ErrBadGeometry, o.BlocksInGroup, o.InodesRatio, o.BlocksInGroup/o.InodesRatio)
+	case o.CacheBlocks < 0:
+		return fmt.Errorf("negative cache size %d", o.CacheBlocks)
+	case o.Sync != SyncCommit && o.Sync != SyncOnClose:
+		return fmt.Errorf("unknown sync policy %d", o.Sync)
+	}
+	return nil
+}
+
+// MakeFileSystemWithOptions opens the depot of opts.Root, or creates it with
+// the geometry of opts when it has no volume file yet.
+//
+// Parameters:
+//   - opts: The location, the geometry, the features and the tuning of the
+//     depot. The geometry of an existing depot comes from its super block.
+//
+// Returns:
+//   - *FileSystem: The file system, ready for use.
+//   - error: An ErrBadGeometry telling the constraint broken by opts, or an
+//     error opening the depot.
+func MakeFileSystemWithOptions(opts Options) (*FileSystem, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{
+		Smeta: SuperBlock{
+			BlockSize:     opts.BlockSize,
+			TotalGroups:   opts.Groups,
+			BlocksInGroup: opts.BlocksInGroup,
+			InodesRatio:   opts.InodesRatio,
+			ShardId:       opts.ShardId,
+		},
+		device: &VolumeFiles{
+			log:      opts.Logger,
+			noSync:   opts.Sync == SyncOnClose,
+			readOnly: opts.ReadOnly,
+			backend:  opts.Backend,
+		},
+		ibCache:  newBlockCache(opts.CacheBlocks),
+		bg:       background{closing: make(chan struct{})},
+		log:      opts.Logger,
+		readOnly: opts.ReadOnly,
+	}
+	if opts.BigAlloc {
+		fs.Smeta.EnableBigAlloc()
+	}
+	for _, f := range opts.Features {
+		f(fs)
+	}
+	if fs.Smeta.HasDedup() && fs.Smeta.HasEncryption() {
+		return nil, ErrDedupEncrypted
+	}
+	fs.Smeta.EnableSysInodes() //new depots only, an existing one keeps its super block
+	if err := fs.device.Init(opts.Root, opts.Pattern, opts.Template, fs.Smeta, fs.blockGroups); err != nil {
+		return nil, err
+	}
+	fs.Smeta = fs.device.smeta
+	fs.geo = &fs.device.geo
+	fs.blockGroups = fs.device.groups
+	if err := fs.initCrypt(); err != nil {
+		return nil, err
+	}
+	if err := fs.initDedup(); err != nil {
+		return nil, err
+	}
+	if err := fs.reserveSysInodes(); err != nil {
+		return nil, err
+	}
+	if err := fs.initMoves(); err != nil {
+		return nil, err
+	}
+	if err := fs.initNames(); err != nil {
+		return nil, err
+	}
+	if missing := fs.MissingGroups(); fs.readOnly && len(missing) > 0 {
+		fs.log.Warnf("Volume files missing for groups %v", missing)
+	}
+	atomic.StoreUint32(&fs.curBlockGroups, 0)
+	fs.log.Debugf("set current group idx:%d", fs.curBlockGroups)
+	fs.log.Infof(
+		"Init file system <Total space: %d GB, Block: %d, Blocksize: %d, Group: %d, INodeSize: %d, TotalInodes: %d>",
+		fs.Smeta.TotalSpace()/(1024*1024*1024),
+		fs.Smeta.TotalBlocks(),
+		fs.Smeta.BlockSize,
+		fs.Smeta.TotalGroups,
+		binary.Size(Inode{}),
+		fs.Smeta.TotalInodes(),
+	)
+	return fs, nil
+}
@@ -0,0 +1,476 @@
+/*
+ pack.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+  On depots created with FeaturePacking a new file starts packed: its meta
+  and its data are a record in a slot of a slab, a block shared by many small
+  files, instead of a block of its own. The inode keeps the slab in
+  DirectPointers[0] and the slot in DirectPointers[1], Inode.Blocks is 0.
+  A slab starts with a slot directory:
+
+    [magic u32][slots u32] then per slot [owner inode u32][offset u32][length u32]
+
+  and the records fill the block from its end. A slot whose owner is 0 is
+  free. A file stays packed while its meta and data take PackLimit bytes at
+  most, beyond that it moves to blocks of its own with the meta in front of
+  the data like any other file.
+
+  A record is never changed in place: a write stores the new record and
+  releases the old slot in the same transaction. The slot changes are
+  resolved on commit under the slab lock, where the slabs they touch are
+  compacted and written whole, and a slab left without records is freed.
+  Slabs with room are remembered in memory, a depot opened again fills the
+  slabs it frees slots in.
+*/
+
+const (
+	PackLimit     = 2048 // bytes of meta and data of a packed file at most
+	slabMagic     = 0x42414C53
+	slabHeader    = 8
+	slabEntrySize = 12
+)
+
+var ErrBadSlot = errors.New("Bad packed slot")
+
+// FeaturePacking packs the meta and the data of small files into shared
+// blocks.
+var FeaturePacking Feature = func(fs *FileSystem) {
+	fs.Smeta.EnablePacking()
+}
+
+func (i *Inode) IsPacked() bool {
+	return i.Attr&(1<<InodeAttrPacked) != 0
+}
+
+type packer struct {
+	lock sync.RWMutex // held across the commit of slot changes
+	open map[uint32]int
+}
+
+// slotChange releases the slot of a record of inodeptr, or stores the record
+// of inode when inode is set.
+type slotChange struct {
+	inodeptr uint32
+	inode    *Inode
+	slab     uint32
+	slot     uint32
+	rec      []byte
+}
+
+// releaseSlot releases the record of the packed inode when tx commits.
+func (tx *txn) releaseSlot(inodeptr uint32, inode *Inode) {
+	if inode.DirectPointers[0] != 0 {
+		tx.slots = append(tx.slots, slotChange{inodeptr: inodeptr, slab: inode.DirectPointers[0], slot: inode.DirectPointers[1]})
+	}
+}
+
+// storeSlot stores rec as the record of inode when tx commits, the slot is
+// set in the inode then. A record stored before for the inode is replaced.
+func (tx *txn) storeSlot(inodeptr uint32, inode *Inode, rec []byte) {
+	for i := range tx.slots {
+		if c := &tx.slots[i]; c.inode != nil && c.inodeptr == inodeptr {
+			c.inode, c.rec = inode, rec
+			return
+		}
+	}
+	tx.slots = append(tx.slots, slotChange{inodeptr: inodeptr, inode: inode, rec: rec})
+}
+
+type slab struct {
+	owners []uint32
+	recs   [][]byte
+}
+
+func decodeSlab(buf []byte) (*slab, error) {
+	if binary.LittleEndian.Uint32(buf) != slabMagic {
+		return nil, ErrBadSlot
+	}
+	n := int(binary.LittleEndian.Uint32(buf[4:]))
+	end := slabHeader + n*slabEntrySize
+	if end > len(buf) {
+		return nil, ErrBadSlot
+	}
+	s := &slab{owners: make([]uint32, n), recs: make([][]byte, n)}
+	for i := 0; i < n; i++ {
+		e := buf[slabHeader+i*slabEntrySize:]
+		s.owners[i] = binary.LittleEndian.Uint32(e)
+		if s.owners[i] == 0 {
+			continue
+		}
+		off, size := int(binary.LittleEndian.Uint32(e[4:])), int(binary.LittleEndian.Uint32(e[8:]))
+		if off < end || off+size > len(buf) {
+			return nil, ErrBadSlot
+		}
+		s.recs[i] = append([]byte(nil), buf[off:off+size]...)
+	}
+	return s, nil
+}
+
+// encode returns the slab as a block of bs bytes, the records are packed
+// at its end.
+func (s *slab) encode(bs int) []byte {
+	buf := make([]byte, bs)
+	binary.LittleEndian.PutUint32(buf, slabMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(s.owners)))
+	off := bs
+	for i, owner := range s.owners {
+		if owner == 0 {
+			continue
+		}
+		off -= len(s.recs[i])
+		copy(buf[off:], s.recs[i])
+		e := buf[slabHeader+i*slabEntrySize:]
+		binary.LittleEndian.PutUint32(e, owner)
+		binary.LittleEndian.PutUint32(e[4:], uint32(off))
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(s.recs[i])))
+	}
+	return buf
+}
+
+func (s *slab) used() int {
+	n := slabHeader + len(s.owners)*slabEntrySize
+	for _, rec := range s.recs {
+		n += len(rec)
+	}
+	return n
+}
+
+func (s *slab) freeSlot() int {
+	for i, owner := range s.owners {
+		if owner == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// fits reports whether a record of n bytes fits in a slab of bs bytes.
+func (s *slab) fits(bs, n int) bool {
+	if s.freeSlot() < 0 {
+		n += slabEntrySize
+	}
+	return s.used()+n <= bs
+}
+
+func (s *slab) put(owner uint32, rec []byte) uint32 {
+	i := s.freeSlot()
+	if i < 0 {
+		i = len(s.owners)
+		s.owners = append(s.owners, 0)
+		s.recs = append(s.recs, nil)
+	}
+	s.owners[i], s.recs[i] = owner, rec
+	return uint32(i)
+}
+
+// drop frees the slot of owner, the free slots at the end of the directory
+// are cut.
+func (s *slab) drop(slot, owner uint32) {
+	if int(slot) >= len(s.owners) || s.owners[slot] != owner {
+		return
+	}
+	s.owners[slot], s.recs[slot] = 0, nil
+	n := len(s.owners)
+	for n > 0 && s.owners[n-1] == 0 {
+		n--
+	}
+	s.owners, s.recs = s.owners[:n], s.recs[:n]
+}
+
+func (fs *FileSystem) readSlab(ptr uint32) (*slab, error) {
+	if EntAddr(ptr).IsBigBlock() > 0 {
+		return nil, ErrBadSlot
+	}
+	buf := make([]byte, fs.Smeta.BlockSize)
+	if _, _, err := fs.readBlock(ptr, 0, buf); err != nil {
+		return nil, err
+	}
+	return decodeSlab(buf)
+}
+
+// slabRecord returns the record in slot of the slab s, for inode.
+func slabRecord(s *slab, slot uint32, inode *Inode) ([]byte, error) {
+	if int(slot) >= len(s.owners) || s.owners[slot] == 0 || uint64(len(s.recs[slot])) != inode.DataSize() {
+		return nil, ErrBadSlot
+	}
+	return s.recs[slot], nil
+}
+
+// packedRecord returns the meta and the data of the packed inode.
+func (fs *FileSystem) packedRecord(inode *Inode) ([]byte, error) {
+	fs.pack.lock.RLock()
+	defer fs.pack.lock.RUnlock()
+	s, err := fs.readSlab(inode.DirectPointers[0])
+	if err != nil {
+		return nil, err
+	}
+	return slabRecord(s, inode.DirectPointers[1], inode)
+}
+
+// newPacked sets up inodeptr as an empty packed file of generation seq with
+// the meta mbuff, its record is stored when tx commits.
+func (fs *FileSystem) newPacked(tx *txn, inodeptr uint32, seq uint32, mbuff []byte) (*Inode, error) {
+	inode := &Inode{
+		Seq:   seq,
+		Attr:  1 << InodeAttrPacked,
+		CTime: uint64(time.Now().Unix()),
+	}
+	return inode, fs.repack(tx, inodeptr, inode, mbuff, nil)
+}
+
+// repack replaces the record of the packed inode by the meta mbuff and data
+// in tx. The inode moves to blocks of its own when they take more than
+// PackLimit bytes.
+func (fs *FileSystem) repack(tx *txn, inodeptr uint32, inode *Inode, mbuff, data []byte) error {
+	tx.releaseSlot(inodeptr, inode)
+	if len(mbuff)+len(data) > PackLimit {
+		return fs.unpack(tx, inodeptr, inode, mbuff, data)
+	}
+	inode.MetaSize = uint16(len(mbuff))
+	inode.FileSize = uint64(len(data))
+	tx.storeSlot(inodeptr, inode, append(append([]byte(nil), mbuff...), data...))
+	return fs.syncInode(tx, inodeptr, inode)
+}
+
+// unpack moves inode to blocks of its own holding mbuff and data, in tx. The
+// caller releases the slot.
+func (fs *FileSystem) unpack(tx *txn, inodeptr uint32, inode *Inode, mbuff, data []byte) error {
+	blks, _, err := fs.allocBlocks(tx, 1, 1, false)
+	if err != nil {
+		return err
+	}
+	// a new block, nothing refers to it before tx commits
+	if _, _, err := fs.writeBlock(blks[0], mbuff, 0); err != nil {
+		return err
+	}
+	inode.Attr &^= 1 << InodeAttrPacked
+	if fs.Smeta.HasExtents() {
+		inode.Attr |= 1 << InodeAttrExtents
+	}
+	inode.MetaSize = uint16(len(mbuff))
+	inode.FileSize = 0
+	inode.Blocks = 1
+	inode.DirectPointers = [DirectBlocks]uint32{blks[0]}
+	if len(data) == 0 {
+		return fs.syncInode(tx, inodeptr, inode)
+	}
+	vf := &Vfile{fs: fs, Inodeptr: inodeptr, Inode: inode, tx: tx}
+	cur, err := fs.slotOffset(tx, inode, 0)
+	if err != nil {
+		return err
+	}
+	_, err = vf.writeSlots(&cur, data)
+	return err
+}
+
+// packedOffset returns the offset of the position pos of a packed or an
+// inline file, as if its data followed the meta in a block.
+func (fs *FileSystem) packedOffset(inode *Inode, pos int64) VfileOffset {
+	at := int64(inode.MetaSize) + pos
+	bs := int64(fs.Smeta.BlockSize)
+	return VfileOffset{offset: pos, blockIdx: uint32(at / bs), blkRemOffset: int(at % bs)}
+}
+
+// readPacked reads the data of the packed inode at cur.
+func (fs *FileSystem) readPacked(inode *Inode, cur *VfileOffset, data []byte) (int, error) {
+	if uint64(cur.offset) >= inode.FileSize {
+		return 0, io.EOF
+	}
+	rec, err := fs.packedRecord(inode)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(data, rec[int64(inode.MetaSize)+cur.offset:])
+	*cur = fs.packedOffset(inode, cur.offset+int64(n))
+	return n, nil
+}
+
+// writePacked writes data at cur of a packed file, a file growing beyond
+// PackLimit is unpacked first.
+func (vf *Vfile) writePacked(cur *VfileOffset, data []byte) (int, error) {
+	fs := vf.fs
+	rec, err := fs.packedRecord(vf.Inode)
+	if err != nil {
+		return 0, err
+	}
+	mbuff, old := rec[:vf.Inode.MetaSize], rec[vf.Inode.MetaSize:]
+	end := max(int64(len(old)), cur.offset+int64(len(data)))
+	if int64(len(mbuff))+end > PackLimit {
+		if err := vf.unpack(mbuff, old); err != nil {
+			return 0, err
+		}
+		if *cur, err = fs.slotOffset(vf.tx, vf.Inode, cur.offset); err != nil {
+			return 0, err
+		}
+		return vf.writeSlots(cur, data)
+	}
+	buf := make([]byte, end)
+	copy(buf, old)
+	copy(buf[cur.offset:], data)
+	if err := fs.repack(vf.tx, vf.Inodeptr, vf.Inode, mbuff, buf); err != nil {
+		return 0, err
+	}
+	*cur = fs.packedOffset(vf.Inode, cur.offset+int64(len(data)))
+	return len(data), nil
+}
+
+// truncatePacked changes the size of a packed file.
+func (vf *Vfile) truncatePacked(size int64) error {
+	rec, err := vf.fs.packedRecord(vf.Inode)
+	if err != nil {
+		return err
+	}
+	mbuff, old := rec[:vf.Inode.MetaSize], rec[vf.Inode.MetaSize:]
+	if int64(len(mbuff))+size > PackLimit {
+		if err := vf.unpack(mbuff, old); err != nil {
+			return err
+		}
+		return vf.extend(size)
+	}
+	buf := make([]byte, size)
+	copy(buf, old)
+	return vf.fs.repack(vf.tx, vf.Inodeptr, vf.Inode, mbuff, buf)
+}
+
+func (vf *Vfile) unpack(mbuff, data []byte) error {
+	vf.tx.releaseSlot(vf.Inodeptr, vf.Inode)
+	return vf.fs.unpack(vf.tx, vf.Inodeptr, vf.Inode, mbuff, data)
+}
+
+// stageSlots resolves the slot changes of tx: the slots released are freed
+// first, then every record stored goes to a slab of tx or a slab known to
+// have room, or to a new slab. The slabs touched are staged whole, the
+// empty ones are released. The slab lock must be held.
+func (fs *FileSystem) stageSlots(tx *txn) error {
+	bs := int(fs.Smeta.BlockSize)
+	slabs := make(map[uint32]*slab)
+	var order []uint32
+	load := func(ptr uint32) (*slab, error) {
+		if s, ok := slabs[ptr]; ok {
+			return s, nil
+		}
+		s, err := fs.readSlab(ptr)
+		if err != nil {
+			return nil, err
+		}
+		slabs[ptr] = s
+		order = append(order, ptr)
+		return s, nil
+	}
+	for _, c := range tx.slots {
+		if c.inode != nil {
+			continue
+		}
+		s, err := load(c.slab)
+		if err != nil {
+			return err
+		}
+		s.drop(c.slot, c.inodeptr)
+	}
+	for _, c := range tx.slots {
+		if c.inode == nil {
+			continue
+		}
+		ptr, err := fs.findSlab(tx, slabs, order, len(c.rec), load)
+		if err != nil {
+			return err
+		}
+		if ptr == 0 {
+			blks, _, err := fs.allocBlocks(tx, 1, 1, false)
+			if err != nil {
+				return err
+			}
+			ptr = blks[0]
+			slabs[ptr] = &slab{}
+			order = append(order, ptr)
+		}
+		c.inode.DirectPointers[0] = ptr
+		c.inode.DirectPointers[1] = slabs[ptr].put(c.inodeptr, c.rec)
+		if err := fs.syncInode(tx, c.inodeptr, c.inode); err != nil {
+			return err
+		}
+	}
+	tx.slabRoom = make(map[uint32]int)
+	for _, ptr := range order {
+		s := slabs[ptr]
+		if len(s.owners) == 0 {
+			if err := fs.releaseDataBlock(tx, []uint32{ptr}); err != nil {
+				return err
+			}
+			tx.slabRoom[ptr] = -1
+			continue
+		}
+		if err := fs.stageBlock(tx, ptr, s.encode(bs), 0); err != nil {
+			return err
+		}
+		tx.slabRoom[ptr] = bs - s.used()
+	}
+	return nil
+}
+
+// findSlab returns a slab with room for a record of n bytes, or 0 when a
+// new one is needed. The slabs of retired groups take no records.
+func (fs *FileSystem) findSlab(tx *txn, slabs map[uint32]*slab, order []uint32, n int, load func(uint32) (*slab, error)) (uint32, error) {
+	bs := int(fs.Smeta.BlockSize)
+	for _, ptr := range order {
+		if slabs[ptr].fits(bs, n) && !fs.isRetired(ptr) {
+			return ptr, nil
+		}
+	}
+	for ptr, room := range fs.pack.open {
+		if _, ok := slabs[ptr]; ok || room < n || fs.isRetired(ptr) {
+			continue
+		}
+		s, err := load(ptr)
+		if err != nil {
+			return 0, err
+		}
+		if s.fits(bs, n) {
+			return ptr, nil
+		}
+	}
+	return 0, nil
+}
+
+// settleSlots remembers the room left in the slabs of tx once it is
+// durable.
+func (fs *FileSystem) settleSlots(tx *txn) {
+	p := &fs.pack
+	if p.open == nil {
+		p.open = make(map[uint32]int)
+	}
+	for ptr, room := range tx.slabRoom {
+		if room < slabEntrySize+FileMetaAlign {
+			delete(p.open, ptr)
+		} else {
+			p.open[ptr] = room
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ readonly.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+  A file system opened by OpenReadOnly inspects a depot without changing a
+  byte of it, such as a backup snapshot or a read-only mount. The volume files
+  and the journal are opened O_RDONLY and a missing volume file is reported
+  instead of being created. A committed transaction left in the journal is not
+  replayed, the depot is read as the volumes hold it.
+
+  Every mutating call fails with a *ReadOnlyError, and system files never
+  created read as empty ones.
+*/
+
+var ErrMissingGroup = errors.New("Missing volume file")
+
+// ReadOnlyError names the operation rejected by a read-only file system,
+// errors.Is reports it as ErrReadOnly.
+type ReadOnlyError struct {
+	Op string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%s: read-only file system", e.Op)
+}
+
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
+
+// OpenReadOnly opens the depot of root read-only.
+//
+// Parameters:
+//   - root: The directory of the volume files.
+//   - features: Features needed to read the depot, such as WithKeyProvider
+//     for an encrypted one.
+//
+// Returns:
+//   - *FileSystem: A file system whose mutating calls fail with a
+//     *ReadOnlyError. Reading a file of a missing group fails with
+//     ErrMissingGroup, see MissingGroups.
+//   - error: An error if root holds no depot or it cannot be read.
+func OpenReadOnly(root string, features ...Feature) (*FileSystem, error) {
+	return MakeFileSystemWithOptions(Options{Root: root, Features: features, ReadOnly: true})
+}
+
+// ReadOnly reports whether the file system was opened read-only.
+func (fs *FileSystem) ReadOnly() bool {
+	return fs.readOnly
+}
+
+// MissingGroups returns the ids of the groups, from 1 on, that have no volume
+// file. A writable file system creates them on first use.
+func (fs *FileSystem) MissingGroups() []uint32 {
+	return fs.device.missingGroups()
+}
+
+// alive fails the calls made after Close with os.ErrClosed.
+func (fs *FileSystem) alive() error {
+	if fs.device.closed.Load() {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// writable fails the operation op of a read-only or closed file system.
+func (fs *FileSystem) writable(op string) error {
+	if err := fs.alive(); err != nil {
+		return err
+	}
+	if fs.readOnly {
+		return &ReadOnlyError{Op: op}
+	}
+	return nil
+}
@@ -20,6 +20,8 @@
 
 package dpfs
 
+import "sort"
+
 type Seg struct {
 	offset int
 	length int
@@ -66,3 +68,31 @@ func mergeSeg(addr []uint32) ([]Seg, int) {
 	}
 	return segs, bits
 }
+
+// bitSpans returns the merged byte ranges of a bitmap touched by the bits of
+// addr. Unlike mergeSeg the input does not need to be sorted and a big block
+// starting in the middle of a byte covers the 9 bytes it spans.
+func bitSpans(addr []uint32) []Seg {
+	type span struct{ from, to int }
+	spans := make([]span, 0, len(addr))
+	for _, e := range addr {
+		idx, _, isBig := EntAddr(e).GetAddr()
+		last := idx
+		if isBig > 0 {
+			last += 63
+		}
+		spans = append(spans, span{int(idx / 8), int(last/8) + 1})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].from < spans[j].from })
+	segs := []Seg{}
+	for _, s := range spans {
+		if n := len(segs); n > 0 && segs[n-1].offset+segs[n-1].length >= s.from {
+			if end := s.to - segs[n-1].offset; end > segs[n-1].length {
+				segs[n-1].length = end
+			}
+			continue
+		}
+		segs = append(segs, Seg{offset: s.from, length: s.to - s.from})
+	}
+	return segs
+}
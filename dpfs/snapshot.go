@@ -0,0 +1,478 @@
+/*
+ snapshot.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+/*
+  A snapshot freezes the files of the depot as they are when it is taken:
+  every regular file is cloned (see clone.go) to a frozen inode, which shares
+  the blocks of the file and is never written. A later write to the file
+  copies the blocks it changes. Frozen inodes take no part in the file list
+  and the name index, and their uids are unknown to OpenFile, UpdateMeta,
+  CloneFile and DeleteFile.
+
+  A snapshot is a frozen inode of its own, holding a name log (see
+  namelog.go) that maps the uid of every file to the uid of its frozen copy.
+  The system file SysInodeSnaps is a name log of the snapshots by name, its
+  ExtMetas is the epoch of the log like for directories. A snapshot is taken
+  and deleted with the tree lock and every inode lock held, so that no
+  operation runs half done meanwhile. Directories are not part of a
+  snapshot, its files are found by uid.
+*/
+
+var (
+	ErrSnapshotExists = errors.New("Snapshot exists")
+	ErrNoSnapshot     = errors.New("Snapshot not found")
+	ErrReadOnly       = errors.New("Read-only file")
+	errFrozen         = errors.New("Frozen inode")
+)
+
+// SnapshotInfo describes a snapshot listed by ListSnapshots.
+type SnapshotInfo struct {
+	Name  string
+	CTime uint64
+	Files int
+}
+
+// Snapshot is a read-only view of the files of the depot at the moment the
+// snapshot was taken.
+type Snapshot struct {
+	Name  string
+	CTime uint64
+	fs    *FileSystem
+	files map[string]string // uid of a file, uid of its frozen copy
+}
+
+type snapCatalog struct {
+	lock   sync.Mutex
+	loaded bool
+	epoch  uint32
+	snaps  map[string]string // name, uid of the snapshot
+	file   *Vfile
+}
+
+// lockInodes takes every inode lock, so that no file operation runs until
+// the returned function releases them. The tree lock must be held: outside
+// of it an operation holds a single inode lock at a time.
+func (fs *FileSystem) lockInodes() func() {
+	for i := range fs.inodeLocks {
+		fs.inodeLocks[i].Lock()
+	}
+	return func() {
+		for i := range fs.inodeLocks {
+			fs.inodeLocks[i].Unlock()
+		}
+	}
+}
+
+// loadSnapsLocked reads the snapshot catalog. The catalog lock must be held.
+func (fs *FileSystem) loadSnapsLocked() error {
+	c := &fs.snaps
+	if c.loaded {
+		return nil
+	}
+	f, err := fs.openSysFile(SysInodeSnaps, 0, encodeDirMeta(0))
+	if err != nil {
+		return err
+	}
+	if len(f.Meta.ExtMetas) != dirMetaSize {
+		return errors.New("Bad snapshot catalog meta")
+	}
+	c.file = f
+	c.epoch = binary.LittleEndian.Uint32(f.Meta.ExtMetas)
+	c.snaps = make(map[string]string)
+	err = fs.readLog(f, c.epoch, func(op nameOp) {
+		if op.op == nameAdd {
+			c.snaps[op.name] = op.uid
+		} else if c.snaps[op.name] == op.uid {
+			delete(c.snaps, op.name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.loaded = true
+	return nil
+}
+
+// snapshotsReady checks that the depot can keep snapshots.
+func (fs *FileSystem) snapshotsReady() error {
+	if fs.dedup == nil {
+		return ErrNoClones
+	}
+	if !fs.Smeta.HasSysInodes() {
+		return ErrNoSysInodes
+	}
+	return nil
+}
+
+// CreateSnapshot freezes the current files of the depot and their content
+// under name. The files stay writable, the blocks they change later on are
+// copied so that the snapshot keeps seeing the content it froze. A snapshot
+// takes a block per file for the meta, the data blocks are shared.
+//
+// Parameters:
+//   - name: The name of the snapshot.
+//
+// Returns:
+//   - error: ErrSnapshotExists when a snapshot of that name exists,
+//     ErrNoClones on a depot without FeatureClones or FeatureDedup, or any
+//     other error. No snapshot is taken in that case.
+func (fs *FileSystem) CreateSnapshot(name string) error {
+	if err := fs.writable("CreateSnapshot"); err != nil {
+		return err
+	}
+	if err := fs.snapshotsReady(); err != nil {
+		return err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	defer fs.lockInodes()()
+	c := &fs.snaps
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := fs.loadSnapsLocked(); err != nil {
+		return err
+	}
+	if _, ok := c.snaps[name]; ok {
+		return ErrSnapshotExists
+	}
+	tx := fs.beginTx()
+	uid, err := fs.freezeFiles(tx, name)
+	if err == nil {
+		err = fs.writeLog(tx, c.file, c.epoch, []nameOp{{nameAdd, name, uid}}, false)
+	}
+	if err != nil {
+		c.loaded = false
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		c.loaded = false
+		return err
+	}
+	c.snaps[name] = uid
+	return nil
+}
+
+// freezeFiles clones every regular file to a frozen inode in tx, and sets
+// up the snapshot name listing them. It returns the uid of the snapshot.
+func (fs *FileSystem) freezeFiles(tx *txn, name string) (string, error) {
+	// list the files first, the clones are allocated from the same bitmaps
+	var ptrs []uint32
+	for g := 0; g < int(fs.groupCount()); g++ {
+		if !fs.device.volumes[g].ready.Load() {
+			continue
+		}
+		bm := fs.GetInodeBitmap(g)
+		for i := 0; i < len(bm)*8; i++ {
+			if bm[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			if ptr := MakeEntAddr(uint32(i), uint32(g)+1, false); fs.isValidInode(ptr) {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+	}
+	var ops []nameOp
+	for _, ptr := range ptrs {
+		node, err := fs.readInode(ptr)
+		if err != nil {
+			return "", err
+		}
+		if node.IsDir() || node.IsQuarantined() || node.IsFrozen() {
+			continue
+		}
+		mbuff, err := fs.readMeta(node)
+		if err != nil {
+			return "", err
+		}
+		_, frozen, err := fs.cloneInode(tx, node, mbuff, 1<<InodeAttrFrozen)
+		if err != nil {
+			return "", err
+		}
+		ops = append(ops, nameOp{nameAdd, fs.inode2Uid(ptr, node), frozen})
+	}
+	m := FileMeta{Name: name, ExtMetas: encodeDirMeta(0)}
+	mbuff, err := m.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	if len(mbuff) >= int(fs.Smeta.BlockSize) {
+		return "", errors.New("File meta overlimit")
+	}
+	inodeptr, err := fs.allocInode(tx)
+	if err != nil {
+		return "", err
+	}
+	oldnode, err := fs.readInodeTx(tx, inodeptr)
+	if err != nil {
+		return "", err
+	}
+	node, err := fs.initInode(tx, inodeptr, oldnode.Seq+1, 1<<InodeAttrFrozen, mbuff)
+	if err != nil {
+		return "", err
+	}
+	f, err := fs.inodeFile(inodeptr, node)
+	if err != nil {
+		return "", err
+	}
+	if err := fs.writeLog(tx, f, 0, ops, false); err != nil {
+		return "", err
+	}
+	return fs.inode2Uid(inodeptr, f.Inode), nil
+}
+
+// loadSnapshot reads the snapshot uid named name.
+func (fs *FileSystem) loadSnapshot(name, uid string) (*Snapshot, *Vfile, error) {
+	key := FileKey{}
+	if err := fs.parseUid(&key, uid); err != nil {
+		return nil, nil, err
+	}
+	node, err := fs.readInode(key.Inodeptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.inode2Uid(key.Inodeptr, node) != uid || !node.IsFrozen() {
+		return nil, nil, errors.New("Bad snapshot inode")
+	}
+	f, err := fs.inodeFile(key.Inodeptr, node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(f.Meta.ExtMetas) != dirMetaSize {
+		return nil, nil, errors.New("Bad snapshot meta")
+	}
+	s := &Snapshot{Name: name, CTime: node.CTime, fs: fs, files: make(map[string]string)}
+	err = fs.readLog(f, binary.LittleEndian.Uint32(f.Meta.ExtMetas), func(op nameOp) {
+		s.files[op.name] = op.uid
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, f, nil
+}
+
+// ListSnapshots returns the snapshots of the depot, the oldest first.
+//
+// Returns:
+//   - []SnapshotInfo: The name, the creation time and the number of files
+//     of every snapshot.
+//   - error: ErrNoClones on a depot without FeatureClones or FeatureDedup,
+//     or any error reading the snapshots.
+func (fs *FileSystem) ListSnapshots() ([]SnapshotInfo, error) {
+	if err := fs.snapshotsReady(); err != nil {
+		return nil, err
+	}
+	c := &fs.snaps
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := fs.loadSnapsLocked(); err != nil {
+		return nil, err
+	}
+	list := make([]SnapshotInfo, 0, len(c.snaps))
+	for name, uid := range c.snaps {
+		s, _, err := fs.loadSnapshot(name, uid)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, SnapshotInfo{Name: name, CTime: s.CTime, Files: len(s.files)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CTime != list[j].CTime {
+			return list[i].CTime < list[j].CTime
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// OpenSnapshot opens the snapshot name for reading.
+//
+// Parameters:
+//   - name: The name of the snapshot.
+//
+// Returns:
+//   - *Snapshot: The files of the depot as of the moment the snapshot was
+//     taken. It stays usable until the snapshot is deleted.
+//   - error: ErrNoSnapshot when there is no snapshot of that name, or any
+//     error reading it.
+func (fs *FileSystem) OpenSnapshot(name string) (*Snapshot, error) {
+	if err := fs.snapshotsReady(); err != nil {
+		return nil, err
+	}
+	c := &fs.snaps
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := fs.loadSnapsLocked(); err != nil {
+		return nil, err
+	}
+	uid, ok := c.snaps[name]
+	if !ok {
+		return nil, ErrNoSnapshot
+	}
+	s, _, err := fs.loadSnapshot(name, uid)
+	return s, err
+}
+
+// DeleteSnapshot deletes the snapshot name, the blocks only it kept are
+// freed. Files opened from it fail with FNF afterwards.
+//
+// Parameters:
+//   - name: The name of the snapshot.
+//
+// Returns:
+//   - error: ErrNoSnapshot when there is no snapshot of that name, or any
+//     other error. The snapshot is kept in that case.
+func (fs *FileSystem) DeleteSnapshot(name string) error {
+	if err := fs.writable("DeleteSnapshot"); err != nil {
+		return err
+	}
+	if err := fs.snapshotsReady(); err != nil {
+		return err
+	}
+	fs.tree.lock.Lock()
+	defer fs.tree.lock.Unlock()
+	defer fs.lockInodes()()
+	c := &fs.snaps
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := fs.loadSnapsLocked(); err != nil {
+		return err
+	}
+	uid, ok := c.snaps[name]
+	if !ok {
+		return ErrNoSnapshot
+	}
+	s, f, err := fs.loadSnapshot(name, uid)
+	if err != nil {
+		return err
+	}
+	tx := fs.beginTx()
+	if err := fs.dropSnapshot(tx, s, f); err != nil {
+		c.loaded = false
+		fs.abortTx(tx)
+		return err
+	}
+	if err := fs.commitTx(tx); err != nil {
+		c.loaded = false
+		return err
+	}
+	delete(c.snaps, name)
+	c.epoch++
+	return nil
+}
+
+// dropSnapshot releases the frozen inodes of s and the snapshot f in tx, and
+// rewrites the catalog without it under the next epoch.
+func (fs *FileSystem) dropSnapshot(tx *txn, s *Snapshot, f *Vfile) error {
+	for _, frozen := range s.files {
+		key := FileKey{}
+		if err := fs.parseUid(&key, frozen); err != nil {
+			return err
+		}
+		node, err := fs.readInode(key.Inodeptr)
+		if err != nil {
+			return err
+		}
+		if fs.inode2Uid(key.Inodeptr, node) != frozen {
+			continue
+		}
+		if err := fs.releaseInode(tx, key.Inodeptr, node); err != nil {
+			return err
+		}
+	}
+	if err := fs.releaseInode(tx, f.Inodeptr, f.Inode); err != nil {
+		return err
+	}
+	c := &fs.snaps
+	var ops []nameOp
+	for name, uid := range c.snaps {
+		if name != s.Name {
+			ops = append(ops, nameOp{nameAdd, name, uid})
+		}
+	}
+	if err := fs.writeLog(tx, c.file, c.epoch+1, ops, true); err != nil {
+		return err
+	}
+	m := FileMeta{ExtMetas: encodeDirMeta(c.epoch + 1)}
+	mbuff, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	return fs.storeMeta(tx, c.file.Inodeptr, c.file.Inode, mbuff)
+}
+
+// OpenFile opens the file uid as it was when the snapshot was taken, the
+// handle is read-only.
+//
+// Parameters:
+//   - uid: The unique identifier the file had in the depot.
+//
+// Returns:
+//   - *Vfile: A read-only handle of the frozen file, Write, WriteAt and
+//     Truncate fail with ErrReadOnly.
+//   - error: FNF when the file was not part of the snapshot or the snapshot
+//     was deleted.
+func (s *Snapshot) OpenFile(uid string) (*Vfile, error) {
+	frozen, ok := s.files[uid]
+	if !ok {
+		return nil, FNF
+	}
+	return s.fs.openFile(frozen, true)
+}
+
+// GetFileList returns the files of the snapshot, keyed by the uids they had
+// in the depot.
+//
+// Returns:
+//   - []FileSnap: The files as they were when the snapshot was taken.
+//   - error: FNF when the snapshot was deleted, or any error reading it.
+func (s *Snapshot) GetFileList() ([]FileSnap, error) {
+	list := make([]FileSnap, 0, len(s.files))
+	for uid, frozen := range s.files {
+		key := FileKey{}
+		if err := s.fs.parseUid(&key, frozen); err != nil {
+			return nil, err
+		}
+		node, err := s.fs.readInode(key.Inodeptr)
+		if err != nil {
+			return nil, err
+		}
+		if s.fs.inode2Uid(key.Inodeptr, node) != frozen || !s.fs.isValidInode(key.Inodeptr) {
+			return nil, FNF
+		}
+		snap, err := s.fs.node2snap(key.Inodeptr, node)
+		if err != nil {
+			return nil, err
+		}
+		snap.Key = uid
+		list = append(list, snap)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
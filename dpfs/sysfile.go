@@ -0,0 +1,124 @@
+/*
+ sysfile.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+/*
+  System files are regular inodes that the file system keeps for itself, they
+  hold data such as the name index. The first SysInodes inodes of group 1 are
+  reserved for them on depots created with AttrSysInodes. A system file is set
+  up the first time it is used. System files do not show in the file list and
+  cannot be opened, updated or deleted through their uid.
+*/
+
+const (
+	SysInodes      = 16 // inodes reserved for system files
+	SysInodeNames  = 1  // the name index
+	SysInodeRoot   = 2  // the root directory
+	SysInodeSnaps  = 3  // the snapshots by name
+	SysInodeMoves  = 4  // the inodes moved by EvacuateGroup
+	SysInodeDefrag = 5  // the cursor of Defragment
+)
+
+func sysInodePtr(idx uint32) uint32 {
+	return MakeEntAddr(idx, 1, false)
+}
+
+func (fs *FileSystem) isSysInode(inodeptr uint32) bool {
+	idx, group, isBig := EntAddr(inodeptr).GetAddr()
+	return fs.Smeta.HasSysInodes() && group == 1 && isBig == 0 && idx < SysInodes
+}
+
+// reserveSysInodes allocates the inodes of the system files, so that no file
+// takes them.
+func (fs *FileSystem) reserveSysInodes() error {
+	if !fs.Smeta.HasSysInodes() || fs.readOnly {
+		return nil
+	}
+	g := &fs.blockGroups[0]
+	g.lock.Lock()
+	if err := fs.device.checkReadyLocked(0, g); err != nil {
+		g.lock.Unlock()
+		return err
+	}
+	var ptrs []uint32
+	for i := uint32(0); i < SysInodes; i++ {
+		if p := sysInodePtr(i); !g.inodeBitmap.CheckBit(p) {
+			ptrs = append(ptrs, p)
+		}
+	}
+	g.inodeBitmap.SetBits(ptrs)
+	g.lock.Unlock()
+	if len(ptrs) == 0 {
+		return nil
+	}
+	tx := fs.beginTx()
+	tx.bitmapOp(recAllocInodes, 0, ptrs)
+	return fs.commitTx(tx)
+}
+
+// openSysFile opens the system file idx, it is created with the attributes
+// attr and meta as its ExtMetas on first use. The caller serializes the
+// access to the file.
+func (fs *FileSystem) openSysFile(idx uint32, attr uint16, meta []byte) (*Vfile, error) {
+	ptr := sysInodePtr(idx)
+	node, err := fs.readInode(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if node.Seq == 0 && fs.readOnly {
+		// never created, read as an empty file
+		vf := &Vfile{fs: fs, Meta: &FileMeta{ExtMetas: meta}, Inodeptr: ptr, Inode: node, readOnly: true}
+		return vf, nil
+	}
+	if node.Seq == 0 {
+		m := FileMeta{ExtMetas: meta}
+		mbuff, err := m.ToBytes()
+		if err != nil {
+			return nil, err
+		}
+		tx := fs.beginTx()
+		if node, err = fs.initInode(tx, ptr, 1, attr, mbuff); err != nil {
+			fs.abortTx(tx)
+			return nil, err
+		}
+		if err := fs.commitTx(tx); err != nil {
+			return nil, err
+		}
+	}
+	return fs.inodeFile(ptr, node)
+}
+
+// inodeFile returns a handle of the inode node, for files the file system
+// keeps to itself.
+func (fs *FileSystem) inodeFile(ptr uint32, node *Inode) (*Vfile, error) {
+	meta, err := fs.loadMeta(node)
+	if err != nil {
+		return nil, err
+	}
+	vf := &Vfile{
+		fs:       fs,
+		Meta:     &meta,
+		Inodeptr: ptr,
+		Inode:    node,
+	}
+	vf.offset.blkRemOffset = int(node.MetaSize)
+	return vf, nil
+}
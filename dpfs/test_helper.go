@@ -28,6 +28,7 @@ import (
 	"hash/crc32"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 )
@@ -247,13 +248,34 @@ func (f *FileDataProvider) Close() (uint32, error) {
 	}
 }
 
-func WriteFile(fs *FileSystem, dp DataProvider, name string, meta []byte, echo bool) (string, int64, uint32, *Vfile, error) {
-	var wtn int64 = 0
-	f, key, err := fs.CreateFile(name, meta)
+func WriteFile(fs *FileSystem, dp DataProvider, name string, meta []byte, echo bool, opts ...FileOption) (string, int64, uint32, *Vfile, error) {
+	f, key, err := fs.CreateFile(name, meta, opts...)
+	if err != nil {
+		fmt.Printf("Create file err:%s\n", err)
+		return "", 0, 0, nil, err
+	}
+	return writeData(f, key, dp, name, echo)
+}
+
+// WritePath is WriteFile for the file at path p, the missing directories of
+// p are created.
+func WritePath(fs *FileSystem, dp DataProvider, p string, meta []byte, echo bool, opts ...FileOption) (string, int64, uint32, *Vfile, error) {
+	if dir := path.Dir(p); dir != "." {
+		if _, err := fs.MkdirAll(dir); err != nil {
+			return "", 0, 0, nil, err
+		}
+	}
+	f, key, err := fs.CreatePath(p, meta, opts...)
 	if err != nil {
 		fmt.Printf("Create file err:%s\n", err)
 		return "", 0, 0, nil, err
 	}
+	return writeData(f, key, dp, p, echo)
+}
+
+func writeData(f *Vfile, key string, dp DataProvider, name string, echo bool) (string, int64, uint32, *Vfile, error) {
+	var wtn int64 = 0
+	var err error
 	start := time.Now()
 	for {
 		data, e := dp.Provide()
@@ -294,9 +316,10 @@ func ReadFile(fs *FileSystem, key string, dc DataConsumer, batchLimit int64, ech
 	var offset int64 = 0
 	defer dc.Close()
 	start := time.Now()
-	for offset < int64(f.Inode.FileSize) {
-		if offset+batchLimit > int64(f.Inode.FileSize) {
-			batchLimit = int64(f.Inode.FileSize) - offset
+	size := f.Size()
+	for offset < size {
+		if offset+batchLimit > size {
+			batchLimit = size - offset
 		}
 		r, err := f.Read(data[:batchLimit])
 		if err != nil {
@@ -24,24 +24,60 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/bits"
 	"os"
-	"path/filepath"
-	"regexp"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	InodeBitmapOffset int64 = 0
-	BlockBitmapOffset int64 = 0
-	InodeOffset       int64 = 0
-	BlockOffset       int64 = 0
-	BlockPointers     int   = 0
-)
+// ErrVolumeExists is returned instead of formatting a volume that already
+// holds a depot.
+var ErrVolumeExists = errors.New("Volume file already formatted")
+
+// Geometry is the layout of the volume files of a depot, derived from its
+// super block. Each file system has its own, so that depots of different
+// shapes can be open side by side.
+type Geometry struct {
+	InodeBitmapOffset int64
+	BlockBitmapOffset int64
+	ChecksumOffset    int64 //checksum table, only with AttrChecksums
+	CryptOffset       int64 //encryption table, only with AttrEncrypted
+	DedupOffset       int64 //dedup table, only with AttrDedup
+	InodeOffset       int64
+	BlockOffset       int64
+	BlockPointers     int // pointers per indirect block
+}
+
+// newGeometry returns the layout of the volume files described by smeta.
+func newGeometry(smeta SuperBlock) Geometry {
+	var geo Geometry
+	geo.InodeBitmapOffset = int64(binary.Size(SuperBlock{}) + binary.Size(BlockGroupDescriptor{}))
+	if smeta.HasEncryption() {
+		geo.InodeBitmapOffset += int64(binary.Size(KeyHeader{}))
+	}
+	geo.BlockBitmapOffset = geo.InodeBitmapOffset + int64(smeta.BlocksInGroup/smeta.InodesRatio)/8
+	geo.ChecksumOffset = geo.BlockBitmapOffset + int64(smeta.BlocksInGroup/8)
+	geo.CryptOffset = geo.ChecksumOffset
+	if smeta.HasChecksums() {
+		geo.CryptOffset += int64(smeta.BlocksInGroup) * ChecksumSize
+	}
+	geo.DedupOffset = geo.CryptOffset
+	if smeta.HasEncryption() {
+		geo.DedupOffset += int64(smeta.BlocksInGroup) * CryptEntrySize
+	}
+	geo.InodeOffset = geo.DedupOffset
+	if smeta.HasRefCounts() {
+		geo.InodeOffset += int64(smeta.BlocksInGroup) * DedupEntrySize
+	}
+	inodecap := int64(binary.Size(Inode{})) * int64(smeta.BlocksInGroup/smeta.InodesRatio)
+	geo.BlockOffset = geo.InodeOffset + inodecap
+	geo.BlockPointers = int(smeta.BlockSize) / 4
+	return geo
+}
 
 func align(value, alignment int64) int64 {
 	if alignment == 0 || (alignment&(alignment-1)) != 0 {
@@ -55,19 +91,20 @@ type Volume struct {
 	Status int
 	Id     int
 	Fn     string
-	file   *os.File
+	file   *volumeFile
+	ready  atomic.Bool //file opened and formatted, safe to use without the group lock
 }
 
 func (v *Volume) GetSize() int64 {
 	if v.file == nil {
 		return 0
 	}
-	fileInfo, err := v.file.Stat()
+	size, err := v.file.Size()
 	if err != nil {
 		logrus.Warnf("Error getting file info:%s\n", err)
 		return -1
 	}
-	return fileInfo.Size()
+	return size
 }
 
 type VolumeFiles struct {
@@ -75,9 +112,17 @@ type VolumeFiles struct {
 	pattern string
 	tpl     string
 	smeta   SuperBlock
+	keyHdr  KeyHeader //of encrypted depots, follows the group descriptor
 	//vols    int
-	volumes []Volume
-	groups  []BlockGroup
+	volumes  []Volume
+	groups   []BlockGroup
+	journal  *Journal
+	backend  VolumeBackend
+	geo      Geometry
+	log      logrus.FieldLogger
+	noSync   bool // the volumes and the journal are synced by Close only
+	readOnly bool // the files are opened O_RDONLY and never created
+	closed   atomic.Bool
 }
 
 func countBits(data []byte) int {
@@ -94,33 +139,54 @@ func SortFileNameAscend(files []os.FileInfo) {
 	})
 }
 
+// volume returns the handle of the volume of group idx.
+func (v *VolumeFiles) volume(idx uint32) *volumeFile {
+	return &volumeFile{backend: v.backend, vol: idx}
+}
+
+// missingGroups returns the ids of the groups without a volume file.
+func (v *VolumeFiles) missingGroups() []uint32 {
+	var ids []uint32
+	for i := uint32(0); i < v.smeta.TotalGroups; i++ {
+		v.groups[i].lock.Lock()
+		if v.volumes[i].Status == 0 {
+			ids = append(ids, i+1)
+		}
+		v.groups[i].lock.Unlock()
+	}
+	return ids
+}
+
+// sync syncs the volume file, unless the sync policy leaves it to Close.
+func (v *VolumeFiles) sync(file *volumeFile) error {
+	if v.noSync {
+		return nil
+	}
+	return file.Sync()
+}
+
 func (v *VolumeFiles) FindLastVolumeIdx() uint32 {
 	var idx uint32 = 0
-	for i, e := range v.volumes {
-		if e.Status > 0 {
+	for i := range v.volumes {
+		if v.volumes[i].Status > 0 {
 			idx = uint32(i)
 		}
 	}
 	return idx
 }
 
-func (v *VolumeFiles) loadMeta(files []string) error {
-	if len(files) == 0 {
+func (v *VolumeFiles) loadMeta(vols []uint32) error {
+	if len(vols) == 0 {
 		return nil //use setup values
 	}
-	for _, f := range files {
-		file, err := os.OpenFile(f, os.O_RDWR, 0644)
-		if err != nil {
-			return err
-		}
+	for _, vol := range vols {
 		smeta := SuperBlock{}
-		if err := binary.Read(file, binary.LittleEndian, &smeta); err != nil {
-			file.Close()
+		r := io.NewSectionReader(v.volume(vol), 0, int64(binary.Size(smeta)))
+		if err := binary.Read(r, binary.LittleEndian, &smeta); err != nil {
 			return err
 		}
 		if err := smeta.Verify(); err != nil {
-			logrus.Errorf("Super block error :%s", err)
-			file.Close()
+			v.log.Errorf("Super block error :%s", err)
 		} else {
 			v.smeta = smeta
 			return nil
@@ -129,104 +195,148 @@ func (v *VolumeFiles) loadMeta(files []string) error {
 	return errors.New("Super block not found")
 }
 
-func (v *VolumeFiles) initParas() {
-	InodeBitmapOffset = int64(binary.Size(SuperBlock{}) + binary.Size(BlockGroupDescriptor{}))
-	//BlockBitmapOffset = InodeBitmapOffset + int64(len(v.groups[0].inodeBitmap))
-	v.smeta.TotalInodes()
-	BlockBitmapOffset = InodeBitmapOffset + int64(v.smeta.BlocksInGroup/v.smeta.InodesRatio)/8
-	InodeOffset = BlockBitmapOffset + int64(v.groups[0].blockBitmap.TotalBits()/8)
-	inodecap := int64(binary.Size(Inode{})) * int64(v.smeta.BlocksInGroup/v.smeta.InodesRatio)
-	BlockOffset = InodeOffset + inodecap
-
-	BlockPointers = int(v.smeta.BlockSize) / 4
-}
-
+// initGroups sets up the tables of the groups, with room for the groups
+// Grow may add.
 func (v *VolumeFiles) initGroups() {
-	v.volumes = make([]Volume, v.smeta.TotalGroups)
+	n := uint32(MaxBlockGroupNum)
+	if v.smeta.TotalGroups > n {
+		n = v.smeta.TotalGroups
+	}
+	v.volumes = make([]Volume, n)
 	for i := 1; i <= len(v.volumes); i++ {
 		v.volumes[i-1].Id = i
 		v.volumes[i-1].Fn = fmt.Sprintf(v.tpl, i)
 	}
-	v.groups = make([]BlockGroup, v.smeta.TotalGroups)
+	v.groups = make([]BlockGroup, n)
+	for i := uint32(0); i < v.smeta.TotalGroups; i++ { //fill data later
+		v.initGroup(i)
+	}
+}
+
+func (v *VolumeFiles) initGroup(idx uint32) {
 	ninode := v.smeta.BlocksInGroup / v.smeta.InodesRatio
-	for i := range v.groups { //fill data later
-		v.groups[i] = BlockGroup{
-			//blockBitmap: make([]uint8, v.smeta.BlocksInGroup/8),
-			gmeta: BlockGroupDescriptor{
-				GroupId: uint32(i + 1),
-			},
+	g := &v.groups[idx]
+	g.gmeta = BlockGroupDescriptor{
+		GroupId: idx + 1,
+	}
+	g.blockBitmap.Init(idx+1, make([]uint8, v.smeta.BlocksInGroup/8))
+	g.inodeBitmap.Init(idx+1, make([]uint8, ninode/8))
+	g.retired.Store(false)
+}
+
+// grow switches to smeta, the super block of a grown depot, and sets up the
+// groups it adds. Their volume files are created on first use.
+func (v *VolumeFiles) grow(smeta SuperBlock) {
+	for i := v.smeta.TotalGroups; i < smeta.TotalGroups; i++ {
+		v.groups[i].lock.Lock()
+		v.initGroup(i)
+		v.groups[i].lock.Unlock()
+	}
+	v.smeta = smeta
+}
+
+// shrink switches to smeta, the super block of a shrunk depot, and removes
+// the volume files of the groups it drops.
+func (v *VolumeFiles) shrink(smeta SuperBlock) error {
+	var first error
+	for i := smeta.TotalGroups; i < v.smeta.TotalGroups; i++ {
+		vv := &v.volumes[i]
+		v.groups[i].lock.Lock()
+		vv.ready.Store(false)
+		vv.file = nil
+		if vv.Status > 0 {
+			if err := v.backend.Remove(i); err != nil && first == nil {
+				first = err
+			}
 		}
-		v.groups[i].blockBitmap.Init(uint32(i+1), make([]uint8, v.smeta.BlocksInGroup/8))
-		v.groups[i].inodeBitmap.Init(uint32(i+1), make([]uint8, ninode/8))
+		vv.Status = 0
+		v.groups[i].lock.Unlock()
 	}
+	v.smeta = smeta
+	return first
 }
 
 func (v *VolumeFiles) scanFiles() (int, error) {
-	pattern := regexp.MustCompile(v.pattern)
-
-	d, err := os.Open(v.root)
+	gfs, err := v.backend.Volumes()
 	if err != nil {
 		return 0, err
 	}
-	defer d.Close()
-	files, err := d.Readdir(-1)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	SortFileNameAscend(files)
-	gfs := []string{}
-	for _, file := range files {
-		if !file.IsDir() && pattern.MatchString(file.Name()) {
-			gfs = append(gfs, filepath.Join(v.root, file.Name()))
-		}
+	if len(gfs) == 0 && v.readOnly {
+		return 0, errors.New("No volume file found")
 	}
-
 	if err := v.loadMeta(gfs); err != nil {
 		return 0, err
 	}
 	v.initGroups()
-	v.initParas()
+	v.geo = newGeometry(v.smeta)
+	groups := v.smeta.TotalGroups
+	if err := v.journal.replay(v); err != nil {
+		return 0, err
+	}
+	// a replayed Grow rewrites the super blocks
+	if err := v.loadMeta(gfs); err != nil {
+		return 0, err
+	}
+	if v.smeta.TotalGroups != groups {
+		v.initGroups()
+	}
 
 	start := time.Now()
-	for _, file := range gfs {
-		if err := v.initVolume(file); err != nil {
+	for _, vol := range gfs {
+		if err := v.initVolume(vol); err != nil {
 			return 0, err
 		}
 	}
 	duration := time.Since(start)
-	logrus.Infof("load %d volume files, cost:%s", len(gfs), duration)
+	v.log.Infof("load %d volume files, cost:%s", len(gfs), duration)
 	return len(gfs), nil
 }
 
-func (v *VolumeFiles) initVolume(fn string) error {
-	//vv := &v.volumes[idx]
-	file, err := os.OpenFile(fn, os.O_RDWR, 0644)
+func (v *VolumeFiles) initVolume(vol uint32) error {
+	file := v.volume(vol)
+	size, err := file.Size()
 	if err != nil {
 		return err
 	}
+	r := io.NewSectionReader(file, 0, size)
 	smeta := SuperBlock{}
-	if err := binary.Read(file, binary.LittleEndian, &smeta); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &smeta); err != nil {
+		return err
+	}
+	meta := BlockGroupDescriptor{}
+	if err := binary.Read(r, binary.LittleEndian, &meta); err != nil {
 		return err
 	}
+	if meta.GroupId > v.smeta.TotalGroups {
+		// left behind by a shrink that stopped before removing it
+		v.log.Warnf("Skip the volume file of a removed group :%d", vol+1)
+		return nil
+	}
+	if meta.GroupId != vol+1 {
+		return fmt.Errorf("Volume %d holds group %d", vol+1, meta.GroupId)
+	}
 	if smeta.Crc != v.smeta.Crc {
-		logrus.Errorf("Bad super block in file :%s", fn)
+		v.log.Errorf("Bad super block in file :%s", v.volumes[vol].Fn)
 		return errors.New("Bad super block found")
 	}
-
-	meta := BlockGroupDescriptor{}
-	if err := binary.Read(file, binary.LittleEndian, &meta); err != nil {
-		return err
+	if v.smeta.HasEncryption() {
+		var hdr KeyHeader
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		// an open may have stopped before raising the epoch of every volume
+		hdr.Epoch = max(hdr.Epoch, v.keyHdr.Epoch)
+		v.keyHdr = hdr
 	}
 	//re gen meta
 	bitsI := make([]uint8, v.groups[meta.GroupId-1].inodeBitmap.TotalBits()/8)
-	if _, err := file.Read(bitsI); err != nil {
+	if _, err := io.ReadFull(r, bitsI); err != nil {
 		return err
 	}
 	v.groups[meta.GroupId-1].inodeBitmap.Init(meta.GroupId, bitsI)
 
 	bitsB := make([]uint8, v.groups[meta.GroupId-1].blockBitmap.TotalBits()/8)
-	if _, err := file.Read(bitsB); err != nil {
+	if _, err := io.ReadFull(r, bitsB); err != nil {
 		return err
 	}
 	v.groups[meta.GroupId-1].blockBitmap.Init(meta.GroupId, bitsB)
@@ -237,7 +347,7 @@ func (v *VolumeFiles) initVolume(fn string) error {
 	totalInodes := v.groups[meta.GroupId-1].inodeBitmap.TotalBits()
 	freeInodes := v.groups[meta.GroupId-1].inodeBitmap.FreeBits()
 
-	logrus.Debugf("load group file [grpid:%d, used blocks:%d/%d, used inodes:%d/%d]",
+	v.log.Debugf("load group file [grpid:%d, used blocks:%d/%d, used inodes:%d/%d]",
 		meta.GroupId,
 		totalBlocks-int(freeBlocks), totalBlocks,
 		totalInodes-int(freeInodes), totalInodes,
@@ -245,38 +355,80 @@ func (v *VolumeFiles) initVolume(fn string) error {
 	v.groups[meta.GroupId-1].gmeta = meta
 	v.volumes[meta.GroupId-1].Status = 1
 	v.volumes[meta.GroupId-1].file = file
+	v.volumes[meta.GroupId-1].ready.Store(true)
 	return nil
 }
 
-func (v *VolumeFiles) checkReady(idx uint32, g *BlockGroup) error { //todo fix
+// formatted reports whether the volume of group idx holds a valid super
+// block, which a volume about to be formatted must not: it was not found by
+// scanFiles, or the file system was closed.
+func (v *VolumeFiles) formatted(idx uint32) bool {
+	if size, err := v.backend.Size(idx); err != nil || size == 0 {
+		return false
+	}
+	smeta := SuperBlock{}
+	r := io.NewSectionReader(v.volume(idx), 0, int64(binary.Size(smeta)))
+	if err := binary.Read(r, binary.LittleEndian, &smeta); err != nil {
+		return false
+	}
+	return smeta.Verify() == nil
+}
+
+// checkReady makes sure the volume file of group idx exists and is opened.
+// It takes the group lock on the slow path, callers already holding the
+// lock must use checkReadyLocked instead.
+func (v *VolumeFiles) checkReady(idx uint32, g *BlockGroup) error {
+	if v.volumes[idx].ready.Load() {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return v.checkReadyLocked(idx, g)
+}
+
+func (v *VolumeFiles) checkReadyLocked(idx uint32, g *BlockGroup) error {
 	vv := &v.volumes[idx]
-	var err error
+	if vv.ready.Load() {
+		return nil
+	}
+	if v.closed.Load() {
+		return os.ErrClosed
+	}
+	if vv.Status == 0 && v.readOnly {
+		return fmt.Errorf("%w: group %d (%s)", ErrMissingGroup, idx+1, vv.Fn)
+	}
 	if vv.Status == 0 {
-		//init file
-		vv.file, err = os.Create(filepath.Join(v.root, vv.Fn))
-		if err != nil {
-			return err
+		if v.formatted(idx) {
+			return fmt.Errorf("%w: group %d (%s)", ErrVolumeExists, idx+1, vv.Fn)
 		}
+		//init file
+		vv.file = v.volume(idx)
+		w := io.NewOffsetWriter(vv.file, 0)
 		v.smeta.Sign()
-		if err := binary.Write(vv.file, binary.LittleEndian, v.smeta); err != nil {
+		if err := binary.Write(w, binary.LittleEndian, v.smeta); err != nil {
 			return err
 		}
-		if err := binary.Write(vv.file, binary.LittleEndian, g.gmeta); err != nil {
+		if err := binary.Write(w, binary.LittleEndian, g.gmeta); err != nil {
 			return err
 		}
+		if v.smeta.HasEncryption() {
+			if err := binary.Write(w, binary.LittleEndian, v.keyHdr); err != nil {
+				return err
+			}
+		}
 
 		dataI := g.inodeBitmap.GetData(-1, 0)
-		if _, err := vv.file.Write(dataI); err != nil {
+		if _, err := w.Write(dataI); err != nil {
 			return err
 		}
 
 		dataB := g.blockBitmap.GetData(-1, 0)
-		if _, err := vv.file.Write(dataB); err != nil {
+		if _, err := w.Write(dataB); err != nil {
 			return err
 		}
 
-		zeroBytes := make([]byte, InodeSize*int(8*len(dataI)))
-		if _, err := vv.file.Write(zeroBytes); err != nil {
+		// checksum, encryption and dedup tables and the inodes read as zeros
+		if err := vv.file.Truncate(v.geo.BlockOffset); err != nil {
 			return err
 		}
 
@@ -284,14 +436,10 @@ func (v *VolumeFiles) checkReady(idx uint32, g *BlockGroup) error { //todo fix
 		if err := vv.file.Sync(); err != nil {
 			return err
 		}
-	} else {
-		if vv.file == nil {
-			vv.file, err = os.Open(filepath.Join(v.root, vv.Fn))
-			if err != nil {
-				return err
-			}
-		}
+	} else if vv.file == nil {
+		vv.file = v.volume(idx)
 	}
+	vv.ready.Store(true)
 	return nil
 }
 
@@ -309,11 +457,25 @@ func (v *VolumeFiles) Init(root, pattern, tpl string, smeta SuperBlock, groups [
 		v.tpl = tpl
 	}
 	v.smeta = smeta //set default
+	if v.log == nil {
+		v.log = logrus.StandardLogger()
+	}
+	if v.backend == nil {
+		b := NewFileBackend(root, v.pattern, v.tpl)
+		b.readOnly = v.readOnly
+		v.backend = b
+	}
+	journal, err := openJournal(v.volume(JournalVolume), v.readOnly)
+	if err != nil {
+		return err
+	}
+	journal.log, journal.noSync = v.log, v.noSync
+	v.journal = journal
 	//scan file
 	if n, err := v.scanFiles(); err != nil {
 		return err
 	} else if n > 0 {
-		logrus.Debugf("Overwrite the original superblock by reading parameters from the specified file")
+		v.log.Debugf("Overwrite the original superblock by reading parameters from the specified file")
 	}
 	return nil
 }
@@ -0,0 +1,53 @@
+/*
+ volume_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVolumeNoReformat(t *testing.T) {
+	fs, err := MakeFileSystemWithOptions(Options{Groups: 2, BlocksInGroup: 2048, Backend: NewMemBackend()})
+	if err != nil {
+		t.Fatalf("Failed to open file system: %v", err)
+	}
+	defer fs.Close()
+	if _, _, err := fs.CreateFile("a", nil); err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+
+	// a volume lost track of, as by a double open, is never formatted again
+	g := &fs.blockGroups[0]
+	g.lock.Lock()
+	fs.device.volumes[0].ready.Store(false)
+	fs.device.volumes[0].Status = 0
+	g.lock.Unlock()
+	if err := fs.device.checkReady(0, g); !errors.Is(err, ErrVolumeExists) {
+		t.Errorf("Formatted volume of group 1: %v", err)
+	}
+	if !fs.device.formatted(0) {
+		t.Errorf("Volume of group 1 lost its super block")
+	}
+	if fs.device.formatted(1) {
+		t.Errorf("Volume of group 2 never written")
+	}
+}
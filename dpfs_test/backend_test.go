@@ -0,0 +1,314 @@
+/*
+ backend_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// backendCase opens a backend again and again on the same storage.
+type backendCase struct {
+	name string
+	open func(t *testing.T) dpfs.VolumeBackend
+}
+
+func backendCases() []backendCase {
+	mem := dpfs.NewMemBackend()
+	return []backendCase{
+		{"file", func(t *testing.T) dpfs.VolumeBackend {
+			return dpfs.NewFileBackend(testDir, "", "")
+		}},
+		{"mem", func(t *testing.T) dpfs.VolumeBackend {
+			return mem.Reopen()
+		}},
+		{"image", func(t *testing.T) dpfs.VolumeBackend {
+			b, err := dpfs.NewImageBackend(filepath.Join(testDir, "depot.img"), 64<<20)
+			if err != nil {
+				t.Fatalf("Open image failed: %v", err)
+			}
+			return b
+		}},
+	}
+}
+
+func TestVolumeBackends(t *testing.T) {
+	for _, c := range backendCases() {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.MkdirAll(testDir, 0755); err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(testDir)
+			b := c.open(t)
+			defer b.Close()
+
+			if vols, err := b.Volumes(); err != nil || len(vols) != 0 {
+				t.Fatalf("Bad volumes of an empty backend %v: %v", vols, err)
+			}
+			if _, err := b.Size(2); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Size of a missing volume: %v", err)
+			}
+			if _, err := b.WriteAt(2, []byte("hello"), 100); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if _, err := b.WriteAt(dpfs.JournalVolume, []byte("journal"), 0); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if vols, err := b.Volumes(); err != nil || !reflect.DeepEqual(vols, []uint32{2}) {
+				t.Errorf("Bad volumes %v: %v", vols, err)
+			}
+			if size, err := b.Size(2); err != nil || size != 105 {
+				t.Errorf("Bad size %d: %v", size, err)
+			}
+			buf := bytes.Repeat([]byte{0xff}, 10)
+			if n, err := b.ReadAt(2, buf, 96); n != 9 || err != io.EOF || !bytes.Equal(buf[:9], []byte("\x00\x00\x00\x00hello")) {
+				t.Errorf("Bad read %d %q: %v", n, buf[:n], err)
+			}
+
+			// the bytes cut off read as zeros when the volume grows again
+			if err := b.Truncate(2, 102); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if _, err := b.WriteAt(2, []byte("x"), 110); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			buf = make([]byte, 11)
+			if n, err := b.ReadAt(2, buf, 100); n != 11 || err != nil || !bytes.Equal(buf, []byte("he\x00\x00\x00\x00\x00\x00\x00\x00x")) {
+				t.Errorf("Bad read after truncate %d %q: %v", n, buf[:n], err)
+			}
+			if err := b.Sync(2); err != nil {
+				t.Errorf("Sync failed: %v", err)
+			}
+			if err := b.Remove(2); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+			if vols, err := b.Volumes(); err != nil || len(vols) != 0 {
+				t.Errorf("Bad volumes after remove %v: %v", vols, err)
+			}
+			if _, err := b.ReadAt(2, buf, 0); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Read of a removed volume: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendDepots(t *testing.T) {
+	for _, c := range backendCases() {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.MkdirAll(testDir, 0755); err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(testDir)
+			doBackendDepot(t, c)
+		})
+	}
+}
+
+func doBackendDepot(t *testing.T, c backendCase) {
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystemWithOptions(dpfs.Options{
+			Groups:        1,
+			BlocksInGroup: 2048,
+			BigAlloc:      true,
+			Backend:       c.open(t),
+			Features:      []dpfs.Feature{dpfs.FeatureChecksums, dpfs.FeatureClones},
+		})
+		if err != nil {
+			t.Fatalf("Failed to open file system: %v", err)
+		}
+		return fs
+	}
+	fs := open()
+	r := mrand.New(mrand.NewSource(25))
+	files := make(map[string][]byte)
+	for i, size := range []int{10, 8192*3 + 1, 8192 * 1500} {
+		data := stressPayload(r, size)
+		key, err := createWith(fs, string(rune('a'+i)), data)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		files[key] = data
+	}
+	if err := fs.Grow(3); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		data := stressPayload(r, 8192*300)
+		key, err := createWith(fs, "more", data)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		files[key] = data
+	}
+	if err := fs.EvacuateGroup(2); err != nil {
+		t.Fatalf("Evacuate failed: %v", err)
+	}
+	fs.Close()
+
+	fs = open()
+	defer fs.Close()
+	if fs.Smeta.TotalGroups != 2 || len(fs.MissingGroups()) != 0 {
+		t.Errorf("Bad groups %d, missing %v", fs.Smeta.TotalGroups, fs.MissingGroups())
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	entries, err := os.ReadDir(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	expect := map[string][]string{
+		"file":  {"depot.journal", "vol.000001", "vol.000002"},
+		"mem":   nil,
+		"image": {"depot.img"},
+	}[c.name]
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("Depot files %v, want %v", names, expect)
+	}
+	if mem, ok := c.open(t).(*dpfs.MemBackend); ok {
+		// the free blocks and the unused inodes take no memory
+		total, free := fs.StatBlocks(-1)
+		used := (total - free) * int64(fs.Smeta.BlockSize)
+		if mem.Allocated() > used+2<<20 {
+			t.Errorf("Volumes with %d bytes in use take %d", used, mem.Allocated())
+		}
+	}
+}
+
+func TestBackendsClosed(t *testing.T) {
+	for _, c := range backendCases() {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.MkdirAll(testDir, 0755); err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(testDir)
+
+			b := c.open(t)
+			if _, err := b.WriteAt(0, []byte("hello"), 0); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if _, err := b.Volumes(); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Volumes after close: %v", err)
+			}
+			if _, err := b.ReadAt(0, make([]byte, 5), 0); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Read after close: %v", err)
+			}
+			if _, err := b.WriteAt(0, []byte("x"), 0); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Write after close: %v", err)
+			}
+			if _, err := b.Size(0); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Size after close: %v", err)
+			}
+			for name, err := range map[string]error{"Sync": b.Sync(0), "Truncate": b.Truncate(0, 1), "Remove": b.Remove(0)} {
+				if !errors.Is(err, os.ErrClosed) {
+					t.Errorf("%s after close: %v", name, err)
+				}
+			}
+			if err := b.Close(); err != nil {
+				t.Errorf("Second close: %v", err)
+			}
+
+			// the volumes outlive Close
+			b = c.open(t)
+			defer b.Close()
+			buf := make([]byte, 5)
+			if _, err := b.ReadAt(0, buf, 0); err != nil || string(buf) != "hello" {
+				t.Errorf("Bad read after reopen %q: %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestDepotClosed(t *testing.T) {
+	for _, c := range backendCases() {
+		t.Run(c.name, func(t *testing.T) {
+			if err := os.MkdirAll(testDir, 0755); err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(testDir)
+
+			open := func() *dpfs.FileSystem {
+				fs, err := dpfs.MakeFileSystemWithOptions(dpfs.Options{
+					Groups:        2,
+					BlocksInGroup: 2048,
+					Backend:       c.open(t),
+				})
+				if err != nil {
+					t.Fatalf("Failed to open file system: %v", err)
+				}
+				return fs
+			}
+			fs := open()
+			data := stressPayload(mrand.New(mrand.NewSource(25)), 8192*3)
+			key, err := createWith(fs, "a", data)
+			if err != nil {
+				t.Fatalf("Create file failed: %v", err)
+			}
+			f, err := fs.OpenFile(key)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// nothing after Close may format the volumes again
+			if _, _, err := fs.CreateFile("b", nil); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Create after close: %v", err)
+			}
+			if _, err := f.WriteAt([]byte("x"), 0); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Write after close: %v", err)
+			}
+			if _, err := f.ReadAt(make([]byte, 10), 0); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Read after close: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Errorf("Second close: %v", err)
+			}
+
+			fs = open()
+			defer fs.Close()
+			if err := readBack(fs, key, data); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
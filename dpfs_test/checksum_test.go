@@ -0,0 +1,173 @@
+/*
+ checksum_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// flipByte inverts a byte in the block ptr straight in the volume file.
+func flipByte(fs *dpfs.FileSystem, ptr uint32, off int64) error {
+	idx, group, _ := dpfs.EntAddr(ptr).GetAddr()
+	file, err := os.OpenFile(filepath.Join(testDir, fmt.Sprintf(dpfs.DefaultVfTpl, group)), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	pos := fs.Geometry().BlockOffset + int64(idx)*int64(fs.Smeta.BlockSize) + off
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, pos); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, pos)
+	return err
+}
+
+// expectChecksum reads the whole file and wants the checksum error of ptr.
+func expectChecksum(fs *dpfs.FileSystem, key string, ptr uint32) error {
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadAt(make([]byte, f.Size()), 0)
+	var ce *dpfs.ChecksumError
+	if !errors.Is(err, dpfs.ErrChecksum) || !errors.As(err, &ce) {
+		return fmt.Errorf("want a checksum error, got %v", err)
+	}
+	idx, group, _ := dpfs.EntAddr(ptr).GetAddr()
+	if ce.Group != group || ce.Block != idx {
+		return fmt.Errorf("checksum error names block %d:%d, want %d:%d", ce.Group, ce.Block, group, idx)
+	}
+	return nil
+}
+
+func TestChecksums(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, false, dpfs.FeatureChecksums)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	fs := open()
+	if !fs.Smeta.HasChecksums() {
+		t.Fatalf("Checksums not enabled")
+	}
+
+	r := mrand.New(mrand.NewSource(10))
+	data := stressPayload(r, 8192*20+77)
+	f, key, err := fs.CreateFile("sums", []byte("meta"))
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// unaligned rewrites and a cut in the middle of a block
+	chunk := stressPayload(r, 8192+300)
+	if _, err := f.WriteAt(chunk, 8192*3+5); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[8192*3+5:], chunk)
+	data = data[:len(data)-5000]
+	if err := f.Truncate(int64(len(data))); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := fs.UpdateMeta(key, "sums.moved", make([]byte, 1500)); err != nil {
+		t.Fatalf("Update meta failed: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	fs = open()
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After reopen: %v", err)
+	}
+	if f, err = fs.OpenFile(key); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	node := *f.Inode
+
+	// a data block
+	if err := flipByte(fs, node.DirectPointers[1], 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChecksum(fs, key, node.DirectPointers[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := flipByte(fs, node.DirectPointers[1], 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After repair: %v", err)
+	}
+	fs.Close()
+
+	// an indirect block, read from the volume after a reopen
+	if err := flipByte(fs, node.SingleIndirect, 4); err != nil {
+		t.Fatal(err)
+	}
+	fs = open()
+	if err := expectChecksum(fs, key, node.SingleIndirect); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || r.Clean() {
+		t.Errorf("Check should report the bad indirect block: %v", err)
+	}
+	fs.Close()
+	if err := flipByte(fs, node.SingleIndirect, 4); err != nil {
+		t.Fatal(err)
+	}
+	fs = open()
+	defer fs.Close()
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After repair: %v", err)
+	}
+	if f, err = fs.OpenFile(key); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, int64(len(data))-4); n != 4 || err != io.EOF {
+		t.Errorf("ReadAt at the end of file returns %d,%v", n, err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ clone_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestCloneFile(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func(features ...dpfs.Feature) *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, features...)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	writeAt := func(fs *dpfs.FileSystem, key string, data []byte, patch []byte, off int64) []byte {
+		t.Helper()
+		f, err := fs.OpenFile(key)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if _, err := f.WriteAt(patch, off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		data = append([]byte(nil), data...)
+		if end := off + int64(len(patch)); end > int64(len(data)) {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		copy(data[off:], patch)
+		return data
+	}
+	fs := open(dpfs.FeatureClones)
+	_, fb := fs.StatBlocks(-1)
+
+	// big blocks at the start, a tail behind a hole in the double indirect tree
+	r := mrand.New(mrand.NewSource(14))
+	base := stressPayload(r, 8192*150+77)
+	orig, err := createWith(fs, "orig", base)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	data := writeAt(fs, orig, base, stressPayload(r, 8192*3), 8192*3000)
+	_, fb1 := fs.StatBlocks(-1)
+	clone, err := fs.CloneFile(orig, "copy")
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb1-fb2 != 1 {
+		t.Errorf("Clone took %d blocks, want only the meta block", fb1-fb2)
+	}
+	if err := checkMeta(fs, clone, "copy", []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(fs, clone, data); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+
+	// writes to the clone copy the big block and the indirect path
+	copied := writeAt(fs, clone, data, stressPayload(r, 5000), 8192*40+3)
+	copied = writeAt(fs, clone, copied, stressPayload(r, 300), 8192*3001)
+	copied = writeAt(fs, clone, copied, stressPayload(r, 8192), int64(len(copied)))
+	if err := readBack(fs, orig, data); err != nil {
+		t.Fatalf("Original changed by a write to the clone: %v", err)
+	}
+	if err := readBack(fs, clone, copied); err != nil {
+		t.Fatal(err)
+	}
+	// and writes to the original leave the clone alone
+	data = writeAt(fs, orig, data, stressPayload(r, 100), 8192*2+9)
+	if err := readBack(fs, clone, copied); err != nil {
+		t.Fatalf("Clone changed by a write to the original: %v", err)
+	}
+	check(fs)
+
+	// cutting a file whose trees are shared
+	second, err := fs.CloneFile(orig, "second")
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	f, err := fs.OpenFile(orig)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := f.Truncate(8192*3000 + 10); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := f.Truncate(8192*40 + 10); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := readBack(fs, orig, data[:8192*40+10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(fs, second, data); err != nil {
+		t.Fatalf("Clone changed by a truncate of the original: %v", err)
+	}
+	check(fs)
+	fs.Close()
+
+	// the reference counts survive a reopen
+	fs = open()
+	check(fs)
+	for key, expect := range map[string][]byte{orig: data[:8192*40+10], clone: copied, second: data} {
+		if err := readBack(fs, key, expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.DeleteFile(second); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := readBack(fs, orig, data[:8192*40+10]); err != nil {
+		t.Fatalf("After delete: %v", err)
+	}
+	check(fs)
+	for _, key := range []string{orig, clone} {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	check(fs)
+	fs.Close()
+
+	os.RemoveAll(testDir)
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	fs = open()
+	defer fs.Close()
+	key, err := createWith(fs, "plain", data[:100])
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := fs.CloneFile(key, "copy"); err != dpfs.ErrNoClones {
+		t.Errorf("Clone without reference counts returns %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ compress_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// logLines returns n bytes of log-like text that compresses well.
+func logLines(r *mrand.Rand, n int) []byte {
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		fmt.Fprintf(&buf, `{"level":"info","seq":%d,"msg":"request served","status":%d}`+"\n", r.Intn(1000), 200+r.Intn(3))
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestCompression(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	_, fb := fs.StatBlocks(-1)
+
+	if _, _, err := fs.CreateFile("bad", nil, dpfs.WithCodec(7)); err == nil {
+		t.Fatalf("Unknown codec should fail")
+	}
+	r := mrand.New(mrand.NewSource(11))
+	data := logLines(r, dpfs.CompressChunk*5+123)
+	f, key, err := fs.CreateFile("log", []byte("meta"), dpfs.WithCodec(dpfs.CodecFlate))
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	for off := 0; off < len(data); off += 10000 {
+		if _, err := f.Write(data[off:min(off+10000, len(data))]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	list, err := fs.GetFileList()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Bad file list %v: %v", list, err)
+	}
+	if list[0].Size != int64(len(data)) || list[0].Physical*4 > list[0].Size {
+		t.Errorf("Bad sizes, logical %d, physical %d", list[0].Size, list[0].Physical)
+	}
+
+	// reads and seeks go straight to their chunk
+	for i := 0; i < 50; i++ {
+		off := r.Int63n(int64(len(data)))
+		buf := make([]byte, r.Intn(dpfs.CompressChunk*2))
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt %d failed: %v", off, err)
+		}
+	}
+	if _, err := f.SeekPos(dpfs.CompressChunk*3 + 7); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	buf := make([]byte, 100)
+	if n, err := f.Read(buf); err != nil || !bytes.Equal(buf[:n], data[dpfs.CompressChunk*3+7:][:n]) {
+		t.Fatalf("Read after seek failed: %v", err)
+	}
+	if end, _ := f.Seek(0, io.SeekEnd); end != int64(len(data)) {
+		t.Errorf("Bad end position %d", end)
+	}
+
+	// rewrites across chunks, a write past the end and truncates
+	chunk := stressPayload(r, dpfs.CompressChunk+500)
+	if _, err := f.WriteAt(chunk, dpfs.CompressChunk-200); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[dpfs.CompressChunk-200:], chunk)
+	if _, err := f.WriteAt([]byte("tail"), int64(len(data))+dpfs.CompressChunk*3); err != nil {
+		t.Fatalf("WriteAt past the end failed: %v", err)
+	}
+	data = append(data, make([]byte, dpfs.CompressChunk*3)...)
+	data = append(data, "tail"...)
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{dpfs.CompressChunk*2 + 99, dpfs.CompressChunk * 2, dpfs.CompressChunk*4 + 1, 0, 5000} {
+		if err := f.Truncate(int64(size)); err != nil {
+			t.Fatalf("Truncate to %d failed: %v", size, err)
+		}
+		data = append(data, make([]byte, max(0, size-len(data)))...)[:size]
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatalf("After truncate to %d: %v", size, err)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if err := iotest.TestReader(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After reopen: %v", err)
+	}
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ concurrent_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+const (
+	stressWorkers = 16
+	stressRounds  = 20
+)
+
+func stressPayload(r *mrand.Rand, size int) []byte {
+	data := make([]byte, size)
+	r.Read(data)
+	return data
+}
+
+func writeInBatches(f *dpfs.Vfile, r *mrand.Rand, data []byte) error {
+	for off := 0; off < len(data); {
+		n := 1 + r.Intn(64*1024)
+		if off+n > len(data) {
+			n = len(data) - off
+		}
+		wtn, err := f.Write(data[off : off+n])
+		if err != nil {
+			return err
+		}
+		if wtn != n {
+			return fmt.Errorf("short write %d!=%d", wtn, n)
+		}
+		off += n
+	}
+	return nil
+}
+
+func readBack(fs *dpfs.FileSystem, key string, expect []byte) error {
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		return err
+	}
+	if f.Size() != int64(len(expect)) {
+		return fmt.Errorf("bad size %d!=%d", f.Size(), len(expect))
+	}
+	got := make([]byte, len(expect))
+	rdn := 0
+	for rdn < len(got) {
+		n, err := f.Read(got[rdn:])
+		if err != nil {
+			return err
+		}
+		rdn += n
+	}
+	if !bytes.Equal(got, expect) {
+		return fmt.Errorf("data mismatch, key:%s", key)
+	}
+	return nil
+}
+
+func stressWorker(fs *dpfs.FileSystem, seed int64) error {
+	r := mrand.New(mrand.NewSource(seed))
+	for i := 0; i < stressRounds; i++ {
+		data := stressPayload(r, r.Intn(300*1024))
+		f, key, err := fs.CreateFile(fmt.Sprintf("stress.%d.%d", seed, i), []byte{byte(i)})
+		if err != nil {
+			return err
+		}
+		if err := writeInBatches(f, r, data); err != nil {
+			return err
+		}
+		if err := readBack(fs, key, data); err != nil {
+			return err
+		}
+		if err := fs.DeleteFile(key); err != nil {
+			return err
+		}
+		if _, err := fs.OpenFile(key); err != dpfs.FNF {
+			return fmt.Errorf("deleted file still readable: %v", err)
+		}
+	}
+	return nil
+}
+
+func TestConcurrentCreateWriteReadDelete(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(4, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			if err := stressWorker(fs, seed); err != nil {
+				errs <- err
+			}
+		}(int64(w + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
+
+func TestConcurrentReadersSharedFile(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(4, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+
+	r := mrand.New(mrand.NewSource(1))
+	data := stressPayload(r, 8192*300+77)
+	f, key, err := fs.CreateFile("shared", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if err := writeInBatches(f, r, data); err != nil {
+		t.Fatalf("Write file failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := readBack(fs, key, data); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ crypt_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// volumesContain tells if any volume file holds the bytes of s.
+func volumesContain(groups int, s []byte) (bool, error) {
+	for g := 1; g <= groups; g++ {
+		data, err := os.ReadFile(filepath.Join(testDir, fmt.Sprintf(dpfs.DefaultVfTpl, g)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(data, s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestEncryption(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	keyFile := filepath.Join(testDir, "keys")
+	open := func(kp dpfs.KeyProvider) (*dpfs.FileSystem, error) {
+		var features []dpfs.Feature
+		if kp != nil {
+			features = append(features, dpfs.WithKeyProvider(kp))
+		}
+		return dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, false, features...)
+	}
+	kp, err := dpfs.NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	// the content hashes of dedup are not encrypted
+	if _, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, false, dpfs.FeatureDedup, dpfs.WithKeyProvider(kp)); !errors.Is(err, dpfs.ErrDedupEncrypted) {
+		t.Fatalf("Dedup with encryption returns %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, fmt.Sprintf(dpfs.DefaultVfTpl, 1))); !os.IsNotExist(err) {
+		t.Fatalf("Volume created by a rejected depot: %v", err)
+	}
+	fs, err := open(kp)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	if !fs.Smeta.HasEncryption() {
+		t.Fatalf("Encryption not enabled")
+	}
+	_, fb := fs.StatBlocks(-1)
+
+	secret := []byte("top-secret-payload|")
+	data := bytes.Repeat(secret, 8192*20/len(secret))
+	meta := bytes.Repeat([]byte("secret-meta|"), 120) // in a meta block
+	f, key, err := fs.CreateFile("vault", meta)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	chunk := []byte(strings.Repeat("patched|", 1000))
+	if _, err := f.WriteAt(chunk, 8192*4+11); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[8192*4+11:], chunk)
+	// removed before the rotation, its blocks are left free under the old key
+	scratch, scratchKey, err := fs.CreateFile("scratch", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := scratch.Write(data[:8192*3]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	for _, s := range [][]byte{secret, []byte("secret-meta|"), []byte("patched|")} {
+		if found, err := volumesContain(2, s); err != nil || found {
+			t.Fatalf("Plaintext %q in the volumes: %v", s, err)
+		}
+	}
+	if _, err := open(nil); !errors.Is(err, dpfs.ErrNoKeyProvider) {
+		t.Fatalf("Open without keys returns %v", err)
+	}
+
+	// keys reloaded from the file
+	if kp, err = dpfs.NewFileKeyProvider(keyFile); err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	if fs, err = open(kp); err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After reopen: %v", err)
+	}
+	if err := fs.DeleteFile(scratchKey); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	id, err := kp.AddKey()
+	if err != nil {
+		t.Fatalf("Add key failed: %v", err)
+	}
+	done, err := fs.RotateKey()
+	if err != nil {
+		t.Fatalf("Rotate key failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Re-encryption failed: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After rotation: %v", err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	// the old key is no longer needed
+	lines := strings.Split(strings.TrimSpace(readText(t, keyFile)), "\n")
+	if !strings.HasPrefix(lines[len(lines)-1], fmt.Sprintf("%d:", id)) {
+		t.Fatalf("Bad key file %v", lines)
+	}
+	newOnly := filepath.Join(testDir, "keys.new")
+	if err := os.WriteFile(newOnly, []byte(lines[len(lines)-1]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if kp, err = dpfs.NewFileKeyProvider(newOnly); err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	if fs, err = open(kp); err != nil {
+		t.Fatalf("Failed to open with the new key only: %v", err)
+	}
+	defer fs.Close()
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("With the new key only: %v", err)
+	}
+	if err := checkMeta(fs, key, "vault", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// tampering fails authentication
+	if f, err = fs.OpenFile(key); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	ptr := f.Inode.DirectPointers[2]
+	if err := flipByte(fs, ptr, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 100), 8192*2); !errors.Is(err, dpfs.ErrAuth) {
+		t.Errorf("Read of a tampered block returns %v", err)
+	}
+	if err := flipByte(fs, ptr, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+}
+
+func readText(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateKeyClose(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	keyFile := filepath.Join(testDir, "keys")
+	open := func() *dpfs.FileSystem {
+		kp, err := dpfs.NewFileKeyProvider(keyFile)
+		if err != nil {
+			t.Fatalf("Failed to load key file: %v", err)
+		}
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, false, dpfs.WithKeyProvider(kp))
+		if err != nil {
+			t.Fatalf("Failed to open file system: %v", err)
+		}
+		return fs
+	}
+	fs := open()
+	files := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 8192*4)
+		key, err := createWith(fs, "rotate", data)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		files[key] = data
+	}
+	fs.Close()
+
+	// a rotation left running is stopped by Close
+	kp, err := dpfs.NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	if _, err := kp.AddKey(); err != nil {
+		t.Fatalf("Add key failed: %v", err)
+	}
+	fs = open()
+	done, err := fs.RotateKey()
+	if err != nil {
+		t.Fatalf("Rotate key failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, dpfs.ErrRotateStopped) {
+			t.Errorf("Rotation cut by Close returns %v", err)
+		}
+	default:
+		t.Fatalf("Close returned before the rotation")
+	}
+	if _, err := fs.RotateKey(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Rotate key after close: %v", err)
+	}
+
+	fs = open()
+	defer fs.Close()
+	if done, err = fs.RotateKey(); err != nil {
+		t.Fatalf("Rotate key failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Resumed re-encryption failed: %v", err)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
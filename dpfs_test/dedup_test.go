@@ -0,0 +1,273 @@
+/*
+ dedup_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func createWith(fs *dpfs.FileSystem, name string, data []byte) (string, error) {
+	f, key, err := fs.CreateFile(name, []byte("meta"))
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	return key, err
+}
+
+func expectRefs(fs *dpfs.FileSystem, refs int64) error {
+	st, err := fs.DedupStats()
+	if err != nil {
+		return err
+	}
+	if st.References != refs || st.LogicalBytes-st.PhysicalBytes != refs*dpfs.DefaultBlockSize {
+		return fmt.Errorf("bad dedup stats %+v, want %d references", st, refs)
+	}
+	return nil
+}
+
+func TestDedup(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeatureDedup)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	fs := open()
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(13))
+	base := stressPayload(r, 8192*16+100)
+	v1, err := createWith(fs, "v1", base)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// the second version differs in a block and has more data behind
+	data2 := append(append([]byte(nil), base...), stressPayload(r, 8192*2)...)
+	copy(data2[8192*5:], stressPayload(r, 300))
+	v2, err := createWith(fs, "v2", data2)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// the first block holds the meta, the sixth the change
+	if err := expectRefs(fs, 14); err != nil {
+		t.Fatal(err)
+	}
+	// copy on write of a shared block
+	f, err := fs.OpenFile(v2)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	patch := stressPayload(r, 1000)
+	if _, err := f.WriteAt(patch, 8192*9+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data2[8192*9+10:], patch)
+	if err := expectRefs(fs, 13); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(fs, v1, base); err != nil {
+		t.Fatalf("Shared block written in place: %v", err)
+	}
+	if err := readBack(fs, v2, data2); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	fs.Close()
+
+	// the index survives a reopen
+	fs = open()
+	if err := expectRefs(fs, 13); err != nil {
+		t.Fatal(err)
+	}
+	v3, err := createWith(fs, "v3", base)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := expectRefs(fs, 28); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = fs.OpenFile(v3); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := f.Truncate(8192 * 3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := f.Truncate(8192*3 + 5000); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	data3 := append(append([]byte(nil), base[:8192*3]...), make([]byte, 5000)...)
+	check(fs)
+	for key, data := range map[string][]byte{v1: base, v2: data2, v3: data3} {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.DeleteFile(v1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := readBack(fs, v2, data2); err != nil {
+		t.Fatalf("After delete: %v", err)
+	}
+	if err := readBack(fs, v3, data3); err != nil {
+		t.Fatalf("After delete: %v", err)
+	}
+	check(fs)
+	for _, key := range []string{v2, v3} {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := expectRefs(fs, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	check(fs)
+
+	// writers of the same content in parallel
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				key, err := createWith(fs, fmt.Sprintf("p%02d", i), base)
+				if err == nil {
+					err = readBack(fs, key, base)
+				}
+				if err == nil && j%2 == 0 {
+					err = fs.DeleteFile(key)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Parallel writer failed: %v", err)
+	}
+	check(fs)
+	list, err := fs.GetFileList()
+	if err != nil {
+		t.Fatalf("File list failed: %v", err)
+	}
+	for _, snap := range list {
+		if err := fs.DeleteFile(snap.Key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	fs.Close()
+}
+
+func TestDedupTruncateReuse(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeatureDedup)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	fs := open()
+	_, fb := fs.StatBlocks(-1)
+
+	// the blocks behind the first one are identical
+	data := bytes.Repeat([]byte{0x5a}, 8192*7)
+	key, err := createWith(fs, "same", data)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// the shared block is freed along with its references
+	if err := f.Truncate(0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	r := mrand.New(mrand.NewSource(131))
+	data = stressPayload(r, 8192*7)
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	clone, err := fs.CloneFile(key, "clone")
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	check(fs)
+	fs.Close()
+
+	fs = open()
+	defer fs.Close()
+	check(fs)
+	if err := fs.DeleteFile(clone); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatalf("After deleting the clone: %v", err)
+	}
+	check(fs)
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+}
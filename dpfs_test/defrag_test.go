@@ -0,0 +1,287 @@
+/*
+ defrag_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// freeRuns returns the number of runs of free blocks of bitmap.
+func freeRuns(bitmap []uint8) int {
+	runs := 0
+	for i := 0; i < len(bitmap)*8; i++ {
+		if bitmap[i/8]&(1<<(i%8)) == 0 && (i == 0 || bitmap[(i-1)/8]&(1<<((i-1)%8)) != 0) {
+			runs++
+		}
+	}
+	return runs
+}
+
+func TestDefragment(t *testing.T) {
+	cases := []struct {
+		name     string
+		features []dpfs.Feature
+	}{
+		{"plain", nil},
+		{"dedup", []dpfs.Feature{dpfs.FeatureDedup}},
+		{"extents", []dpfs.Feature{dpfs.FeatureExtents}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doDefragment(t, c.features)
+		})
+	}
+}
+
+func doDefragment(t *testing.T, features []dpfs.Feature) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(1, 4096, testDir, "", "", 0, true, features...)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	r := mrand.New(mrand.NewSource(21))
+	// the files grow a block at a time side by side, every other one goes
+	var keys []string
+	var handles []*dpfs.Vfile
+	for i := 0; i < 8; i++ {
+		f, key, err := fs.CreateFile("frag", []byte("meta"))
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		keys, handles = append(keys, key), append(handles, f)
+	}
+	files := make(map[string][]byte)
+	for round := 0; round < 150; round++ {
+		for i, f := range handles {
+			chunk := stressPayload(r, 8192)
+			if _, err := f.Write(chunk); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			files[keys[i]] = append(files[keys[i]], chunk...)
+		}
+	}
+	for i := 1; i < len(keys); i += 2 {
+		if err := fs.DeleteFile(keys[i]); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(files, keys[i])
+	}
+	if fs.Smeta.HasRefCounts() {
+		// shared blocks stay where they are
+		clone, err := fs.CloneFile(keys[0], "clone")
+		if err != nil {
+			t.Fatalf("Clone failed: %v", err)
+		}
+		files[clone] = files[keys[0]]
+	}
+	runs := freeRuns(fs.GetBlockBitmap(0))
+
+	stop := make(chan struct{})
+	done, err := fs.Defragment(dpfs.DefragOptions{Rate: 500, Stop: stop})
+	if err != nil {
+		t.Fatalf("Defragment failed: %v", err)
+	}
+	if _, err := fs.Defragment(dpfs.DefragOptions{}); !errors.Is(err, dpfs.ErrDefragRunning) {
+		t.Errorf("Second pass should fail: %v", err)
+	}
+	for fs.DefragProgress().Files == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; !errors.Is(err, dpfs.ErrDefragStopped) {
+		t.Fatalf("Stopped pass returns %v", err)
+	}
+	stats := fs.DefragProgress()
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(1, 4096, testDir, "", "", 0, true, features...)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	// the pass resumes with readers of the files beside it
+	var reading atomic.Bool
+	reading.Store(true)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(files))
+	for key, data := range files {
+		f, err := fs.OpenFile(key)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		wg.Add(1)
+		go func(f *dpfs.Vfile, data []byte, seed int64) {
+			defer wg.Done()
+			r := mrand.New(mrand.NewSource(seed))
+			buf := make([]byte, 8192*3)
+			for reading.Load() {
+				off := r.Int63n(int64(len(data)))
+				n, err := f.ReadAt(buf, off)
+				if err != nil && err != io.EOF || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+					errs <- errors.New("Read during defragmentation failed")
+					return
+				}
+			}
+		}(f, data, int64(len(data)))
+	}
+	done, err = fs.Defragment(dpfs.DefragOptions{})
+	if err != nil {
+		t.Fatalf("Defragment failed: %v", err)
+	}
+	err = <-done
+	reading.Store(false)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		t.Fatalf("Resumed pass failed: %v", err)
+	}
+	for err := range errs {
+		t.Fatal(err)
+	}
+	resumed := fs.DefragProgress()
+	if resumed.Files == 0 || resumed.Files+stats.Files > len(files) {
+		t.Errorf("Passes rewrote %d+%d files of %d", stats.Files, resumed.Files, len(files))
+	}
+	big := stats.BigBlocks + resumed.BigBlocks
+	// later passes only move files to the front, until nothing moves
+	for pass := 0; ; pass++ {
+		done, err := fs.Defragment(dpfs.DefragOptions{Restart: true})
+		if err != nil {
+			t.Fatalf("Defragment failed: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("Pass failed: %v", err)
+		}
+		s := fs.DefragProgress()
+		if s.Files == 0 {
+			break
+		}
+		if pass == 5 {
+			t.Fatalf("Passes never end")
+		}
+		big += s.BigBlocks
+	}
+	if withBig := !fs.Smeta.HasExtents(); withBig != (big > 0) {
+		t.Errorf("%d big blocks made", big)
+	}
+	// the blocks of the clone stay scattered
+	if after := freeRuns(fs.GetBlockBitmap(0)); after > runs/2 {
+		t.Errorf("Free space not consolidated: %d runs -> %d runs", runs, after)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
+
+func TestDefragClose(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(1, 4096, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	r := mrand.New(mrand.NewSource(21))
+	var keys []string
+	var handles []*dpfs.Vfile
+	files := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		f, key, err := fs.CreateFile("frag", nil)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		keys, handles = append(keys, key), append(handles, f)
+	}
+	for round := 0; round < 50; round++ {
+		for i, f := range handles {
+			chunk := stressPayload(r, 8192)
+			if _, err := f.Write(chunk); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			files[keys[i]] = append(files[keys[i]], chunk...)
+		}
+	}
+
+	// a slow pass left running is stopped by Close
+	done, err := fs.Defragment(dpfs.DefragOptions{Rate: 10})
+	if err != nil {
+		t.Fatalf("Defragment failed: %v", err)
+	}
+	for fs.DefragProgress().Files == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, dpfs.ErrDefragStopped) {
+			t.Errorf("Pass cut by Close returns %v", err)
+		}
+	default:
+		t.Fatalf("Close returned before the pass")
+	}
+	if _, err := fs.Defragment(dpfs.DefragOptions{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Defragment after close: %v", err)
+	}
+
+	fs, err = dpfs.MakeFileSystem(1, 4096, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	done, err = fs.Defragment(dpfs.DefragOptions{})
+	if err != nil {
+		t.Fatalf("Defragment failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Resumed pass failed: %v", err)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ dir_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func dirNames(fs *dpfs.FileSystem, p string) (string, error) {
+	list, err := fs.ReadDir(p)
+	if err != nil {
+		return "", err
+	}
+	s := ""
+	for _, e := range list {
+		if e.IsDir {
+			s += e.Name + "/ "
+		} else {
+			s += e.Name + " "
+		}
+	}
+	return s, nil
+}
+
+func expectDir(t *testing.T, fs *dpfs.FileSystem, p, expect string) {
+	t.Helper()
+	if s, err := dirNames(fs, p); err != nil || s != expect {
+		t.Errorf("ReadDir(%q) returns %q,%v, want %q", p, s, err, expect)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	expectDir(t, fs, "/", "")
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+
+	r := mrand.New(mrand.NewSource(9))
+	data := stressPayload(r, 8192*5+11)
+	if _, err := fs.MkdirAll("docs/2024/q1"); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	f, key, err := fs.CreatePath("docs/2024/q1/report.txt", []byte("meta"))
+	if err != nil {
+		t.Fatalf("Create path failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, _, err := fs.CreatePath("docs/readme", nil); err != nil {
+		t.Fatalf("Create path failed: %v", err)
+	}
+	expectDir(t, fs, "", "docs/ ")
+	expectDir(t, fs, "docs", "2024/ readme ")
+
+	errCases := []struct {
+		what string
+		err  error
+		want error
+	}{
+		{"mkdir of an existing dir", errOf(fs.Mkdir("docs/2024")), dpfs.ErrExists},
+		{"mkdir without parent", errOf(fs.Mkdir("a/b")), dpfs.FNF},
+		{"mkdir below a file", errOf(fs.Mkdir("docs/readme/x")), dpfs.ErrNotDir},
+		{"create of an existing file", errOf3(fs.CreatePath("docs/readme", nil)), dpfs.ErrExists},
+		{"create with a bad path", errOf3(fs.CreatePath("docs/../x", nil)), dpfs.ErrBadPath},
+		{"open of a dir", errOf(fs.OpenPath("docs")), dpfs.ErrIsDir},
+		{"read of a file as dir", errOf(fs.ReadDir("docs/readme")), dpfs.ErrNotDir},
+		{"delete of a full dir", fs.DeletePath("docs/2024", false), dpfs.ErrDirNotEmpty},
+		{"rename onto a file", fs.Rename("docs/2024/q1/report.txt", "docs/readme"), dpfs.ErrExists},
+		{"rename into itself", fs.Rename("docs", "docs/2024/docs"), dpfs.ErrBadPath},
+	}
+	for _, c := range errCases {
+		if !errors.Is(c.err, c.want) {
+			t.Errorf("%s returns %v, want %v", c.what, c.err, c.want)
+		}
+	}
+	if d, _ := fs.Stat("docs"); d.Uid == "" || !d.IsDir {
+		t.Errorf("Bad stat of a dir: %+v", d)
+	}
+	if _, err := fs.OpenFile(dirUid(fs, "docs")); err != dpfs.ErrIsDir {
+		t.Errorf("Open of a dir by uid returns %v", err)
+	}
+
+	// move a file across directories, then move its directory
+	if err := fs.Rename("docs/2024/q1/report.txt", "docs/report.old"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := fs.Rename("docs/2024", "archive"); err != nil {
+		t.Fatalf("Rename of a dir failed: %v", err)
+	}
+	expectDir(t, fs, "", "archive/ docs/ ")
+	expectDir(t, fs, "docs", "readme report.old ")
+	expectDir(t, fs, "archive", "q1/ ")
+	if f, err := fs.OpenPath("docs/report.old"); err != nil || f.Meta.Name != "report.old" {
+		t.Fatalf("Open of a moved file failed: %v", err)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	if uids, err := fs.LookupByName("report.old"); err != nil || uids[0] != key {
+		t.Errorf("Name index not updated by rename: %v %v", uids, err)
+	}
+
+	// enough entries to compact the log of a directory
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.CreatePath(fmt.Sprintf("archive/q1/f%03d", i), nil); err != nil {
+			t.Fatalf("Create path failed: %v", err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := fs.DeletePath(fmt.Sprintf("archive/q1/f%03d", i), false); err != nil {
+			t.Fatalf("Delete path failed: %v", err)
+		}
+	}
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expectDir(t, fs, "docs", "readme ")
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	list, err := fs.ReadDir("archive/q1")
+	if err != nil || len(list) != 50 || list[0].Name != "f001" {
+		t.Fatalf("Bad dir after reopen: %d entries, %v", len(list), err)
+	}
+	if _, _, err := fs.CreatePath("docs/report.old", nil); err != nil {
+		t.Errorf("Create in place of a deleted file failed: %v", err)
+	}
+	if err := fs.DeletePath("archive", true); err != nil {
+		t.Fatalf("Recursive delete failed: %v", err)
+	}
+	if err := fs.DeletePath("docs", true); err != nil {
+		t.Fatalf("Recursive delete failed: %v", err)
+	}
+	expectDir(t, fs, "", "")
+	if list, err := fs.ScanPrefix(""); err != nil || len(list) != 0 {
+		t.Errorf("Names left after delete: %v %v", list, err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
+
+func errOf[T any](_ T, err error) error {
+	return err
+}
+
+func errOf3[T, U any](_ T, _ U, err error) error {
+	return err
+}
+
+func dirUid(fs *dpfs.FileSystem, p string) string {
+	e, _ := fs.Stat(p)
+	return e.Uid
+}
@@ -0,0 +1,229 @@
+/*
+ evacuate_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestEvacuateGroup(t *testing.T) {
+	cases := []struct {
+		name     string
+		features []dpfs.Feature
+	}{
+		{"plain", nil},
+		{"dedup", []dpfs.Feature{dpfs.FeatureDedup}},
+		{"packed", []dpfs.Feature{dpfs.FeaturePacking, dpfs.FeatureInline, dpfs.FeatureExtents}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := doEvacuate(t, c.features); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func doEvacuate(t *testing.T, features []dpfs.Feature) error {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(1, 2048, testDir, "", "", 0, true, features...)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	r := mrand.New(mrand.NewSource(20))
+	files := make(map[string][]byte)
+	create := func(name string, data []byte) *dpfs.Vfile {
+		f, key, err := fs.CreateFile(name, []byte("meta"))
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		files[key] = data
+		return f
+	}
+	old := stressPayload(r, 8192*300+17)
+	oldFile := create("old", old)
+	if err := fs.Grow(3); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+
+	// group 1 takes what follows: a tail of the old file, new files of every
+	// size, directories and clones or snapshots where the depot has them
+	tail := stressPayload(r, 8192*40)
+	if _, err := oldFile.Write(tail); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var oldKey string
+	for key, data := range files {
+		oldKey, files[key] = key, append(data, tail...)
+	}
+	shared := stressPayload(r, 8192*120)
+	moved := create("shared", shared)
+	create("copy", shared)
+	create("tiny", []byte("tiny"))
+	create("small", stressPayload(r, 1500))
+	create("empty", nil)
+	if _, err := fs.MkdirAll("/a/b"); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	f, _, err := fs.CreatePath("/a/b/c", nil)
+	if err != nil {
+		t.Fatalf("Create path failed: %v", err)
+	}
+	inDir := stressPayload(r, 8192*3)
+	if _, err := f.Write(inDir); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var snap *dpfs.Snapshot
+	var frozen []byte
+	clones := fs.Smeta.HasRefCounts()
+	if clones {
+		clone, err := fs.CloneFile(oldKey, "clone")
+		if err != nil {
+			t.Fatalf("Clone failed: %v", err)
+		}
+		files[clone] = files[oldKey]
+		if err := fs.CreateSnapshot("before"); err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		if _, err := oldFile.WriteAt(tail[:8192], 8192*5); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		frozen = files[oldKey]
+		files[oldKey] = append([]byte(nil), frozen...)
+		copy(files[oldKey][8192*5:], tail[:8192])
+		if snap, err = fs.OpenSnapshot("before"); err != nil {
+			t.Fatalf("Open snapshot failed: %v", err)
+		}
+	}
+	if _, free := fs.StatBlocks(1); free == 2048 {
+		t.Fatalf("Nothing allocated in group 1")
+	}
+	if _, free := fs.StatBlocks(2); free != 2048 {
+		t.Fatalf("Group 2 in use")
+	}
+
+	if err := fs.EvacuateGroup(0); !errors.Is(err, dpfs.ErrSysGroup) {
+		t.Errorf("Evacuation of group 0 should fail: %v", err)
+	}
+	if err := fs.EvacuateGroup(3); !errors.Is(err, dpfs.ErrBadGroupNum) {
+		t.Errorf("Evacuation of a missing group should fail: %v", err)
+	}
+	if err := fs.EvacuateGroup(1); err != nil {
+		return err
+	}
+	if _, free := fs.StatBlocks(1); free != 2048 {
+		t.Errorf("Group 1 not empty, %d free blocks", free)
+	}
+	if fs.Smeta.TotalGroups != 3 {
+		t.Errorf("Group 1 is not the last one, got %d groups", fs.Smeta.TotalGroups)
+	}
+	if _, err := moved.Write([]byte("x")); err != dpfs.FNF {
+		t.Errorf("Handle of a moved file should be gone: %v", err)
+	}
+	// nothing goes to a retired group
+	create("later", stressPayload(r, 8192*2))
+	if _, free := fs.StatBlocks(1); free != 2048 {
+		t.Errorf("Group 1 allocated after evacuation")
+	}
+	if err := fs.EvacuateGroup(2); err != nil {
+		return err
+	}
+	if fs.Smeta.TotalGroups != 1 {
+		t.Fatalf("Bad group number %d after the evacuations", fs.Smeta.TotalGroups)
+	}
+	for g := 2; g <= 3; g++ {
+		if _, err := os.Stat(filepath.Join(testDir, fmt.Sprintf("vol.%06d", g))); !os.IsNotExist(err) {
+			t.Errorf("Volume file of group %d left: %v", g, err)
+		}
+	}
+
+	check := func() error {
+		for key, data := range files {
+			if err := readBack(fs, key, data); err != nil {
+				return err
+			}
+		}
+		got, err := fs.OpenPath("/a/b/c")
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, len(inDir)+1)
+		if n, _ := got.Read(buf); n != len(inDir) {
+			return errors.New("bad file in directory")
+		}
+		if uids, err := fs.LookupByName("shared"); err != nil || len(uids) != 1 {
+			return errors.New("name index lost a moved file")
+		}
+		if snap != nil {
+			if err := readSnapshot(snap, oldKey, frozen); err != nil {
+				return err
+			}
+		}
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+		return nil
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(1, 2048, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	if fs.Smeta.TotalGroups != 1 {
+		t.Fatalf("Bad group number %d after reopen", fs.Smeta.TotalGroups)
+	}
+	if clones {
+		if snap, err = fs.OpenSnapshot("before"); err != nil {
+			t.Fatalf("Open snapshot failed: %v", err)
+		}
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	// a group added again is not retired
+	if err := fs.Grow(2); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	create("again", stressPayload(r, 8192*1000))
+	if _, free := fs.StatBlocks(1); free == 2048 {
+		t.Errorf("Nothing allocated in the group added again")
+	}
+	return check()
+}
@@ -0,0 +1,162 @@
+/*
+ extent_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"io"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestExtents(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeatureExtents, dpfs.FeatureClones)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	fs := open()
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(18))
+	files := map[string][]byte{}
+
+	// a file written in one go is a single run of blocks
+	big := stressPayload(r, 8192*3000+77)
+	key, err := createWith(fs, "big", big)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	files[key] = big
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if f.Inode.TripleIndirect != 0 {
+		t.Errorf("Map of a contiguous file left the inode")
+	}
+	for i := 0; i < 200; i++ {
+		off := r.Int63n(int64(len(big)))
+		buf := make([]byte, r.Intn(8192*3))
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF || !bytes.Equal(buf[:n], big[off:off+int64(n)]) {
+			t.Fatalf("ReadAt %d failed: %v", off, err)
+		}
+	}
+
+	// block by block writes to two files interleave their blocks, enough
+	// extents for a tree of extent blocks
+	var keys [2]string
+	var datas [2][]byte
+	var handles [2]*dpfs.Vfile
+	for i := range handles {
+		if handles[i], keys[i], err = fs.CreateFile("frag", nil); err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+	}
+	for b := 0; b < 1500; b++ {
+		for i, h := range handles {
+			chunk := stressPayload(r, 8192)
+			if _, err := h.Write(chunk); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			datas[i] = append(datas[i], chunk...)
+		}
+	}
+	if handles[0].Inode.TripleIndirect == 0 {
+		t.Errorf("Fragmented file has no extent tree")
+	}
+	// a hole, a patch across extents and a cut inside the tree
+	hole := make([]byte, 8192*10)
+	chunk := stressPayload(r, 8192*5)
+	if _, err := handles[0].WriteAt(chunk, int64(len(datas[0]))+int64(len(hole))); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	datas[0] = append(append(datas[0], hole...), chunk...)
+	patch := stressPayload(r, 8192*7+11)
+	if _, err := handles[0].WriteAt(patch, 8192*600+3); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(datas[0][8192*600+3:], patch)
+	datas[1] = datas[1][:8192*900+5]
+	if err := handles[1].Truncate(int64(len(datas[1]))); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	for i := range keys {
+		files[keys[i]] = datas[i]
+	}
+
+	// a clone shares the blocks until either side writes
+	clone, err := fs.CloneFile(keys[0], "clone")
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	cf, err := fs.OpenFile(clone)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	cdata := append([]byte(nil), datas[0]...)
+	if _, err := cf.WriteAt(patch, 8192*100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(cdata[8192*100:], patch)
+	files[clone] = cdata
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(fs)
+	fs.Close()
+
+	fs = open()
+	defer fs.Close()
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatalf("After reopen: %v", err)
+		}
+	}
+	for key := range files {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	check(fs)
+}
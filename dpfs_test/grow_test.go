@@ -0,0 +1,189 @@
+/*
+ grow_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"errors"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestGrow(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(1, 1024, testDir, "", "", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	r := mrand.New(mrand.NewSource(19))
+	data := stressPayload(r, 8192*2500)
+	f, key, err := fs.CreateFile("big", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	n := 0
+	for ; n < len(data); n += 8192 {
+		if _, err := f.Write(data[n : n+8192]); err != nil {
+			break
+		}
+	}
+	if n == len(data) {
+		t.Fatalf("Write beyond the capacity should fail")
+	}
+	if _, free := fs.StatBlocks(-1); free != 0 {
+		t.Fatalf("Depot not full, %d free blocks", free)
+	}
+
+	if err := fs.Grow(1); !errors.Is(err, dpfs.ErrBadGroupNum) {
+		t.Errorf("Grow to the same size should fail: %v", err)
+	}
+	if err := fs.Grow(dpfs.MaxBlockGroupNum + 1); !errors.Is(err, dpfs.ErrBadGroupNum) {
+		t.Errorf("Grow beyond MaxBlockGroupNum should fail: %v", err)
+	}
+	if err := fs.Grow(3); err != nil {
+		t.Fatalf("Grow failed: %v", err)
+	}
+	if fs.Smeta.TotalGroups != 3 {
+		t.Fatalf("Bad group number %d", fs.Smeta.TotalGroups)
+	}
+	if total, free := fs.StatBlocks(-1); total != 3*1024 || free != 2*1024 {
+		t.Errorf("Bad block count %d/%d after grow", free, total)
+	}
+	if _, err := f.Seek(int64(n), 0); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if _, err := f.Write(data[n:]); err != nil {
+		t.Fatalf("Write after grow failed: %v", err)
+	}
+	small, skey, err := fs.CreateFile("small", []byte("meta"))
+	if err != nil {
+		t.Fatalf("Create file after grow failed: %v", err)
+	}
+	if _, err := small.Write(data[:8192*3]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for g := 1; g < 3; g++ {
+		if _, free := fs.StatBlocks(g); free == 1024 {
+			t.Errorf("Nothing allocated in new group %d", g)
+		}
+	}
+	fs.Close()
+
+	// the group number of the call is that of a new depot only
+	fs, err = dpfs.MakeFileSystem(1, 1024, testDir, "", "", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	if fs.Smeta.TotalGroups != 3 {
+		t.Fatalf("Bad group number %d after reopen", fs.Smeta.TotalGroups)
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(fs, skey, data[:8192*3]); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
+
+func TestGrowConcurrent(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(1, 1024, testDir, "", "", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+	r := mrand.New(mrand.NewSource(191))
+	files := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		data := stressPayload(r, 8192*10+i)
+		key, err := createWith(fs, "f", data)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		files[key] = data
+	}
+
+	// the listings and the stats run beside Grow
+	stop := make(chan struct{})
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				switch i {
+				case 0:
+					if _, err := fs.GetFileList(); err != nil {
+						errs <- err
+						return
+					}
+				case 1:
+					for g := 0; g < dpfs.MaxBlockGroupNum; g++ {
+						fs.GetVolumeInfo(g)
+						fs.GetBlockBitmap(g)
+						fs.GetInodeBitmap(g)
+					}
+				case 2:
+					fs.StatBlocks(-1)
+					fs.StatInodes(-1)
+				}
+			}
+		}(i)
+	}
+	for n := uint32(2); n <= 8; n++ {
+		if err := fs.Grow(n); err != nil {
+			t.Errorf("Grow to %d failed: %v", n, err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Listing beside Grow failed: %v", err)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ inline_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestInlineData(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeatureInline, dpfs.FeatureClones)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	inline := func(fs *dpfs.FileSystem, key string) bool {
+		t.Helper()
+		f, err := fs.OpenFile(key)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return f.Inode.IsInline()
+	}
+	fs := open()
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(17))
+	files := map[string][]byte{}
+	for i, size := range []int{0, 1, 10, 39, dpfs.InlineLimit} {
+		data := stressPayload(r, size)
+		key, err := createWith(fs, fmt.Sprintf("tiny%d", i), data)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if !inline(fs, key) {
+			t.Errorf("File of %d bytes is not inline", size)
+		}
+		files[key] = data
+	}
+	// a meta block each, and the first block of the name index
+	if _, fb1 := fs.StatBlocks(-1); fb-fb1 != int64(len(files))+1 {
+		t.Errorf("%d inline files take %d blocks", len(files), fb-fb1)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// patch and truncate within the limit
+	key, err := createWith(fs, "edit", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("abc"), 4); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := f.Truncate(6); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := f.Truncate(20); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	want := append([]byte("0123ab"), make([]byte, 14)...)
+	if err := readBack(fs, key, want); err != nil {
+		t.Fatal(err)
+	}
+	if !inline(fs, key) {
+		t.Errorf("File within the limit left inline mode")
+	}
+	files[key] = want
+
+	// growing beyond the limit moves the data to blocks
+	grow, err := createWith(fs, "grow", []byte("tiny"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f, err = fs.OpenFile(grow)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	big := stressPayload(r, 8192*3)
+	if _, err := f.WriteAt(big, 100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	want = append([]byte("tiny"), make([]byte, 96)...)
+	want = append(want, big...)
+	if err := readBack(fs, grow, want); err != nil {
+		t.Fatal(err)
+	}
+	if inline(fs, grow) {
+		t.Errorf("File beyond the limit is still inline")
+	}
+	files[grow] = want
+	extend, err := createWith(fs, "extend", []byte("abc"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f, err = fs.OpenFile(extend)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := f.Truncate(dpfs.InlineLimit + 1); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	files[extend] = append([]byte("abc"), make([]byte, dpfs.InlineLimit-2)...)
+
+	// a clone copies the data of the inode
+	for key, data := range files {
+		if len(data) == 10 {
+			clone, err := fs.CloneFile(key, "clone")
+			if err != nil {
+				t.Fatalf("Clone failed: %v", err)
+			}
+			f, err := fs.OpenFile(clone)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if _, err := f.WriteAt([]byte("x"), 0); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			files[clone] = append([]byte("x"), data[1:]...)
+			break
+		}
+	}
+	check(fs)
+	fs.Close()
+
+	fs = open()
+	defer fs.Close()
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatalf("After reopen: %v", err)
+		}
+		if inline(fs, key) != (len(data) <= dpfs.InlineLimit) {
+			t.Errorf("File of %d bytes inline:%v", len(data), !inline(fs, key))
+		}
+	}
+	for key := range files {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	check(fs)
+}
+
+func TestInlineEncrypted(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	kp, err := dpfs.NewFileKeyProvider(filepath.Join(testDir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeatureInline, dpfs.WithKeyProvider(kp))
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	secret := []byte("tiny-secret-payload")
+	key, err := createWith(fs, "tiny", secret)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if f.Inode.IsInline() {
+		t.Errorf("File of an encrypted depot is inline")
+	}
+	if err := readBack(fs, key, secret); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	if found, err := volumesContain(2, secret); err != nil || found {
+		t.Errorf("Plaintext %q in the volumes: %v", secret, err)
+	}
+}
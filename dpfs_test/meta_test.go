@@ -0,0 +1,121 @@
+/*
+ meta_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func checkMeta(fs *dpfs.FileSystem, key string, name string, meta []byte) error {
+	f, err := fs.OpenFile(key)
+	if err != nil {
+		return err
+	}
+	if f.Meta.Name != name || !bytes.Equal(f.Meta.ExtMetas, meta) {
+		return fmt.Errorf("bad meta [%s,%d bytes], want [%s,%d bytes]", f.Meta.Name, len(f.Meta.ExtMetas), name, len(meta))
+	}
+	list, err := fs.GetFileList()
+	if err != nil {
+		return err
+	}
+	for _, snap := range list {
+		if snap.Key == key && snap.Name != name {
+			return fmt.Errorf("bad name in file list: %s", snap.Name)
+		}
+	}
+	return nil
+}
+
+func TestUpdateMeta(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(7))
+	data := stressPayload(r, 8192*3+99)
+	f, key, err := fs.CreateFile("report.txt", []byte("v1"))
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	updates := []struct {
+		name string
+		meta []byte
+	}{
+		{"report.doc", []byte("v2")}, // same size, in place
+		{"r", nil},                   // smaller, in place
+		{strings.Repeat("n", 300), bytes.Repeat([]byte{1}, 1500)}, // moves to a meta block
+		{"report.txt", []byte("v3")},                              // stays in the meta block
+	}
+	for _, u := range updates {
+		if err := fs.UpdateMeta(key, u.name, u.meta); err != nil {
+			t.Fatalf("Update meta failed: %v", err)
+		}
+		if err := checkMeta(fs, key, u.name, u.meta); err != nil {
+			t.Fatal(err)
+		}
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatalf("Data changed by meta update: %v", err)
+		}
+	}
+	if err := fs.UpdateMeta(key, "big", make([]byte, dpfs.MaxFileMetaSize+1)); err == nil {
+		t.Errorf("Meta over the limit should fail")
+	}
+	if err := fs.UpdateMeta("0000001000040000000100000000", "x", nil); err == nil {
+		t.Errorf("Update of a missing file should fail")
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	if err := checkMeta(fs, key, "report.txt", []byte("v3")); err != nil {
+		t.Fatalf("After reopen: %v", err)
+	}
+	if err := fs.DeleteFile(key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ names_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func checkNames(fs *dpfs.FileSystem, prefix string, expect []dpfs.NameEntry) error {
+	list, err := fs.ScanPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(list, expect) {
+		return fmt.Errorf("scan %q returns %v, want %v", prefix, list, expect)
+	}
+	for _, e := range expect {
+		uids, err := fs.LookupByName(e.Name)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, uid := range uids {
+			found = found || uid == e.Uid
+		}
+		if !found {
+			return fmt.Errorf("lookup %q misses %s", e.Name, e.Uid)
+		}
+	}
+	return nil
+}
+
+func TestNameIndex(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+
+	keys := make(map[string]string)
+	for _, name := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		_, key, err := fs.CreateFile(name, nil)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		keys[name] = key
+	}
+	_, dup, err := fs.CreateFile("c", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if uids, err := fs.LookupByName("c"); err != nil || !reflect.DeepEqual(uids, []string{keys["c"], dup}) {
+		t.Errorf("Lookup of a shared name returns %v,%v", uids, err)
+	}
+	if _, err := fs.LookupByName("d"); err != dpfs.FNF {
+		t.Errorf("Lookup of a missing name returns %v", err)
+	}
+	if err := fs.SetUniqueNames(true); !errors.Is(err, dpfs.ErrNameExists) {
+		t.Errorf("Unique names with a shared name returns %v", err)
+	}
+	if err := fs.UpdateMeta(dup, "d", nil); err != nil {
+		t.Fatalf("Update meta failed: %v", err)
+	}
+	keys["d"] = dup
+	if err := fs.SetUniqueNames(true); err != nil {
+		t.Fatalf("Unique names failed: %v", err)
+	}
+	if _, _, err := fs.CreateFile("a/1", nil); !errors.Is(err, dpfs.ErrNameExists) {
+		t.Errorf("Create of a taken name returns %v", err)
+	}
+	if err := fs.UpdateMeta(keys["d"], "c", nil); !errors.Is(err, dpfs.ErrNameExists) {
+		t.Errorf("Rename to a taken name returns %v", err)
+	}
+	if err := fs.UpdateMeta(keys["d"], "d", []byte("meta")); err != nil {
+		t.Errorf("Update meta keeping the name failed: %v", err)
+	}
+	if err := fs.DeleteFile(keys["b/2"]); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expect := []dpfs.NameEntry{{Name: "b/1", Uid: keys["b/1"]}, {Name: "b/3", Uid: keys["b/3"]}}
+	if err := checkNames(fs, "b/", expect); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() || r.Inodes != 5 {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	fs.Close()
+
+	fs, err = dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	expect = append([]dpfs.NameEntry{{Name: "a/1", Uid: keys["a/1"]}}, expect...)
+	expect = append(expect, dpfs.NameEntry{Name: "c", Uid: keys["c"]}, dpfs.NameEntry{Name: "d", Uid: keys["d"]})
+	if err := checkNames(fs, "", expect); err != nil {
+		t.Fatalf("After reopen: %v", err)
+	}
+	if _, _, err := fs.CreateFile("c", nil); !errors.Is(err, dpfs.ErrNameExists) {
+		t.Errorf("Unique names lost after reopen: %v", err)
+	}
+
+	// enough renames to compact the log
+	for i := 0; i < 700; i++ {
+		if err := fs.UpdateMeta(keys["d"], fmt.Sprintf("d.%d", i), nil); err != nil {
+			t.Fatalf("Update meta failed: %v", err)
+		}
+	}
+	expect[len(expect)-1].Name = "d.699"
+	if err := checkNames(fs, "", expect); err != nil {
+		t.Fatalf("After compaction: %v", err)
+	}
+	if err := fs.RebuildNameIndex(); err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	if err := checkNames(fs, "", expect); err != nil {
+		t.Fatalf("After rebuild: %v", err)
+	}
+	for _, e := range expect {
+		if err := fs.DeleteFile(e.Uid); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if list, err := fs.ScanPrefix(""); err != nil || len(list) != 0 {
+		t.Errorf("Names left after delete: %v %v", list, err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
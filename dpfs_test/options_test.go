@@ -0,0 +1,205 @@
+/*
+ options_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOptionsGeometry(t *testing.T) {
+	bad := []dpfs.Options{
+		{Groups: 0},
+		{Groups: dpfs.MaxBlockGroupNum + 1},
+		{Groups: 1, BlockSize: 6000},
+		{Groups: 1, BlockSize: dpfs.MaxBlockSize * 2},
+		{Groups: 1, BlocksInGroup: 1000},
+		{Groups: 1, BlocksInGroup: dpfs.DefaultBlocksInGroup * 2},
+		{Groups: 1, InodesRatio: 6},
+		{Groups: 1, BlocksInGroup: 1024, InodesRatio: 12}, // 85 inodes
+		{Groups: 1, BlocksInGroup: 1024, InodesRatio: 2048},
+	}
+	for _, opts := range bad {
+		opts.Root = testDir
+		if _, err := dpfs.MakeFileSystemWithOptions(opts); !errors.Is(err, dpfs.ErrBadGeometry) {
+			t.Errorf("Options %+v should fail: %v", opts, err)
+		}
+	}
+	if _, err := os.Stat(testDir); err == nil {
+		t.Errorf("Bad options created the depot")
+	}
+}
+
+func TestOptionsDepots(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  dpfs.Options
+		files int
+		size  int
+	}{
+		{"small", dpfs.Options{BlockSize: 4096, InodesRatio: 4, BlocksInGroup: 4096}, 300, 3000},
+		{"media", dpfs.Options{BlockSize: 64 * 1024, InodesRatio: 64, BlocksInGroup: 4096, BigAlloc: true}, 3, 64*1024*150 + 77},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doOptionsDepot(t, c.opts, c.files, c.size)
+		})
+	}
+}
+
+func doOptionsDepot(t *testing.T, opts dpfs.Options, files, size int) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	opts.Root, opts.Groups, opts.Logger, opts.Sync = testDir, 2, logger, dpfs.SyncOnClose
+	fs, err := dpfs.MakeFileSystemWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Init file system") {
+		t.Errorf("Nothing logged to the logger given")
+	}
+	if fs.Smeta.BlockSize != opts.BlockSize || fs.Smeta.TotalInodes() != int64(2*opts.BlocksInGroup/opts.InodesRatio) {
+		t.Fatalf("Bad geometry: %+v", fs.Smeta)
+	}
+	r := mrand.New(mrand.NewSource(22))
+	data := make(map[string][]byte)
+	for i := 0; i < files; i++ {
+		payload := stressPayload(r, size+r.Intn(size))
+		f, key, err := fs.CreateFile("file", nil)
+		if err != nil {
+			t.Fatalf("Create file failed: %v", err)
+		}
+		if _, err := f.Write(payload); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		data[key] = payload
+	}
+	fs.Close()
+
+	// the geometry comes from the super block
+	fs, err = dpfs.MakeFileSystemWithOptions(dpfs.Options{Root: testDir, Groups: 1})
+	if err != nil {
+		t.Fatalf("Failed to reopen file system: %v", err)
+	}
+	defer fs.Close()
+	if fs.Smeta.BlockSize != opts.BlockSize || fs.Smeta.InodesRatio != opts.InodesRatio || fs.Smeta.TotalGroups != 2 {
+		t.Fatalf("Geometry changed by reopen: %+v", fs.Smeta)
+	}
+	for key, payload := range data {
+		if err := readBack(fs, key, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+}
+
+func TestDepotsSideBySide(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	shapes := []dpfs.Options{
+		{BlockSize: 4096, InodesRatio: 4, BlocksInGroup: 4096},
+		{BlockSize: 64 * 1024, InodesRatio: 64, BlocksInGroup: 4096, BigAlloc: true},
+		{BlocksInGroup: 2048, Features: []dpfs.Feature{dpfs.FeatureChecksums, dpfs.FeatureDedup}},
+	}
+	open := func() []*dpfs.FileSystem {
+		var list []*dpfs.FileSystem
+		for i, opts := range shapes {
+			opts.Root, opts.Groups = filepath.Join(testDir, fmt.Sprint(i)), 2
+			if err := os.MkdirAll(opts.Root, 0755); err != nil {
+				t.Fatalf("Failed to create depot dir: %v", err)
+			}
+			fs, err := dpfs.MakeFileSystemWithOptions(opts)
+			if err != nil {
+				t.Fatalf("Failed to open depot %d: %v", i, err)
+			}
+			list = append(list, fs)
+		}
+		return list
+	}
+	depots := open()
+	if depots[0].Geometry() == depots[1].Geometry() || depots[1].Geometry() == depots[2].Geometry() {
+		t.Fatalf("Depots share a geometry")
+	}
+
+	// interleave the writes, a 4 KB depot reaches its double indirect tree
+	r := mrand.New(mrand.NewSource(23))
+	data := make([]map[string][]byte, len(depots))
+	for i := range data {
+		data[i] = make(map[string][]byte)
+	}
+	for n := 0; n < 4; n++ {
+		for i, fs := range depots {
+			payload := stressPayload(r, 4096*1100+r.Intn(100000))
+			f, key, err := fs.CreateFile(fmt.Sprint("file", n), nil)
+			if err != nil {
+				t.Fatalf("Create file in depot %d failed: %v", i, err)
+			}
+			if _, err := f.Write(payload); err != nil {
+				t.Fatalf("Write to depot %d failed: %v", i, err)
+			}
+			data[i][key] = payload
+		}
+	}
+	check := func() {
+		for i, fs := range depots {
+			for key, payload := range data[i] {
+				if err := readBack(fs, key, payload); err != nil {
+					t.Fatalf("Depot %d: %v", i, err)
+				}
+			}
+			if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+				t.Errorf("Inconsistent depot %d: %v %v", i, err, r.Issues)
+			}
+		}
+	}
+	check()
+	for _, fs := range depots {
+		fs.Close()
+	}
+
+	depots = open()
+	defer func() {
+		for _, fs := range depots {
+			fs.Close()
+		}
+	}()
+	check()
+}
@@ -0,0 +1,197 @@
+/*
+ pack_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func TestTailPacking(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, dpfs.FeaturePacking, dpfs.FeatureClones)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	fs := open()
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(16))
+	files := map[string][]byte{}
+	for i := 0; i < 200; i++ {
+		data := stressPayload(r, 200)
+		key, err := createWith(fs, fmt.Sprintf("obj%d", i), data)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		files[key] = data
+	}
+	if _, fb1 := fs.StatBlocks(-1); fb-fb1 > 10 {
+		t.Errorf("200 small files take %d blocks", fb-fb1)
+	}
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := fs.GetFileList()
+	if err != nil || len(list) != len(files) {
+		t.Fatalf("File list shows %d files: %v", len(list), err)
+	}
+
+	// rewrite, rename, shrink and grow within the limit, then beyond it
+	var keys []string
+	for key := range files {
+		keys = append(keys, key)
+	}
+	f, err := fs.OpenFile(keys[0])
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("patch"), 50); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(files[keys[0]][50:], "patch")
+	if err := f.Truncate(80); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	files[keys[0]] = files[keys[0]][:80]
+	if err := f.Truncate(500); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	files[keys[0]] = append(files[keys[0]], make([]byte, 420)...)
+	if err := fs.UpdateMeta(keys[1], "renamed", []byte("meta")); err != nil {
+		t.Fatalf("Update meta failed: %v", err)
+	}
+	if err := checkMeta(fs, keys[1], "renamed", []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	big := stressPayload(r, 8192*3+5)
+	f, err = fs.OpenFile(keys[2])
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := f.WriteAt(big, 100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	files[keys[2]] = append(files[keys[2]][:100], big...)
+	f, err = fs.OpenFile(keys[3])
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := f.Truncate(8192 * 2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	files[keys[3]] = append(files[keys[3]], make([]byte, 8192*2-200)...)
+	clone, err := fs.CloneFile(keys[4], "copy")
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	files[clone] = append([]byte(nil), files[keys[4]]...)
+	f, err = fs.OpenFile(clone)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("clone"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(files[clone], "clone")
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(fs)
+
+	// the slots freed are taken again
+	_, fb2 := fs.StatBlocks(-1)
+	for _, key := range keys[100:] {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(files, key)
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := mrand.New(mrand.NewSource(seed))
+			for i := 0; i < 25; i++ {
+				data := stressPayload(r, 50+r.Intn(150))
+				key, err := createWith(fs, "again", data)
+				if err != nil {
+					errs <- err
+					return
+				}
+				lock.Lock()
+				files[key] = data
+				lock.Unlock()
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// only the name index grows
+	if _, fb3 := fs.StatBlocks(-1); fb3 < fb2-2 {
+		t.Errorf("Freed slots not reused, %d->%d free blocks", fb2, fb3)
+	}
+	check(fs)
+	fs.Close()
+
+	fs = open()
+	defer fs.Close()
+	for key, data := range files {
+		if err := readBack(fs, key, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	check(fs)
+	if _, fb4 := fs.StatBlocks(-1); fb != fb4 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb4)
+	}
+}
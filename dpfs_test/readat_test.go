@@ -0,0 +1,133 @@
+/*
+ readat_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"io"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+var (
+	_ io.ReadWriteSeeker = (*dpfs.Vfile)(nil)
+	_ io.ReaderAt        = (*dpfs.Vfile)(nil)
+	_ io.WriterAt        = (*dpfs.Vfile)(nil)
+)
+
+func TestReaderAt(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(4, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+
+	r := mrand.New(mrand.NewSource(6))
+	data := stressPayload(r, 8192*90+123)
+	f, key, err := fs.CreateFile("readat", []byte("meta"))
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if f.Size() != int64(len(data)) {
+		t.Fatalf("Bad size %d", f.Size())
+	}
+	// TestReader reads at every offset, keep the file small
+	small, _, err := fs.CreateFile("small", nil)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := small.Write(data[:8192*3+7]); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := small.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if err := iotest.TestReader(small, data[:8192*3+7]); err != nil {
+		t.Fatal(err)
+	}
+
+	// parallel range reads on one handle
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := mrand.New(mrand.NewSource(seed))
+			for j := 0; j < 50; j++ {
+				off := r.Int63n(int64(len(data)))
+				buf := make([]byte, r.Intn(8192*3))
+				n, err := io.NewSectionReader(f, off, int64(len(buf))).Read(buf)
+				if err != nil && err != io.EOF || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+					errs <- err
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Parallel ReadAt failed: %v", err)
+	}
+
+	// WriteAt keeps the position of the handle
+	pos, _ := f.Seek(100, io.SeekStart)
+	chunk := stressPayload(r, 8192*2)
+	if n, err := f.WriteAt(chunk, 8192*5+3); err != nil || n != len(chunk) {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[8192*5+3:], chunk)
+	if n, err := f.WriteAt(chunk, int64(len(data))+8192*70); err != nil || n != len(chunk) {
+		t.Fatalf("WriteAt beyond end of file failed: %v", err)
+	}
+	data = append(data, make([]byte, 8192*70)...)
+	data = append(data, chunk...)
+	if cur, _ := f.Seek(0, io.SeekCurrent); cur != pos {
+		t.Errorf("WriteAt moved the position %d->%d", pos, cur)
+	}
+	if end, _ := f.Seek(-10, io.SeekEnd); end != int64(len(data))-10 {
+		t.Errorf("Bad end position %d", end)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek to a negative position should fail")
+	}
+	if err := readBack(fs, key, data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if n, err := f.ReadAt(buf, int64(len(data))-40); n != 40 || err != io.EOF {
+		t.Errorf("ReadAt at the end of file returns %d,%v", n, err)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ readonly_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+// dirState returns the size, the modification time and the hash of every
+// file in dir.
+func dirState(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]string)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		state[e.Name()] = fmt.Sprintf("%d %v %x", info.Size(), info.ModTime(), sha256.Sum256(data))
+	}
+	return state, nil
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	if _, err := dpfs.OpenReadOnly(testDir); err == nil {
+		t.Fatalf("Read-only open of an empty dir should fail")
+	}
+	if state, _ := dirState(testDir); len(state) != 0 {
+		t.Fatalf("Read-only open created %v", state)
+	}
+
+	open := func() *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(3, 1024, testDir, "", "", 0, true, dpfs.FeatureClones)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	open().Close()
+	// the root directory and the snapshot catalog are created on first use
+	fs, err := dpfs.OpenReadOnly(testDir)
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	if names, err := dirNames(fs, "/"); err != nil || names != "" {
+		t.Errorf("Bad root dir %q: %v", names, err)
+	}
+	if list, err := fs.ListSnapshots(); err != nil || len(list) != 0 {
+		t.Errorf("Bad snapshot list %v: %v", list, err)
+	}
+	fs.Close()
+
+	fs = open()
+	r := mrand.New(mrand.NewSource(24))
+	small, large := stressPayload(r, 5000), stressPayload(r, 8192*1100+3) // large spills into group 2
+	smallKey, err := createWith(fs, "small", small)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	largeKey, err := createWith(fs, "large", large)
+	if err != nil {
+		t.Fatalf("Create file failed: %v", err)
+	}
+	if _, err := fs.MkdirAll("/docs"); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	f, _, err := fs.CreatePath("/docs/a.txt", nil)
+	if err != nil {
+		t.Fatalf("Create path failed: %v", err)
+	}
+	if _, err := f.Write(small); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	fs.Close()
+	before, err := dirState(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = dpfs.OpenReadOnly(testDir)
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	if !fs.ReadOnly() || !reflect.DeepEqual(fs.MissingGroups(), []uint32{3}) {
+		t.Errorf("Bad read-only state %v %v", fs.ReadOnly(), fs.MissingGroups())
+	}
+	for key, data := range map[string][]byte{smallKey: small, largeKey: large} {
+		if err := readBack(fs, key, data); err != nil {
+			t.Error(err)
+		}
+	}
+	if list, err := fs.GetFileList(); err != nil || len(list) != 3 {
+		t.Errorf("Bad file list %v: %v", list, err)
+	}
+	if keys, err := fs.LookupByName("large"); err != nil || len(keys) != 1 || keys[0] != largeKey {
+		t.Errorf("Bad lookup %v: %v", keys, err)
+	}
+	if names, err := dirNames(fs, "/docs"); err != nil || names != "a.txt " {
+		t.Errorf("Bad dir %q: %v", names, err)
+	}
+	snap, err := fs.OpenSnapshot("s1")
+	if err != nil {
+		t.Fatalf("Open snapshot failed: %v", err)
+	}
+	if err := readSnapshot(snap, smallKey, small); err != nil {
+		t.Error(err)
+	}
+	if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+		t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+	}
+
+	f, err = fs.OpenFile(smallKey)
+	if err != nil {
+		t.Fatalf("Open file failed: %v", err)
+	}
+	mutations := map[string]error{
+		"CreateFile":       errOf3(fs.CreateFile("x", nil)),
+		"DeleteFile":       fs.DeleteFile(smallKey),
+		"UpdateMeta":       fs.UpdateMeta(smallKey, "x", nil),
+		"CloneFile":        errOf(fs.CloneFile(smallKey, "x")),
+		"Mkdir":            errOf(fs.Mkdir("/x")),
+		"CreatePath":       errOf3(fs.CreatePath("/docs/b.txt", nil)),
+		"Rename":           fs.Rename("/docs/a.txt", "/docs/b.txt"),
+		"DeletePath":       fs.DeletePath("/docs", true),
+		"CreateSnapshot":   fs.CreateSnapshot("s2"),
+		"DeleteSnapshot":   fs.DeleteSnapshot("s1"),
+		"SetUniqueNames":   fs.SetUniqueNames(true),
+		"RebuildNameIndex": fs.RebuildNameIndex(),
+		"Grow":             fs.Grow(4),
+		"EvacuateGroup":    fs.EvacuateGroup(1),
+		"Defragment":       errOf(fs.Defragment(dpfs.DefragOptions{})),
+		"Check":            errOf(fs.Check(dpfs.CheckOptions{Repair: true})),
+		"Write":            errOf(f.Write([]byte("x"))),
+		"WriteAt":          errOf(f.WriteAt([]byte("x"), 0)),
+		"Truncate":         f.Truncate(0),
+	}
+	for op, err := range mutations {
+		var re *dpfs.ReadOnlyError
+		if !errors.Is(err, dpfs.ErrReadOnly) || !errors.As(err, &re) || re.Op != op {
+			t.Errorf("%s of a read-only file system: %v", op, err)
+		}
+	}
+	fs.Close()
+	if after, _ := dirState(testDir); !reflect.DeepEqual(before, after) {
+		t.Errorf("Read-only file system changed the depot %v -> %v", before, after)
+	}
+
+	// a missing volume is reported, never created
+	vol := filepath.Join(testDir, fmt.Sprintf(dpfs.DefaultVfTpl, 2))
+	if err := os.Rename(vol, filepath.Join(t.TempDir(), "vol")); err != nil {
+		t.Fatal(err)
+	}
+	delete(before, filepath.Base(vol))
+	fs, err = dpfs.OpenReadOnly(testDir)
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	if !reflect.DeepEqual(fs.MissingGroups(), []uint32{2, 3}) {
+		t.Errorf("Bad missing groups %v", fs.MissingGroups())
+	}
+	if err := readBack(fs, smallKey, small); err != nil {
+		t.Error(err)
+	}
+	if err := readBack(fs, largeKey, large); !errors.Is(err, dpfs.ErrMissingGroup) {
+		t.Errorf("Read of a missing group: %v", err)
+	}
+	fs.Close()
+	if after, _ := dirState(testDir); !reflect.DeepEqual(before, after) {
+		t.Errorf("Read-only file system changed the depot %v -> %v", before, after)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ snapshot_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func readSnapshot(s *dpfs.Snapshot, key string, expect []byte) error {
+	f, err := s.OpenFile(key)
+	if err != nil {
+		return err
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, expect) {
+		return fmt.Errorf("data mismatch in snapshot, key:%s", key)
+	}
+	return nil
+}
+
+func TestSnapshot(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	open := func(features ...dpfs.Feature) *dpfs.FileSystem {
+		fs, err := dpfs.MakeFileSystem(2, 64*1024, testDir, "", "", 0, true, features...)
+		if err != nil {
+			t.Fatalf("Failed to create file system: %v", err)
+		}
+		return fs
+	}
+	check := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+			t.Fatalf("Inconsistent file system: %v %v", err, r.Issues)
+		}
+	}
+	fs := open(dpfs.FeatureClones)
+	// the snapshot catalog takes a block on first use
+	if list, err := fs.ListSnapshots(); err != nil || len(list) != 0 {
+		t.Fatalf("Bad snapshot list %v: %v", list, err)
+	}
+	_, fb := fs.StatBlocks(-1)
+
+	r := mrand.New(mrand.NewSource(15))
+	old := map[string][]byte{}
+	var keys []string
+	for i, size := range []int{100, 8192*4 + 5, 8192*150 + 77} {
+		data := stressPayload(r, size)
+		key, err := createWith(fs, fmt.Sprintf("file%d", i), data)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		old[key] = data
+		keys = append(keys, key)
+	}
+	if err := fs.CreateSnapshot("before"); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := fs.CreateSnapshot("before"); err != dpfs.ErrSnapshotExists {
+		t.Errorf("Snapshot of a taken name returns %v", err)
+	}
+
+	// change, delete and add files behind the snapshot
+	f, err := fs.OpenFile(keys[2])
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	patch := stressPayload(r, 8192*2)
+	if _, err := f.WriteAt(patch, 8192*40+3); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	changed := append([]byte(nil), old[keys[2]]...)
+	copy(changed[8192*40+3:], patch)
+	if err := fs.DeleteFile(keys[1]); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	added, err := createWith(fs, "later", stressPayload(r, 999))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	list, err := fs.GetFileList()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("File list shows %d files: %v", len(list), err)
+	}
+	if err := readBack(fs, keys[2], changed); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(fs *dpfs.FileSystem) {
+		t.Helper()
+		s, err := fs.OpenSnapshot("before")
+		if err != nil {
+			t.Fatalf("Open snapshot failed: %v", err)
+		}
+		for key, data := range old {
+			if err := readSnapshot(s, key, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.OpenFile(added); err != dpfs.FNF {
+			t.Errorf("File added later is in the snapshot: %v", err)
+		}
+		list, err := s.GetFileList()
+		if err != nil || len(list) != len(old) {
+			t.Fatalf("Snapshot lists %d files: %v", len(list), err)
+		}
+		for _, snap := range list {
+			if int(snap.Size) != len(old[snap.Key]) {
+				t.Errorf("Bad size of %s in the snapshot: %d", snap.Key, snap.Size)
+			}
+		}
+		f, err := s.OpenFile(keys[0])
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if _, err := f.Write([]byte("x")); err != dpfs.ErrReadOnly {
+			t.Errorf("Write to a snapshot returns %v", err)
+		}
+		if err := f.Truncate(0); err != dpfs.ErrReadOnly {
+			t.Errorf("Truncate of a snapshot returns %v", err)
+		}
+	}
+	verify(fs)
+	check(fs)
+	fs.Close()
+
+	fs = open(dpfs.FeatureClones)
+	verify(fs)
+	if err := fs.CreateSnapshot("after"); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	snaps, err := fs.ListSnapshots()
+	if err != nil || len(snaps) != 2 || snaps[0].Files != 3 || snaps[1].Files != 3 {
+		t.Fatalf("Bad snapshot list %v: %v", snaps, err)
+	}
+	s, err := fs.OpenSnapshot("before")
+	if err != nil {
+		t.Fatalf("Open snapshot failed: %v", err)
+	}
+	if err := fs.DeleteSnapshot("before"); err != nil {
+		t.Fatalf("Delete snapshot failed: %v", err)
+	}
+	if _, err := s.OpenFile(keys[0]); err != dpfs.FNF {
+		t.Errorf("Deleted snapshot opens a file: %v", err)
+	}
+	if _, err := fs.OpenSnapshot("before"); err != dpfs.ErrNoSnapshot {
+		t.Errorf("Open of a deleted snapshot returns %v", err)
+	}
+	s, err = fs.OpenSnapshot("after")
+	if err != nil {
+		t.Fatalf("Open snapshot failed: %v", err)
+	}
+	if err := readSnapshot(s, keys[2], changed); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	for _, key := range []string{keys[0], keys[2], added} {
+		if err := fs.DeleteFile(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := readSnapshot(s, keys[2], changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("after"); err != nil {
+		t.Fatalf("Delete snapshot failed: %v", err)
+	}
+	check(fs)
+	if _, fb2 := fs.StatBlocks(-1); fb != fb2 {
+		t.Errorf("Leaked blocks %d->%d", fb, fb2)
+	}
+	fs.Close()
+
+	os.RemoveAll(testDir)
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	fs = open()
+	defer fs.Close()
+	if err := fs.CreateSnapshot("x"); err != dpfs.ErrNoClones {
+		t.Errorf("Snapshot without clones returns %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ sparse_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+type sparseOp struct {
+	pos   int64
+	size  int //bytes written at pos, or the new size when truncate is set
+	trunc bool
+}
+
+// dirtyBlocks fills the free blocks with garbage, so that stale data shows up
+// when a hole is not read back as zeros.
+func dirtyBlocks(fs *dpfs.FileSystem, size int) error {
+	f, key, err := fs.CreateFile("dirty", nil)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bytes.Repeat([]byte{0xa5}, size)); err != nil {
+		return err
+	}
+	return fs.DeleteFile(key)
+}
+
+func doSparse(fs *dpfs.FileSystem, ops []sparseOp) error {
+	r := mrand.New(mrand.NewSource(int64(len(ops))))
+	f, key, err := fs.CreateFile("sparse", nil)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, op := range ops {
+		if op.trunc {
+			if err := f.Truncate(int64(op.size)); err != nil {
+				return err
+			}
+			if op.size < len(data) {
+				data = data[:op.size]
+			} else {
+				data = append(data, make([]byte, op.size-len(data))...)
+			}
+			continue
+		}
+		if off, err := f.SeekPos(op.pos); err != nil {
+			return err
+		} else if buf := make([]byte, 1); int(op.pos) >= len(data) {
+			if _, err := f.Read(buf); err != io.EOF {
+				return fmt.Errorf("read beyond end of file at %d: %v", op.pos, err)
+			}
+			f.SeekOffset(off)
+		}
+		chunk := stressPayload(r, op.size)
+		if _, err := f.Write(chunk); err != nil {
+			return fmt.Errorf("write %d bytes at %d: %v", op.size, op.pos, err)
+		}
+		if end := int(op.pos) + op.size; end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[op.pos:], chunk)
+		if err := readBack(fs, key, data); err != nil {
+			return fmt.Errorf("write %d bytes at %d: %v", op.size, op.pos, err)
+		}
+	}
+	return nil
+}
+
+func TestSparse(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(4, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+	if err := dirtyBlocks(fs, 8192*3000); err != nil {
+		t.Fatalf("Failed to dirty blocks: %v", err)
+	}
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+
+	testSuits := [][]sparseOp{
+		{{pos: 8192*3 + 7, size: 100}},
+		{{pos: 100, size: 10}, {pos: 8192 * 20, size: 8192}, {pos: 8192 * 5, size: 8192*2 + 3}},
+		{{pos: 8192 * 3000, size: 8192 * 70}, {pos: 8192*100 - 1, size: 2}, {pos: 10, size: 8192 * 9}},
+		{{pos: 50, size: 50}, {size: 8192 * 500, trunc: true}, {pos: 8192 * 100, size: 8192 * 65},
+			{pos: 8192*400 + 9, size: 8192 * 3}},
+		{{pos: 0, size: 8192 * 70}, {size: 8192*2 + 1, trunc: true}, {pos: 8192 * 10, size: 20}},
+	}
+	for i, ops := range testSuits {
+		t.Run(fmt.Sprintf("Sparse-%d", i), func(t *testing.T) {
+			_, before := fs.StatBlocks(-1)
+			if err := doSparse(fs, ops); err != nil {
+				t.Fatal(err)
+			}
+			list, err := fs.GetFileList()
+			if err != nil || len(list) != 1 {
+				t.Fatalf("Bad file list: %v", err)
+			}
+			// every write takes at most its blocks and a pointer block per level
+			var limit int64 = 1
+			for _, op := range ops {
+				if !op.trunc {
+					limit += int64(op.size/8192+2) + 3
+				}
+			}
+			if _, after := fs.StatBlocks(-1); before-after > limit {
+				t.Errorf("Holes take blocks, %d used, limit %d", before-after, limit)
+			}
+			if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+				t.Errorf("Inconsistent file system: %v %v", err, r.Issues)
+			}
+			if err := fs.DeleteFile(list[0].Key); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
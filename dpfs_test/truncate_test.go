@@ -0,0 +1,118 @@
+/*
+ truncate_test.go
+
+ GNU GENERAL PUBLIC LICENSE
+ Version 3, 29 June 2007
+ Copyright (C) 2024 Jack Ng <jack.ng.ca@gmail.com>
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program.  If not, see <https://www.gnu.org/licenses/> */
+
+package dpfs_test
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/jaco00/depot-fs/dpfs"
+)
+
+func doTruncate(fs *dpfs.FileSystem, size int, sizes []int) error {
+	r := mrand.New(mrand.NewSource(int64(size)))
+	data := stressPayload(r, size)
+	f, key, err := fs.CreateFile("truncate", nil)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	pos := int64(len(data))
+	for _, s := range sizes {
+		if err := f.Truncate(int64(s)); err != nil {
+			return fmt.Errorf("truncate to %d failed: %v", s, err)
+		}
+		if s <= len(data) {
+			data = data[:s]
+		} else {
+			data = append(data, make([]byte, s-len(data))...)
+		}
+		if err := readBack(fs, key, data); err != nil {
+			return fmt.Errorf("truncate to %d: %v", s, err)
+		}
+		if pos > int64(s) {
+			pos = int64(s)
+		}
+		if off := f.GetOffset(); off != mustSeek(f, pos) {
+			return fmt.Errorf("bad position after truncate to %d", s)
+		}
+	}
+	mustSeek(f, int64(len(data)))
+	tail := stressPayload(r, 8192*3+17)
+	if _, err := f.Write(tail); err != nil {
+		return err
+	}
+	if err := readBack(fs, key, append(data, tail...)); err != nil {
+		return fmt.Errorf("append after truncate: %v", err)
+	}
+	return fs.DeleteFile(key)
+}
+
+func mustSeek(f *dpfs.Vfile, pos int64) dpfs.VfileOffset {
+	off, _ := f.SeekPos(pos)
+	return off
+}
+
+func TestTruncate(t *testing.T) {
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fs, err := dpfs.MakeFileSystem(4, 64*1024, testDir, "", "", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+	defer fs.Close()
+	_, fb := fs.StatBlocks(-1)
+	_, fi := fs.StatInodes(-1)
+
+	testSuits := []struct {
+		size  int
+		sizes []int
+	}{
+		{100, []int{50, 0, 10}},
+		{8192 * 4, []int{8192*2 - 32, 8192*2 - 33, 8192 * 5}},
+		{8192 * 20, []int{8192*8 + 1, 8192 * 7, 8192 * 30}},
+		{8192 * 180, []int{8192*100 + 5, 8192*70 - 1, 8192 * 9}}, //split big blocks
+		{8192 * 2100, []int{8192 * 2060, 8192 * 2040, 8192 * 2100}},
+		{8192 * 3, []int{8192 * 200, 8192*64 + 100}},
+	}
+	for _, s := range testSuits {
+		t.Run(fmt.Sprintf("Size:%d,Truncate:%v", s.size, s.sizes), func(t *testing.T) {
+			if err := doTruncate(fs, s.size, s.sizes); err != nil {
+				t.Error(err)
+			}
+			if r, err := fs.Check(dpfs.CheckOptions{}); err != nil || !r.Clean() {
+				t.Errorf("Inconsistent file system after truncate: %v %v", err, r.Issues)
+			}
+		})
+	}
+	_, fb2 := fs.StatBlocks(-1)
+	_, fi2 := fs.StatInodes(-1)
+	if fb != fb2 || fi != fi2 {
+		t.Errorf("Leaked resources, free blocks %d->%d, free inodes %d->%d", fb, fb2, fi, fi2)
+	}
+}
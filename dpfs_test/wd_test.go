@@ -22,7 +22,6 @@ package dpfs_test
 
 import (
 	"fmt"
-	"os"
 	"testing"
 	"time"
 
@@ -31,15 +30,16 @@ import (
 )
 
 func TestWD(t *testing.T) {
-	if err := os.MkdirAll(testDir, 0755); err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(testDir)
-
-	fs, err := dpfs.MakeFileSystem(dpfs.MaxBlockGroupNum, dpfs.DefaultBlocksInGroup, testDir, "", "", 0, true)
+	// the groups only take the pages written in memory
+	fs, err := dpfs.MakeFileSystemWithOptions(dpfs.Options{
+		Groups:   dpfs.MaxBlockGroupNum,
+		BigAlloc: true,
+		Backend:  dpfs.NewMemBackend(),
+	})
 	if err != nil {
 		t.Fatalf("Failed to create file system: %v", err)
 	}
+	defer fs.Close()
 
 	testSuits := [][]int64{
 		{4, 1024},
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 
@@ -25,7 +26,30 @@ var (
 	showInfo      = flag.Bool("I", false, "Show all info")
 	batchAddFile  = flag.Int("b", 0, "Batch add a specified number of small files for testing")
 	listFile      = flag.Bool("l", false, "Show all files")
+	findName      = flag.String("n", "", "Show the files whose name starts with the prefix")
 	showGraph     = flag.Bool("g", false, "Show block bitmap graph")
+	checkFs       = flag.Bool("fsck", false, "Check the consistency of the volume files")
+	repairFs      = flag.Bool("repair", false, "Repair the problems found by -fsck")
+	fsckReport    = flag.String("report", "", "Write the -fsck report to file")
+	checksums     = flag.Bool("c", false, "Keep a checksum of every block when creating a new depot")
+	compress      = flag.Bool("z", false, "Compress the files copied by -i")
+	dedup         = flag.Bool("D", false, "Store identical blocks once when creating a new depot")
+	clones        = flag.Bool("C", false, "Keep block reference counts for file clones when creating a new depot")
+	packing       = flag.Bool("P", false, "Pack small files into shared blocks when creating a new depot")
+	inline        = flag.Bool("inline", false, "Keep the data of tiny files in their inode when creating a new depot")
+	extents       = flag.Bool("extents", false, "Map the blocks of files by extents when creating a new depot")
+	cloneFile     = flag.String("cp", "", "Clone file by uid, sharing its blocks")
+	cloneName     = flag.String("name", "", "Name of the file created by -cp")
+	snapshot      = flag.String("snap", "", "Take a snapshot of all files under the name")
+	dropSnapshot  = flag.String("unsnap", "", "Delete the snapshot by name")
+	listSnapshots = flag.Bool("snaps", false, "Show all snapshots")
+	keyFile       = flag.String("k", "", "Encrypt a new depot with the keys of the file, created when missing")
+	rotateKey     = flag.Bool("rotate", false, "Add a new key to the -k file and re-encrypt the depot with it")
+	growGroups    = flag.Int("grow", 0, "Grow the depot to the number of volume files")
+	evacuate      = flag.Int("evacuate", 0, "Move everything out of the group of the index, the last groups are removed")
+	defrag        = flag.Bool("defrag", false, "Rewrite the scattered files into runs of blocks, resuming the last pass")
+	defragRate    = flag.Int("rate", 0, "Blocks copied per second at most by -defrag, 0 for no limit")
+	readOnly      = flag.Bool("ro", false, "Open the depot read-only, no file is created or changed")
 	verboseLog    = flag.Bool("v", false, "Use verbose logging for developer")
 	help          = flag.Bool("h", false, "Display this help message")
 	fs            *dpfs.FileSystem
@@ -49,13 +73,55 @@ func main() {
 	}
 	var group uint32 = 32
 	var err error
-	fs, err = dpfs.MakeFileSystem(group, 0, *dataDir, "", "", 1, true)
+	var features []dpfs.Feature
+	if *checksums {
+		features = append(features, dpfs.FeatureChecksums)
+	}
+	if *dedup {
+		features = append(features, dpfs.FeatureDedup)
+	}
+	if *clones {
+		features = append(features, dpfs.FeatureClones)
+	}
+	if *packing {
+		features = append(features, dpfs.FeaturePacking)
+	}
+	if *inline {
+		features = append(features, dpfs.FeatureInline)
+	}
+	if *extents {
+		features = append(features, dpfs.FeatureExtents)
+	}
+	var keys *dpfs.FileKeyProvider
+	if *keyFile != "" {
+		if keys, err = dpfs.NewFileKeyProvider(*keyFile); err != nil {
+			logrus.Errorf("Load key file failed:%s", err)
+			return
+		}
+		features = append(features, dpfs.WithKeyProvider(keys))
+	}
+	if *readOnly {
+		fs, err = dpfs.OpenReadOnly(*dataDir, features...)
+	} else {
+		fs, err = dpfs.MakeFileSystem(group, 0, *dataDir, "", "", 1, true, features...)
+	}
 	if err != nil {
 		logrus.Errorf("Init file system failed:%s", err)
 		return
 	}
 	start := time.Now()
 	if *eraseAll {
+		entries, err := fs.ReadDir("")
+		if err != nil && err != dpfs.ErrNoSysInodes {
+			logrus.Errorf("Read root directory failed:%s", err)
+			return
+		}
+		for _, e := range entries {
+			if err := fs.DeletePath(e.Name, true); err != nil {
+				logrus.Errorf("Delete path:%s, failed:%s", e.Name, err)
+				return
+			}
+		}
 		snap, err := fs.GetFileList()
 		if err != nil {
 			logrus.Errorf("Load file list failed:%s", err)
@@ -70,6 +136,52 @@ func main() {
 	} else if *delFile != "" {
 		err := fs.DeleteFile(*delFile)
 		fmt.Printf("Delete file: %s [%v]\n", *delFile, err)
+	} else if *cloneFile != "" {
+		uid, err := fs.CloneFile(*cloneFile, *cloneName)
+		fmt.Printf("Clone file: %s -> %s [%v]\n", *cloneFile, uid, err)
+	} else if *snapshot != "" {
+		err := fs.CreateSnapshot(*snapshot)
+		fmt.Printf("Create snapshot: %s [%v]\n", *snapshot, err)
+	} else if *dropSnapshot != "" {
+		err := fs.DeleteSnapshot(*dropSnapshot)
+		fmt.Printf("Delete snapshot: %s [%v]\n", *dropSnapshot, err)
+	} else if *listSnapshots {
+		list, err := fs.ListSnapshots()
+		if err != nil {
+			logrus.Errorf("Load snapshots failed:%s", err)
+			return
+		}
+		for _, s := range list {
+			fmt.Printf("%-20s  %-25s  %d files\n", s.Name, time.Unix(int64(s.CTime), 0).Format(time.RFC3339), s.Files)
+		}
+	} else if *rotateKey {
+		if keys == nil {
+			logrus.Errorf("Key rotation needs a key file (-k)")
+			return
+		}
+		id, err := keys.AddKey()
+		if err != nil {
+			logrus.Errorf("Add key failed:%s", err)
+			return
+		}
+		done, err := fs.RotateKey()
+		if err == nil {
+			err = <-done
+		}
+		fmt.Printf("Rotate to key: %d [%v]\n", id, err)
+	} else if *growGroups > 0 {
+		err := fs.Grow(uint32(*growGroups))
+		fmt.Printf("Grow to %d groups [%v]\n", *growGroups, err)
+	} else if *evacuate > 0 {
+		err := fs.EvacuateGroup(*evacuate)
+		fmt.Printf("Evacuate group %d, %d groups left [%v]\n", *evacuate, fs.Smeta.TotalGroups, err)
+	} else if *defrag {
+		done, err := fs.Defragment(dpfs.DefragOptions{Rate: *defragRate})
+		if err == nil {
+			err = <-done
+		}
+		s := fs.DefragProgress()
+		fmt.Printf("Defragment %d files, %d blocks copied, %d big blocks made [%v]\n", s.Files, s.Blocks, s.BigBlocks, err)
 	} else if *readFile != "" {
 		var batchLimit int64 = 10 * 1024 * 1024
 		dc, err := dpfs.NewNullDataConsumer(false)
@@ -97,20 +209,23 @@ func main() {
 		}
 	} else if *toDir != "" {
 		fmt.Printf("############################save data###############################\n")
-		snap, err := fs.GetFileList()
+		crcsnap, err := listTree()
 		if err != nil {
 			logrus.Errorf("Load file list failed:%s", err)
 			return
 		}
-		crcsnap := make([]FileCrc, len(snap))
-		for i, a := range snap {
-			crcsnap[i].snap = a
-		}
 		err = saveFiles(crcsnap, *toDir, false)
 		if err != nil {
 			logrus.Errorf("save files failed :%s", err)
 			return
 		}
+	} else if *checkFs {
+		report, err := fs.Check(dpfs.CheckOptions{Repair: *repairFs, Report: *fsckReport})
+		if err != nil {
+			logrus.Errorf("Check file system failed:%s", err)
+			return
+		}
+		report.WriteTo(os.Stdout)
 	} else if *showInfo {
 		printInfo()
 	} else if *showGraph {
@@ -125,6 +240,15 @@ func main() {
 			return
 		}
 		printFileList(snap)
+	} else if *findName != "" {
+		list, err := fs.ScanPrefix(*findName)
+		if err != nil {
+			logrus.Errorf("Scan name index failed:%s", err)
+			return
+		}
+		for _, e := range list {
+			fmt.Printf("%s  %s\n", e.Uid, e.Name)
+		}
 	} else if *fillLargeFile > 0 {
 		if err := testingLargeFile(fs, int64(*fillLargeFile)); err != nil {
 			logrus.Errorf("Testing large file failed: %s", err)
@@ -149,10 +273,11 @@ type FileCrc struct {
 
 func printFileList(list []dpfs.FileSnap) {
 	for _, v := range list {
-		fmt.Printf("%-8x %-30s %-10s %-25s %s\n",
+		fmt.Printf("%-8x %-30s %-10s %-10s %-25s %s\n",
 			v.Inode,
 			v.Key,
 			dpfs.FormatBytes(v.Size),
+			dpfs.FormatBytes(v.Physical),
 			time.Unix(int64(v.CTime), 0).Local().Format("2006-01-02 15:04:05 MST"),
 			v.Name,
 		)
@@ -169,6 +294,19 @@ func printInfo() {
 	fmt.Printf("Inode size:%d\n", binary.Size(dpfs.Inode{}))
 	fmt.Printf("Blocks [%9d/%-9d]\n", tb-fb, tb)
 	fmt.Printf("Inodes [%9d/%-9d]\n", ti-fi, ti)
+	if list, err := fs.GetFileList(); err == nil {
+		var size, physical int64
+		for _, v := range list {
+			size += v.Size
+			physical += v.Physical
+		}
+		fmt.Printf("Files:%d, size:%s, stored:%s\n", len(list), dpfs.FormatBytes(size), dpfs.FormatBytes(physical))
+	}
+	if st, err := fs.DedupStats(); err == nil {
+		fmt.Printf("Dedup: logical:%s, physical:%s, shared blocks:%d, saved:%s\n",
+			dpfs.FormatBytes(st.LogicalBytes), dpfs.FormatBytes(st.PhysicalBytes), st.SharedBlocks,
+			dpfs.FormatBytes(st.LogicalBytes-st.PhysicalBytes))
+	}
 	fmt.Printf("\n== GROUP INFO ==\n")
 	fmt.Printf("%-3s %-15s %-18s %-18s %s\n", "ID", "FNAME", "INODES", "BLOCKS", "SIZE")
 	for i := 0; i < int(fs.Smeta.TotalGroups); i++ {
@@ -196,10 +334,14 @@ func saveFile(path, name string) (FileCrc, error) {
 	if err != nil {
 		return info, err
 	}
-	key, _, crc1, _, err := dpfs.WriteFile(fs, fdp, name, nil, true)
+	var opts []dpfs.FileOption
+	if *compress {
+		opts = append(opts, dpfs.WithCodec(dpfs.CodecFlate))
+	}
+	key, _, crc1, _, err := dpfs.WritePath(fs, fdp, filepath.ToSlash(name), nil, true, opts...)
 	info.crc = crc1
 	info.snap.Key = key
-	return info, nil
+	return info, err
 }
 
 func saveFiles(list []FileCrc, dst string, crcCheck bool) error {
@@ -221,6 +363,45 @@ func saveFiles(list []FileCrc, dst string, crcCheck bool) error {
 	return nil
 }
 
+// listTree returns the files of the directory tree by path, followed by the
+// files outside of it by name.
+func listTree() ([]FileCrc, error) {
+	var list []FileCrc
+	inTree := make(map[string]bool)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			p := path.Join(dir, e.Name)
+			if e.IsDir {
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			}
+			inTree[e.Uid] = true
+			list = append(list, FileCrc{snap: dpfs.FileSnap{Key: e.Uid, Name: p}})
+		}
+		return nil
+	}
+	if err := walk(""); err != nil && err != dpfs.ErrNoSysInodes {
+		return nil, err
+	}
+	snap, err := fs.GetFileList()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range snap {
+		if !inTree[a.Key] {
+			list = append(list, FileCrc{snap: a})
+		}
+	}
+	return list, nil
+}
+
 func scanDir(src string) ([]FileCrc, error) {
 	infos := []FileCrc{}
 	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {